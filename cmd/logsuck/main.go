@@ -25,11 +25,15 @@ import (
 
 	internalConfig "github.com/jackbister/logsuck/internal/config"
 	"github.com/jackbister/logsuck/internal/dependencyinjection"
+	internalPipeline "github.com/jackbister/logsuck/internal/pipeline"
 	"github.com/jackbister/logsuck/internal/tasks"
 	"github.com/jackbister/logsuck/internal/web"
 
+	"github.com/jackbister/logsuck/pkg/logsuck/archive"
 	"github.com/jackbister/logsuck/pkg/logsuck/config"
 	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/pipeline"
+	"github.com/jackbister/logsuck/plugins/sqlite_common"
 
 	"go.uber.org/dig"
 )
@@ -50,7 +54,7 @@ func main() {
 
 	var err error
 	var logger *slog.Logger
-	if cmdFlags.PrintJsonSchema {
+	if cmdFlags.PrintJsonSchema || cmdFlags.ListSteps || cmdFlags.MigrateDryRun {
 		logger = slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
 	} else if cmdFlags.LogType == "development" {
 		logger = slog.New(slog.NewTextHandler(
@@ -96,6 +100,106 @@ func main() {
 		}
 	}
 
+	if cmdFlags.ListSteps {
+		err = c.Invoke(func(p struct {
+			dig.In
+
+			StepDefinitions []pipeline.StepDefinition `group:"steps"`
+		}) {
+			err := internalPipeline.WriteStepHelp(os.Stdout, p.StepDefinitions)
+			if err != nil {
+				logger.Error("Failed to write step documentation", slog.Any("error", err))
+				panic(err)
+			}
+			os.Exit(0)
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if cmdFlags.MigrateDryRun {
+		err = c.Invoke(func(p struct {
+			dig.In
+
+			Migrator *sqlite_common.Migrator `optional:"true"`
+		}) {
+			if p.Migrator == nil {
+				fmt.Println("The configured plugins do not use SQLite migrations.")
+				os.Exit(0)
+			}
+			pending, err := p.Migrator.Plan()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			if len(pending) == 0 {
+				fmt.Println("The database is up to date.")
+				os.Exit(0)
+			}
+			for _, pm := range pending {
+				fmt.Printf("%v: version %v: %v\n", pm.PluginName, pm.Migration.Version, pm.Migration.Description)
+			}
+			os.Exit(0)
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if cmdFlags.Restore != "" {
+		err = c.Invoke(func(p struct {
+			dig.In
+
+			Cfg *sqlite_common.Config `optional:"true"`
+		}) {
+			if p.Cfg == nil {
+				fmt.Fprintln(os.Stderr, "The configured plugins do not use an SQLite database.")
+				os.Exit(1)
+			}
+			err := sqlite_common.Restore(cmdFlags.Restore, p.Cfg.FileName, logger)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			fmt.Printf("Restored %v from %v.\n", p.Cfg.FileName, cmdFlags.Restore)
+			os.Exit(0)
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if cmdFlags.Thaw != "" {
+		err = c.Invoke(func(p struct {
+			dig.In
+
+			ConfigSource config.Source
+			EventsRepo   events.Repository
+		}) {
+			cfg, err := p.ConfigSource.Get()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			dir, err := archive.Directory(&cfg.Cfg)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			numEvents, err := archive.Thaw(dir, cmdFlags.Thaw, p.EventsRepo)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			fmt.Printf("Thawed %v events from %v.\n", numEvents, cmdFlags.Thaw)
+			os.Exit(0)
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	err = c.Invoke(func(p struct {
 		dig.In
 
@@ -47,10 +47,14 @@ type CommandLineFlags struct {
 	FieldExtractors   FlagStringArray
 	HostName          string
 	JsonParser        bool
+	ListSteps         bool
 	LogType           string
+	MigrateDryRun     bool
 	PrintJsonSchema   bool
 	PrintVersion      bool
 	Recipient         string
+	Restore           string
+	Thaw              string
 	TimeField         string
 	TimeLayout        string
 	WebAddr           string
@@ -73,9 +77,13 @@ func ParseCommandLine() *CommandLineFlags {
 	flag.StringVar(&ret.Forwarder, "forwarder", "", "Enables forwarder mode and sets the address to forward events to. Forwarding is off by default.")
 	flag.StringVar(&ret.HostName, "hostname", "", "The name of the host running this instance of logsuck. By default, logsuck will attempt to retrieve the hostname from the operating system.")
 	flag.BoolVar(&ret.JsonParser, "json", false, "Parse the given files as JSON instead of using Regex to parse. The fieldexctractor flag will be ignored. Disabled by default.")
+	flag.BoolVar(&ret.ListSteps, "listSteps", false, "Print documentation for the available pipeline steps and quit.")
+	flag.BoolVar(&ret.MigrateDryRun, "migrate-dry-run", false, "Print the database migrations which would be applied on startup and quit without applying them.")
 	flag.StringVar(&ret.LogType, "logType", "production", "The type of logger to use. Set it to 'development' to get human readable logging instead of JSON logging")
 	flag.BoolVar(&ret.PrintJsonSchema, "schema", false, "Print configuration schema and quit.")
 	flag.BoolVar(&ret.PrintVersion, "version", false, "Print version info and quit.")
+	flag.StringVar(&ret.Restore, "restore", "", "Replace the SQLite database with the given backup file, which is checked for corruption first, and quit. Logsuck must not be running while restoring.")
+	flag.StringVar(&ret.Thaw, "thaw", "", "Add the events of the given day (YYYY-MM-DD, UTC) which were archived by @logsuck/ArchiveTask back to the database, remove them from the archive and quit.")
 	flag.StringVar(&ret.Recipient, "recipient", "", "Enables recipient mode and sets the port to expose the recipient on. Recipient mode is off by default.")
 	flag.StringVar(&ret.TimeField, "timefield", "_time", "The name of the field which will contain the timestamp of the event. Default '_time'.")
 	flag.StringVar(&ret.TimeLayout, "timelayout", "2006/01/02 15:04:05", "The layout of the timestamp which will be extracted in the time field. For more information on how to write a timelayout and examples, see https://golang.org/pkg/time/#Parse and https://golang.org/pkg/time/#pkg-constants. There are also the special timelayouts \"UNIX\", \"UNIX_MILLIS\", and \"UNIX_DECIMAL_NANOS\". \"UNIX\" expects the _time field to contain the number of seconds since the Unix epoch, \"UNIX_MILLIS\" expects it to contain the number of milliseconds since the Unix epoch, and UNIX_DECIMAL_NANOS expects it to contain a string of the form \"<UNIX>.<NANOS>\" where \"<UNIX>\" is the number of seconds since the Unix epoch and \"<NANOS>\" is the number of elapsed nanoseconds in that second.")
@@ -27,6 +27,7 @@ import (
 	"github.com/jackbister/logsuck/internal/web"
 
 	"github.com/jackbister/logsuck/pkg/logsuck/config"
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
 	"github.com/jackbister/logsuck/pkg/logsuck/tasks"
 
 	"go.uber.org/dig"
@@ -122,6 +123,10 @@ func provideBasics(c *dig.Container, forceStaticConfig bool, cfg *config.Config,
 	if err != nil {
 		return err
 	}
+	err = c.Provide(events.NewIngestionMetrics)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -193,6 +198,10 @@ func provideTasks(c *dig.Container, logger *slog.Logger) error {
 	if err != nil {
 		return err
 	}
+	err = c.Provide(internalTasks.NewTaskStatusSource)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
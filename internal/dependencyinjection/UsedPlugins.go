@@ -21,7 +21,9 @@ import (
 	"github.com/jackbister/logsuck/pkg/logsuck"
 	"github.com/jackbister/logsuck/pkg/logsuck/config"
 	"github.com/jackbister/logsuck/plugins/filereader"
+	"github.com/jackbister/logsuck/plugins/memory"
 	"github.com/jackbister/logsuck/plugins/recipient"
+	"github.com/jackbister/logsuck/plugins/segment_events"
 	"github.com/jackbister/logsuck/plugins/sqlite_common"
 	"github.com/jackbister/logsuck/plugins/sqlite_config"
 	"github.com/jackbister/logsuck/plugins/sqlite_events"
@@ -31,13 +33,26 @@ import (
 )
 
 func GetUsedPlugins(cfg *config.Config) []logsuck.Plugin {
-	var plugins = []logsuck.Plugin{
-		sqlite_common.Plugin,
-		sqlite_config.Plugin,
-		sqlite_events.Plugin,
-		sqlite_jobs.Plugin,
-		steps.Plugin,
-		tasks.Plugin,
+	var plugins []logsuck.Plugin
+	if memory.IsConfigured(cfg) {
+		plugins = []logsuck.Plugin{
+			memory.Plugin,
+			steps.Plugin,
+			tasks.Plugin,
+		}
+	} else {
+		plugins = []logsuck.Plugin{
+			sqlite_common.Plugin,
+			sqlite_config.Plugin,
+			sqlite_jobs.Plugin,
+			steps.Plugin,
+			tasks.Plugin,
+		}
+		if segment_events.IsConfigured(cfg) {
+			plugins = append(plugins, segment_events.Plugin)
+		} else {
+			plugins = append(plugins, sqlite_events.Plugin)
+		}
 	}
 
 	if cfg.Recipient.Enabled {
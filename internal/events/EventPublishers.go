@@ -68,13 +68,15 @@ func BatchedRepositoryPublisher(p BatchedRepositoryPublisherParams) api.Publishe
 	}
 }
 
-func (ep *batchedRepositoryPublisher) PublishEvent(evt api.RawEvent, timeLayout string, fileParser parser.FileParser) {
+func (ep *batchedRepositoryPublisher) PublishEvent(evt api.RawEvent, timeLayout string, fileParser parser.FileParser, indexedFields []string, index string) {
 	processed := api.Event{
-		Raw:      evt.Raw,
-		Host:     ep.cfg.HostName,
-		SourceId: evt.SourceId,
-		Source:   evt.Source,
-		Offset:   evt.Offset,
+		Raw:         evt.Raw,
+		Host:        ep.cfg.HostName,
+		SourceId:    evt.SourceId,
+		Source:      evt.Source,
+		Offset:      evt.Offset,
+		Index:       index,
+		Fingerprint: evt.Fingerprint,
 	}
 
 	fields, err := parser.ExtractFields(strings.ToLower(evt.Raw), fileParser)
@@ -96,6 +98,8 @@ func (ep *batchedRepositoryPublisher) PublishEvent(evt api.RawEvent, timeLayout
 	} else {
 		processed.Timestamp = time.Now()
 	}
+	processed.IndexedFields = api.SelectIndexedFields(fields, indexedFields)
+	processed.IndexedFieldsVersion = parser.ExtractorVersion(fileParser, indexedFields)
 
 	ep.adder <- processed
 }
@@ -112,4 +116,5 @@ func NopEventPublisher() api.Publisher {
 	return &nopEventPublisher{}
 }
 
-func (ep *nopEventPublisher) PublishEvent(_ api.RawEvent, _ string, _ parser.FileParser) {}
+func (ep *nopEventPublisher) PublishEvent(_ api.RawEvent, _ string, _ parser.FileParser, _ []string, _ string) {
+}
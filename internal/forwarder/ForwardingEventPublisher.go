@@ -95,7 +95,9 @@ func ForwardingEventPublisher(p ForwardingEventPublisherParams) events.Publisher
 	return &ep
 }
 
-func (ep *forwardingEventPublisher) PublishEvent(evt events.RawEvent, timeLayout string, fileParser parser.FileParser) {
+// PublishEvent forwards the raw event to the recipient. Fields are extracted and the index is chosen by the recipient, so timeLayout,
+// fileParser, indexedFields and index are ignored.
+func (ep *forwardingEventPublisher) PublishEvent(evt events.RawEvent, timeLayout string, fileParser parser.FileParser, indexedFields []string, index string) {
 	ep.adder <- evt
 }
 
@@ -156,11 +158,12 @@ func toRpcEvents(evts []events.RawEvent) []rpc.RawEvent {
 	ret := make([]rpc.RawEvent, len(evts))
 	for i, e := range evts {
 		ret[i] = rpc.RawEvent{
-			Raw:      e.Raw,
-			Host:     e.Host,
-			Source:   e.Source,
-			SourceId: e.SourceId,
-			Offset:   e.Offset,
+			Raw:         e.Raw,
+			Host:        e.Host,
+			Source:      e.Source,
+			SourceId:    e.SourceId,
+			Offset:      e.Offset,
+			Fingerprint: e.Fingerprint,
 		}
 	}
 	return ret
@@ -175,6 +175,24 @@ func (e *Engine) StartJob(query string, startTime, endTime *time.Time) (*int64,
 	return id, nil
 }
 
+// Explain compiles the query and describes how it would be executed, without starting a job.
+func (e *Engine) Explain(query string, startTime, endTime *time.Time) (*internalPipeline.Explanation, error) {
+	pl, err := e.pipelineCompiler.Compile(query, startTime, endTime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile search query: %w", err)
+	}
+	explanation, err := pl.Explain(pipeline.Parameters{
+		ConfigSource: e.configSource,
+		EventsRepo:   e.eventRepo,
+
+		Logger: e.logger,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to explain search query: %w", err)
+	}
+	return explanation, nil
+}
+
 func (e *Engine) Abort(jobId int64) error {
 	cancelFunc := e.cancels[jobId]
 	if cancelFunc != nil {
@@ -0,0 +1,184 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"log/slog"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	internalPipeline "github.com/jackbister/logsuck/internal/pipeline"
+	"github.com/jackbister/logsuck/pkg/logsuck/config"
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	api "github.com/jackbister/logsuck/pkg/logsuck/jobs"
+	"github.com/jackbister/logsuck/plugins/memory"
+	"github.com/jackbister/logsuck/plugins/steps"
+
+	"go.uber.org/dig"
+)
+
+func TestStartJob_Events(t *testing.T) {
+	e, eventRepo, jobRepo := newTestEngine(t)
+	eventRepo.AddBatch([]events.Event{
+		newEvent("2024/03/01 00:00:00 user=jack logged in", 0, 0),
+		newEvent("2024/03/01 00:00:01 user=jill logged in", 1, 100),
+		newEvent("2024/03/01 00:00:02 user=jack logged out", 2, 200),
+	})
+
+	id, err := e.StartJob("user=jack", nil, nil)
+	if err != nil {
+		t.Fatalf("got error when starting job: %v", err)
+	}
+	waitForJob(t, jobRepo, *id)
+
+	ids, err := jobRepo.GetResults(*id, events.SortModeTimestampDesc, 0, 10)
+	if err != nil {
+		t.Fatalf("got error when getting results: %v", err)
+	}
+	if !reflect.DeepEqual(ids, []int64{3, 1}) {
+		t.Fatalf("got unexpected result ids=%v", ids)
+	}
+	values, err := jobRepo.GetFieldValues(*id, "user")
+	if err != nil {
+		t.Fatalf("got error when getting field values: %v", err)
+	}
+	if !reflect.DeepEqual(values, map[string]int{"jack": 2}) {
+		t.Fatalf("got unexpected field values=%v", values)
+	}
+}
+
+func TestStartJob_Table(t *testing.T) {
+	e, eventRepo, jobRepo := newTestEngine(t)
+	eventRepo.AddBatch([]events.Event{
+		newEvent("2024/03/01 00:00:00 user=jack logged in", 0, 0),
+		newEvent("2024/03/01 00:00:01 user=jill logged in", 1, 100),
+	})
+
+	id, err := e.StartJob("in | table \"user\"", nil, nil)
+	if err != nil {
+		t.Fatalf("got error when starting job: %v", err)
+	}
+	waitForJob(t, jobRepo, *id)
+
+	rows, err := jobRepo.GetTableResults(*id, 0, 10)
+	if err != nil {
+		t.Fatalf("got error when getting table results: %v", err)
+	}
+	expected := []api.TableRow{
+		{RowNumber: 0, Values: map[string]string{"user": "jill"}},
+		{RowNumber: 1, Values: map[string]string{"user": "jack"}},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Fatalf("got unexpected rows=%v, expected %v", rows, expected)
+	}
+}
+
+func newTestEngine(t *testing.T) (*Engine, events.Repository, api.Repository) {
+	cfg := &config.Config{
+		Plugins: map[string]any{"@logsuck/memory": map[string]any{}},
+		Files: map[string]config.FileConfig{
+			"log.txt": {
+				Filename: "log.txt",
+			},
+		},
+		FileTypes: map[string]config.FileTypeConfig{
+			"DEFAULT": {
+				Name:         "DEFAULT",
+				TimeLayout:   "2006/01/02 15:04:05",
+				ReadInterval: 1 * time.Second,
+				ParserType:   config.ParserTypeRegex,
+				Regex: &config.RegexParserConfig{
+					EventDelimiter:  regexp.MustCompile("\n"),
+					FieldExtractors: []*regexp.Regexp{regexp.MustCompile("(\\w+)=(\\w+)")},
+				},
+			},
+		},
+		HostTypes: map[string]config.HostTypeConfig{
+			"DEFAULT": {
+				Files: []config.HostFileConfig{{Name: "log.txt"}},
+			},
+		},
+	}
+	c := dig.New()
+	err := c.Provide(func() *config.Config { return cfg })
+	if err != nil {
+		t.Fatalf("got error when providing config: %v", err)
+	}
+	err = c.Provide(func() config.Source { return &config.StaticSource{Config: *cfg} })
+	if err != nil {
+		t.Fatalf("got error when providing config source: %v", err)
+	}
+	err = c.Provide(slog.Default)
+	if err != nil {
+		t.Fatalf("got error when providing logger: %v", err)
+	}
+	err = c.Provide(func() bool { return false }, dig.Name("forceStaticConfig"))
+	if err != nil {
+		t.Fatalf("got error when providing forceStaticConfig: %v", err)
+	}
+	for _, p := range []func(*dig.Container, *slog.Logger) error{memory.Plugin.Provide, steps.Plugin.Provide} {
+		err = p(c, slog.Default())
+		if err != nil {
+			t.Fatalf("got error when providing plugin: %v", err)
+		}
+	}
+	err = c.Provide(internalPipeline.NewPipelineCompiler)
+	if err != nil {
+		t.Fatalf("got error when providing pipeline compiler: %v", err)
+	}
+	err = c.Provide(NewEngine)
+	if err != nil {
+		t.Fatalf("got error when providing engine: %v", err)
+	}
+	var e *Engine
+	var eventRepo events.Repository
+	var jobRepo api.Repository
+	err = c.Invoke(func(engine *Engine, er events.Repository, jr api.Repository) {
+		e, eventRepo, jobRepo = engine, er, jr
+	})
+	if err != nil {
+		t.Fatalf("got error when creating engine: %v", err)
+	}
+	return e, eventRepo, jobRepo
+}
+
+func newEvent(raw string, d time.Duration, offset int64) events.Event {
+	return events.Event{
+		Raw:       raw,
+		Timestamp: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC).Add(d * time.Second),
+		Host:      "localhost",
+		Source:    "log.txt",
+		SourceId:  "source-1",
+		Offset:    offset,
+	}
+}
+
+func waitForJob(t *testing.T, jobRepo api.Repository, id int64) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := jobRepo.Get(id)
+		if err != nil {
+			t.Fatalf("got error when getting job: %v", err)
+		}
+		if job.State != api.StateRunning {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("jobId=%v did not finish in time", id)
+}
@@ -71,7 +71,7 @@ func (pc *PipelineCompiler) Compile(input string, startTime, endTime *time.Time)
 			return nil, fmt.Errorf("failed to compile pipeline: no step definition found for StepType=%v", step.StepType)
 		}
 		// This feels pretty dumb
-		if i == 0 && step.StepType == "search" {
+		if i == 0 && (step.StepType == "search" || step.StepType == "archivesearch") {
 			if startTime != nil {
 				step.Args["startTime"] = startTime.Format(time.RFC3339Nano)
 			}
@@ -79,7 +79,7 @@ func (pc *PipelineCompiler) Compile(input string, startTime, endTime *time.Time)
 				step.Args["endTime"] = endTime.Format(time.RFC3339Nano)
 			}
 		}
-		res, err := stepDefinition.Compiler(step.Value, step.Args)
+		res, err := stepDefinition.Compile(step.Value, step.Args)
 		if err != nil {
 			return nil, fmt.Errorf("failed to compile pipeline: failed to compile step %v: %w", i, err)
 		}
@@ -94,6 +94,21 @@ func (pc *PipelineCompiler) Compile(input string, startTime, endTime *time.Time)
 	}
 	compiledSteps = compiledSteps[lastGeneratorIndex:]
 
+	var reversible api.ReversibleStep
+	for _, compiled := range compiledSteps {
+		if rs, ok := compiled.(api.ReversibleStep); ok {
+			reversible = rs
+		} else if _, ok := compiled.(api.OrderReversingStep); ok {
+			if reversible == nil {
+				return nil, fmt.Errorf("failed to compile pipeline: %v must come after a step which produces events in a reversible order, like search", compiled.Name())
+			}
+			reversible.Reverse()
+		} else if _, ok := compiled.(api.StepWithSortMode); ok {
+			// The order of the events is decided by this step now, so an earlier step can no longer be reversed
+			reversible = nil
+		}
+	}
+
 	outputType := compiledSteps[0].OutputType()
 	for i, compiled := range compiledSteps {
 		if (compiled.InputType() == api.PipeTypePropagate || compiled.OutputType() == api.PipeTypePropagate) && compiled.InputType() != compiled.OutputType() {
@@ -160,6 +175,41 @@ func (p *Pipeline) Execute(ctx context.Context, params api.Parameters) <-chan ap
 	return p.outChan
 }
 
+type StepExplanation struct {
+	Name       string         `json:"name"`
+	InputType  string         `json:"inputType"`
+	OutputType string         `json:"outputType"`
+	Details    map[string]any `json:"details,omitempty"`
+}
+
+type Explanation struct {
+	Steps      []StepExplanation `json:"steps"`
+	OutputType string            `json:"outputType"`
+}
+
+// Explain describes the steps in the pipeline and how they will be executed without executing them.
+func (p *Pipeline) Explain(params api.Parameters) (*Explanation, error) {
+	steps := make([]StepExplanation, len(p.steps))
+	for i, s := range p.steps {
+		steps[i] = StepExplanation{
+			Name:       s.Name(),
+			InputType:  s.InputType().String(),
+			OutputType: s.OutputType().String(),
+		}
+		if es, ok := s.(api.ExplainableStep); ok {
+			details, err := es.Explain(params)
+			if err != nil {
+				return nil, fmt.Errorf("failed to explain step %v: %w", i, err)
+			}
+			steps[i].Details = details
+		}
+	}
+	return &Explanation{
+		Steps:      steps,
+		OutputType: p.OutputType().String(),
+	}, nil
+}
+
 func (p *Pipeline) GetStepNames() []string {
 	ret := make([]string, len(p.steps))
 	for i, s := range p.steps {
@@ -90,6 +90,33 @@ func TestSortMode_SurroundingPipeline(t *testing.T) {
 	}
 }
 
+func TestSortMode_ReversePipeline(t *testing.T) {
+	p, err := newTestPipelineCompiler().Compile("hello | reverse", nil, nil)
+	if err != nil {
+		t.Fatalf("got error when compiling pipeline: %v", err)
+	}
+	if p.SortMode() != events.SortModeTimestampAsc {
+		t.Error("unexpected sortMode, expected SortModeTimestampAsc for reversed pipeline", p.SortMode())
+	}
+}
+
+func TestSortMode_DoubleReversePipeline(t *testing.T) {
+	p, err := newTestPipelineCompiler().Compile("hello | reverse | where x=y | reverse", nil, nil)
+	if err != nil {
+		t.Fatalf("got error when compiling pipeline: %v", err)
+	}
+	if p.SortMode() != events.SortModeTimestampDesc {
+		t.Error("unexpected sortMode, expected SortModeTimestampDesc for pipeline which is reversed twice", p.SortMode())
+	}
+}
+
+func TestSortMode_ReverseSurroundingPipeline(t *testing.T) {
+	_, err := newTestPipelineCompiler().Compile("| surrounding eventId=1 | reverse", nil, nil)
+	if err == nil {
+		t.Error("expected error when reversing surrounding pipeline since its order cannot be reversed")
+	}
+}
+
 func TestTypePropagation_Events(t *testing.T) {
 	p, _ := newTestPipelineCompiler().Compile("| where x=y", nil, nil)
 	if p.OutputType() != api.PipeTypeEvents {
@@ -103,3 +130,35 @@ func TestTypePropagation_Table(t *testing.T) {
 		t.Error("unexpected output type, expected PipelinePipeTypeTable since the where pipe should propagate the table pipe's output type", p.OutputType())
 	}
 }
+
+func TestExplain(t *testing.T) {
+	p, err := newTestPipelineCompiler().Compile("hello userid=123 | rex \"(?P<x>\\d+)\" | table \"x\"", nil, nil)
+	if err != nil {
+		t.Fatalf("got error when compiling pipeline: %v", err)
+	}
+	explanation, err := p.Explain(api.Parameters{})
+	if err != nil {
+		t.Fatalf("got error when explaining pipeline: %v", err)
+	}
+	expectedSteps := []StepExplanation{
+		{Name: "search", InputType: "none", OutputType: "events"},
+		{Name: "rex", InputType: "events", OutputType: "events"},
+		{Name: "table", InputType: "events", OutputType: "table"},
+	}
+	if len(explanation.Steps) != len(expectedSteps) {
+		t.Fatalf("unexpected number of steps in explanation, expected=%v, got=%v", len(expectedSteps), len(explanation.Steps))
+	}
+	for i, expected := range expectedSteps {
+		got := explanation.Steps[i]
+		if got.Name != expected.Name || got.InputType != expected.InputType || got.OutputType != expected.OutputType {
+			t.Errorf("unexpected explanation for step %v, expected=%+v, got=%+v", i, expected, got)
+		}
+	}
+	inProcess := explanation.Steps[0].Details["inProcessFilters"]
+	if !reflect.DeepEqual(inProcess, []string{"hello", "userid=123"}) {
+		t.Errorf("unexpected inProcessFilters for search step, expected=[hello userid=123], got=%v", inProcess)
+	}
+	if explanation.OutputType != "table" {
+		t.Errorf("unexpected output type in explanation, expected=table, got=%v", explanation.OutputType)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	api "github.com/jackbister/logsuck/pkg/logsuck/pipeline"
+)
+
+// WriteStepHelp writes human readable documentation for the given steps, sorted by name, to w.
+func WriteStepHelp(w io.Writer, stepDefinitions []api.StepDefinition) error {
+	sorted := make([]api.StepDefinition, len(stepDefinitions))
+	for i, sd := range stepDefinitions {
+		sorted[i] = sd.WithDefaults()
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].StepName < sorted[j].StepName
+	})
+	for i, sd := range sorted {
+		if i > 0 {
+			if _, err := fmt.Fprintln(w); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%v\n", sd.Usage()); err != nil {
+			return err
+		}
+		if sd.Summary != "" {
+			if _, err := fmt.Fprintf(w, "    %v\n", sd.Summary); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "    Input: %v, output: %v\n", sd.InputType, sd.OutputType); err != nil {
+			return err
+		}
+		if len(sd.Options) > 0 {
+			if _, err := fmt.Fprintf(w, "    Options:\n"); err != nil {
+				return err
+			}
+			for _, o := range sd.Options {
+				line := fmt.Sprintf("      %v (%v", o.Name, o.Type)
+				if o.Required {
+					line += ", required"
+				}
+				if o.Default != "" {
+					line += ", default " + o.Default
+				}
+				line += ")"
+				if o.Description != "" {
+					line += ": " + o.Description
+				}
+				if _, err := fmt.Fprintln(w, line); err != nil {
+					return err
+				}
+			}
+		}
+		if len(sd.Examples) > 0 {
+			if _, err := fmt.Fprintf(w, "    Examples:\n"); err != nil {
+				return err
+			}
+			for _, e := range sd.Examples {
+				if _, err := fmt.Fprintf(w, "      %v\n", e); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
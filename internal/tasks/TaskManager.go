@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"sort"
 	"sync"
 	"time"
 
@@ -75,6 +76,7 @@ type TaskManager struct {
 	taskContext  TaskContext
 	tasks        map[string]tasks.Task
 	taskData     sync.Map //<string, TaskData>
+	lastRuns     sync.Map //<string, tasks.RunInfo>
 	ctx          context.Context
 	configSource config.Source
 
@@ -92,6 +94,10 @@ type TaskManagerParams struct {
 	Tasks []tasks.Task `group:"tasks"`
 }
 
+func NewTaskStatusSource(tm *TaskManager) tasks.StatusSource {
+	return tm
+}
+
 func NewTaskManager(p TaskManagerParams) (*TaskManager, error) {
 	r, err := p.CfgSource.Get()
 	if err != nil {
@@ -188,6 +194,11 @@ func (tm *TaskManager) ScheduleTask(name string) error {
 					endTime := time.Now()
 					td.state = TaskStateNotRunning
 					tm.taskData.Store(name, td)
+					runInfo := tasks.RunInfo{StartTime: startTime, EndTime: endTime}
+					if rr, ok := t.(tasks.ResultReporter); ok {
+						runInfo.Result = rr.LastResult()
+					}
+					tm.lastRuns.Store(name, runInfo)
 					logger.Info("task finished",
 						slog.Duration("duration", endTime.Sub(startTime)))
 				}
@@ -238,3 +249,29 @@ func (tm *TaskManager) UpdateConfig(cfg config.Config) {
 		tm.ScheduleTask(t.Name)
 	}
 }
+
+// Statuses returns the status of every registered task, sorted by name. Tasks which are not scheduled are included with Enabled
+// set to false.
+func (tm *TaskManager) Statuses() []tasks.Status {
+	ret := make([]tasks.Status, 0, len(tm.tasks))
+	for tn := range tm.tasks {
+		status := tasks.Status{Name: tn}
+		if tdAny, ok := tm.taskData.Load(tn); ok {
+			if td, ok := tdAny.(TaskData); ok {
+				status.Enabled = td.enabled
+				status.Running = td.state == TaskStateRunning
+				status.Interval = td.interval.String()
+			}
+		}
+		if riAny, ok := tm.lastRuns.Load(tn); ok {
+			if ri, ok := riAny.(tasks.RunInfo); ok {
+				status.LastRun = &ri
+			}
+		}
+		ret = append(ret, status)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
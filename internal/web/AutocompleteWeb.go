@@ -0,0 +1,263 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/parser"
+	"github.com/jackbister/logsuck/pkg/logsuck/pipeline"
+)
+
+// autocompleteRecentJobs is the number of recent jobs whose field statistics are used for field name and value suggestions
+const autocompleteRecentJobs = 10
+
+const maxAutocompleteSuggestions = 10
+
+// autocompleteIndexedFieldValues is the number of the most common values of an indexed field which are considered for field value suggestions
+const autocompleteIndexedFieldValues = 100
+
+type autocompleteSuggestion struct {
+	Value       string `json:"value"`
+	Description string `json:"description,omitempty"`
+	Example     string `json:"example,omitempty"`
+}
+
+var completionTypeNames = map[parser.CompletionType]string{
+	parser.CompletionTypeNone:        "none",
+	parser.CompletionTypeStepName:    "stepName",
+	parser.CompletionTypeOption:      "option",
+	parser.CompletionTypeOptionValue: "optionValue",
+	parser.CompletionTypeFieldName:   "fieldName",
+	parser.CompletionTypeFieldValue:  "fieldValue",
+}
+
+func addAutocompleteEndpoints(g *gin.RouterGroup, wi *webImpl) {
+	g.GET("/autocomplete", func(c *gin.Context) {
+		query := c.Query("query")
+		// cursor is given in UTF-16 code units since that is what selectionStart in the browser counts, so it needs to be converted to a
+		// byte offset. The cursor is at the end of the query if it is not given.
+		byteCursor := len(query)
+		if cursorString, ok := c.GetQuery("cursor"); ok {
+			cursor, err := strconv.Atoi(cursorString)
+			if err != nil {
+				c.AbortWithError(400, fmt.Errorf("failed to parse cursor as integer: %w", err))
+				return
+			}
+			byteCursor = utf16OffsetToByteOffset(query, cursor)
+		}
+
+		cc := parser.GetCompletionContext(query, byteCursor)
+		suggestions, err := wi.getSuggestions(cc)
+		if err != nil {
+			c.AbortWithError(500, err)
+			return
+		}
+		c.JSON(200, gin.H{
+			"type":        completionTypeNames[cc.Type],
+			"prefix":      cc.Prefix,
+			"suggestions": suggestions,
+		})
+	})
+}
+
+func (wi *webImpl) getSuggestions(cc parser.CompletionContext) ([]autocompleteSuggestion, error) {
+	switch cc.Type {
+	case parser.CompletionTypeStepName:
+		ret := make([]autocompleteSuggestion, 0, len(wi.stepDefinitions))
+		for name, sd := range wi.stepDefinitions {
+			if hasPrefixFold(name, cc.Prefix) {
+				suggestion := autocompleteSuggestion{
+					Value:       name,
+					Description: sd.Summary,
+				}
+				if len(sd.Examples) > 0 {
+					suggestion.Example = sd.Examples[0]
+				}
+				ret = append(ret, suggestion)
+			}
+		}
+		sort.Slice(ret, func(i, j int) bool {
+			return ret[i].Value < ret[j].Value
+		})
+		return ret, nil
+	case parser.CompletionTypeOption:
+		sd, ok := wi.stepDefinitions[cc.StepType]
+		if !ok {
+			return []autocompleteSuggestion{}, nil
+		}
+		if sd.Options == nil {
+			// Steps without declared options, like where, take arbitrary field names as options
+			return wi.getFieldNameSuggestions(cc.Prefix)
+		}
+		ret := make([]autocompleteSuggestion, 0, len(sd.Options))
+		for _, o := range sd.Options {
+			if hasPrefixFold(o.Name, cc.Prefix) {
+				ret = append(ret, autocompleteSuggestion{
+					Value:       o.Name,
+					Description: describeStepOption(o),
+				})
+			}
+		}
+		return ret, nil
+	case parser.CompletionTypeOptionValue:
+		sd, ok := wi.stepDefinitions[cc.StepType]
+		if !ok {
+			return []autocompleteSuggestion{}, nil
+		}
+		if sd.Options == nil {
+			return wi.getFieldValueSuggestions(cc.Name, cc.Prefix)
+		}
+		for _, o := range sd.Options {
+			if o.Name != cc.Name {
+				continue
+			}
+			ret := []autocompleteSuggestion{}
+			if o.Type == pipeline.StepOptionTypeBool {
+				for _, v := range []string{"false", "true"} {
+					if hasPrefixFold(v, cc.Prefix) {
+						ret = append(ret, autocompleteSuggestion{Value: v})
+					}
+				}
+			} else if o.Default != "" && hasPrefixFold(o.Default, cc.Prefix) {
+				ret = append(ret, autocompleteSuggestion{Value: o.Default, Description: "Default"})
+			}
+			return ret, nil
+		}
+		return []autocompleteSuggestion{}, nil
+	case parser.CompletionTypeFieldName:
+		return wi.getFieldNameSuggestions(cc.Prefix)
+	case parser.CompletionTypeFieldValue:
+		return wi.getFieldValueSuggestions(cc.Name, cc.Prefix)
+	}
+	return []autocompleteSuggestion{}, nil
+}
+
+func (wi *webImpl) getFieldNameSuggestions(prefix string) ([]autocompleteSuggestion, error) {
+	occurrences, err := wi.jobRepo.GetRecentFieldOccurences(autocompleteRecentJobs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get field name suggestions: %w", err)
+	}
+	// host and source are always available, so they should always be suggested even if there are no recent jobs
+	for _, f := range []string{"host", "source"} {
+		if _, ok := occurrences[f]; !ok {
+			occurrences[f] = 0
+		}
+	}
+	return topSuggestions(occurrences, prefix), nil
+}
+
+func (wi *webImpl) getFieldValueSuggestions(fieldName string, prefix string) ([]autocompleteSuggestion, error) {
+	occurrences, err := wi.jobRepo.GetRecentFieldValues(autocompleteRecentJobs, fieldName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get field value suggestions for fieldName=%v: %w", fieldName, err)
+	}
+	if fieldName == "source" || fieldName == "host" {
+		cfg, err := wi.configSource.Get()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get field value suggestions for fieldName=%v: failed to get config: %w", fieldName, err)
+		}
+		if fieldName == "source" {
+			for _, f := range cfg.Cfg.Files {
+				if _, ok := occurrences[f.Filename]; !ok {
+					occurrences[f.Filename] = 0
+				}
+			}
+		} else if _, ok := occurrences[cfg.Cfg.HostName]; !ok && cfg.Cfg.HostName != "" {
+			occurrences[cfg.Cfg.HostName] = 0
+		}
+	} else if sp, ok := wi.eventRepo.(events.IndexedFieldStatsProvider); ok {
+		// Indexed fields have counts for all events, which are more accurate than the counts from the recent jobs
+		counts, err := sp.GetIndexedFieldValueCounts(strings.ToLower(fieldName), autocompleteIndexedFieldValues)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get field value suggestions for fieldName=%v: %w", fieldName, err)
+		}
+		for k, v := range counts {
+			if v > occurrences[k] {
+				occurrences[k] = v
+			}
+		}
+	}
+	return topSuggestions(occurrences, prefix), nil
+}
+
+func describeStepOption(o pipeline.StepOption) string {
+	ret := o.Description
+	details := o.Type.String()
+	if o.Required {
+		details += ", required"
+	}
+	if o.Default != "" {
+		details += ", default " + o.Default
+	}
+	if ret != "" {
+		ret += " "
+	}
+	return ret + "(" + details + ")"
+}
+
+// topSuggestions returns the most common values in occurrences which start with prefix
+func topSuggestions(occurrences map[string]int, prefix string) []autocompleteSuggestion {
+	values := make([]string, 0, len(occurrences))
+	for k := range occurrences {
+		if hasPrefixFold(k, prefix) {
+			values = append(values, k)
+		}
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if occurrences[values[i]] != occurrences[values[j]] {
+			return occurrences[values[i]] > occurrences[values[j]]
+		}
+		return values[i] < values[j]
+	})
+	if len(values) > maxAutocompleteSuggestions {
+		values = values[:maxAutocompleteSuggestions]
+	}
+	ret := make([]autocompleteSuggestion, len(values))
+	for i, v := range values {
+		ret[i] = autocompleteSuggestion{Value: v}
+	}
+	return ret
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// utf16OffsetToByteOffset converts an offset in UTF-16 code units to an offset in bytes. Characters outside the Basic Multilingual Plane,
+// like most emoji, are one rune but two UTF-16 code units. An offset between the two code units of such a character is moved to the start
+// of the character.
+func utf16OffsetToByteOffset(s string, utf16Offset int) int {
+	if utf16Offset <= 0 {
+		return 0
+	}
+	units := 0
+	for byteOffset, r := range s {
+		if r >= 0x10000 {
+			units += 2
+		} else {
+			units++
+		}
+		if units > utf16Offset {
+			return byteOffset
+		}
+	}
+	return len(s)
+}
@@ -0,0 +1,45 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"testing"
+)
+
+var utf16OffsetTests = []struct {
+	name     string
+	s        string
+	offset   int
+	expected int
+}{
+	{"ascii", "level=info", 6, 6},
+	{"start", "level=info", 0, 0},
+	{"past end", "level=info", 100, 10},
+	{"two byte character", "é=1", 1, 2},
+	// 😀 is outside the Basic Multilingual Plane, so it is two UTF-16 code units but four bytes
+	{"after non-BMP character", "😀 level=info", 8, 10},
+	{"end with non-BMP character", "msg=😀", 6, 8},
+	{"within non-BMP character", "a😀b", 2, 1},
+}
+
+func TestUtf16OffsetToByteOffset(t *testing.T) {
+	for _, tt := range utf16OffsetTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := utf16OffsetToByteOffset(tt.s, tt.offset); got != tt.expected {
+				t.Fatalf("got unexpected byte offset for s=%q, offset=%v, expected=%v, got=%v", tt.s, tt.offset, tt.expected, got)
+			}
+		})
+	}
+}
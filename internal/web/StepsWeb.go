@@ -0,0 +1,85 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackbister/logsuck/pkg/logsuck/pipeline"
+)
+
+type stepOptionDto struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Type        string `json:"type"`
+	Default     string `json:"default,omitempty"`
+	Required    bool   `json:"required"`
+}
+
+type stepDefinitionDto struct {
+	Name    string `json:"name"`
+	Summary string `json:"summary,omitempty"`
+	Usage   string `json:"usage"`
+	Value   string `json:"value,omitempty"`
+	// Options is null for steps which accept arbitrary options, like where
+	Options    []stepOptionDto `json:"options"`
+	Examples   []string        `json:"examples"`
+	InputType  string          `json:"inputType"`
+	OutputType string          `json:"outputType"`
+}
+
+func addStepsEndpoints(g *gin.RouterGroup, wi *webImpl) {
+	g.GET("/steps", func(c *gin.Context) {
+		ret := make([]stepDefinitionDto, 0, len(wi.stepDefinitions))
+		for _, sd := range wi.stepDefinitions {
+			ret = append(ret, toStepDefinitionDto(sd))
+		}
+		sort.Slice(ret, func(i, j int) bool {
+			return ret[i].Name < ret[j].Name
+		})
+		c.JSON(200, ret)
+	})
+}
+
+func toStepDefinitionDto(sd pipeline.StepDefinition) stepDefinitionDto {
+	var options []stepOptionDto
+	if sd.Options != nil {
+		options = make([]stepOptionDto, len(sd.Options))
+		for i, o := range sd.Options {
+			options[i] = stepOptionDto{
+				Name:        o.Name,
+				Description: o.Description,
+				Type:        o.Type.String(),
+				Default:     o.Default,
+				Required:    o.Required,
+			}
+		}
+	}
+	examples := sd.Examples
+	if examples == nil {
+		examples = []string{}
+	}
+	return stepDefinitionDto{
+		Name:       sd.StepName,
+		Summary:    sd.Summary,
+		Usage:      sd.Usage(),
+		Value:      sd.Value,
+		Options:    options,
+		Examples:   examples,
+		InputType:  sd.InputType.String(),
+		OutputType: sd.OutputType.String(),
+	}
+}
@@ -21,7 +21,6 @@ import (
 	"io/fs"
 	"log/slog"
 	"net/http"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"text/template"
@@ -30,11 +29,14 @@ import (
 	"github.com/gin-gonic/gin"
 	internalJobs "github.com/jackbister/logsuck/internal/jobs"
 
+	"github.com/jackbister/logsuck/pkg/logsuck/archive"
 	"github.com/jackbister/logsuck/pkg/logsuck/config"
 	"github.com/jackbister/logsuck/pkg/logsuck/events"
 	"github.com/jackbister/logsuck/pkg/logsuck/indexedfiles"
 	"github.com/jackbister/logsuck/pkg/logsuck/jobs"
 	"github.com/jackbister/logsuck/pkg/logsuck/parser"
+	"github.com/jackbister/logsuck/pkg/logsuck/pipeline"
+	"github.com/jackbister/logsuck/pkg/logsuck/tasks"
 	"github.com/jackbister/logsuck/pkg/logsuck/util"
 
 	"go.uber.org/dig"
@@ -45,14 +47,18 @@ type Web interface {
 }
 
 type webImpl struct {
-	configSource  config.Source
-	configRepo    config.Repository
-	configSchema  map[string]any
-	staticConfig  *config.Config
-	eventRepo     events.Repository
-	jobRepo       jobs.Repository
-	jobEngine     *internalJobs.Engine
-	enumProviders map[string]EnumProvider
+	configSource    config.Source
+	configRepo      config.Repository
+	configSchema    map[string]any
+	staticConfig    *config.Config
+	eventRepo       events.Repository
+	jobRepo         jobs.Repository
+	jobEngine       *internalJobs.Engine
+	enumProviders   map[string]EnumProvider
+	stepDefinitions map[string]pipeline.StepDefinition
+	taskStatuses    tasks.StatusSource
+	// ingestionMetrics may be nil, in which case the metrics are always empty
+	ingestionMetrics *events.IngestionMetrics
 
 	logger *slog.Logger
 }
@@ -69,16 +75,19 @@ func (w webError) Error() string {
 type WebParams struct {
 	dig.In
 
-	ConfigSource config.Source
-	ConfigRepo   config.Repository
-	ConfigSchema map[string]any `name:"configSchema"`
-	StaticConfig *config.Config
-	EventRepo    events.Repository
-	JobRepo      jobs.Repository
-	JobEngine    *internalJobs.Engine
-	Logger       *slog.Logger
-
-	EnumProviders []EnumProvider `group:"enumProviders"`
+	ConfigSource     config.Source
+	ConfigRepo       config.Repository
+	ConfigSchema     map[string]any `name:"configSchema"`
+	StaticConfig     *config.Config
+	EventRepo        events.Repository
+	JobRepo          jobs.Repository
+	JobEngine        *internalJobs.Engine
+	TaskStatuses     tasks.StatusSource       `optional:"true"`
+	IngestionMetrics *events.IngestionMetrics `optional:"true"`
+	Logger           *slog.Logger
+
+	EnumProviders   []EnumProvider            `group:"enumProviders"`
+	StepDefinitions []pipeline.StepDefinition `group:"steps"`
 }
 
 func NewWeb(p WebParams) Web {
@@ -86,6 +95,10 @@ func NewWeb(p WebParams) Web {
 	for _, e := range p.EnumProviders {
 		enumProviders[e.Name()] = e
 	}
+	stepDefinitions := make(map[string]pipeline.StepDefinition, len(p.StepDefinitions))
+	for _, s := range p.StepDefinitions {
+		stepDefinitions[s.StepName] = s.WithDefaults()
+	}
 	return webImpl{
 		staticConfig: p.StaticConfig,
 		configSource: p.ConfigSource,
@@ -95,7 +108,10 @@ func NewWeb(p WebParams) Web {
 		jobRepo:      p.JobRepo,
 		jobEngine:    p.JobEngine,
 
-		enumProviders: enumProviders,
+		enumProviders:    enumProviders,
+		stepDefinitions:  stepDefinitions,
+		taskStatuses:     p.TaskStatuses,
+		ingestionMetrics: p.IngestionMetrics,
 
 		logger: p.Logger,
 	}
@@ -167,6 +183,15 @@ func (wi webImpl) Serve() error {
 			c.AbortWithError(wErr.code, wErr)
 			return
 		}
+		if c.Query("explain") == "true" {
+			explanation, err := wi.jobEngine.Explain(strings.TrimSpace(searchString), startTime, endTime)
+			if err != nil {
+				c.AbortWithError(500, err)
+				return
+			}
+			c.JSON(200, explanation)
+			return
+		}
 		id, err := wi.jobEngine.StartJob(strings.TrimSpace(searchString), startTime, endTime)
 		if err != nil {
 			c.AbortWithError(500, err)
@@ -276,6 +301,10 @@ func (wi webImpl) Serve() error {
 	})
 
 	addConfigEndpoints(g, &wi)
+	addAutocompleteEndpoints(g, &wi)
+	addStepsEndpoints(g, &wi)
+	addTasksEndpoints(g, &wi)
+	addIngestionEndpoints(g, &wi)
 
 	r.NoRoute(func(c *gin.Context) {
 		path := c.Request.URL.Path
@@ -287,15 +316,15 @@ func (wi webImpl) Serve() error {
 }
 
 func (wi *webImpl) getJobResults(job *jobs.Job, skip, take int) ([]events.EventWithExtractedFields, error) {
-	eventIds, err := wi.jobRepo.GetResults(job.Id, skip, take)
+	eventIds, err := wi.jobRepo.GetResults(job.Id, job.SortMode, skip, take)
 	if err != nil {
 		return nil, err
 	}
-	results, err := wi.eventRepo.GetByIds(eventIds, job.SortMode)
+	cfg, err := wi.configSource.Get()
 	if err != nil {
 		return nil, err
 	}
-	cfg, err := wi.configSource.Get()
+	results, err := wi.getEventsByIds(&cfg.Cfg, eventIds, job.SortMode)
 	if err != nil {
 		return nil, err
 	}
@@ -317,6 +346,7 @@ func (wi *webImpl) getJobResults(job *jobs.Job, skip, take int) ([]events.EventW
 			Host:      r.Host,
 			Source:    r.Source,
 			SourceId:  r.SourceId,
+			Index:     r.Index,
 			Timestamp: r.Timestamp,
 			Fields:    fields,
 		})
@@ -324,6 +354,43 @@ func (wi *webImpl) getJobResults(job *jobs.Job, skip, take int) ([]events.EventW
 	return retResults, nil
 }
 
+// getEventsByIds gets the events with the given IDs from the repository, or from the archive for IDs of archived events which were
+// found by archivesearch. The events are returned in the same order as the IDs if any of them are archived.
+func (wi *webImpl) getEventsByIds(cfg *config.Config, ids []int64, sortMode events.SortMode) ([]events.EventWithId, error) {
+	repoIds := make([]int64, 0, len(ids))
+	archivedIds := []int64{}
+	for _, id := range ids {
+		if _, _, ok := archive.ParseEventId(id); ok {
+			archivedIds = append(archivedIds, id)
+		} else {
+			repoIds = append(repoIds, id)
+		}
+	}
+	results, err := wi.eventRepo.GetByIds(repoIds, sortMode)
+	if err != nil || len(archivedIds) == 0 {
+		return results, err
+	}
+	dir, err := archive.Directory(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get archived events: %w", err)
+	}
+	archived, err := archive.GetByIds(dir, archivedIds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get archived events: %w", err)
+	}
+	byId := make(map[int64]events.EventWithId, len(results)+len(archived))
+	for _, evt := range append(results, archived...) {
+		byId[evt.Id] = evt
+	}
+	ret := make([]events.EventWithId, 0, len(byId))
+	for _, id := range ids {
+		if evt, ok := byId[id]; ok {
+			ret = append(ret, evt)
+		}
+	}
+	return ret, nil
+}
+
 func parseTemplate(fs http.FileSystem) (*template.Template, error) {
 	f, err := fs.Open("template.html")
 	if err != nil {
@@ -389,12 +456,7 @@ func getSourceToIndexedFileConfig(evts []events.EventWithId, indexedFileConfigs
 			continue
 		}
 		for i, ifc := range indexedFileConfigs {
-			absGlob, err := filepath.Abs(ifc.Filename)
-			if err != nil {
-				// TODO:
-				continue
-			}
-			if m, err := filepath.Match(absGlob, evt.Source); err == nil && m {
+			if ifc.Matches(evt.Source) {
 				sourceToConfig[evt.Source] = &indexedFileConfigs[i]
 				goto nextfile
 			}
@@ -0,0 +1,462 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package archive reads and writes the archive files created by ArchiveTask. Events are archived per day (UTC) in a gzip compressed file
+// with one JSON encoded event per line. Each events file has an index file next to it which describes the events in the file, so that
+// searches can skip the files that cannot contain matching events without decompressing them.
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/config"
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+)
+
+// TaskName is the name of the task which archives events. The archive directory is read from the configuration of this task.
+const TaskName = "@logsuck/ArchiveTask"
+
+// DayLayout is the layout of the days used to name the archive files.
+const DayLayout = "2006-01-02"
+
+const (
+	eventsSuffix = ".ndjson.gz"
+	indexSuffix  = ".index.json"
+	thawedSuffix = ".thawed"
+	// thawBatchSize is the number of events added to the repository at a time when thawing a day.
+	thawBatchSize = 1000
+	// idEpochDays is the number of days from 0000-12-31 to 1970-01-01. Event IDs count days from 0000-12-31 so that they are negative for
+	// every day which can be formatted using DayLayout, including the days before 1970.
+	idEpochDays = 719163
+)
+
+// Event is an archived event. Each line of an events file contains an Event encoded as JSON.
+type Event struct {
+	Raw       string    `json:"raw"`
+	Timestamp time.Time `json:"timestamp"`
+	Host      string    `json:"host"`
+	Source    string    `json:"source"`
+	SourceId  string    `json:"sourceId"`
+	Offset    int64     `json:"offset"`
+	Index     string    `json:"index"`
+}
+
+// Index describes the events in the events file of a day.
+type Index struct {
+	Day       string    `json:"day"`
+	NumEvents int       `json:"numEvents"`
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime"`
+	Hosts     []string  `json:"hosts"`
+	Sources   []string  `json:"sources"`
+	Indexes   []string  `json:"indexes"`
+	// Size is the size of the events file after the last completed Append. Anything after it was left by an Append which did not
+	// finish.
+	Size int64 `json:"size"`
+	// LastBatchIds are the repository IDs of the events passed to the last Append.
+	LastBatchIds []int64 `json:"lastBatchIds,omitempty"`
+}
+
+// Directory returns the archive directory configured for ArchiveTask.
+func Directory(cfg *config.Config) (string, error) {
+	tc, ok := cfg.Tasks[TaskName]
+	if !ok {
+		return "", fmt.Errorf("%v is not configured", TaskName)
+	}
+	dir, ok := tc.Config["directory"].(string)
+	if !ok || dir == "" {
+		return "", fmt.Errorf("directory is not set in the configuration of %v", TaskName)
+	}
+	return dir, nil
+}
+
+// Day returns the day an event with the given timestamp is archived under.
+func Day(t time.Time) string {
+	return t.UTC().Format(DayLayout)
+}
+
+// Days returns the days which have been archived in dir, oldest first.
+func Days(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive directory: %w", err)
+	}
+	ret := []string{}
+	for _, e := range entries {
+		if day, ok := strings.CutSuffix(e.Name(), indexSuffix); ok && !e.IsDir() {
+			ret = append(ret, day)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// ReadIndex reads the index of the events file of the given day. The returned error wraps os.ErrNotExist if the day has not been archived.
+func ReadIndex(dir, day string) (*Index, error) {
+	b, err := os.ReadFile(filepath.Join(dir, day+indexSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index of day=%v: %w", day, err)
+	}
+	var idx Index
+	err = json.Unmarshal(b, &idx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse index of day=%v: %w", day, err)
+	}
+	return &idx, nil
+}
+
+// Append adds the events to the events file of the given day and updates its index. The events are appended to the file as a new gzip
+// member, and the index is written afterwards with the new size of the file, so a crash while appending leaves data after the size in the
+// index which is ignored by Read and removed by the next Append.
+// ArchiveTask deletes the events from the repository after they have been appended, so if it is stopped in between it appends the same
+// events again on its next run. Events with the same IDs as the events passed to the previous Append are therefore skipped.
+func Append(dir, day string, evts []events.EventWithId) error {
+	if len(evts) == 0 {
+		return nil
+	}
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	idx, err := ReadIndex(dir, day)
+	if errors.Is(err, os.ErrNotExist) {
+		idx = &Index{Day: day}
+	} else if err != nil {
+		return err
+	}
+	lastBatch := make(map[int64]struct{}, len(idx.LastBatchIds))
+	for _, id := range idx.LastBatchIds {
+		lastBatch[id] = struct{}{}
+	}
+	newEvts := make([]events.EventWithId, 0, len(evts))
+	for _, evt := range evts {
+		if _, ok := lastBatch[evt.Id]; !ok {
+			newEvts = append(newEvts, evt)
+		}
+	}
+	if len(newEvts) == 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, day+eventsSuffix), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open events file: %w", err)
+	}
+	defer f.Close()
+	size, err := idx.validSize(f)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	if err != nil {
+		return fmt.Errorf("failed to remove incomplete events from events file: %w", err)
+	}
+	// A gzip file may consist of several members, which are decompressed as if they were one stream
+	gz := gzip.NewWriter(f)
+	enc := json.NewEncoder(gz)
+	for _, evt := range newEvts {
+		err = enc.Encode(Event{
+			Raw:       evt.Raw,
+			Timestamp: evt.Timestamp,
+			Host:      evt.Host,
+			Source:    evt.Source,
+			SourceId:  evt.SourceId,
+			Offset:    evt.Offset,
+			Index:     evt.Index,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to write event: %w", err)
+		}
+	}
+	err = gz.Close()
+	if err != nil {
+		return fmt.Errorf("failed to compress events: %w", err)
+	}
+	err = f.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync events file: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get size of events file: %w", err)
+	}
+
+	idx.add(newEvts)
+	idx.Size = fi.Size()
+	idx.LastBatchIds = make([]int64, len(evts))
+	for i, evt := range evts {
+		idx.LastBatchIds[i] = evt.Id
+	}
+	return writeIndex(dir, idx)
+}
+
+// validSize returns the size of the part of the events file which is described by the index.
+func (idx *Index) validSize(f *os.File) (int64, error) {
+	if idx.Size > 0 || idx.NumEvents == 0 {
+		return idx.Size, nil
+	}
+	// Indexes written before the size was added to them describe the whole file
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get size of events file: %w", err)
+	}
+	return fi.Size(), nil
+}
+
+func (idx *Index) add(evts []events.EventWithId) {
+	hosts := toSet(idx.Hosts)
+	sources := toSet(idx.Sources)
+	indexes := toSet(idx.Indexes)
+	if idx.NumEvents == 0 {
+		idx.StartTime = evts[0].Timestamp
+		idx.EndTime = evts[0].Timestamp
+	}
+	for _, evt := range evts {
+		if evt.Timestamp.Before(idx.StartTime) {
+			idx.StartTime = evt.Timestamp
+		}
+		if evt.Timestamp.After(idx.EndTime) {
+			idx.EndTime = evt.Timestamp
+		}
+		hosts[evt.Host] = struct{}{}
+		sources[evt.Source] = struct{}{}
+		if evt.Index == "" {
+			indexes[events.DefaultIndex] = struct{}{}
+		} else {
+			indexes[evt.Index] = struct{}{}
+		}
+	}
+	idx.NumEvents += len(evts)
+	idx.Hosts = sortedKeys(hosts)
+	idx.Sources = sortedKeys(sources)
+	idx.Indexes = sortedKeys(indexes)
+}
+
+func writeIndex(dir string, idx *Index) error {
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return fmt.Errorf("failed to marshal index: %w", err)
+	}
+	fileName := filepath.Join(dir, idx.Day+indexSuffix)
+	tmpFileName := filepath.Join(dir, "."+idx.Day+indexSuffix+".tmp")
+	err = os.WriteFile(tmpFileName, b, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	err = os.Rename(tmpFileName, fileName)
+	if err != nil {
+		return fmt.Errorf("failed to rename index: %w", err)
+	}
+	return nil
+}
+
+// Read calls fn for every event in the events file of the given day, in the order they were archived. line is the number of the line
+// containing the event, starting from 0. Read stops and returns the error if fn returns an error.
+func Read(dir, day string, fn func(line int, evt Event) error) error {
+	idx, err := ReadIndex(dir, day)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(filepath.Join(dir, day+eventsSuffix))
+	if err != nil {
+		return fmt.Errorf("failed to open events file of day=%v: %w", day, err)
+	}
+	defer f.Close()
+	size, err := idx.validSize(f)
+	if err != nil {
+		return err
+	}
+	gz, err := gzip.NewReader(io.LimitReader(f, size))
+	if err != nil {
+		return fmt.Errorf("failed to decompress events file of day=%v: %w", day, err)
+	}
+	defer gz.Close()
+	r := bufio.NewReader(gz)
+	for line := 0; ; line++ {
+		b, err := r.ReadBytes('\n')
+		if err == io.EOF && len(b) == 0 {
+			return nil
+		} else if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read events file of day=%v: %w", day, err)
+		}
+		var evt Event
+		err = json.Unmarshal(b, &evt)
+		if err != nil {
+			return fmt.Errorf("failed to parse line %v of events file of day=%v: %w", line, day, err)
+		}
+		err = fn(line, evt)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// EventId returns the ID of the archived event on the given line of the events file of the given day. The IDs of archived events are
+// negative so that they can be told apart from the IDs of events in the repository.
+func EventId(day string, line int) (int64, error) {
+	t, err := time.Parse(DayLayout, day)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse day: %w", err)
+	}
+	days := t.Unix()/(24*60*60) + idEpochDays
+	return -(days<<32 | int64(line)), nil
+}
+
+// ParseEventId returns the day and line of the archived event with the given ID. ok is false if the ID is not the ID of an archived event.
+func ParseEventId(id int64) (day string, line int, ok bool) {
+	if id >= 0 {
+		return "", 0, false
+	}
+	id = -id
+	days := id>>32 - idEpochDays
+	return time.Unix(days*24*60*60, 0).UTC().Format(DayLayout), int(id & (1<<32 - 1)), true
+}
+
+// GetByIds returns the archived events with the given IDs, in the same order as the IDs. IDs of events which no longer exist in the
+// archive, for example because the day has been thawed, are skipped.
+func GetByIds(dir string, ids []int64) ([]events.EventWithId, error) {
+	linesByDay := map[string]map[int]struct{}{}
+	for _, id := range ids {
+		day, line, ok := ParseEventId(id)
+		if !ok {
+			continue
+		}
+		if _, ok := linesByDay[day]; !ok {
+			linesByDay[day] = map[int]struct{}{}
+		}
+		linesByDay[day][line] = struct{}{}
+	}
+	found := make(map[int64]events.EventWithId, len(ids))
+	for day, lines := range linesByDay {
+		err := Read(dir, day, func(line int, evt Event) error {
+			if _, ok := lines[line]; ok {
+				id, _ := EventId(day, line)
+				found[id] = evt.WithId(id)
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	ret := make([]events.EventWithId, 0, len(found))
+	for _, id := range ids {
+		if evt, ok := found[id]; ok {
+			ret = append(ret, evt)
+		}
+	}
+	return ret, nil
+}
+
+func (evt Event) WithId(id int64) events.EventWithId {
+	return events.EventWithId{
+		Id:        id,
+		Raw:       evt.Raw,
+		Timestamp: evt.Timestamp,
+		Host:      evt.Host,
+		Source:    evt.Source,
+		SourceId:  evt.SourceId,
+		Offset:    evt.Offset,
+		Index:     evt.Index,
+	}
+}
+
+// IsThawed returns true if the given day has been thawed. ArchiveTask does not archive the events of thawed days.
+func IsThawed(dir, day string) bool {
+	_, err := os.Stat(filepath.Join(dir, day+thawedSuffix))
+	return err == nil
+}
+
+// Thaw adds the archived events of the given day back to the repository and then removes them from the archive. The day is marked as
+// thawed first, so that ArchiveTask does not archive the events again while they are being added. The events keep their original offsets,
+// so thawing a day again after an interrupted thaw does not add duplicates, and the surrounding events of a thawed event can be found.
+// Returns the number of events read from the archive.
+func Thaw(dir, day string, repo events.Repository) (int, error) {
+	_, err := time.Parse(DayLayout, day)
+	if err != nil {
+		return 0, fmt.Errorf("day=%v must be formatted as YYYY-MM-DD: %w", day, err)
+	}
+	_, err = ReadIndex(dir, day)
+	if err != nil {
+		return 0, err
+	}
+	err = os.WriteFile(filepath.Join(dir, day+thawedSuffix), []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0o644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark day=%v as thawed: %w", day, err)
+	}
+	numEvents := 0
+	batch := make([]events.Event, 0, thawBatchSize)
+	err = Read(dir, day, func(line int, evt Event) error {
+		batch = append(batch, events.Event{
+			Raw:       evt.Raw,
+			Timestamp: evt.Timestamp,
+			Host:      evt.Host,
+			Source:    evt.Source,
+			SourceId:  evt.SourceId,
+			Offset:    evt.Offset,
+			Index:     evt.Index,
+		})
+		if len(batch) < thawBatchSize {
+			return nil
+		}
+		numEvents += len(batch)
+		err := repo.AddBatch(batch)
+		batch = batch[:0]
+		return err
+	})
+	if err == nil && len(batch) > 0 {
+		numEvents += len(batch)
+		err = repo.AddBatch(batch)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to add events of day=%v: %w", day, err)
+	}
+	// The index is removed first so that the day is no longer listed by Days if removing the events file fails
+	err = os.Remove(filepath.Join(dir, day+indexSuffix))
+	if err != nil {
+		return 0, fmt.Errorf("failed to remove index of day=%v: %w", day, err)
+	}
+	err = os.Remove(filepath.Join(dir, day+eventsSuffix))
+	if err != nil {
+		return 0, fmt.Errorf("failed to remove events file of day=%v: %w", day, err)
+	}
+	return numEvents, nil
+}
+
+func toSet(values []string) map[string]struct{} {
+	ret := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		ret[v] = struct{}{}
+	}
+	return ret
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
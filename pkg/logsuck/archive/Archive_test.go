@@ -0,0 +1,254 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+)
+
+func TestAppendAndRead(t *testing.T) {
+	dir := t.TempDir()
+	err := Append(dir, "2024-01-02", []events.EventWithId{
+		{Id: 1, Raw: "first", Timestamp: time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC), Host: "a", Source: "x.log", Index: "main"},
+		{Id: 2, Raw: "second", Timestamp: time.Date(2024, 1, 2, 11, 0, 0, 0, time.UTC), Host: "a", Source: "y.log", Index: "main"},
+	})
+	if err != nil {
+		t.Fatalf("got error when appending events: %v", err)
+	}
+	err = Append(dir, "2024-01-02", []events.EventWithId{
+		{Id: 3, Raw: "late", Timestamp: time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC), Host: "b", Source: "x.log"},
+	})
+	if err != nil {
+		t.Fatalf("got error when appending events: %v", err)
+	}
+
+	raws := []string{}
+	err = Read(dir, "2024-01-02", func(line int, evt Event) error {
+		if line != len(raws) {
+			t.Fatalf("expected line=%v, got line=%v", len(raws), line)
+		}
+		raws = append(raws, evt.Raw)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("got error when reading events: %v", err)
+	}
+	if !reflect.DeepEqual(raws, []string{"first", "second", "late"}) {
+		t.Fatalf("got unexpected raws=%v", raws)
+	}
+
+	idx, err := ReadIndex(dir, "2024-01-02")
+	if err != nil {
+		t.Fatalf("got error when reading index: %v", err)
+	}
+	if idx.Size == 0 || !reflect.DeepEqual(idx.LastBatchIds, []int64{3}) {
+		t.Fatalf("expected index to contain the size of the file and the IDs of the last batch, got size=%v, lastBatchIds=%v", idx.Size, idx.LastBatchIds)
+	}
+	idx.Size = 0
+	idx.LastBatchIds = nil
+	expected := Index{
+		Day:       "2024-01-02",
+		NumEvents: 3,
+		StartTime: time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC),
+		EndTime:   time.Date(2024, 1, 2, 11, 0, 0, 0, time.UTC),
+		Hosts:     []string{"a", "b"},
+		Sources:   []string{"x.log", "y.log"},
+		Indexes:   []string{"main"},
+	}
+	if !reflect.DeepEqual(*idx, expected) {
+		t.Fatalf("expected index=%+v, got %+v", expected, *idx)
+	}
+
+	days, err := Days(dir)
+	if err != nil || !reflect.DeepEqual(days, []string{"2024-01-02"}) {
+		t.Fatalf("expected days=[2024-01-02], got days=%v, err=%v", days, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected only the events file and index in the directory, got entries=%v, err=%v", entries, err)
+	}
+}
+
+func TestEventIds(t *testing.T) {
+	for _, tt := range []struct {
+		day  string
+		line int
+	}{
+		{"0001-01-01", 0},
+		{"1960-05-01", 7},
+		{"1969-12-31", 1<<32 - 1},
+		{"1970-01-01", 0},
+		{"1970-01-02", 0},
+		{"2024-01-02", 0},
+		{"2024-01-02", 12345},
+		{"2099-12-31", 1<<32 - 1},
+	} {
+		id, err := EventId(tt.day, tt.line)
+		if err != nil {
+			t.Fatalf("got error when creating ID for day=%v: %v", tt.day, err)
+		}
+		if id >= 0 {
+			t.Fatalf("expected ID of archived event to be negative, got id=%v", id)
+		}
+		day, line, ok := ParseEventId(id)
+		if !ok || day != tt.day || line != tt.line {
+			t.Fatalf("expected day=%v, line=%v, got day=%v, line=%v, ok=%v", tt.day, tt.line, day, line, ok)
+		}
+	}
+	if _, _, ok := ParseEventId(123); ok {
+		t.Fatalf("expected positive ID to not be an archived event")
+	}
+}
+
+func TestAppendSkipsLastBatch(t *testing.T) {
+	dir := t.TempDir()
+	ts := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+	for _, batch := range [][]events.EventWithId{
+		{{Id: 1, Raw: "a", Timestamp: ts}, {Id: 2, Raw: "b", Timestamp: ts}},
+		// The events were appended but not deleted from the repository before the task stopped, so the next run appends them again
+		{{Id: 1, Raw: "a", Timestamp: ts}, {Id: 2, Raw: "b", Timestamp: ts}, {Id: 3, Raw: "c", Timestamp: ts}},
+		{{Id: 3, Raw: "c", Timestamp: ts}},
+	} {
+		err := Append(dir, "2024-01-02", batch)
+		if err != nil {
+			t.Fatalf("got error when appending events: %v", err)
+		}
+	}
+	raws := readRaws(t, dir, "2024-01-02")
+	if !reflect.DeepEqual(raws, []string{"a", "b", "c"}) {
+		t.Fatalf("expected every event to be archived once, got raws=%v", raws)
+	}
+	idx, err := ReadIndex(dir, "2024-01-02")
+	if err != nil || idx.NumEvents != 3 {
+		t.Fatalf("expected index with numEvents=3, got idx=%+v, err=%v", idx, err)
+	}
+}
+
+func TestAppendIgnoresIncompleteData(t *testing.T) {
+	dir := t.TempDir()
+	ts := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+	err := Append(dir, "2024-01-02", []events.EventWithId{{Id: 1, Raw: "a", Timestamp: ts}})
+	if err != nil {
+		t.Fatalf("got error when appending events: %v", err)
+	}
+	// Simulate an Append which was interrupted after writing part of its gzip member but before writing the index
+	f, err := os.OpenFile(filepath.Join(dir, "2024-01-02"+eventsSuffix), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("got error when opening events file: %v", err)
+	}
+	_, err = f.Write([]byte{0x1f, 0x8b, 0x08, 0x00, 0x12})
+	f.Close()
+	if err != nil {
+		t.Fatalf("got error when writing to events file: %v", err)
+	}
+	if raws := readRaws(t, dir, "2024-01-02"); !reflect.DeepEqual(raws, []string{"a"}) {
+		t.Fatalf("expected incomplete data to be ignored, got raws=%v", raws)
+	}
+
+	err = Append(dir, "2024-01-02", []events.EventWithId{{Id: 2, Raw: "b", Timestamp: ts}})
+	if err != nil {
+		t.Fatalf("got error when appending events: %v", err)
+	}
+	if raws := readRaws(t, dir, "2024-01-02"); !reflect.DeepEqual(raws, []string{"a", "b"}) {
+		t.Fatalf("expected incomplete data to be replaced by the next append, got raws=%v", raws)
+	}
+}
+
+func readRaws(t *testing.T, dir, day string) []string {
+	raws := []string{}
+	err := Read(dir, day, func(line int, evt Event) error {
+		raws = append(raws, evt.Raw)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("got error when reading events: %v", err)
+	}
+	return raws
+}
+
+func TestGetByIds(t *testing.T) {
+	dir := t.TempDir()
+	for _, day := range []string{"2024-01-01", "2024-01-02"} {
+		err := Append(dir, day, []events.EventWithId{
+			{Raw: day + " a", Timestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+			{Raw: day + " b", Timestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		})
+		if err != nil {
+			t.Fatalf("got error when appending events: %v", err)
+		}
+	}
+	id1, _ := EventId("2024-01-02", 1)
+	id2, _ := EventId("2024-01-01", 0)
+	missing, _ := EventId("2024-01-03", 0)
+	evts, err := GetByIds(dir, []int64{id1, missing, id2})
+	if err != nil {
+		t.Fatalf("got error when getting archived events: %v", err)
+	}
+	if len(evts) != 2 || evts[0].Id != id1 || evts[0].Raw != "2024-01-02 b" || evts[1].Id != id2 || evts[1].Raw != "2024-01-01 a" {
+		t.Fatalf("got unexpected events=%v", evts)
+	}
+}
+
+// addBatchRepo is a repository which only supports AddBatch, which is all that Thaw uses.
+type addBatchRepo struct {
+	events.Repository
+	added []events.Event
+}
+
+func (r *addBatchRepo) AddBatch(evts []events.Event) error {
+	r.added = append(r.added, evts...)
+	return nil
+}
+
+func TestThawKeepsOffsets(t *testing.T) {
+	dir := t.TempDir()
+	ts := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+	err := Append(dir, "2024-01-02", []events.EventWithId{
+		{Id: 1, Raw: "a", Timestamp: ts, Source: "x.log", Offset: 100},
+		{Id: 2, Raw: "b", Timestamp: ts, Source: "x.log", Offset: 250},
+	})
+	if err != nil {
+		t.Fatalf("got error when appending events: %v", err)
+	}
+	repo := &addBatchRepo{}
+	n, err := Thaw(dir, "2024-01-02", repo)
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 thawed events, got n=%v, err=%v", n, err)
+	}
+	if len(repo.added) != 2 || repo.added[0].Offset != 100 || repo.added[1].Offset != 250 {
+		t.Fatalf("expected thawed events to keep their offsets, got events=%+v", repo.added)
+	}
+}
+
+func TestThawRejectsInvalidDay(t *testing.T) {
+	dir := t.TempDir()
+	_, err := Thaw(dir, "../2024-01-02", nil)
+	if err == nil {
+		t.Fatalf("expected error when thawing invalid day")
+	}
+	_, err = Thaw(dir, "2024-01-02", nil)
+	if err == nil {
+		t.Fatalf("expected error when thawing day which has not been archived")
+	}
+	if IsThawed(dir, "2024-01-02") {
+		t.Fatalf("expected day which has not been archived to not be marked as thawed")
+	}
+}
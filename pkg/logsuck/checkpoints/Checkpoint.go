@@ -0,0 +1,49 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package checkpoints
+
+import "time"
+
+// Checkpoint records how far a watched file has been read, so that reading can resume from the same position after Logsuck is
+// restarted instead of reading the whole file again.
+type Checkpoint struct {
+	Host string `json:"host"`
+	Path string `json:"path"`
+
+	// Device and Inode identify the file the checkpoint was written for. They are zero on platforms where they are not available.
+	Device uint64 `json:"device"`
+	Inode  uint64 `json:"inode"`
+	// Fingerprint is a hash of the first FingerprintSize bytes of the file. It is used to detect that the file at Path has been replaced
+	// when Device and Inode are not available, or when the file system reuses inodes.
+	Fingerprint     []byte `json:"fingerprint"`
+	FingerprintSize int64  `json:"fingerprintSize"`
+
+	// Offset is the position in the file of the first byte which has not been published as part of an event yet.
+	Offset int64 `json:"offset"`
+	// Complete is true if the file is compressed and has been read to its end. Compressed files are not expected to change, so they are
+	// not read again.
+	Complete bool      `json:"complete"`
+	SourceId string    `json:"sourceId"`
+	Updated  time.Time `json:"updated"`
+}
+
+type Repository interface {
+	// Get returns the checkpoint for the file at path on the given host, or nil if there is no checkpoint for the file.
+	Get(host, path string) (*Checkpoint, error)
+	// List returns the checkpoints of all files on the given host.
+	List(host string) ([]Checkpoint, error)
+	// Put creates or replaces the checkpoint for the file at c.Path on c.Host.
+	Put(c Checkpoint) error
+}
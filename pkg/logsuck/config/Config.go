@@ -29,6 +29,9 @@ type Config struct {
 	HostTypes map[string]HostTypeConfig
 	Tasks     map[string]TaskConfig
 
+	// DefaultIndexes are the indexes which are searched when a search does not specify an index. All indexes are searched if it is empty.
+	DefaultIndexes []string
+
 	Plugins map[string]any
 }
 
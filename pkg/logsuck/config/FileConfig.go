@@ -17,4 +17,9 @@ package config
 type FileConfig struct {
 	Filename  string
 	Filetypes []string
+	// Index is the name of the index the events from the file are stored in. events.DefaultIndex is used if it is empty.
+	Index string
+	// Exclude contains glob patterns for files which match Filename but should not be read. A pattern without a path separator is
+	// matched against the name of the file, other patterns are matched against the whole path.
+	Exclude []string
 }
@@ -31,6 +31,9 @@ type FileTypeConfig struct {
 	TimeLayout   string
 	ReadInterval time.Duration
 	ParserType   ParserType
+	// IndexedFields are the names of fields which will be extracted when events are indexed and saved alongside the event,
+	// which allows searches to filter on them without extracting fields from every event.
+	IndexedFields []string
 
 	JSON  *JsonParserConfig
 	Regex *RegexParserConfig
@@ -38,12 +41,30 @@ type FileTypeConfig struct {
 
 type JsonParserConfig struct {
 	EventDelimiter *regexp.Regexp
+	// Multiline is used to assemble events from several delimited lines. It is nil if every line is an event.
+	Multiline *MultilineConfig
 
 	TimeField string
 }
 
 type RegexParserConfig struct {
-	EventDelimiter  *regexp.Regexp
+	EventDelimiter *regexp.Regexp
+	// Multiline is used to assemble events from several delimited lines. It is nil if every line is an event.
+	Multiline       *MultilineConfig
 	FieldExtractors []*regexp.Regexp
 	TimeField       string
 }
+
+// MultilineConfig makes a parser assemble events which span several lines, such as stack traces. The lines are the strings separated
+// by the parser's EventDelimiter.
+type MultilineConfig struct {
+	// LineStartPattern matches the lines which start a new event. Lines which do not match are appended to the previous event.
+	LineStartPattern *regexp.Regexp
+	// MaxLines is the maximum number of lines in an event. The next line starts a new event even if it does not match LineStartPattern.
+	MaxLines int
+	// MaxBytes is the maximum size of an event. A line which would make the event larger starts a new event, so only events consisting of
+	// a single line can be larger.
+	MaxBytes int
+	// FlushTimeout is how long the last event in a file is kept waiting for more lines after nothing more has been written to the file.
+	FlushTimeout time.Duration
+}
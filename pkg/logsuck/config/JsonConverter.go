@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -49,12 +50,23 @@ type jsonWebConfig struct {
 type jsonJsonFileTypeParserConfig struct {
 	EventDelimiter string `json:"eventDelimiter"`
 	TimeField      string `json:"timeField"`
+
+	jsonMultilineConfig
 }
 
 type jsonRegexFileTypeParserConfig struct {
 	EventDelimiter  string   `json:"eventDelimiter"`
 	FieldExtractors []string `json:"fieldExtractors"`
 	TimeField       string   `json:"timeField"`
+
+	jsonMultilineConfig
+}
+
+type jsonMultilineConfig struct {
+	LineStartPattern string `json:"lineStartPattern,omitempty"`
+	MaxLines         int    `json:"maxLines,omitempty"`
+	MaxBytes         int    `json:"maxBytes,omitempty"`
+	FlushTimeout     string `json:"flushTimeout,omitempty"`
 }
 
 type jsonFileTypeParserConfig struct {
@@ -67,13 +79,16 @@ type jsonFileTypeParserConfig struct {
 type jsonFileConfig struct {
 	Filename  string   `json:"fileName"`
 	FileTypes []string `json:"fileTypes"`
+	Index     string   `json:"index,omitempty"`
+	Exclude   []string `json:"exclude,omitempty"`
 }
 
 type jsonFileTypeConfig struct {
-	Name         string                    `json:"name"`
-	TimeLayout   string                    `json:"timeLayout"`
-	ReadInterval string                    `json:"readInterval"`
-	Parser       *jsonFileTypeParserConfig `json:"parser"`
+	Name          string                    `json:"name"`
+	TimeLayout    string                    `json:"timeLayout"`
+	ReadInterval  string                    `json:"readInterval"`
+	Parser        *jsonFileTypeParserConfig `json:"parser"`
+	IndexedFields []string                  `json:"indexedFields,omitempty"`
 }
 
 type jsonHostTypeFileConfig struct {
@@ -103,6 +118,8 @@ type jsonConfig struct {
 	HostTypes []jsonHostTypeConfig      `json:"hostTypes"`
 	Tasks     map[string]jsonTaskConfig `json:"tasks"`
 
+	DefaultIndexes []string `json:"defaultIndexes,omitempty"`
+
 	Plugins map[string]any `json:"plugins"`
 }
 
@@ -170,6 +187,9 @@ func FromJSON(jsonString []byte, logger *slog.Logger) (*Config, error) {
 		files[f.Filename] = FileConfig{
 			Filename:  f.Filename,
 			Filetypes: f.FileTypes,
+			// Index names are case insensitive in searches, so they are always stored in lowercase
+			Index:   strings.ToLower(f.Index),
+			Exclude: f.Exclude,
 		}
 	}
 
@@ -317,6 +337,11 @@ func FromJSON(jsonString []byte, logger *slog.Logger) (*Config, error) {
 		}
 	}
 
+	defaultIndexes := make([]string, len(cfg.DefaultIndexes))
+	for i, idx := range cfg.DefaultIndexes {
+		defaultIndexes[i] = strings.ToLower(idx)
+	}
+
 	plugins := cfg.Plugins
 	for k, k2 := range CorePlugins {
 		if v, ok := cfgMap[k2]; ok {
@@ -339,6 +364,8 @@ func FromJSON(jsonString []byte, logger *slog.Logger) (*Config, error) {
 		HostTypes: hostTypes,
 		Tasks:     tasksConfig,
 
+		DefaultIndexes: defaultIndexes,
+
 		Plugins: plugins,
 	}, nil
 }
@@ -360,6 +387,8 @@ func ToJSON(c *Config) ([]byte, error) {
 		files = append(files, jsonFileConfig{
 			Filename:  v.Filename,
 			FileTypes: v.Filetypes,
+			Index:     v.Index,
+			Exclude:   v.Exclude,
 		})
 	}
 	fileTypes := make([]jsonFileTypeConfig, 0, len(c.FileTypes))
@@ -373,27 +402,30 @@ func ToJSON(c *Config) ([]byte, error) {
 			parser = jsonFileTypeParserConfig{
 				Type: "Regex",
 				RegexConfig: &jsonRegexFileTypeParserConfig{
-					EventDelimiter:  v.Regex.EventDelimiter.String(),
-					FieldExtractors: fieldExtractors,
-					TimeField:       v.Regex.TimeField,
+					EventDelimiter:      v.Regex.EventDelimiter.String(),
+					FieldExtractors:     fieldExtractors,
+					TimeField:           v.Regex.TimeField,
+					jsonMultilineConfig: multilineToJSON(v.Regex.Multiline),
 				},
 			}
 		} else if v.ParserType == ParserTypeJSON {
 			parser = jsonFileTypeParserConfig{
 				Type: "JSON",
 				JsonConfig: &jsonJsonFileTypeParserConfig{
-					EventDelimiter: v.JSON.EventDelimiter.String(),
-					TimeField:      v.JSON.TimeField,
+					EventDelimiter:      v.JSON.EventDelimiter.String(),
+					TimeField:           v.JSON.TimeField,
+					jsonMultilineConfig: multilineToJSON(v.JSON.Multiline),
 				},
 			}
 		} else {
 			return nil, fmt.Errorf("failed to convert config to json: unknown parserType=%v", v.ParserType)
 		}
 		fileTypes = append(fileTypes, jsonFileTypeConfig{
-			Name:         v.Name,
-			TimeLayout:   v.TimeLayout,
-			ReadInterval: v.ReadInterval.String(),
-			Parser:       &parser,
+			Name:          v.Name,
+			TimeLayout:    v.TimeLayout,
+			ReadInterval:  v.ReadInterval.String(),
+			Parser:        &parser,
+			IndexedFields: v.IndexedFields,
 		})
 	}
 	hostTypes := make([]jsonHostTypeConfig, 0, len(c.HostTypes))
@@ -444,6 +476,8 @@ func ToJSON(c *Config) ([]byte, error) {
 		HostTypes: hostTypes,
 		Tasks:     tasks,
 
+		DefaultIndexes: c.DefaultIndexes,
+
 		Plugins: c.Plugins,
 	}
 	// This is all very ugly. We marshal the configuration and then unmarshal it to a map[string]any
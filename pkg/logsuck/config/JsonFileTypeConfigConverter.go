@@ -39,6 +39,10 @@ var defaultRegexParserConfig = RegexParserConfig{
 
 const defaultTimeLayout = "2006/01/02 15:04:05"
 
+const defaultMultilineMaxLines = 500
+const defaultMultilineMaxBytes = 128 * 1024
+const defaultMultilineFlushTimeout = 5 * time.Second
+
 func FileTypeConfigFromJSON(jsonFileTypes []jsonFileTypeConfig, logger *slog.Logger) (map[string]FileTypeConfig, error) {
 	var err error
 	fileTypes := make(map[string]FileTypeConfig, len(jsonFileTypes))
@@ -81,8 +85,14 @@ func FileTypeConfigFromJSON(jsonFileTypes []jsonFileTypeConfig, logger *slog.Log
 					slog.Any("error", err))
 			}
 
+			multiline, err := multilineFromJSON(ft.Name, &ft.Parser.JsonConfig.jsonMultilineConfig, logger)
+			if err != nil {
+				return nil, err
+			}
+
 			jsonParserConfig = &JsonParserConfig{
 				EventDelimiter: eventDelimiter,
+				Multiline:      multiline,
 				TimeField:      ft.Parser.JsonConfig.TimeField,
 			}
 		} else if ft.Parser.Type == "Regex" {
@@ -123,8 +133,14 @@ func FileTypeConfigFromJSON(jsonFileTypes []jsonFileTypeConfig, logger *slog.Log
 					slog.String("defaultTimeField", defaultTimeField))
 			}
 
+			multiline, err := multilineFromJSON(ft.Name, &ft.Parser.RegexConfig.jsonMultilineConfig, logger)
+			if err != nil {
+				return nil, err
+			}
+
 			regexParserConfig = &RegexParserConfig{
 				EventDelimiter:  eventDelimiter,
+				Multiline:       multiline,
 				FieldExtractors: fe,
 				TimeField:       timeField,
 			}
@@ -136,12 +152,13 @@ func FileTypeConfigFromJSON(jsonFileTypes []jsonFileTypeConfig, logger *slog.Log
 		}
 
 		fileTypes[ft.Name] = FileTypeConfig{
-			Name:         ft.Name,
-			TimeLayout:   ft.TimeLayout,
-			ReadInterval: readInterval,
-			ParserType:   parserType,
-			JSON:         jsonParserConfig,
-			Regex:        regexParserConfig,
+			Name:          ft.Name,
+			TimeLayout:    ft.TimeLayout,
+			ReadInterval:  readInterval,
+			ParserType:    parserType,
+			IndexedFields: ft.IndexedFields,
+			JSON:          jsonParserConfig,
+			Regex:         regexParserConfig,
 		}
 	}
 
@@ -156,3 +173,60 @@ func FileTypeConfigFromJSON(jsonFileTypes []jsonFileTypeConfig, logger *slog.Log
 	}
 	return fileTypes, nil
 }
+
+// multilineFromJSON returns the multiline configuration of a parser, or nil if the parser does not have a lineStartPattern.
+func multilineFromJSON(fileType string, cfg *jsonMultilineConfig, logger *slog.Logger) (*MultilineConfig, error) {
+	if cfg.LineStartPattern == "" {
+		if cfg.MaxLines != 0 || cfg.MaxBytes != 0 || cfg.FlushTimeout != "" {
+			logger.Warn("got multiline configuration without lineStartPattern for fileType, every line will be an event",
+				slog.String("fileType", fileType))
+		}
+		return nil, nil
+	}
+	lineStartPattern, err := regexp.Compile(cfg.LineStartPattern)
+	if err != nil {
+		logger.Error("failed to read config for fileType: failed to compile lineStartPattern regexp",
+			slog.String("fileType", fileType),
+			slog.Any("error", err))
+		return nil, fmt.Errorf("failed to read config for fileType: failed to compile lineStartPattern regexp")
+	}
+	ret := MultilineConfig{
+		LineStartPattern: lineStartPattern,
+		MaxLines:         defaultMultilineMaxLines,
+		MaxBytes:         defaultMultilineMaxBytes,
+		FlushTimeout:     defaultMultilineFlushTimeout,
+	}
+	if cfg.MaxLines < 0 || cfg.MaxBytes < 0 {
+		logger.Error("failed to read config for fileType: maxLines and maxBytes must not be negative",
+			slog.String("fileType", fileType))
+		return nil, fmt.Errorf("failed to read config for fileType: maxLines and maxBytes must not be negative")
+	}
+	if cfg.MaxLines != 0 {
+		ret.MaxLines = cfg.MaxLines
+	}
+	if cfg.MaxBytes != 0 {
+		ret.MaxBytes = cfg.MaxBytes
+	}
+	if cfg.FlushTimeout != "" {
+		ret.FlushTimeout, err = time.ParseDuration(cfg.FlushTimeout)
+		if err != nil || ret.FlushTimeout <= 0 {
+			logger.Error("failed to read config for fileType: failed to parse flushTimeout",
+				slog.String("fileType", fileType),
+				slog.String("flushTimeout", cfg.FlushTimeout))
+			return nil, fmt.Errorf("failed to read config for fileType: failed to parse flushTimeout")
+		}
+	}
+	return &ret, nil
+}
+
+func multilineToJSON(cfg *MultilineConfig) jsonMultilineConfig {
+	if cfg == nil {
+		return jsonMultilineConfig{}
+	}
+	return jsonMultilineConfig{
+		LineStartPattern: cfg.LineStartPattern.String(),
+		MaxLines:         cfg.MaxLines,
+		MaxBytes:         cfg.MaxBytes,
+		FlushTimeout:     cfg.FlushTimeout.String(),
+	}
+}
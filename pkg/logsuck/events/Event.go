@@ -14,7 +14,10 @@
 
 package events
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 // RawEvent represents an Event that has not yet been enriched with information about field values etc.
 type RawEvent struct {
@@ -23,8 +26,14 @@ type RawEvent struct {
 	Source   string
 	SourceId string
 	Offset   int64
+	// Fingerprint is a hash of the start of the file the event was read from, which identifies the file even if it is renamed or
+	// compressed. It is empty if the start of the file was not long enough to identify it when the event was read.
+	Fingerprint []byte
 }
 
+// DefaultIndex is the index used for events from files which are not configured to use a specific index.
+const DefaultIndex = "main"
+
 type Event struct {
 	Raw       string
 	Timestamp time.Time
@@ -32,6 +41,31 @@ type Event struct {
 	Source    string
 	SourceId  string
 	Offset    int64
+	// Index is the name of the index the event is stored in. Repositories use DefaultIndex if it is empty.
+	Index string
+	// Fingerprint identifies the file the event was read from, see RawEvent.
+	Fingerprint []byte
+	// IndexedFields contains the values of the fields which were extracted when the event was indexed, based on the indexedFields
+	// configuration of the event's fileTypes. Fields which were not found in the event are not included.
+	IndexedFields map[string]string
+	// IndexedFieldsVersion is the version of the field extraction which IndexedFields were extracted with, see parser.ExtractorVersion.
+	IndexedFieldsVersion string
+}
+
+// SelectIndexedFields returns the subset of fields whose names are in indexedFields, or nil if indexedFields is empty.
+// Field names are compared case insensitively since fields are extracted from the lowercased event.
+func SelectIndexedFields(fields map[string]string, indexedFields []string) map[string]string {
+	if len(indexedFields) == 0 {
+		return nil
+	}
+	ret := make(map[string]string, len(indexedFields))
+	for _, f := range indexedFields {
+		f = strings.ToLower(f)
+		if v, ok := fields[f]; ok {
+			ret[f] = v
+		}
+	}
+	return ret
 }
 
 type EventWithId struct {
@@ -41,6 +75,8 @@ type EventWithId struct {
 	Host      string
 	SourceId  string
 	Source    string
+	Index     string
+	Offset    int64
 }
 
 type EventWithExtractedFields struct {
@@ -50,6 +86,7 @@ type EventWithExtractedFields struct {
 	Host      string
 	Source    string
 	SourceId  string
+	Index     string
 	Fields    map[string]string
 }
 
@@ -0,0 +1,112 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"sort"
+	"sync"
+)
+
+// SourceMetrics counts the events from one source which have been added to the events repository since Logsuck was started.
+type SourceMetrics struct {
+	Host   string `json:"host"`
+	Source string `json:"source"`
+	// AddedEvents is the number of events which were stored.
+	AddedEvents int64 `json:"addedEvents"`
+	// SkippedDuplicates is the number of events which were not stored since they were duplicates of existing events.
+	SkippedDuplicates int64 `json:"skippedDuplicates"`
+}
+
+// IngestionMetrics is used by events repositories to count the events added from each source. It is safe for concurrent use, and a nil
+// *IngestionMetrics ignores everything recorded in it so that repositories do not need to check whether metrics are enabled.
+type IngestionMetrics struct {
+	mu      sync.Mutex
+	sources map[sourceKey]*SourceMetrics
+}
+
+type sourceKey struct {
+	host   string
+	source string
+}
+
+func NewIngestionMetrics() *IngestionMetrics {
+	return &IngestionMetrics{sources: map[sourceKey]*SourceMetrics{}}
+}
+
+// Record adds the number of added and skipped events to the metrics of the source.
+func (m *IngestionMetrics) Record(host, source string, added, skippedDuplicates int64) {
+	if m == nil || (added == 0 && skippedDuplicates == 0) {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := sourceKey{host: host, source: source}
+	sm, ok := m.sources[k]
+	if !ok {
+		sm = &SourceMetrics{Host: host, Source: source}
+		m.sources[k] = sm
+	}
+	sm.AddedEvents += added
+	sm.SkippedDuplicates += skippedDuplicates
+}
+
+// RecordBatch records a batch of events which has been added to the repository, where duplicates are the events in the batch which were
+// skipped since they were duplicates of existing events.
+func (m *IngestionMetrics) RecordBatch(evts []Event, duplicates []Event) {
+	if m == nil {
+		return
+	}
+	counts := map[sourceKey]*SourceMetrics{}
+	get := func(evt *Event) *SourceMetrics {
+		k := sourceKey{host: evt.Host, source: evt.Source}
+		sm, ok := counts[k]
+		if !ok {
+			sm = &SourceMetrics{Host: evt.Host, Source: evt.Source}
+			counts[k] = sm
+		}
+		return sm
+	}
+	for i := range evts {
+		get(&evts[i]).AddedEvents++
+	}
+	for i := range duplicates {
+		sm := get(&duplicates[i])
+		sm.AddedEvents--
+		sm.SkippedDuplicates++
+	}
+	for _, sm := range counts {
+		m.Record(sm.Host, sm.Source, sm.AddedEvents, sm.SkippedDuplicates)
+	}
+}
+
+// Snapshot returns the current metrics of every source, sorted by host and source.
+func (m *IngestionMetrics) Snapshot() []SourceMetrics {
+	if m == nil {
+		return []SourceMetrics{}
+	}
+	m.mu.Lock()
+	ret := make([]SourceMetrics, 0, len(m.sources))
+	for _, sm := range m.sources {
+		ret = append(ret, *sm)
+	}
+	m.mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Host != ret[j].Host {
+			return ret[i].Host < ret[j].Host
+		}
+		return ret[i].Source < ret[j].Source
+	})
+	return ret
+}
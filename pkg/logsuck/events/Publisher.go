@@ -19,5 +19,7 @@ import (
 )
 
 type Publisher interface {
-	PublishEvent(evt RawEvent, timeLayout string, fileParser parser.FileParser)
+	// PublishEvent publishes an event read from a file. indexedFields are the names of the fields that should be extracted and saved
+	// with the event, see IndexedFileConfig.IndexedFields. index is the name of the index the event should be stored in.
+	PublishEvent(evt RawEvent, timeLayout string, fileParser parser.FileParser, indexedFields []string, index string)
 }
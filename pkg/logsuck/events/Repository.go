@@ -15,6 +15,7 @@
 package events
 
 import (
+	"context"
 	"time"
 
 	"github.com/jackbister/logsuck/pkg/logsuck/search"
@@ -26,12 +27,86 @@ const (
 	SortModeNone             SortMode = 0
 	SortModeTimestampDesc    SortMode = 1
 	SortModePreserveArgOrder SortMode = 2
+	SortModeTimestampAsc     SortMode = 3
 )
 
 type Repository interface {
 	AddBatch(events []Event) error
 	DeleteBatch(ids []int64) error
-	FilterStream(srch *search.Search, searchStartTime, searchEndTime *time.Time) <-chan []EventWithId
+	// FilterStream returns the events matching the search in pages. The events are ordered by timestamp and then by ID, newest first unless
+	// sortMode is SortModeTimestampAsc.
+	FilterStream(srch *search.Search, searchStartTime, searchEndTime *time.Time, sortMode SortMode) <-chan []EventWithId
 	GetByIds(ids []int64, sortMode SortMode) ([]EventWithId, error)
 	GetSurroundingEvents(id int64, count int) ([]EventWithId, error)
 }
+
+// IndexedFieldStatsProvider is an optional interface which a Repository that saves Event.IndexedFields can implement to provide
+// statistics about the values of indexed fields without extracting fields from every event.
+type IndexedFieldStatsProvider interface {
+	// GetIndexedFieldValueCounts returns the number of events with each value of the given indexed field. At most limit values are
+	// returned, starting with the most common ones.
+	GetIndexedFieldValueCounts(fieldName string, limit int) (map[string]int, error)
+}
+
+// StoredFields are the indexed fields which were saved with an event, see Event.IndexedFields.
+type StoredFields struct {
+	// Version is the version of the field extraction which the fields were extracted with, see parser.ExtractorVersion.
+	Version string
+	Fields  map[string]string
+}
+
+// IndexedFieldReader is an optional interface which a Repository that saves Event.IndexedFields can implement so that the indexed fields of
+// events can be used without extracting them from the events again.
+type IndexedFieldReader interface {
+	// GetIndexedFields returns the indexed fields of the events with the given IDs. Events without any saved fields are left out, either
+	// because no indexed fields were configured when they were indexed or because none of the indexed fields were found in them.
+	GetIndexedFields(ids []int64) (map[int64]StoredFields, error)
+}
+
+// FilterExplanation describes how a Repository executes FilterStream for a search. It is used by explain mode.
+type FilterExplanation struct {
+	// Statement is the statement used to retrieve the first page of events.
+	Statement string `json:"statement"`
+	// Parameters are the values bound to the placeholders in Statement.
+	Parameters []any `json:"parameters"`
+	// PushedDownFilters are the filters from the search which are applied by the repository itself.
+	// Any filter in the search that is not listed here is only applied after the events have been retrieved.
+	PushedDownFilters []string `json:"pushedDownFilters"`
+}
+
+// FilterExplainer is an optional interface which a Repository can implement to describe how it executes FilterStream.
+type FilterExplainer interface {
+	ExplainFilter(srch *search.Search, searchStartTime, searchEndTime *time.Time, sortMode SortMode) (*FilterExplanation, error)
+}
+
+// PartitionDeleter is an optional interface which a Repository that stores events in time-based partitions can implement to delete old
+// events by dropping whole partitions, which is much faster than deleting the events one by one.
+type PartitionDeleter interface {
+	// DeletePartitionsBefore deletes the partitions which only contain events with timestamps before endTime and returns the number of
+	// deleted partitions. Partitions which contain both older and newer events are not deleted.
+	DeletePartitionsBefore(endTime time.Time) (int, error)
+}
+
+// StorageSizer is an optional interface which a Repository can implement to support deleting events based on the size of the storage.
+type StorageSizer interface {
+	// StorageSize returns the number of bytes used to store the events. Space which has been freed by deleting events but which has not
+	// been returned to the operating system is not included.
+	StorageSize() (int64, error)
+	// Compact returns the space freed by deleting events to the operating system if possible.
+	Compact() error
+}
+
+// EncryptionReporter is an optional interface which a Repository that can encrypt the stored events implements to report whether it
+// does. Tasks which copy events out of the repository use it to avoid writing them somewhere unencrypted.
+type EncryptionReporter interface {
+	// Encrypted returns true if the raw events are encrypted at rest.
+	Encrypted() bool
+}
+
+// Reencrypter is an optional interface which a Repository that encrypts the stored events can implement to support rotating the
+// encryption key.
+type Reencrypter interface {
+	// Reencrypt encrypts the events which were encrypted using a previous key with the current key and returns the number of
+	// re-encrypted events. It stops early and returns the error from ctx if ctx is cancelled.
+	Reencrypt(ctx context.Context) (int, error)
+}
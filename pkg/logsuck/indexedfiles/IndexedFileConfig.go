@@ -17,16 +17,24 @@ package indexedfiles
 import (
 	"fmt"
 	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/jackbister/logsuck/pkg/logsuck/config"
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
 	"github.com/jackbister/logsuck/pkg/logsuck/parser"
+	"github.com/jackbister/logsuck/pkg/logsuck/util/glob"
 )
 
 // IndexedFileConfig contains configuration for a specific file which will be indexed
 type IndexedFileConfig struct {
 	// Filename is the name of the file. It can also be a glob pattern. If the glob pattern matches multiple files, multiple watchers will be started.
-	Filename   string
+	// A ** path element in the pattern matches any number of directories.
+	Filename string
+	// Exclude contains glob patterns for files which match Filename but are not read.
+	Exclude    []string
 	FileParser parser.FileParser
 	// ReadInterval is the time the file watcher will sleep between looking for new events in the file.
 	// A lower duration will make events arrive faster in the search engine, but will consume more CPU.
@@ -35,6 +43,60 @@ type IndexedFileConfig struct {
 	// TimeLayout is the layout of the _time field if it is extracted, following Go's time.Parse style https://golang.org/pkg/time/#Parse
 	// The default is "2006/01/02 15:04:05"
 	TimeLayout string
+	// IndexedFields are the names of the fields which are extracted and saved when the events in this file are indexed.
+	// It is the union of the indexedFields of all fileTypes used by the file.
+	IndexedFields []string
+	// Index is the name of the index the events in this file are stored in.
+	Index string
+}
+
+// Equal returns true if both configs have the same values. The FileParsers are compared by identity.
+func (ifc *IndexedFileConfig) Equal(other *IndexedFileConfig) bool {
+	return ifc.Filename == other.Filename &&
+		ifc.FileParser == other.FileParser &&
+		ifc.ReadInterval == other.ReadInterval &&
+		ifc.TimeLayout == other.TimeLayout &&
+		slices.Equal(ifc.IndexedFields, other.IndexedFields) &&
+		ifc.Index == other.Index &&
+		slices.Equal(ifc.Exclude, other.Exclude)
+}
+
+// Matches returns true if path matches Filename and is not excluded. Relative paths and patterns are relative to the working directory.
+// It is used to find the configuration of the file an event was read from.
+func (ifc *IndexedFileConfig) Matches(path string) bool {
+	absGlob, err := filepath.Abs(ifc.Filename)
+	if err != nil {
+		return false
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	if m, err := glob.Match(absGlob, absPath); err != nil || !m {
+		return false
+	}
+	return !ifc.Excludes(absPath)
+}
+
+// Excludes returns true if path matches one of the patterns in Exclude. A pattern without a path separator is matched against the name
+// of the file, other patterns are matched against the whole path. Invalid patterns never match.
+func (ifc *IndexedFileConfig) Excludes(path string) bool {
+	for _, pattern := range ifc.Exclude {
+		var m bool
+		if strings.ContainsRune(filepath.ToSlash(pattern), '/') {
+			absPattern, err := filepath.Abs(pattern)
+			if err != nil {
+				continue
+			}
+			m, _ = glob.Match(absPattern, path)
+		} else {
+			m, _ = filepath.Match(pattern, filepath.Base(path))
+		}
+		if m {
+			return true
+		}
+	}
+	return false
 }
 
 var defaultReadInterval = 1 * time.Second
@@ -45,7 +107,16 @@ func mergeConfigs(filename string, fileTypes []config.FileTypeConfig, logger *sl
 	var regexParserConfig *config.RegexParserConfig
 	timeLayout := ""
 	var readInterval *time.Duration
+	indexedFields := []string{}
+	seenIndexedFields := map[string]struct{}{}
 	for _, t := range fileTypes {
+		for _, f := range t.IndexedFields {
+			if _, ok := seenIndexedFields[f]; !ok {
+				seenIndexedFields[f] = struct{}{}
+				indexedFields = append(indexedFields, f)
+			}
+		}
+
 		if timeLayout == "" {
 			timeLayout = t.TimeLayout
 		} else {
@@ -169,10 +240,11 @@ func mergeConfigs(filename string, fileTypes []config.FileTypeConfig, logger *sl
 	}
 
 	return &IndexedFileConfig{
-		Filename:     filename,
-		ReadInterval: *readInterval,
-		TimeLayout:   timeLayout,
-		FileParser:   fp,
+		Filename:      filename,
+		ReadInterval:  *readInterval,
+		TimeLayout:    timeLayout,
+		FileParser:    fp,
+		IndexedFields: indexedFields,
 	}, nil
 }
 
@@ -207,6 +279,19 @@ func ReadFileConfig(cfg *config.Config, logger *slog.Logger) ([]IndexedFileConfi
 				slog.String("fileName", v.Name),
 				slog.Any("error", err))
 		}
+		ifc.Index = fileCfg.Index
+		if ifc.Index == "" {
+			ifc.Index = events.DefaultIndex
+		}
+		for _, pattern := range fileCfg.Exclude {
+			if _, err := glob.Match(pattern, pattern); err != nil {
+				logger.Warn("invalid exclude pattern for file. the pattern will be ignored",
+					slog.String("fileName", v.Name),
+					slog.String("pattern", pattern),
+					slog.Any("error", err))
+			}
+		}
+		ifc.Exclude = fileCfg.Exclude
 		indexedFiles = append(indexedFiles, *ifc)
 	}
 	return indexedFiles, nil
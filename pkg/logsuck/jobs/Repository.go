@@ -26,11 +26,17 @@ type Repository interface {
 	AddTableResults(id int64, tableRows []TableRow) error
 	AddFieldStats(id int64, fields []FieldStats) error
 	Get(id int64) (*Job, error)
-	GetResults(id int64, skip int, take int) (eventIds []int64, err error)
+	// GetResults returns the IDs of the events in the job's results ordered by timestamp, oldest first if sortMode is
+	// events.SortModeTimestampAsc and newest first otherwise.
+	GetResults(id int64, sortMode events.SortMode, skip int, take int) (eventIds []int64, err error)
 	GetTableResults(id int64, skip int, take int) ([]TableRow, error)
 	GetFieldOccurences(id int64) (map[string]int, error)
 	GetFieldValues(id int64, fieldName string) (map[string]int, error)
 	GetNumMatchedEvents(id int64) (int64, error)
+	// GetRecentFieldOccurences is like GetFieldOccurences but aggregates over the numJobs most recently started jobs
+	GetRecentFieldOccurences(numJobs int) (map[string]int, error)
+	// GetRecentFieldValues is like GetFieldValues but aggregates over the numJobs most recently started jobs
+	GetRecentFieldValues(numJobs int, fieldName string) (map[string]int, error)
 	Insert(query string, startTime, endTime *time.Time, sortMode events.SortMode, outputType pipeline.PipeType, columnOrder []string) (id *int64, err error)
 	UpdateState(id int64, state State) error
 }
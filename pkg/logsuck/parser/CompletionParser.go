@@ -0,0 +1,217 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import "strings"
+
+type CompletionType int
+
+const (
+	// CompletionTypeNone means that nothing can be suggested at the cursor, for example because the cursor is inside a quoted string.
+	CompletionTypeNone CompletionType = 0
+	// CompletionTypeStepName means that the name of a step is being typed, for example "| re"
+	CompletionTypeStepName CompletionType = 1
+	// CompletionTypeOption means that the name of an option is being typed, for example "| surrounding cou"
+	CompletionTypeOption CompletionType = 2
+	// CompletionTypeOptionValue means that the value of an option is being typed, for example "| surrounding count="
+	CompletionTypeOptionValue CompletionType = 3
+	// CompletionTypeFieldName means that a field name (or a fragment) is being typed in the search, for example "user"
+	CompletionTypeFieldName CompletionType = 4
+	// CompletionTypeFieldValue means that the value of a field is being typed in the search, for example "userId=4"
+	CompletionTypeFieldValue CompletionType = 5
+)
+
+type CompletionContext struct {
+	Type CompletionType
+	// StepType is the type of the step the cursor is in, for example "search" or "rex".
+	// Empty when Type is CompletionTypeStepName or CompletionTypeNone.
+	StepType string
+	// Name is the name of the field or option whose value is being typed.
+	// Only set when Type is CompletionTypeOptionValue or CompletionTypeFieldValue.
+	Name string
+	// Prefix is the part of the word at the cursor that has already been typed.
+	Prefix string
+}
+
+// GetCompletionContext works out what is being typed at the given cursor position in a query.
+// cursor is a byte offset into input. Only the part of the input before the cursor is considered.
+func GetCompletionContext(input string, cursor int) CompletionContext {
+	if cursor < 0 {
+		cursor = 0
+	}
+	if cursor > len(input) {
+		cursor = len(input)
+	}
+	tokens, err := tokenize(input[:cursor])
+	if err != nil {
+		// Most likely an unclosed quote, meaning the cursor is inside a quoted string
+		return CompletionContext{Type: CompletionTypeNone}
+	}
+
+	lastPipe := -1
+	for i, tok := range tokens {
+		if tok.typ == tokenPipe {
+			lastPipe = i
+		}
+	}
+
+	stepType := "search"
+	args := tokens
+	if lastPipe != -1 {
+		segment := skipLeadingWhitespace(tokens[lastPipe+1:])
+		if len(segment) == 0 {
+			return CompletionContext{Type: CompletionTypeStepName}
+		}
+		if segment[0].typ != tokenString {
+			return CompletionContext{Type: CompletionTypeNone}
+		}
+		if len(segment) == 1 {
+			return CompletionContext{Type: CompletionTypeStepName, Prefix: segment[0].value}
+		}
+		stepType = segment[0].value
+		args = segment[1:]
+	}
+
+	if stepType == "search" {
+		return getSearchCompletionContext(args)
+	}
+	return getOptionCompletionContext(stepType, args)
+}
+
+func getSearchCompletionContext(args []token) CompletionContext {
+	ret := CompletionContext{StepType: "search"}
+	if len(args) == 0 {
+		ret.Type = CompletionTypeFieldName
+		return ret
+	}
+	last := args[len(args)-1]
+	switch last.typ {
+	case tokenWhitespace:
+		if field, ok := getOpenInListField(args); ok {
+			ret.Type = CompletionTypeFieldValue
+			ret.Name = field
+			return ret
+		}
+		ret.Type = CompletionTypeFieldName
+		return ret
+	case tokenEquals, tokenNotEquals:
+		if len(args) < 2 || args[len(args)-2].typ != tokenString {
+			ret.Type = CompletionTypeNone
+			return ret
+		}
+		ret.Type = CompletionTypeFieldValue
+		ret.Name = strings.ToLower(args[len(args)-2].value)
+		return ret
+	case tokenLparen, tokenComma:
+		if field, ok := getOpenInListField(args); ok {
+			ret.Type = CompletionTypeFieldValue
+			ret.Name = field
+			return ret
+		}
+	case tokenString:
+		if len(args) >= 3 && (args[len(args)-2].typ == tokenEquals || args[len(args)-2].typ == tokenNotEquals) && args[len(args)-3].typ == tokenString {
+			ret.Type = CompletionTypeFieldValue
+			ret.Name = strings.ToLower(args[len(args)-3].value)
+			ret.Prefix = last.value
+			return ret
+		}
+		if field, ok := getOpenInListField(args[:len(args)-1]); ok {
+			ret.Type = CompletionTypeFieldValue
+			ret.Name = field
+			ret.Prefix = last.value
+			return ret
+		}
+		ret.Type = CompletionTypeFieldName
+		ret.Prefix = last.value
+		return ret
+	}
+	ret.Type = CompletionTypeNone
+	return ret
+}
+
+func getOptionCompletionContext(stepType string, args []token) CompletionContext {
+	ret := CompletionContext{StepType: stepType}
+	last := args[len(args)-1]
+	switch last.typ {
+	case tokenWhitespace:
+		ret.Type = CompletionTypeOption
+		return ret
+	case tokenEquals:
+		if len(args) < 2 || args[len(args)-2].typ != tokenString {
+			ret.Type = CompletionTypeNone
+			return ret
+		}
+		ret.Type = CompletionTypeOptionValue
+		ret.Name = args[len(args)-2].value
+		return ret
+	case tokenString:
+		if len(args) >= 3 && args[len(args)-2].typ == tokenEquals && args[len(args)-3].typ == tokenString {
+			ret.Type = CompletionTypeOptionValue
+			ret.Name = args[len(args)-3].value
+			ret.Prefix = last.value
+			return ret
+		}
+		ret.Type = CompletionTypeOption
+		ret.Prefix = last.value
+		return ret
+	}
+	ret.Type = CompletionTypeNone
+	return ret
+}
+
+// getOpenInListField checks if the tokens end inside an unclosed "<field> [NOT] IN (" list and returns the field name if they do.
+func getOpenInListField(args []token) (string, bool) {
+	lparen := -1
+	for i := len(args) - 1; i >= 0; i-- {
+		if args[i].typ == tokenRparen {
+			return "", false
+		}
+		if args[i].typ == tokenLparen {
+			lparen = i
+			break
+		}
+	}
+	if lparen == -1 {
+		return "", false
+	}
+	i := lparen - 1
+	for i >= 0 && args[i].typ == tokenWhitespace {
+		i--
+	}
+	if i < 0 || args[i].typ != tokenKeyword || args[i].value != "IN" {
+		return "", false
+	}
+	i--
+	for i >= 0 && args[i].typ == tokenWhitespace {
+		i--
+	}
+	if i >= 0 && args[i].typ == tokenKeyword && args[i].value == "NOT" {
+		i--
+		for i >= 0 && args[i].typ == tokenWhitespace {
+			i--
+		}
+	}
+	if i < 0 || args[i].typ != tokenString {
+		return "", false
+	}
+	return strings.ToLower(args[i].value), true
+}
+
+func skipLeadingWhitespace(tokens []token) []token {
+	for len(tokens) > 0 && tokens[0].typ == tokenWhitespace {
+		tokens = tokens[1:]
+	}
+	return tokens
+}
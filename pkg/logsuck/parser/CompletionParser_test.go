@@ -0,0 +1,55 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import "testing"
+
+var completionTests = []struct {
+	input    string
+	cursor   int
+	expected CompletionContext
+}{
+	{"", 0, CompletionContext{Type: CompletionTypeFieldName, StepType: "search"}},
+	{"user", 4, CompletionContext{Type: CompletionTypeFieldName, StepType: "search", Prefix: "user"}},
+	{"hello ", 6, CompletionContext{Type: CompletionTypeFieldName, StepType: "search"}},
+	{"userId=4", 8, CompletionContext{Type: CompletionTypeFieldValue, StepType: "search", Name: "userid", Prefix: "4"}},
+	{"userId!=", 8, CompletionContext{Type: CompletionTypeFieldValue, StepType: "search", Name: "userid"}},
+	{"source IN (", 11, CompletionContext{Type: CompletionTypeFieldValue, StepType: "search", Name: "source"}},
+	{"source NOT IN (a, b", 19, CompletionContext{Type: CompletionTypeFieldValue, StepType: "search", Name: "source", Prefix: "b"}},
+	{"source IN (a) ", 14, CompletionContext{Type: CompletionTypeFieldName, StepType: "search"}},
+	{"\"hello wor", 10, CompletionContext{Type: CompletionTypeNone}},
+	{"hello |", 7, CompletionContext{Type: CompletionTypeStepName}},
+	{"hello | re", 10, CompletionContext{Type: CompletionTypeStepName, Prefix: "re"}},
+	{"hello | rex ", 12, CompletionContext{Type: CompletionTypeOption, StepType: "rex"}},
+	{"hello | rex fi", 14, CompletionContext{Type: CompletionTypeOption, StepType: "rex", Prefix: "fi"}},
+	{"hello | where userId=1", 22, CompletionContext{Type: CompletionTypeOptionValue, StepType: "where", Name: "userId", Prefix: "1"}},
+	{"hello | rex \"(?P<x>\\d+)\"", 24, CompletionContext{Type: CompletionTypeNone, StepType: "rex"}},
+	// Only the part before the cursor is considered
+	{"hello | rex field=_raw", 9, CompletionContext{Type: CompletionTypeStepName, Prefix: "r"}},
+	{"user | rex", 2, CompletionContext{Type: CompletionTypeFieldName, StepType: "search", Prefix: "us"}},
+	// Out of range cursors are clamped
+	{"user", 100, CompletionContext{Type: CompletionTypeFieldName, StepType: "search", Prefix: "user"}},
+}
+
+func TestGetCompletionContext(t *testing.T) {
+	for _, tt := range completionTests {
+		t.Run(tt.input, func(t *testing.T) {
+			res := GetCompletionContext(tt.input, tt.cursor)
+			if res != tt.expected {
+				t.Errorf("got unexpected completion context for input='%v', cursor=%v. expected=%+v, got=%+v", tt.input, tt.cursor, tt.expected, res)
+			}
+		})
+	}
+}
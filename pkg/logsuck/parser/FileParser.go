@@ -14,6 +14,14 @@
 
 package parser
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+)
+
 type RawParserEvent struct {
 	Raw    string
 	Offset int64
@@ -32,4 +40,40 @@ type FileParser interface {
 	CanSplit(b []byte) bool
 	Extract(s string) (*ExtractResult, error)
 	Split(s string) SplitResult
+	// Flush splits s when nothing more will be appended to it, so the remainder of Split is returned as the last event.
+	Flush(s string) SplitResult
+	// FlushTimeout is how long the remainder is kept waiting for more data before it is flushed. Zero means that it is kept until more data
+	// is appended.
+	FlushTimeout() time.Duration
+}
+
+// ExtractorVersion returns a version which identifies how the given indexed fields are extracted by the parser. Indexed fields which were
+// saved with another version may have other values than the ones that would be extracted now, for example because a field extractor has
+// been changed since the event was indexed. It returns an empty string if there are no indexed fields or if the parser is not known.
+func ExtractorVersion(fileParser FileParser, indexedFields []string) string {
+	if len(indexedFields) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	switch p := fileParser.(type) {
+	case *RegexFileParser:
+		sb.WriteString("regex\x00" + p.Cfg.TimeField)
+		for _, rex := range p.Cfg.FieldExtractors {
+			sb.WriteString("\x00" + rex.String())
+		}
+	case *JsonFileParser:
+		sb.WriteString("json\x00" + p.Cfg.TimeField)
+	default:
+		return ""
+	}
+	fields := make([]string, len(indexedFields))
+	for i, f := range indexedFields {
+		fields[i] = strings.ToLower(f)
+	}
+	sort.Strings(fields)
+	for _, f := range fields {
+		sb.WriteString("\x01" + f)
+	}
+	hash := sha256.Sum256([]byte(sb.String()))
+	return hex.EncodeToString(hash[:8])
 }
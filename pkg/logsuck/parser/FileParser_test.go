@@ -0,0 +1,62 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/config"
+)
+
+func regexParser(timeField string, extractors ...string) *RegexFileParser {
+	p := &RegexFileParser{Cfg: config.RegexParserConfig{TimeField: timeField}}
+	for _, e := range extractors {
+		p.Cfg.FieldExtractors = append(p.Cfg.FieldExtractors, regexp.MustCompile(e))
+	}
+	return p
+}
+
+func TestExtractorVersion(t *testing.T) {
+	base := ExtractorVersion(regexParser("_time", `(\w+)=(\w+)`), []string{"status", "method"})
+	if base == "" {
+		t.Fatalf("expected a version for a regex parser with indexed fields")
+	}
+	if v := ExtractorVersion(regexParser("_time", `(\w+)=(\w+)`), []string{"METHOD", "status"}); v != base {
+		t.Fatalf("expected the order and case of the indexed fields to not change the version, base=%v, got=%v", base, v)
+	}
+
+	tests := []struct {
+		name          string
+		fileParser    FileParser
+		indexedFields []string
+	}{
+		{"changed extractor", regexParser("_time", `(\w+)=(\S+)`), []string{"status", "method"}},
+		{"changed time field", regexParser("ts", `(\w+)=(\w+)`), []string{"status", "method"}},
+		{"changed indexed fields", regexParser("_time", `(\w+)=(\w+)`), []string{"status"}},
+		{"json parser", &JsonFileParser{Cfg: config.JsonParserConfig{TimeField: "_time"}}, []string{"status", "method"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if v := ExtractorVersion(tt.fileParser, tt.indexedFields); v == base || v == "" {
+				t.Fatalf("expected a new version, base=%v, got=%v", base, v)
+			}
+		})
+	}
+
+	if v := ExtractorVersion(regexParser("_time", `(\w+)=(\w+)`), nil); v != "" {
+		t.Fatalf("expected no version without indexed fields, got=%v", v)
+	}
+}
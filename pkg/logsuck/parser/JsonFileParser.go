@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"time"
 
 	"github.com/jackbister/logsuck/pkg/logsuck/config"
 )
@@ -57,6 +58,9 @@ func (p *JsonFileParser) Extract(s string) (*ExtractResult, error) {
 }
 
 func (p *JsonFileParser) Split(s string) SplitResult {
+	if p.Cfg.Multiline != nil {
+		return splitMultiline(s, p.Cfg.EventDelimiter, p.Cfg.Multiline, false)
+	}
 	delimiters := p.Cfg.EventDelimiter.FindAllString(s, -1)
 	split := p.Cfg.EventDelimiter.Split(s, -1)
 	rawEvts := split[:len(split)-1]
@@ -75,3 +79,17 @@ func (p *JsonFileParser) Split(s string) SplitResult {
 		Remainder: split[len(split)-1],
 	}
 }
+
+func (p *JsonFileParser) Flush(s string) SplitResult {
+	if p.Cfg.Multiline != nil {
+		return splitMultiline(s, p.Cfg.EventDelimiter, p.Cfg.Multiline, true)
+	}
+	return flushSplitResult(s, p.Split(s))
+}
+
+func (p *JsonFileParser) FlushTimeout() time.Duration {
+	if p.Cfg.Multiline != nil {
+		return p.Cfg.Multiline.FlushTimeout
+	}
+	return 0
+}
@@ -128,7 +128,7 @@ func (tk *tokenizer) tokenize(input string) ([]token, error) {
 			i += endLocation[1]
 		} else {
 			remainder := input[i:]
-			endLocation := strings.IndexAny(remainder, wordDelimiters)
+			endLocation := wordEnd(remainder)
 			var str string
 			if endLocation == -1 {
 				str = remainder
@@ -165,6 +165,21 @@ func (tk *tokenizer) tokenize(input string) ([]token, error) {
 	return tk.tokens, nil
 }
 
+// wordEnd returns the index of the first word delimiter in s, or -1 if s does not contain a delimiter.
+// A ! is only a delimiter when it is part of !=, otherwise it is part of the word.
+func wordEnd(s string) int {
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(wordDelimiters, s[i]) == -1 {
+			continue
+		}
+		if s[i] == '!' && !strings.HasPrefix(s[i:], "!=") {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
 func (tk *tokenizer) handleQuote(str string, quoteIndex int) {
 	if quoteIndex == 0 || str[quoteIndex-1] != '\\' {
 		if tk.insideString {
@@ -92,6 +92,20 @@ var tokenTests = []struct {
 			tokQuoted("quoted"),
 		},
 	},
+	{
+		"!", false, []token{
+			tokString("!"),
+		},
+	},
+	{
+		"a!b c!=d", false, []token{
+			tokString("a!b"),
+			tokSpace,
+			tokString("c"),
+			tokNotEquals,
+			tokString("d"),
+		},
+	},
 	{
 		"\"quoted with spaces\"", false, []token{
 			tokQuoted("quoted with spaces"),
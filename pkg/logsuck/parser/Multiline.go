@@ -0,0 +1,77 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"regexp"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/config"
+)
+
+// splitMultiline splits s into lines using the delimiter and assembles the lines into events according to cfg. The delimiter after the
+// last line of an event is not included in the event. The last event is returned in the remainder since more lines may be appended to
+// it, unless flush is true, in which case the remainder is returned as the last event.
+func splitMultiline(s string, delimiter *regexp.Regexp, cfg *config.MultilineConfig, flush bool) SplitResult {
+	evts := []RawParserEvent{}
+	// start is the offset of the event being assembled and end is the offset of the end of its last line
+	start, end, lines := 0, 0, 0
+	addLine := func(lineStart, lineEnd int) {
+		if lines > 0 && (cfg.LineStartPattern.MatchString(s[lineStart:lineEnd]) || (cfg.MaxBytes > 0 && lineEnd-start > cfg.MaxBytes)) {
+			evts = append(evts, RawParserEvent{Raw: s[start:end], Offset: int64(start)})
+			start, lines = lineStart, 0
+		}
+		end = lineEnd
+		lines++
+	}
+	lineStart := 0
+	for _, loc := range delimiter.FindAllStringIndex(s, -1) {
+		addLine(lineStart, loc[0])
+		lineStart = loc[1]
+		if cfg.MaxLines > 0 && lines >= cfg.MaxLines {
+			evts = append(evts, RawParserEvent{Raw: s[start:end], Offset: int64(start)})
+			start, lines = lineStart, 0
+		}
+	}
+	if !flush {
+		return SplitResult{
+			Events:    evts,
+			Remainder: s[start:],
+		}
+	}
+	if lineStart < len(s) {
+		addLine(lineStart, len(s))
+	}
+	if lines > 0 {
+		evts = append(evts, RawParserEvent{Raw: s[start:end], Offset: int64(start)})
+	}
+	return SplitResult{
+		Events:    evts,
+		Remainder: "",
+	}
+}
+
+// flushSplitResult returns the result of splitting s with the remainder as the last event.
+func flushSplitResult(s string, res SplitResult) SplitResult {
+	if res.Remainder != "" {
+		res.Events = append(res.Events, RawParserEvent{
+			Raw:    res.Remainder,
+			Offset: int64(len(s) - len(res.Remainder)),
+		})
+	}
+	return SplitResult{
+		Events:    res.Events,
+		Remainder: "",
+	}
+}
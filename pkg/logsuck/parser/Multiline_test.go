@@ -0,0 +1,153 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"log/slog"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/config"
+)
+
+const stackTrace = "2024/01/01 12:00:00 ERROR failed\n" +
+	"java.lang.IllegalStateException: failed\n" +
+	"\tat Main.main(Main.java:1)\n" +
+	"2024/01/01 12:00:01 INFO ok\n" +
+	"2024/01/01 12:00:02 ERROR failed again\n" +
+	"\tat Main.main(Main.java:2)\n"
+
+func TestMultilineSplit(t *testing.T) {
+	tests := []struct {
+		name              string
+		input             string
+		maxLines          int
+		maxBytes          int
+		expectedEvents    []RawParserEvent
+		expectedRemainder string
+	}{
+		{
+			name:  "StackTrace",
+			input: stackTrace,
+			expectedEvents: []RawParserEvent{
+				{Raw: "2024/01/01 12:00:00 ERROR failed\njava.lang.IllegalStateException: failed\n\tat Main.main(Main.java:1)", Offset: 0},
+				{Raw: "2024/01/01 12:00:01 INFO ok", Offset: 100},
+			},
+			expectedRemainder: "2024/01/01 12:00:02 ERROR failed again\n\tat Main.main(Main.java:2)\n",
+		},
+		{
+			name:              "PartialLine",
+			input:             "2024/01/01 12:00:00 ERROR failed\n\tat Main",
+			expectedEvents:    []RawParserEvent{},
+			expectedRemainder: "2024/01/01 12:00:00 ERROR failed\n\tat Main",
+		},
+		{
+			name:  "ContinuationLinesAtStart",
+			input: "\tat Main.main(Main.java:1)\n2024/01/01 12:00:01 INFO ok\n",
+			expectedEvents: []RawParserEvent{
+				{Raw: "\tat Main.main(Main.java:1)", Offset: 0},
+			},
+			expectedRemainder: "2024/01/01 12:00:01 INFO ok\n",
+		},
+		{
+			name:     "MaxLines",
+			input:    "2024/01/01 12:00:00 ERROR failed\na\nb\nc\n",
+			maxLines: 2,
+			expectedEvents: []RawParserEvent{
+				{Raw: "2024/01/01 12:00:00 ERROR failed\na", Offset: 0},
+				{Raw: "b\nc", Offset: 35},
+			},
+			expectedRemainder: "",
+		},
+		{
+			name:     "MaxBytes",
+			input:    "2024/01/01 12:00:00 ERROR failed\naaaa\nbbbb\n",
+			maxBytes: 38,
+			expectedEvents: []RawParserEvent{
+				{Raw: "2024/01/01 12:00:00 ERROR failed\naaaa", Offset: 0},
+			},
+			expectedRemainder: "bbbb\n",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := newMultilineParser(tt.maxLines, tt.maxBytes)
+			res := p.Split(tt.input)
+			assertEvents(t, res.Events, tt.expectedEvents)
+			if res.Remainder != tt.expectedRemainder {
+				t.Fatalf("got unexpected remainder, expected=%q, got=%q", tt.expectedRemainder, res.Remainder)
+			}
+		})
+	}
+}
+
+func TestMultilineFlush(t *testing.T) {
+	p := newMultilineParser(0, 0)
+	res := p.Flush("2024/01/01 12:00:02 ERROR failed again\n\tat Main.main(Main.java:2)\n2024/01/01 12:00:03 INFO ok")
+	assertEvents(t, res.Events, []RawParserEvent{
+		{Raw: "2024/01/01 12:00:02 ERROR failed again\n\tat Main.main(Main.java:2)", Offset: 0},
+		{Raw: "2024/01/01 12:00:03 INFO ok", Offset: 66},
+	})
+	if res.Remainder != "" {
+		t.Fatalf("expected empty remainder after flush, got %q", res.Remainder)
+	}
+	if p.FlushTimeout() != time.Second {
+		t.Fatalf("expected FlushTimeout to be 1s, got %v", p.FlushTimeout())
+	}
+}
+
+func TestFlushWithoutMultiline(t *testing.T) {
+	p := RegexFileParser{
+		Cfg: config.RegexParserConfig{
+			EventDelimiter: regexp.MustCompile("\n"),
+		},
+		Logger: slog.Default(),
+	}
+	res := p.Flush("a\nb")
+	assertEvents(t, res.Events, []RawParserEvent{{Raw: "a", Offset: 0}, {Raw: "b", Offset: 2}})
+	if p.FlushTimeout() != 0 {
+		t.Fatalf("expected FlushTimeout to be 0 without multiline, got %v", p.FlushTimeout())
+	}
+}
+
+func newMultilineParser(maxLines, maxBytes int) *RegexFileParser {
+	return &RegexFileParser{
+		Cfg: config.RegexParserConfig{
+			EventDelimiter: regexp.MustCompile("\n"),
+			Multiline: &config.MultilineConfig{
+				LineStartPattern: regexp.MustCompile(`^\d\d\d\d/\d\d/\d\d `),
+				MaxLines:         maxLines,
+				MaxBytes:         maxBytes,
+				FlushTimeout:     time.Second,
+			},
+		},
+		Logger: slog.Default(),
+	}
+}
+
+func assertEvents(t *testing.T, got, expected []RawParserEvent) {
+	t.Helper()
+	if len(got) != len(expected) {
+		t.Fatalf("expected %v events, got %q", len(expected), got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("got unexpected event at index %v, expected=%q, got=%q", i, expected[i], got[i])
+		}
+	}
+}
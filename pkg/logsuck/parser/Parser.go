@@ -36,6 +36,8 @@ func Parse(searchString string) (*search.Search, error) {
 		NotSources:   res.NotSources,
 		Hosts:        res.Hosts,
 		NotHosts:     res.NotHosts,
+		Indexes:      res.Indexes,
+		NotIndexes:   res.NotIndexes,
 	}
 
 	return &ret, nil
@@ -16,6 +16,7 @@ package parser
 
 import (
 	"log/slog"
+	"time"
 
 	"github.com/jackbister/logsuck/pkg/logsuck/config"
 )
@@ -63,6 +64,9 @@ func (r *RegexFileParser) Extract(s string) (*ExtractResult, error) {
 }
 
 func (r *RegexFileParser) Split(s string) SplitResult {
+	if r.Cfg.Multiline != nil {
+		return splitMultiline(s, r.Cfg.EventDelimiter, r.Cfg.Multiline, false)
+	}
 	delimiters := r.Cfg.EventDelimiter.FindAllString(s, -1)
 	split := r.Cfg.EventDelimiter.Split(s, -1)
 	rawEvts := split[:len(split)-1]
@@ -81,3 +85,17 @@ func (r *RegexFileParser) Split(s string) SplitResult {
 		Remainder: split[len(split)-1],
 	}
 }
+
+func (r *RegexFileParser) Flush(s string) SplitResult {
+	if r.Cfg.Multiline != nil {
+		return splitMultiline(s, r.Cfg.EventDelimiter, r.Cfg.Multiline, true)
+	}
+	return flushSplitResult(s, r.Split(s))
+}
+
+func (r *RegexFileParser) FlushTimeout() time.Duration {
+	if r.Cfg.Multiline != nil {
+		return r.Cfg.Multiline.FlushTimeout
+	}
+	return 0
+}
@@ -29,6 +29,8 @@ type SearchParseResult struct {
 	NotSources   map[string]struct{}
 	Hosts        map[string]struct{}
 	NotHosts     map[string]struct{}
+	Indexes      map[string]struct{}
+	NotIndexes   map[string]struct{}
 }
 
 func ParseSearch(input string) (*SearchParseResult, error) {
@@ -151,5 +153,19 @@ func ParseSearch(input string) (*SearchParseResult, error) {
 		}
 	}
 
+	// Index names are always lowercase, see config.FileConfig.Index
+	if indexes, ok := ret.Fields["index"]; ok {
+		ret.Indexes = make(map[string]struct{}, len(indexes))
+		for _, idx := range indexes {
+			ret.Indexes[strings.ToLower(idx)] = struct{}{}
+		}
+	}
+	if indexes, ok := ret.NotFields["index"]; ok {
+		ret.NotIndexes = make(map[string]struct{}, len(indexes))
+		for _, idx := range indexes {
+			ret.NotIndexes[strings.ToLower(idx)] = struct{}{}
+		}
+	}
+
 	return &ret, nil
 }
@@ -164,3 +164,13 @@ func checkFields(t *testing.T, expectedFields map[string][]string, actualFields
 		}
 	}
 }
+
+func TestSearchParserIndexes(t *testing.T) {
+	res, err := ParseSearch("index IN (Audit, main) index!=debug msg")
+	if err != nil {
+		t.Fatalf("got error when parsing search: %v", err)
+	}
+	checkFragments(t, []string{"audit", "main"}, res.Indexes, "indexes")
+	checkFragments(t, []string{"debug"}, res.NotIndexes, "notIndexes")
+	checkFragments(t, []string{"msg"}, res.Fragments, "fragments")
+}
@@ -32,6 +32,21 @@ const (
 	PipeTypePropagate PipeType = 999
 )
 
+func (t PipeType) String() string {
+	switch t {
+	case PipeTypeNone:
+		return "none"
+	case PipeTypeEvents:
+		return "events"
+	case PipeTypeTable:
+		return "table"
+	case PipeTypePropagate:
+		return "propagate"
+	default:
+		return "unknown"
+	}
+}
+
 type Parameters struct {
 	ConfigSource config.Source
 	EventsRepo   events.Repository
@@ -61,17 +76,28 @@ type Step interface {
 	OutputType() PipeType
 }
 
+// ExplainableStep is an optional interface which a Step can implement to add details about how it will be executed to the output of explain mode.
+type ExplainableStep interface {
+	Explain(params Parameters) (map[string]any, error)
+}
+
 type StepWithSortMode interface {
 	SortMode() events.SortMode
 }
 
-type TableGeneratingStep interface {
-	ColumnOrder() []string
+// ReversibleStep is an optional interface for steps which produce events in an order that can be reversed, like search.
+// When a step implementing OrderReversingStep comes after a ReversibleStep, Reverse is called when the pipeline is compiled so that the
+// events are produced in reverse order from the start instead of having to be buffered and reversed afterwards.
+type ReversibleStep interface {
+	StepWithSortMode
+	Reverse()
 }
 
-type StepCompiler func(input string, options map[string]string) (Step, error)
+// OrderReversingStep is implemented by steps which reverse the order of the events, like reverse.
+type OrderReversingStep interface {
+	ReversesOrder()
+}
 
-type StepDefinition struct {
-	StepName string
-	Compiler StepCompiler
+type TableGeneratingStep interface {
+	ColumnOrder() []string
 }
@@ -0,0 +1,203 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/araddon/dateparse"
+)
+
+type StepCompiler func(input string, options map[string]string) (Step, error)
+
+type StepOptionType int
+
+const (
+	StepOptionTypeString StepOptionType = 0
+	StepOptionTypeInt    StepOptionType = 1
+	StepOptionTypeBool   StepOptionType = 2
+	StepOptionTypeTime   StepOptionType = 3
+)
+
+func (t StepOptionType) String() string {
+	switch t {
+	case StepOptionTypeString:
+		return "string"
+	case StepOptionTypeInt:
+		return "int"
+	case StepOptionTypeBool:
+		return "bool"
+	case StepOptionTypeTime:
+		return "time"
+	default:
+		return "unknown"
+	}
+}
+
+// StepOption describes an option which can be given to a step using the <option>=<value> syntax.
+type StepOption struct {
+	Name        string
+	Description string
+	Type        StepOptionType
+	// Default is the value the step will receive if the option is not given. An empty Default means the option is left out.
+	Default  string
+	Required bool
+}
+
+type StepDefinition struct {
+	StepName string
+	Compiler StepCompiler
+
+	// The fields below are optional metadata used when presenting the step to users, for example in autocomplete,
+	// GET /api/v1/steps and logsuck -listSteps.
+
+	// Summary is a short human readable description of what the step does.
+	Summary string
+	// Value describes the value given to the step after its options, for example "<regex>" for rex.
+	// Empty if the step does not take a value.
+	Value string
+	// Options are the options accepted by the step. If Options is non-nil, the options given to the step are validated
+	// against it and defaults are filled in before Compiler is called, so the Compiler does not need to check them itself.
+	// If Options is nil, the options are passed to the Compiler as they are. This is used by steps like where which accept
+	// arbitrary field options.
+	Options []StepOption
+	// IgnoreUnknownOptions makes validation drop options which are not in Options instead of rejecting them. This is used by steps like
+	// table which have always ignored the options given to them.
+	IgnoreUnknownOptions bool
+	// Examples are example queries using the step, for example `| rex "userId (?P<userId>\d+)"`
+	Examples []string
+	// InputType and OutputType are the PipeTypes the step consumes and produces.
+	InputType  PipeType
+	OutputType PipeType
+
+	// Description is used as the Summary if Summary is empty.
+	//
+	// Deprecated: Use Summary instead.
+	Description string
+	// Example is used as the only example if Examples is empty.
+	//
+	// Deprecated: Use Examples instead.
+	Example string
+}
+
+// WithDefaults returns a copy of the step definition where Summary and Examples are filled in from the deprecated Description and
+// Example fields if they are empty.
+func (sd StepDefinition) WithDefaults() StepDefinition {
+	if sd.Summary == "" {
+		sd.Summary = sd.Description
+	}
+	if len(sd.Examples) == 0 && sd.Example != "" {
+		sd.Examples = []string{sd.Example}
+	}
+	return sd
+}
+
+// Compile validates the options against the step's Options and then compiles the step using its Compiler.
+func (sd *StepDefinition) Compile(input string, options map[string]string) (Step, error) {
+	validated, err := sd.ValidateOptions(options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile %v: %w", sd.StepName, err)
+	}
+	return sd.Compiler(input, validated)
+}
+
+// ValidateOptions checks the given options against the step's Options and returns a copy of the options with defaults filled in.
+func (sd *StepDefinition) ValidateOptions(options map[string]string) (map[string]string, error) {
+	if sd.Options == nil {
+		return options, nil
+	}
+	known := make(map[string]StepOption, len(sd.Options))
+	for _, o := range sd.Options {
+		known[o.Name] = o
+	}
+	ret := make(map[string]string, len(sd.Options))
+	for k, v := range options {
+		o, ok := known[k]
+		if !ok && sd.IgnoreUnknownOptions {
+			continue
+		} else if !ok {
+			return nil, fmt.Errorf("unknown option %v. valid options are: %v", k, sd.optionNames())
+		}
+		err := validateOptionValue(o, v)
+		if err != nil {
+			return nil, err
+		}
+		ret[k] = v
+	}
+	for _, o := range sd.Options {
+		if _, ok := ret[o.Name]; ok {
+			continue
+		}
+		if o.Required {
+			return nil, fmt.Errorf("option %v must be provided", o.Name)
+		}
+		if o.Default != "" {
+			ret[o.Name] = o.Default
+		}
+	}
+	return ret, nil
+}
+
+// Usage returns a one line summary of the syntax of the step, for example `| rex [field=<string>] "<regex>"`
+func (sd *StepDefinition) Usage() string {
+	var sb strings.Builder
+	sb.WriteString("| ")
+	sb.WriteString(sd.StepName)
+	for _, o := range sd.Options {
+		sb.WriteString(" ")
+		if o.Required {
+			sb.WriteString(o.Name + "=<" + o.Type.String() + ">")
+		} else {
+			sb.WriteString("[" + o.Name + "=<" + o.Type.String() + ">]")
+		}
+	}
+	if sd.Options == nil {
+		sb.WriteString(" [<field>=<value>]...")
+	}
+	if sd.Value != "" {
+		sb.WriteString(" \"" + sd.Value + "\"")
+	}
+	return sb.String()
+}
+
+func (sd *StepDefinition) optionNames() string {
+	names := make([]string, len(sd.Options))
+	for i, o := range sd.Options {
+		names[i] = o.Name
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func validateOptionValue(o StepOption, value string) error {
+	switch o.Type {
+	case StepOptionTypeInt:
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Errorf("failed to parse option %v as integer: %w", o.Name, err)
+		}
+	case StepOptionTypeBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("failed to parse option %v as boolean: %w", o.Name, err)
+		}
+	case StepOptionTypeTime:
+		if _, err := dateparse.ParseStrict(value); err != nil {
+			return fmt.Errorf("failed to parse option %v as time: %w", o.Name, err)
+		}
+	}
+	return nil
+}
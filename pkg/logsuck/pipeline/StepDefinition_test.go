@@ -0,0 +1,121 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"reflect"
+	"testing"
+)
+
+var testStepDefinition = StepDefinition{
+	StepName: "test",
+	Value:    "<value>",
+	Options: []StepOption{
+		{Name: "id", Type: StepOptionTypeInt, Required: true},
+		{Name: "count", Type: StepOptionTypeInt, Default: "100"},
+		{Name: "verbose", Type: StepOptionTypeBool},
+		{Name: "since", Type: StepOptionTypeTime},
+	},
+}
+
+var validateOptionsTests = []struct {
+	name        string
+	options     map[string]string
+	expected    map[string]string
+	expectError bool
+}{
+	{"required and default", map[string]string{"id": "1"}, map[string]string{"id": "1", "count": "100"}, false},
+	{"default overridden", map[string]string{"id": "1", "count": "5"}, map[string]string{"id": "1", "count": "5"}, false},
+	{"all types", map[string]string{"id": "1", "verbose": "true", "since": "2024-01-01T00:00:00Z"}, map[string]string{"id": "1", "count": "100", "verbose": "true", "since": "2024-01-01T00:00:00Z"}, false},
+	{"missing required", map[string]string{}, nil, true},
+	{"unknown option", map[string]string{"id": "1", "idd": "2"}, nil, true},
+	{"invalid int", map[string]string{"id": "abc"}, nil, true},
+	{"invalid bool", map[string]string{"id": "1", "verbose": "maybe"}, nil, true},
+	{"invalid time", map[string]string{"id": "1", "since": "yesterday-ish"}, nil, true},
+}
+
+func TestValidateOptions(t *testing.T) {
+	for _, tt := range validateOptionsTests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := testStepDefinition.ValidateOptions(tt.options)
+			if tt.expectError {
+				if err == nil {
+					t.Fatalf("expected error but got nil, res=%v", res)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(res, tt.expected) {
+				t.Fatalf("got unexpected options. expected=%v, got=%v", tt.expected, res)
+			}
+		})
+	}
+}
+
+func TestValidateOptionsNilOptionsPassesThrough(t *testing.T) {
+	sd := StepDefinition{StepName: "where"}
+	options := map[string]string{"anything": "goes"}
+	res, err := sd.ValidateOptions(options)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(res, options) {
+		t.Fatalf("expected options to be passed through unchanged, got=%v", res)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	expected := `| test id=<int> [count=<int>] [verbose=<bool>] [since=<time>] "<value>"`
+	if res := testStepDefinition.Usage(); res != expected {
+		t.Fatalf("got unexpected usage. expected=%v, got=%v", expected, res)
+	}
+}
+
+func TestWithDefaults(t *testing.T) {
+	sd := StepDefinition{StepName: "old", Description: "An old step.", Example: "| old"}.WithDefaults()
+	if sd.Summary != "An old step." || !reflect.DeepEqual(sd.Examples, []string{"| old"}) {
+		t.Fatalf("expected Summary and Examples to be filled in from Description and Example, got Summary=%v, Examples=%v", sd.Summary, sd.Examples)
+	}
+	sd = StepDefinition{StepName: "new", Summary: "A new step.", Examples: []string{"| new"}, Description: "ignored", Example: "ignored"}.WithDefaults()
+	if sd.Summary != "A new step." || !reflect.DeepEqual(sd.Examples, []string{"| new"}) {
+		t.Fatalf("expected Summary and Examples to be kept, got Summary=%v, Examples=%v", sd.Summary, sd.Examples)
+	}
+}
+
+func TestValidateOptionsIgnoreUnknownOptions(t *testing.T) {
+	sd := StepDefinition{
+		StepName:             "table",
+		Value:                "<fields>",
+		Options:              []StepOption{{Name: "limit", Type: StepOptionTypeInt}},
+		IgnoreUnknownOptions: true,
+	}
+	res, err := sd.ValidateOptions(map[string]string{"limit": "5", "unknown": "value"})
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(res, map[string]string{"limit": "5"}) {
+		t.Fatalf("expected the unknown option to be dropped, got=%v", res)
+	}
+	if _, err := sd.ValidateOptions(map[string]string{"limit": "abc"}); err == nil {
+		t.Fatalf("expected known options to still be validated")
+	}
+	// Steps which ignore unknown options do not take arbitrary field options, so they must not be shown in the usage
+	expected := `| table [limit=<int>] "<fields>"`
+	if res := sd.Usage(); res != expected {
+		t.Fatalf("got unexpected usage. expected=%v, got=%v", expected, res)
+	}
+}
@@ -19,11 +19,12 @@ import (
 )
 
 type RawEvent struct {
-	Raw      string
-	Host     string
-	Source   string
-	SourceId string
-	Offset   int64
+	Raw         string
+	Host        string
+	Source      string
+	SourceId    string
+	Offset      int64
+	Fingerprint []byte
 }
 
 type ReceiveEventsRequest struct {
@@ -0,0 +1,143 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package search
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// CompileFragment creates a regexp which matches the fragment as a whole word case insensitively. * matches anything, and every other
+// character only matches itself. It is used for fragments, hosts, sources and field values, so that every repository and the search step
+// agree on which events match a search.
+func CompileFragment(frag string) (*regexp.Regexp, error) {
+	pre := "(^|\\W)"
+	if strings.HasPrefix(frag, "*") {
+		pre = ""
+	}
+	post := "($|\\W)"
+	if strings.HasSuffix(frag, "*") {
+		post = ""
+	}
+	rexString := "(?is)" + pre + wildcardPattern(frag) + post
+	rex, err := regexp.Compile(rexString)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile rexString=%v: %w", rexString, err)
+	}
+	return rex, nil
+}
+
+// CompileWildcard creates a regexp which matches the whole value case insensitively, where * matches anything. It is used for index
+// names, which are matched in the same way as the LIKE patterns used by @logsuck/sqlite_events.
+func CompileWildcard(value string) *regexp.Regexp {
+	return regexp.MustCompile("(?is)^" + wildcardPattern(value) + "$")
+}
+
+func wildcardPattern(value string) string {
+	parts := strings.Split(value, "*")
+	for i, p := range parts {
+		parts[i] = regexp.QuoteMeta(p)
+	}
+	return strings.Join(parts, ".*")
+}
+
+// Matcher checks whether events match the fragments, hosts, sources and indexes of a search. Fields are not checked since that requires
+// extracting them from the events, which is done by the search step.
+type Matcher struct {
+	fragments    []*regexp.Regexp
+	notFragments []*regexp.Regexp
+	hosts        []*regexp.Regexp
+	notHosts     []*regexp.Regexp
+	sources      []*regexp.Regexp
+	notSources   []*regexp.Regexp
+	indexes      []*regexp.Regexp
+	notIndexes   []*regexp.Regexp
+}
+
+func NewMatcher(srch *Search) *Matcher {
+	return &Matcher{
+		fragments:    compileFragments(srch.Fragments),
+		notFragments: compileFragments(srch.NotFragments),
+		hosts:        compileFragments(srch.Hosts),
+		notHosts:     compileFragments(srch.NotHosts),
+		sources:      compileFragments(srch.Sources),
+		notSources:   compileFragments(srch.NotSources),
+		indexes:      compileWildcards(srch.Indexes),
+		notIndexes:   compileWildcards(srch.NotIndexes),
+	}
+}
+
+// Matches returns true if an event with the given raw event, host, source and index matches the search.
+func (m *Matcher) Matches(raw, host, source, index string) bool {
+	return m.MatchesRaw(raw) && m.MatchesHost(host) && m.MatchesSource(source) && m.MatchesIndex(index)
+}
+
+// MatchesRaw returns true if the raw event contains every fragment and none of the not fragments.
+func (m *Matcher) MatchesRaw(raw string) bool {
+	return matchesAll(m.fragments, raw) && !matchesAny(m.notFragments, raw)
+}
+
+func (m *Matcher) MatchesHost(host string) bool {
+	return matchesAll(m.hosts, host) && !matchesAny(m.notHosts, host)
+}
+
+func (m *Matcher) MatchesSource(source string) bool {
+	return matchesAll(m.sources, source) && !matchesAny(m.notSources, source)
+}
+
+// MatchesIndex returns true if the index is one of the indexes of the search, or the search has no indexes, and it is not one of the not
+// indexes.
+func (m *Matcher) MatchesIndex(index string) bool {
+	return (len(m.indexes) == 0 || matchesAny(m.indexes, index)) && !matchesAny(m.notIndexes, index)
+}
+
+func matchesAll(rexes []*regexp.Regexp, s string) bool {
+	for _, r := range rexes {
+		if !r.MatchString(s) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesAny(rexes []*regexp.Regexp, s string) bool {
+	for _, r := range rexes {
+		if r.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileFragments compiles the fragments in sorted order. A fragment which can not be compiled is left out, which means it does not
+// exclude any events.
+func compileFragments(frags map[string]struct{}) []*regexp.Regexp {
+	ret := make([]*regexp.Regexp, 0, len(frags))
+	for _, f := range sortedKeys(frags) {
+		if r, err := CompileFragment(f); err == nil {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+func compileWildcards(values map[string]struct{}) []*regexp.Regexp {
+	ret := make([]*regexp.Regexp, 0, len(values))
+	for _, v := range sortedKeys(values) {
+		ret = append(ret, CompileWildcard(v))
+	}
+	return ret
+}
@@ -0,0 +1,75 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package search
+
+import "testing"
+
+func TestCompileFragment(t *testing.T) {
+	tests := []struct {
+		frag     string
+		s        string
+		expected bool
+	}{
+		{"hello", "say hello world", true},
+		{"hello", "othello", false},
+		{"HELLO", "hello", true},
+		{"hel*", "HELLO", true},
+		{"*LLO", "hello", true},
+		{"*pointer*", "java.lang.NullPointerException", true},
+		{"a.c", "a.c", true},
+		{"a.c", "abc", false},
+		{"f(x)", "called f(x) twice", true},
+		{"1+1", "11", false},
+		{"1+1", "1+1=2", true},
+		{"[a-z]", "b", false},
+		{"foo*bar", "foo\nbar", true},
+	}
+	for _, tt := range tests {
+		rex, err := CompileFragment(tt.frag)
+		if err != nil {
+			t.Fatalf("got error when compiling fragment=%q: %v", tt.frag, err)
+		}
+		if actual := rex.MatchString(tt.s); actual != tt.expected {
+			t.Errorf("expected fragment=%q matching %q to be %v, got %v", tt.frag, tt.s, tt.expected, actual)
+		}
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	m := NewMatcher(&Search{
+		Fragments:    map[string]struct{}{"error": {}},
+		NotFragments: map[string]struct{}{"timeout*": {}},
+		Sources:      map[string]struct{}{"*access*": {}},
+		NotHosts:     map[string]struct{}{"test": {}},
+		Indexes:      map[string]struct{}{"web*": {}},
+	})
+	tests := []struct {
+		raw, host, source, index string
+		expected                 bool
+	}{
+		{"an error occurred", "prod", "/var/log/access.log", "web", true},
+		{"an error occurred", "prod", "/var/log/access.log", "WEB-2", true},
+		{"no problems", "prod", "/var/log/access.log", "web", false},
+		{"an error: timeouts", "prod", "/var/log/access.log", "web", false},
+		{"an error occurred", "test", "/var/log/access.log", "web", false},
+		{"an error occurred", "prod", "/var/log/app.log", "web", false},
+		{"an error occurred", "prod", "/var/log/access.log", "main", false},
+	}
+	for _, tt := range tests {
+		if actual := m.Matches(tt.raw, tt.host, tt.source, tt.index); actual != tt.expected {
+			t.Errorf("expected event %+v to match=%v, got %v", tt, tt.expected, actual)
+		}
+	}
+}
@@ -14,6 +14,11 @@
 
 package search
 
+import (
+	"sort"
+	"strings"
+)
+
 type Search struct {
 	Fragments    map[string]struct{}
 	NotFragments map[string]struct{}
@@ -23,4 +28,88 @@ type Search struct {
 	NotSources   map[string]struct{}
 	Hosts        map[string]struct{}
 	NotHosts     map[string]struct{}
+	Indexes      map[string]struct{}
+	NotIndexes   map[string]struct{}
+	// IndexedFieldsVersions are the versions of the field extraction which are currently configured, see parser.ExtractorVersion. They are
+	// not part of the search string. Repositories only use indexed fields which were extracted with one of these versions to narrow down
+	// the events, since the values of indexed fields saved with other versions may be stale.
+	IndexedFieldsVersions map[string]struct{}
+}
+
+// DescribeFragments returns human readable descriptions of the Fragments and NotFragments of the search, sorted alphabetically.
+func (s *Search) DescribeFragments() []string {
+	ret := make([]string, 0, len(s.Fragments)+len(s.NotFragments))
+	ret = append(ret, sortedKeys(s.Fragments)...)
+	for _, f := range sortedKeys(s.NotFragments) {
+		ret = append(ret, "NOT "+f)
+	}
+	return ret
+}
+
+// DescribeSourcesAndHosts returns human readable descriptions of the Sources, NotSources, Hosts and NotHosts of the search.
+func (s *Search) DescribeSourcesAndHosts() []string {
+	ret := []string{}
+	ret = append(ret, describeSet("host", s.Hosts, false)...)
+	ret = append(ret, describeSet("host", s.NotHosts, true)...)
+	ret = append(ret, describeSet("source", s.Sources, false)...)
+	ret = append(ret, describeSet("source", s.NotSources, true)...)
+	return ret
+}
+
+// DescribeIndexes returns human readable descriptions of the Indexes and NotIndexes of the search.
+func (s *Search) DescribeIndexes() []string {
+	ret := []string{}
+	ret = append(ret, describeSet("index", s.Indexes, false)...)
+	ret = append(ret, describeSet("index", s.NotIndexes, true)...)
+	return ret
+}
+
+// DescribeFields returns human readable descriptions of the Fields and NotFields of the search, sorted by field name.
+func (s *Search) DescribeFields() []string {
+	ret := make([]string, 0, len(s.Fields)+len(s.NotFields))
+	for _, k := range sortedFieldKeys(s.Fields) {
+		ret = append(ret, describeField(k, s.Fields[k], false))
+	}
+	for _, k := range sortedFieldKeys(s.NotFields) {
+		ret = append(ret, describeField(k, s.NotFields[k], true))
+	}
+	return ret
+}
+
+func describeSet(name string, values map[string]struct{}, not bool) []string {
+	if len(values) == 0 {
+		return nil
+	}
+	return []string{describeField(name, sortedKeys(values), not)}
+}
+
+func describeField(name string, values []string, not bool) string {
+	if len(values) == 1 {
+		if not {
+			return name + "!=" + values[0]
+		}
+		return name + "=" + values[0]
+	}
+	if not {
+		return name + " NOT IN (" + strings.Join(values, ", ") + ")"
+	}
+	return name + " IN (" + strings.Join(values, ", ") + ")"
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func sortedFieldKeys(m map[string][]string) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
 }
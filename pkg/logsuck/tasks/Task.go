@@ -14,10 +14,41 @@
 
 package tasks
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type Task interface {
 	Name() string
 	Run(cfg map[string]any, ctx context.Context)
 	ConfigSchema() map[string]any
 }
+
+// ResultReporter can be implemented by a Task which wants to report what happened during its latest run. The value returned by
+// LastResult is included in the task status returned by the API, so it must be possible to marshal as JSON.
+type ResultReporter interface {
+	LastResult() any
+}
+
+// RunInfo describes a finished run of a task.
+type RunInfo struct {
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime"`
+	// Result is the value returned by LastResult after the run if the task implements ResultReporter, and nil otherwise.
+	Result any `json:"result,omitempty"`
+}
+
+type Status struct {
+	Name     string `json:"name"`
+	Enabled  bool   `json:"enabled"`
+	Running  bool   `json:"running"`
+	Interval string `json:"interval,omitempty"`
+	// LastRun is nil if the task has not finished a run since Logsuck was started.
+	LastRun *RunInfo `json:"lastRun,omitempty"`
+}
+
+// StatusSource provides the status of all tasks known to Logsuck.
+type StatusSource interface {
+	Statuses() []Status
+}
@@ -0,0 +1,102 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package glob matches file paths against glob patterns. Patterns use the syntax of filepath.Match, and a path element consisting of
+// only ** additionally matches any number of directories, so that /var/log/**/*.log matches both /var/log/a.log and /var/log/b/c/d.log.
+package glob
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const recursiveElement = "**"
+
+// Match reports whether name matches pattern. The only possible error is filepath.ErrBadPattern.
+func Match(pattern, name string) (bool, error) {
+	return matchElements(split(pattern), split(name))
+}
+
+func matchElements(pattern, name []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == recursiveElement {
+			for i := 0; i <= len(name); i++ {
+				if m, err := matchElements(pattern[1:], name[i:]); err != nil || m {
+					return m, err
+				}
+			}
+			return false, nil
+		}
+		if len(name) == 0 {
+			return false, nil
+		}
+		if m, err := filepath.Match(pattern[0], name[0]); err != nil || !m {
+			return false, err
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0, nil
+}
+
+// CanContain reports whether the directory dir may contain files matching pattern, either directly or in one of its subdirectories.
+func CanContain(pattern, dir string) bool {
+	return canContain(split(pattern), split(dir))
+}
+
+func canContain(pattern, dir []string) bool {
+	if len(dir) == 0 {
+		// At least one element must be left to match the names of the files in the directory
+		return len(pattern) > 0
+	}
+	if len(pattern) == 0 {
+		return false
+	}
+	if pattern[0] == recursiveElement {
+		return canContain(pattern, dir[1:]) || canContain(pattern[1:], dir)
+	}
+	m, err := filepath.Match(pattern[0], dir[0])
+	return err == nil && m && canContain(pattern[1:], dir[1:])
+}
+
+// Base returns the longest leading directory of pattern which does not contain any special characters. All files matching pattern are
+// in this directory or in its subdirectories.
+func Base(pattern string) string {
+	elements := split(pattern)
+	i := 0
+	for i < len(elements)-1 && !hasMeta(elements[i]) {
+		i++
+	}
+	base := strings.Join(elements[:i], "/")
+	if base == "" || base == filepath.VolumeName(pattern) {
+		if strings.HasPrefix(filepath.ToSlash(pattern[len(base):]), "/") {
+			base += "/"
+		} else if base == "" {
+			base = "."
+		}
+	}
+	return filepath.FromSlash(base)
+}
+
+func split(path string) []string {
+	return strings.Split(filepath.ToSlash(path), "/")
+}
+
+func hasMeta(element string) bool {
+	magic := `*?[`
+	if runtime.GOOS != "windows" {
+		magic = `*?[\`
+	}
+	return strings.ContainsAny(element, magic)
+}
@@ -0,0 +1,106 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package glob
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		name     string
+		expected bool
+	}{
+		{"/var/log/*.log", "/var/log/a.log", true},
+		{"/var/log/*.log", "/var/log/b/a.log", false},
+		{"/var/log/**/*.log", "/var/log/a.log", true},
+		{"/var/log/**/*.log", "/var/log/b/a.log", true},
+		{"/var/log/**/*.log", "/var/log/b/c/d/a.log", true},
+		{"/var/log/**/*.log", "/var/log/b/a.txt", false},
+		{"/var/log/**/*.log", "/var/other/a.log", false},
+		{"/var/log/**", "/var/log/b/c", true},
+		{"/var/**/apps/*/app.log", "/var/log/apps/x/app.log", true},
+		{"/var/**/apps/*/app.log", "/var/log/apps/app.log", false},
+		{"/var/log/**/b/**/*.log", "/var/log/a/b/c/d.log", true},
+		{"/var/log/a**.log", "/var/log/abc.log", true},
+		{"/var/log/a**.log", "/var/log/a/b.log", false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.pattern+" "+tt.name, func(t *testing.T) {
+			m, err := Match(filepath.FromSlash(tt.pattern), filepath.FromSlash(tt.name))
+			if err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+			if m != tt.expected {
+				t.Fatalf("expected Match to return %v, got %v", tt.expected, m)
+			}
+		})
+	}
+
+	_, err := Match("/var/log/[", "/var/log/a")
+	if err != filepath.ErrBadPattern {
+		t.Fatalf("expected ErrBadPattern for invalid pattern, got %v", err)
+	}
+}
+
+func TestCanContain(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		dir      string
+		expected bool
+	}{
+		{"/var/log/*.log", "/var/log", true},
+		{"/var/log/*.log", "/var/log/b", false},
+		{"/var/log/*.log", "/var", true},
+		{"/var/log/**/*.log", "/var/log/b/c", true},
+		{"/var/log/*/app.log", "/var/log/b", true},
+		{"/var/log/*/app.log", "/var/log/b/c", false},
+		{"/var/log/apps/**/*.log", "/var/log/other", false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.pattern+" "+tt.dir, func(t *testing.T) {
+			if c := CanContain(filepath.FromSlash(tt.pattern), filepath.FromSlash(tt.dir)); c != tt.expected {
+				t.Fatalf("expected CanContain to return %v, got %v", tt.expected, c)
+			}
+		})
+	}
+}
+
+func TestBase(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		expected string
+	}{
+		{"/var/log/app.log", "/var/log"},
+		{"/var/log/*.log", "/var/log"},
+		{"/var/log/apps/**/*.log", "/var/log/apps"},
+		{"/var/*/app.log", "/var"},
+		{"/*.log", "/"},
+		{"*.log", "."},
+		{"logs/*.log", "logs"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.pattern, func(t *testing.T) {
+			if b := Base(filepath.FromSlash(tt.pattern)); b != filepath.FromSlash(tt.expected) {
+				t.Fatalf("expected Base to return %q, got %q", tt.expected, b)
+			}
+		})
+	}
+}
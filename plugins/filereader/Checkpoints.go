@@ -0,0 +1,100 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filereader
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/checkpoints"
+)
+
+// fingerprintSize is the maximum number of bytes at the start of a file which are hashed to create its fingerprint.
+const fingerprintSize = 1024
+
+// fileState is the identity of an open file, used to decide if a checkpoint belongs to the file.
+type fileState struct {
+	device uint64
+	inode  uint64
+	// hasIdentity is false on platforms where device and inode are not available
+	hasIdentity bool
+	size        int64
+	// compressed is true if the file is compressed, in which case size is not the size of the contents which are read
+	compressed bool
+}
+
+func getFileState(f *os.File) (fileState, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return fileState{}, fmt.Errorf("error getting file info: %w", err)
+	}
+	device, inode, ok := fileIdentity(fi)
+	return fileState{
+		device:      device,
+		inode:       inode,
+		hasIdentity: ok,
+		size:        fi.Size(),
+	}, nil
+}
+
+// fingerprint returns a hash of the first size bytes of the file and the number of bytes that were hashed, which is less than size if the
+// file is smaller than size.
+func fingerprint(f *os.File, size int64) ([]byte, int64, error) {
+	prefix, err := readPrefix(f, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	return hashPrefix(prefix), int64(len(prefix)), nil
+}
+
+func hashPrefix(prefix []byte) []byte {
+	sum := sha256.Sum256(prefix)
+	return sum[:]
+}
+
+// readPrefix returns the first size bytes of the file, or the whole file if it is smaller than size.
+func readPrefix(f *os.File, size int64) ([]byte, error) {
+	buf := make([]byte, size)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error reading start of file: %w", err)
+	}
+	return buf[:n], nil
+}
+
+// checkpointMismatch returns a description of why the checkpoint cannot be used to resume reading the file, or the empty string if reading
+// can resume from the checkpoint's offset.
+func checkpointMismatch(cp *checkpoints.Checkpoint, f *os.File, state fileState) (string, error) {
+	if state.hasIdentity && (cp.Device != 0 || cp.Inode != 0) && (cp.Device != state.device || cp.Inode != state.inode) {
+		return "replaced", nil
+	}
+	if state.size < cp.Offset {
+		return "truncated", nil
+	}
+	if cp.FingerprintSize > 0 {
+		fp, n, err := fingerprint(f, cp.FingerprintSize)
+		if err != nil {
+			return "", err
+		}
+		if n != cp.FingerprintSize || !bytes.Equal(fp, cp.Fingerprint) {
+			return "replaced", nil
+		}
+	}
+	return "", nil
+}
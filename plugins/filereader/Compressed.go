@@ -0,0 +1,96 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filereader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxZstdWindowSize is the largest window a zstd frame may declare. The decoder keeps a window of decompressed data in memory, so a small
+// crafted file could otherwise make it allocate a lot of memory. This is the largest window used by the zstd command unless --long is
+// given.
+const maxZstdWindowSize = 8 << 20
+
+// maxMagicSize is the length of the longest magic bytes in compressionMagics.
+const maxMagicSize = 6
+
+var compressionMagics = []struct {
+	name  string
+	magic []byte
+}{
+	{name: "gzip", magic: []byte{0x1f, 0x8b}},
+	{name: "zstd", magic: []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{name: "bzip2", magic: []byte("BZh")},
+	{name: "xz", magic: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+}
+
+// compressionOf returns the name of the compression format of a file starting with prefix, or the empty string if the file does not
+// start with the magic bytes of a known compression format.
+func compressionOf(prefix []byte) string {
+	for _, c := range compressionMagics {
+		if bytes.HasPrefix(prefix, c.magic) {
+			return c.name
+		}
+	}
+	return ""
+}
+
+// compressedExtensions are the file name extensions of the compression formats.
+var compressedExtensions = map[string]string{
+	".gz":  "gzip",
+	".zst": "zstd",
+	".bz2": "bzip2",
+	".xz":  "xz",
+}
+
+// detectCompression returns the compression format of the file with the given name, which starts with prefix. The magic bytes at the
+// start of the file are used if there are enough of them. Otherwise the extension of the name is used, since a compressed file which is
+// still being written may not contain its magic bytes yet.
+func detectCompression(name string, prefix []byte) string {
+	if c := compressionOf(prefix); c != "" {
+		return c
+	}
+	if len(prefix) < maxMagicSize {
+		return compressedExtensions[filepath.Ext(name)]
+	}
+	return ""
+}
+
+// newDecompressor returns a reader which decompresses r, or an error if the compression format is not supported.
+func newDecompressor(compression string, r io.Reader) (io.Reader, error) {
+	switch compression {
+	case "gzip":
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("error reading gzip header: %w", err)
+		}
+		return gz, nil
+	case "zstd":
+		// With a concurrency of 1 the decoder does not start any goroutines, so it does not need to be closed
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(maxZstdWindowSize))
+		if err != nil {
+			return nil, fmt.Errorf("error creating zstd decoder: %w", err)
+		}
+		return zr, nil
+	default:
+		return nil, fmt.Errorf("%v compressed files are not supported. only gzip and zstd compressed files can be read", compression)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filereader
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/checkpoints"
+)
+
+func TestCompressedFiles(t *testing.T) {
+	content := lines("a", 3) + "last line without newline"
+	tests := []struct {
+		name     string
+		compress func(t *testing.T, fileName string) string
+	}{
+		{name: "gzip", compress: func(t *testing.T, fileName string) string {
+			gzipFile(t, fileName)
+			return fileName + ".gz"
+		}},
+		{name: "zstd", compress: zstdFile},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fileName := filepath.Join(dir, "app.log.1")
+			writeFile(t, fileName, content)
+			compressed := tt.compress(t, fileName)
+			repo := &memoryCheckpoints{m: map[string]checkpoints.Checkpoint{}}
+			pub, stop := runFileWatcher(t, compressed, repo, 4)
+
+			evts := pub.get()
+			expected := append(splitLines(lines("a", 3)), "last line without newline")
+			offset := int64(0)
+			for i, evt := range evts {
+				if evt.Raw != expected[i] || evt.Offset != offset {
+					t.Fatalf("got unexpected event at index=%v, expected raw=%q and offset=%v, got %+v", i, expected[i], offset, evt)
+				}
+				offset += int64(len(expected[i]) + 1)
+			}
+			waitForCheckpoint(t, repo, compressed, int64(len(content)))
+			cp, _ := repo.Get("localhost", compressed)
+			if !cp.Complete {
+				t.Fatalf("expected checkpoint for compressed file to be complete, got %+v", cp)
+			}
+			stop()
+
+			pub, _ = runFileWatcher(t, compressed, repo, 0)
+			time.Sleep(20 * rotatedFileReads * time.Millisecond)
+			if len(pub.get()) != 0 {
+				t.Fatalf("expected compressed file not to be read again, got %v", pub.get())
+			}
+		})
+	}
+}
+
+func TestCompressedFileContinuesRotatedFile(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "app.log")
+	repo := &memoryCheckpoints{m: map[string]checkpoints.Checkpoint{}}
+	writeFile(t, fileName, lines("a", 2))
+	first, stop := runFileWatcher(t, fileName, repo, 2)
+	waitForCheckpoint(t, repo, fileName, int64(len(lines("a", 2))))
+	stop()
+
+	// The file is written to, rotated and compressed while Logsuck is stopped
+	appendFile(t, fileName, lines("b", 1))
+	rename(t, fileName, fileName+".1")
+	gzipFile(t, fileName+".1")
+	pub := runGlobWatcher(t, filepath.Join(dir, "app.log*"), repo)
+
+	evts := waitForEvents(t, pub, 1)
+	assertRaws(t, evts, splitLines(lines("b", 1)))
+	if evts[0].Offset != int64(len(lines("a", 2))) || evts[0].SourceId != first.get()[0].SourceId {
+		t.Fatalf("expected compressed file to continue where the rotated file was read to, got %+v", evts[0])
+	}
+}
+
+func TestUnsupportedCompressedFile(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "app.log.1.bz2")
+	writeFile(t, fileName, "BZh91AY&SY"+lines("a", 1))
+	pub := runGlobWatcher(t, filepath.Join(dir, "app.log*"), nil)
+	waitForEvents(t, pub, 0)
+}
+
+func TestZstdWindowSizeIsLimited(t *testing.T) {
+	// A frame header declaring a 128MB window, which is followed by an empty last raw block
+	frame := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 17 << 3, 0x01, 0x00, 0x00}
+	r, err := newDecompressor("zstd", bytes.NewReader(frame))
+	if err == nil {
+		_, err = io.ReadAll(r)
+	}
+	if err == nil {
+		t.Fatalf("expected error when reading zstd frame with a window larger than maxZstdWindowSize")
+	}
+}
+
+// zstdFile compresses the file to fileName.zst using the zstd command and removes the file. The test is skipped if the zstd command is not
+// available.
+func zstdFile(t *testing.T, fileName string) string {
+	t.Helper()
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd is not installed")
+	}
+	out, err := exec.Command("zstd", "-q", "--rm", fileName).CombinedOutput()
+	if err != nil {
+		t.Fatalf("got error when compressing file: %v, output=%s", err, out)
+	}
+	return fileName + ".zst"
+}
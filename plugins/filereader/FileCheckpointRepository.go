@@ -0,0 +1,139 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filereader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/checkpoints"
+)
+
+type checkpointKey struct {
+	host string
+	path string
+}
+
+// FileCheckpointRepository stores checkpoints in a JSON state file. It is used instead of the checkpoint repository provided by the
+// storage plugin when checkpointFile is set in the configuration of this plugin.
+type FileCheckpointRepository struct {
+	fileName string
+
+	mu          sync.Mutex
+	checkpoints map[checkpointKey]checkpoints.Checkpoint
+}
+
+// NewFileCheckpointRepository reads the checkpoints in the given file. The file does not need to exist, it will be created when the
+// first checkpoint is written.
+func NewFileCheckpointRepository(fileName string) (*FileCheckpointRepository, error) {
+	ret := &FileCheckpointRepository{
+		fileName:    fileName,
+		checkpoints: map[checkpointKey]checkpoints.Checkpoint{},
+	}
+	b, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading checkpoint file=%v: %w", fileName, err)
+	}
+	var cps []checkpoints.Checkpoint
+	err = json.Unmarshal(b, &cps)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling checkpoint file=%v: %w", fileName, err)
+	}
+	for _, cp := range cps {
+		ret.checkpoints[checkpointKey{host: cp.Host, path: cp.Path}] = cp
+	}
+	return ret, nil
+}
+
+func (r *FileCheckpointRepository) Get(host, path string) (*checkpoints.Checkpoint, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cp, ok := r.checkpoints[checkpointKey{host: host, path: path}]
+	if !ok {
+		return nil, nil
+	}
+	return &cp, nil
+}
+
+func (r *FileCheckpointRepository) List(host string) ([]checkpoints.Checkpoint, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := []checkpoints.Checkpoint{}
+	for k, cp := range r.checkpoints {
+		if k.host == host {
+			ret = append(ret, cp)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Path < ret[j].Path
+	})
+	return ret, nil
+}
+
+// Put writes all checkpoints to a temporary file which is then renamed to the state file, so that a crash while writing does not leave
+// a partially written state file behind.
+func (r *FileCheckpointRepository) Put(c checkpoints.Checkpoint) error {
+	if c.Updated.IsZero() {
+		c.Updated = time.Now()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checkpoints[checkpointKey{host: c.Host, path: c.Path}] = c
+	cps := make([]checkpoints.Checkpoint, 0, len(r.checkpoints))
+	for _, cp := range r.checkpoints {
+		cps = append(cps, cp)
+	}
+	sort.Slice(cps, func(i, j int) bool {
+		if cps[i].Host != cps[j].Host {
+			return cps[i].Host < cps[j].Host
+		}
+		return cps[i].Path < cps[j].Path
+	})
+	b, err := json.MarshalIndent(cps, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling checkpoints: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.fileName), filepath.Base(r.fileName)+".tmp")
+	if err != nil {
+		return fmt.Errorf("error creating temporary checkpoint file: %w", err)
+	}
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing temporary checkpoint file=%v: %w", tmp.Name(), err)
+	}
+	err = os.Rename(tmp.Name(), r.fileName)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error renaming temporary checkpoint file=%v to %v: %w", tmp.Name(), r.fileName, err)
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !unix
+// +build !unix
+
+package filereader
+
+import "os"
+
+// fileIdentity is not implemented on this platform, so replaced files are only detected using the fingerprint of their first bytes.
+func fileIdentity(fi os.FileInfo) (device uint64, inode uint64, ok bool) {
+	return 0, 0, false
+}
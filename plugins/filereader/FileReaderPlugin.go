@@ -21,6 +21,7 @@ import (
 	"log/slog"
 
 	"github.com/jackbister/logsuck/pkg/logsuck"
+	"github.com/jackbister/logsuck/pkg/logsuck/config"
 
 	_ "github.com/mattn/go-sqlite3"
 	"go.uber.org/dig"
@@ -33,12 +34,29 @@ var schemaString string
 
 type Config struct {
 	FileName string
+	// CheckpointFile is the name of a JSON state file to store checkpoints in. When it is empty, checkpoints are stored using the
+	// checkpoints.Repository provided by the storage plugins, if there is one.
+	CheckpointFile string
 }
 
 var Plugin = logsuck.Plugin{
 	Name: pluginName,
 	Provide: func(c *dig.Container, logger *slog.Logger) error {
-		err := c.Provide(NewGlobWatcherCoordinator)
+		err := c.Provide(func(cfg *config.Config) *Config {
+			ret := Config{}
+			cfgMap, ok := cfg.Plugins[pluginName].(map[string]any)
+			if !ok {
+				return &ret
+			}
+			if cf, ok := cfgMap["checkpointFile"].(string); ok {
+				ret.CheckpointFile = cf
+			}
+			return &ret
+		})
+		if err != nil {
+			return err
+		}
+		err = c.Provide(NewGlobWatcherCoordinator)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,278 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filereader
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackbister/logsuck/pkg/logsuck/checkpoints"
+)
+
+// minFingerprintMatchSize is the minimum number of bytes a fingerprint must cover for a file to be recognized as a copy of another file
+// using the fingerprint alone. A file with the same device and inode as a file which has been read is recognized using a fingerprint of
+// any size.
+const minFingerprintMatchSize = 64
+
+// maxReleasedFiles is the maximum number of files which are not being read that are remembered by a FileRegistry. The files which were
+// released first are forgotten first.
+const maxReleasedFiles = 10000
+
+// FileRegistry keeps track of the files which have been read, identified by their device, inode and the fingerprint of their first bytes.
+// It is shared by all FileWatchers, so that a file which is found under a new name after being rotated, or which is a copy of a file that
+// was truncated by logrotate's copytruncate, is recognized and read from where the previous FileWatcher stopped instead of from the start.
+type FileRegistry struct {
+	hostName    string
+	checkpoints checkpoints.Repository
+
+	mu      sync.Mutex
+	entries []*fileEntry
+
+	logger *slog.Logger
+}
+
+// fileEntry is the state of a file which has been read. An entry is claimed while a FileWatcher is reading it. A FileWatcher which opens
+// a file matching an entry claimed by another FileWatcher waits for the entry to be released before it reads the file, so that the
+// contents of a file are never read by two FileWatchers at the same time.
+type fileEntry struct {
+	path  string
+	state fileState
+
+	fingerprint     []byte
+	fingerprintSize int64
+
+	sourceId string
+	offset   int64
+	// complete is true if the entry was released by a FileWatcher which read a compressed file to its end
+	complete bool
+
+	claimed  bool
+	released time.Time
+}
+
+// NewFileRegistry creates a FileRegistry which remembers the files in the checkpoints for the host. checkpoints may be nil, in which case
+// the registry only remembers the files read since Logsuck was started.
+func NewFileRegistry(hostName string, cps checkpoints.Repository, logger *slog.Logger) (*FileRegistry, error) {
+	r := &FileRegistry{
+		hostName:    hostName,
+		checkpoints: cps,
+		entries:     []*fileEntry{},
+		logger:      logger,
+	}
+	if cps == nil {
+		return r, nil
+	}
+	list, err := cps.List(hostName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list checkpoints for host=%v: %w", hostName, err)
+	}
+	for _, cp := range list {
+		r.entries = append(r.entries, &fileEntry{
+			path: cp.Path,
+			state: fileState{
+				device:      cp.Device,
+				inode:       cp.Inode,
+				hasIdentity: cp.Device != 0 || cp.Inode != 0,
+			},
+			fingerprint:     cp.Fingerprint,
+			fingerprintSize: cp.FingerprintSize,
+			sourceId:        cp.SourceId,
+			offset:          cp.Offset,
+			complete:        cp.Complete,
+			released:        cp.Updated,
+		})
+	}
+	return r, nil
+}
+
+// claim finds the entry matching the file which was opened at path. If a released entry matches, it is claimed and resumed is true.
+// If the matching entry is claimed by another FileWatcher, it is returned as wait and the file must not be read until tryClaim succeeds.
+// Otherwise a new claimed entry is created for the file. prefix is the start of the file, up to fingerprintSize bytes. For a compressed
+// file it is the start of the decompressed contents.
+func (r *FileRegistry) claim(path string, state fileState, prefix []byte) (e *fileEntry, resumed bool, wait *fileEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	match := r.find(prefix, state)
+	if match != nil && match.claimed {
+		return nil, false, match
+	}
+	if match != nil {
+		r.claimEntry(match, path, state)
+		return match, true, nil
+	}
+	return r.add(path, state, prefix), false, nil
+}
+
+// tryClaim claims an entry returned as wait by claim, if it has been released.
+func (r *FileRegistry) tryClaim(e *fileEntry, path string, state fileState) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e.claimed {
+		return false
+	}
+	found := false
+	for _, other := range r.entries {
+		if other == e {
+			found = true
+			break
+		}
+	}
+	if !found {
+		r.entries = append(r.entries, e)
+	}
+	r.claimEntry(e, path, state)
+	return true
+}
+
+// replace releases e without its device and inode, since the file it was read from now has other contents, and creates a new claimed entry
+// for the new contents of the file.
+func (r *FileRegistry) replace(e *fileEntry, offset int64, path string, state fileState, prefix []byte) *fileEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e.state = fileState{}
+	r.releaseEntry(e, offset)
+	return r.add(path, state, prefix)
+}
+
+// update sets the fingerprint of a claimed entry, which grows until it covers fingerprintSize bytes as the file is written to.
+func (r *FileRegistry) update(e *fileEntry, fp []byte, fpSize int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e.fingerprint = fp
+	e.fingerprintSize = fpSize
+}
+
+// release releases a claimed entry, so that the file can be read by another FileWatcher from offset.
+func (r *FileRegistry) release(e *fileEntry, offset int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.releaseEntry(e, offset)
+	r.prune()
+}
+
+// finish releases a claimed entry after its compressed file has been read to the end. A compressed file matching the entry is not read
+// again.
+func (r *FileRegistry) finish(e *fileEntry, offset int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.releaseEntry(e, offset)
+	e.complete = true
+	r.prune()
+}
+
+func (r *FileRegistry) claimEntry(e *fileEntry, path string, state fileState) {
+	e.path = path
+	e.state = state
+	e.claimed = true
+}
+
+func (r *FileRegistry) releaseEntry(e *fileEntry, offset int64) {
+	e.offset = offset
+	e.complete = false
+	e.claimed = false
+	e.released = time.Now()
+}
+
+// add creates a claimed entry. Released entries with the same device and inode are removed since the file they were read from has been
+// replaced.
+func (r *FileRegistry) add(path string, state fileState, prefix []byte) *fileEntry {
+	if state.hasIdentity {
+		kept := r.entries[:0]
+		for _, e := range r.entries {
+			if !e.claimed && e.state.hasIdentity && e.state.device == state.device && e.state.inode == state.inode {
+				continue
+			}
+			kept = append(kept, e)
+		}
+		r.entries = kept
+	}
+	e := &fileEntry{
+		path:            path,
+		state:           state,
+		fingerprint:     hashPrefix(prefix),
+		fingerprintSize: int64(len(prefix)),
+		sourceId:        uuid.NewString(),
+		claimed:         true,
+	}
+	r.entries = append(r.entries, e)
+	return e
+}
+
+// find returns the entry which best matches the file starting with prefix. An entry matches if the file starts with the bytes the entry's
+// fingerprint was created from. An entry with the same device and inode as the file is preferred, and unless the file is compressed it
+// only matches if the file has not been truncated to before the entry's offset. Other entries only match if their fingerprint covers at
+// least minFingerprintMatchSize bytes.
+func (r *FileRegistry) find(prefix []byte, state fileState) *fileEntry {
+	fingerprints := map[int64][]byte{}
+	var best *fileEntry
+	bestSameInode := false
+	for _, e := range r.entries {
+		if e.fingerprintSize == 0 || int64(len(prefix)) < e.fingerprintSize {
+			continue
+		}
+		sameInode := e.state.hasIdentity && state.hasIdentity && e.state.device == state.device && e.state.inode == state.inode
+		if sameInode && !state.compressed && state.size < e.offset {
+			continue
+		}
+		if !sameInode && e.fingerprintSize < minFingerprintMatchSize {
+			continue
+		}
+		fp, ok := fingerprints[e.fingerprintSize]
+		if !ok {
+			fp = hashPrefix(prefix[:e.fingerprintSize])
+			fingerprints[e.fingerprintSize] = fp
+		}
+		if !bytes.Equal(fp, e.fingerprint) {
+			continue
+		}
+		if best == nil || (sameInode && !bestSameInode) || (sameInode == bestSameInode && e.fingerprintSize > best.fingerprintSize) {
+			best = e
+			bestSameInode = sameInode
+		}
+	}
+	return best
+}
+
+// prune forgets the released entries which were released first when there are more than maxReleasedFiles released entries.
+func (r *FileRegistry) prune() {
+	released := make([]*fileEntry, 0, len(r.entries))
+	for _, e := range r.entries {
+		if !e.claimed {
+			released = append(released, e)
+		}
+	}
+	if len(released) <= maxReleasedFiles {
+		return
+	}
+	sort.Slice(released, func(i, j int) bool {
+		return released[i].released.Before(released[j].released)
+	})
+	forget := map[*fileEntry]struct{}{}
+	for _, e := range released[:len(released)-maxReleasedFiles] {
+		forget[e] = struct{}{}
+	}
+	kept := r.entries[:0]
+	for _, e := range r.entries {
+		if _, ok := forget[e]; !ok {
+			kept = append(kept, e)
+		}
+	}
+	r.entries = kept
+}
@@ -15,6 +15,7 @@
 package filereader
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -24,30 +25,36 @@ import (
 	"sync"
 	"time"
 
+	"github.com/jackbister/logsuck/pkg/logsuck/checkpoints"
 	"github.com/jackbister/logsuck/pkg/logsuck/indexedfiles"
 	"go.uber.org/dig"
 
 	"github.com/jackbister/logsuck/pkg/logsuck/config"
 	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/parser"
+	"github.com/jackbister/logsuck/pkg/logsuck/util/glob"
 
 	"github.com/fsnotify/fsnotify"
-	"github.com/google/uuid"
 )
 
 // FileWatcherCommand is a command that can be sent to a FileWatcher to tell it to perform various actions
 type FileWatcherCommand int
 
 const (
-	// CommandReopen closes the file and opens it again
+	// CommandReopen makes the watcher check if the file has been truncated, moved or removed without waiting for the next read
 	CommandReopen FileWatcherCommand = 1
 	// CommandReload updates the file watcher's configuration to the new configuration stored in the "newFileConfig" property
 	CommandReloadConfig FileWatcherCommand = 2
 )
 
-// There is probably a cleaner solution to this.
-// Maybe we could just have one fsnotify.Watcher for all files since we check for glob match anyway?
-var fsWatchers = map[string]*fsnotify.Watcher{}
-var fsWatchersLock = sync.Mutex{}
+// defaultCheckpointInterval is the time between writes of a file's checkpoint. The checkpoint written is the offset which had been read when the
+// previous checkpoint was written, so that the events before the offset have been written to the repository by the publisher before the
+// checkpoint is written. Any events which are read again after a crash are rejected as duplicates.
+const defaultCheckpointInterval = 5 * time.Second
+
+// rotatedFileReads is the number of read intervals a file which has been moved or removed is read after nothing more has been written to it.
+// Programs usually keep writing to their log file for a short while after it has been rotated, until they have reopened it.
+const rotatedFileReads = 10
 
 type GlobWatcherCoordinator struct {
 	logger       slog.Logger
@@ -56,6 +63,7 @@ type GlobWatcherCoordinator struct {
 	staticConfig config.Config
 	configSource config.Source
 	publisher    events.Publisher
+	registry     *FileRegistry
 	ctx          context.Context
 }
 
@@ -66,10 +74,29 @@ type GlobWatcherCoordinatorParams struct {
 	StaticConfig *config.Config
 	ConfigSource config.Source
 	Publisher    events.Publisher
-	Ctx          context.Context
+	Cfg          *Config
+	// Checkpoints is provided by the storage plugins which can keep checkpoints. If it is nil and no checkpointFile is configured, every
+	// file is read from the start when Logsuck starts.
+	Checkpoints checkpoints.Repository `optional:"true"`
+	Ctx         context.Context
 }
 
-func NewGlobWatcherCoordinator(p GlobWatcherCoordinatorParams) events.Reader {
+func NewGlobWatcherCoordinator(p GlobWatcherCoordinatorParams) (events.Reader, error) {
+	cps := p.Checkpoints
+	if p.Cfg.CheckpointFile != "" {
+		fcr, err := NewFileCheckpointRepository(p.Cfg.CheckpointFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create checkpoint repository: %w", err)
+		}
+		cps = fcr
+	}
+	if cps == nil {
+		p.Logger.Info("no checkpoint repository is available. files will be read from the start every time Logsuck starts")
+	}
+	registry, err := NewFileRegistry(p.StaticConfig.HostName, cps, p.Logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file registry: %w", err)
+	}
 	return &GlobWatcherCoordinator{
 		logger:       *p.Logger,
 		watchers:     map[string]*GlobWatcher{},
@@ -77,8 +104,9 @@ func NewGlobWatcherCoordinator(p GlobWatcherCoordinatorParams) events.Reader {
 		staticConfig: *p.StaticConfig,
 		configSource: p.ConfigSource,
 		publisher:    p.Publisher,
+		registry:     registry,
 		ctx:          p.Ctx,
-	}
+	}, nil
 }
 
 func (gwc *GlobWatcherCoordinator) Start() error {
@@ -140,7 +168,7 @@ func (gwc *GlobWatcherCoordinator) reloadFileWatchers() {
 			continue
 		}
 		gwc.logger.Info("creating new watcher", slog.String("fileName", k))
-		w, err := NewGlobWatcher(v, v.Filename, gwc.staticConfig.HostName, gwc.publisher, gwc.ctx, gwc.logger)
+		w, err := NewGlobWatcher(v, v.Filename, gwc.staticConfig.HostName, gwc.publisher, gwc.registry, gwc.ctx, gwc.logger)
 		if err != nil {
 			gwc.logger.Warn("got error when creating GlobWatcher", slog.String("fileName", v.Filename), slog.Any("error", err))
 			continue
@@ -152,8 +180,13 @@ func (gwc *GlobWatcherCoordinator) reloadFileWatchers() {
 
 // GlobWatcher watches a glob pattern to find log files. When a log file is found it will create a FileWatcher to read the file.
 type GlobWatcher struct {
-	glob string
+	glob    string
+	absGlob string
+	// watcher is notified when files and directories are created in the directories which can contain files matching the glob
+	watcher *fsnotify.Watcher
 
+	// mu protects fileConfig and m, which are updated by UpdateConfig while the watcher is running
+	mu         sync.Mutex
 	fileConfig indexedfiles.IndexedFileConfig
 	m          map[string]*FileWatcher
 	ctx        context.Context
@@ -162,21 +195,39 @@ type GlobWatcher struct {
 	hostName string
 
 	eventPublisher events.Publisher
+	registry       *FileRegistry
 
 	logger slog.Logger
 }
 
+// UpdateConfig makes the GlobWatcher and its FileWatchers use the new config. FileWatchers for files which are excluded by the new config
+// are stopped.
 func (gw *GlobWatcher) UpdateConfig(cfg indexedfiles.IndexedFileConfig) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
 	gw.logger.Info("updating fileConfig for GlobWatcher",
 		slog.String("fileName", gw.fileConfig.Filename))
-	if cfg == gw.fileConfig {
+	if cfg.Equal(&gw.fileConfig) {
 		gw.logger.Info("new config for GlobWatcher is the same as before. will not do anything",
 			slog.String("fileName", gw.fileConfig.Filename))
 		return
 	}
-	for _, v := range gw.m {
-		v.newFileConfig = &cfg
-		v.commands <- CommandReloadConfig
+	gw.fileConfig = cfg
+	for path, fw := range gw.m {
+		if cfg.Excludes(path) {
+			gw.logger.Info("path is excluded by the new config. will stop reading it",
+				slog.String("path", path),
+				slog.String("glob", gw.absGlob))
+			fw.Cancel()
+			delete(gw.m, path)
+			continue
+		}
+		newCfg := cfg
+		fw.newFileConfig = &newCfg
+		select {
+		case fw.commands <- CommandReloadConfig:
+		case <-fw.ctx.Done():
+		}
 	}
 }
 
@@ -185,6 +236,8 @@ type FileWatcher struct {
 	fileConfig    indexedfiles.IndexedFileConfig
 	newFileConfig *indexedfiles.IndexedFileConfig
 	ctx           context.Context
+	// Cancel stops the FileWatcher
+	Cancel func()
 
 	filename string
 	hostName string
@@ -192,22 +245,56 @@ type FileWatcher struct {
 	commands       chan FileWatcherCommand
 	eventPublisher events.Publisher
 	file           *os.File
+	// reader reads the contents of file, decompressing them if the file is compressed
+	reader io.Reader
+	// compression is the compression format of file, or the empty string if it is not compressed. Compressed files are read once and
+	// are not expected to be written to, so they are not tailed.
+	compression string
+	// completed is the compressed file at the path which has been read to its end. The path is not opened again until it refers to
+	// another file.
+	completed os.FileInfo
 
 	currentSourceId string
-	currentOffset   int64
-	readBuf         []byte
-	workingBuf      []byte
+	// currentOffset is the offset in the file of the first byte in workingBuf
+	currentOffset int64
+	readBuf       []byte
+	workingBuf    []byte
+	// lastRead is the time when something was last read from the file
+	lastRead time.Time
+
+	registry *FileRegistry
+	// entry is the registry's entry for the file while it is being read
+	entry *fileEntry
+	// waitingFor is the entry of another file matching the file, which must be released before the file is read
+	waitingFor *fileEntry
+	openFailed bool
+	// ignoredFingerprint is the fingerprint of a compressed file at the path which cannot be read
+	ignoredFingerprint []byte
+
+	checkpointInterval time.Duration
+	// fileState, fingerprint and fingerprintSize are written with the checkpoint to identify the current file
+	fileState       fileState
+	fingerprint     []byte
+	fingerprintSize int64
+	// lastSize is the size of the file when it was last checked for truncation
+	lastSize       int64
+	lastCheckpoint time.Time
+	// pendingOffset is the offset which will be written in the next checkpoint
+	pendingOffset int64
+	savedOffset   int64
 
 	logger slog.Logger
 }
 
 // NewGlobWatcher creates a new watcher. The watcher will find any log files matching the glob pattern and create new FileWatchers for them.
-// The FileWatchers will publish events to the given eventPublisher.
+// The FileWatchers will publish events to the given eventPublisher. The FileWatchers use the registry to recognize files which they have
+// already read, for example after the files have been rotated or Logsuck has been restarted.
 func NewGlobWatcher(
 	fileConfig indexedfiles.IndexedFileConfig,
 	glob string,
 	hostName string,
 	eventPublisher events.Publisher,
+	registry *FileRegistry,
 	ctx context.Context,
 
 	logger slog.Logger,
@@ -224,6 +311,7 @@ func NewGlobWatcher(
 		hostName: hostName,
 
 		eventPublisher: eventPublisher,
+		registry:       registry,
 
 		logger: logger,
 	}
@@ -236,97 +324,64 @@ func (gw *GlobWatcher) Start() error {
 	if err != nil {
 		return fmt.Errorf("error geting absGlob for glob=%s: %w", gw.glob, err)
 	}
-	dir, err := filepath.Abs(filepath.Dir(gw.glob))
+	gw.absGlob = absGlob
+	dir := glob.Base(absGlob)
+	gw.watcher, err = fsnotify.NewWatcher()
 	if err != nil {
-		return fmt.Errorf("error getting directory for glob=%s: %w", gw.glob, err)
+		return fmt.Errorf("error creating FileWatcher for dir=%s, filename=%s: %w", dir, gw.glob, err)
 	}
-	fsWatchersLock.Lock()
-	defer fsWatchersLock.Unlock()
-	var watcher *fsnotify.Watcher
-	if w, ok := fsWatchers[dir]; ok {
-		watcher = w
-	} else {
-		watcher, err = fsnotify.NewWatcher()
-		if err != nil {
-			return fmt.Errorf("error creating FileWatcher for dir=%s, filename=%s: %w", dir, gw.glob, err)
-		}
-		err = watcher.Add(dir)
-		if err != nil {
-			return fmt.Errorf("error adding dir to FileWatcher for dir=%s, filename=%s: %w", dir, gw.glob, err)
-		}
-	}
-	initial, err := filepath.Glob(gw.glob)
+	err = gw.watcher.Add(dir)
 	if err != nil {
-		return fmt.Errorf("got error when globbing using glob=%s: %w", gw.glob, err)
-	}
-	for _, file := range initial {
-		absPath, err := filepath.Abs(file)
-		if err != nil {
-			gw.logger.Warn("got error when performing filepath.Abs(file)",
-				slog.String("dir", dir),
-				slog.String("file", file),
-				slog.Any("error", err))
-			continue
-		}
-		fw, err := NewFileWatcher(gw.fileConfig, absPath, gw.hostName, gw.eventPublisher, gw.ctx, gw.logger)
-		if err != nil {
-			gw.logger.Warn("got error when creating new FileWatcher for filename matching glob",
-				slog.String("fileName", absPath),
-				slog.String("glob", gw.glob),
-				slog.Any("error", err))
-			continue
-		}
-		go fw.Start()
-		gw.m[absPath] = fw
+		gw.watcher.Close()
+		return fmt.Errorf("error adding dir to FileWatcher for dir=%s, filename=%s: %w", dir, gw.glob, err)
 	}
+	gw.scan(dir)
 
 	go func() {
+		defer gw.watcher.Close()
 		for {
 			select {
 			case <-gw.ctx.Done():
 				return
-			case evt := <-watcher.Events:
-				if evt.Op&(fsnotify.Create|fsnotify.Remove) == 0 {
+			case err := <-gw.watcher.Errors:
+				gw.logger.Warn("got error from fsnotify",
+					slog.String("glob", gw.glob),
+					slog.Any("error", err))
+			case evt := <-gw.watcher.Events:
+				if evt.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
 					continue
 				}
-				path := evt.Name
-				matched, err := filepath.Match(absGlob, path)
+				absPath, err := filepath.Abs(evt.Name)
 				if err != nil {
-					gw.logger.Warn("got error when matching glob against path",
-						slog.String("glob", gw.glob),
-						slog.String("path", path),
+					gw.logger.Warn("got error when performing filepath.Abs(evt.Name) after receiving fsnotify",
+						slog.String("evtName", evt.Name),
 						slog.Any("error", err))
 					continue
 				}
-				if !matched {
-					gw.logger.Info("path does not match glob, skipping",
-						slog.String("path", path),
-						slog.String("glob", absGlob))
+
+				gw.mu.Lock()
+				fw, ok := gw.m[absPath]
+				gw.mu.Unlock()
+				if ok {
+					// If the FileWatcher is busy it will check the file on its next read anyway
+					select {
+					case fw.commands <- CommandReopen:
+					default:
+					}
 					continue
 				}
-
-				absPath, err := filepath.Abs(path)
+				if evt.Op&fsnotify.Create == 0 {
+					continue
+				}
+				fi, err := os.Stat(absPath)
 				if err != nil {
-					gw.logger.Warn("got error when performing filepath.Abs(dir/evt.Name) after receiving fsnotify",
-						slog.String("dir", dir),
-						slog.String("evtName", evt.Name),
-						slog.Any("error", err))
+					// The file may already have been removed again
 					continue
 				}
-
-				if fw, ok := gw.m[absPath]; ok {
-					fw.commands <- CommandReopen
+				if fi.IsDir() {
+					gw.addDir(absPath)
 				} else {
-					fw, err = NewFileWatcher(gw.fileConfig, absPath, gw.hostName, gw.eventPublisher, gw.ctx, gw.logger)
-					if err != nil {
-						gw.logger.Warn("got error when creating new FileWatcher for filename matching glob",
-							slog.String("fileName", absPath),
-							slog.String("glob", gw.glob),
-							slog.Any("error", err))
-						continue
-					}
-					go fw.Start()
-					gw.m[absPath] = fw
+					gw.startFileWatcher(absPath)
 				}
 			}
 		}
@@ -334,18 +389,103 @@ func (gw *GlobWatcher) Start() error {
 	return nil
 }
 
+// addDir starts watching a directory which has been created below the glob's base directory if the directory can contain files matching
+// the glob. Files and directories which were created in the directory before it was watched are found by scanning it.
+func (gw *GlobWatcher) addDir(dir string) {
+	if !glob.CanContain(gw.absGlob, dir) {
+		return
+	}
+	err := gw.watcher.Add(dir)
+	if err != nil {
+		gw.logger.Warn("got error when adding directory to fsnotify watcher",
+			slog.String("dir", dir),
+			slog.String("glob", gw.glob),
+			slog.Any("error", err))
+		return
+	}
+	gw.scan(dir)
+}
+
+// scan starts FileWatchers for the files in dir which match the glob, and watches the subdirectories of dir which can contain matching
+// files. Symbolic links to directories are not followed.
+func (gw *GlobWatcher) scan(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		gw.logger.Warn("got error when reading directory",
+			slog.String("dir", dir),
+			slog.String("glob", gw.glob),
+			slog.Any("error", err))
+		return
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			gw.addDir(path)
+			continue
+		}
+		if entry.Type()&os.ModeSymlink != 0 {
+			if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+				continue
+			}
+		}
+		gw.startFileWatcher(path)
+	}
+}
+
+// startFileWatcher starts a FileWatcher for the file at path if the path matches the glob and is not excluded.
+func (gw *GlobWatcher) startFileWatcher(path string) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	if _, ok := gw.m[path]; ok {
+		return
+	}
+	matched, err := glob.Match(gw.absGlob, path)
+	if err != nil {
+		gw.logger.Warn("got error when matching glob against path",
+			slog.String("glob", gw.glob),
+			slog.String("path", path),
+			slog.Any("error", err))
+		return
+	}
+	if !matched {
+		gw.logger.Debug("path does not match glob, skipping",
+			slog.String("path", path),
+			slog.String("glob", gw.absGlob))
+		return
+	}
+	if gw.fileConfig.Excludes(path) {
+		gw.logger.Debug("path is excluded, skipping",
+			slog.String("path", path),
+			slog.String("glob", gw.absGlob))
+		return
+	}
+	fw, err := NewFileWatcher(gw.fileConfig, path, gw.hostName, gw.eventPublisher, gw.registry, gw.ctx, gw.logger)
+	if err != nil {
+		gw.logger.Warn("got error when creating new FileWatcher for filename matching glob",
+			slog.String("fileName", path),
+			slog.String("glob", gw.glob),
+			slog.Any("error", err))
+		return
+	}
+	go fw.Start()
+	gw.m[path] = fw
+}
+
 // NewFileWatcher returns a FileWatcher which will watch a file and publish events according to the IndexedFileConfig
 func NewFileWatcher(
 	fileConfig indexedfiles.IndexedFileConfig,
 	filename string,
 	hostName string,
 	eventPublisher events.Publisher,
+	registry *FileRegistry,
 	ctx context.Context,
 	logger slog.Logger,
 ) (*FileWatcher, error) {
+	fwCtx, cancel := context.WithCancel(ctx)
 	return &FileWatcher{
 		fileConfig: fileConfig,
-		ctx:        ctx,
+		ctx:        fwCtx,
+		Cancel:     cancel,
 
 		filename: filename,
 		hostName: hostName,
@@ -358,6 +498,9 @@ func NewFileWatcher(
 		readBuf:       make([]byte, 4096),
 		workingBuf:    make([]byte, 0, 4096),
 
+		registry:           registry,
+		checkpointInterval: defaultCheckpointInterval,
+
 		logger: logger,
 	}, nil
 }
@@ -367,6 +510,8 @@ func (fw *FileWatcher) Start() {
 	if fw.fileConfig.FileParser == nil {
 		fw.logger.Warn("FileParser is nil. will not watch this file. review your configuration to make sure that this file has an associated file type with a parser configured.",
 			slog.String("fileName", fw.filename))
+		// Nothing would receive commands sent to the watcher
+		fw.Cancel()
 		return
 	}
 	ticker := time.NewTicker(fw.fileConfig.ReadInterval)
@@ -374,68 +519,581 @@ func (fw *FileWatcher) Start() {
 	for {
 		select {
 		case <-fw.ctx.Done():
+			fw.close()
 			return
 		case cmd := <-fw.commands:
-			if cmd == CommandReopen && fw.file != nil {
-				fw.readToEnd()
-				fw.file.Close()
-				fw.file = nil
+			if cmd == CommandReloadConfig {
+				fw.reloadConfig()
+				ticker.Reset(fw.fileConfig.ReadInterval)
 			}
+			// The file is checked below without waiting for the next tick
 		case <-ticker.C: // Proceed
 		}
+		if fw.completed != nil && !fw.completedFileReplaced() {
+			fw.checkpoint(time.Now())
+			continue
+		}
+		if fw.file != nil && fw.waitingFor == nil && fw.compression == "" {
+			fw.checkFile()
+		}
 		if fw.file == nil {
-			f, err := os.Open(fw.filename)
-			if err != nil {
-				fw.logger.Warn("error opening file, will retry later",
-					slog.String("fileName", fw.filename))
+			fw.open()
+		}
+		if fw.waitingFor != nil {
+			fw.takeOver()
+		}
+		if fw.file != nil && fw.waitingFor == nil {
+			if fw.compression != "" {
+				fw.readCompressed()
 			} else {
-				fw.file = f
-				fw.currentSourceId = uuid.NewString()
-				fw.currentOffset = 0
-				fw.workingBuf = fw.workingBuf[:0]
-				fw.logger.Info("opened file",
-					slog.String("fileName", fw.filename),
-					slog.String("sourceId", fw.currentSourceId))
+				fw.flushIfQuiet(fw.read(), time.Now())
+				fw.updateFingerprint()
 			}
+			fw.checkpoint(time.Now())
+		}
+	}
+}
+
+// reloadConfig starts using the config in newFileConfig.
+func (fw *FileWatcher) reloadConfig() {
+	if fw.newFileConfig == nil {
+		return
+	}
+	if fw.newFileConfig.FileParser == nil {
+		fw.logger.Warn("FileParser is nil in the new config. will keep using the old config for this file. review your configuration to make sure that this file has an associated file type with a parser configured.",
+			slog.String("fileName", fw.filename))
+		fw.newFileConfig = nil
+		return
+	}
+	fw.logger.Info("reloading config for file",
+		slog.String("fileName", fw.filename))
+	fw.fileConfig = *fw.newFileConfig
+	fw.newFileConfig = nil
+}
+
+// open opens the file and finds out where to start reading it using the registry.
+func (fw *FileWatcher) open() {
+	f, err := os.Open(fw.filename)
+	if err != nil {
+		// Rotated files are often removed, so the error is only logged once until the file can be opened again
+		if !fw.openFailed {
+			fw.logger.Warn("error opening file, will retry later",
+				slog.String("fileName", fw.filename),
+				slog.Any("error", err))
+			fw.openFailed = true
+		}
+		return
+	}
+	fw.openFailed = false
+	state, err := getFileState(f)
+	if err != nil {
+		fw.logger.Warn("failed to get state of file, will retry later",
+			slog.String("fileName", fw.filename),
+			slog.Any("error", err))
+		f.Close()
+		return
+	}
+	prefix, err := readPrefix(f, fingerprintSize)
+	if err != nil {
+		fw.logger.Warn("failed to read start of file, will retry later",
+			slog.String("fileName", fw.filename),
+			slog.Any("error", err))
+		f.Close()
+		return
+	}
+	var reader io.Reader = f
+	compression := detectCompression(fw.filename, prefix)
+	if compression != "" {
+		reader, prefix = fw.openCompressed(f, compression, state, prefix)
+		if reader == nil {
+			f.Close()
+			return
+		}
+		state.compressed = true
+	}
+	entry, resumed, wait := fw.registry.claim(fw.filename, state, prefix)
+	fw.file = f
+	fw.reader = reader
+	fw.compression = compression
+	fw.fileState = state
+	fw.lastSize = state.size
+	fw.workingBuf = fw.workingBuf[:0]
+	if wait != nil {
+		fw.logger.Info("file has the same contents as a file which is being read, will wait until that file has been read",
+			slog.String("fileName", fw.filename),
+			slog.String("otherFileName", wait.path))
+		fw.waitingFor = wait
+		return
+	}
+	fw.start(entry, resumed)
+}
+
+// openCompressed returns a reader for the decompressed contents of the compressed file f, and the start of the decompressed contents.
+// It returns a nil reader if the file should not be read yet, or if it cannot be read at all.
+func (fw *FileWatcher) openCompressed(f *os.File, compression string, state fileState, rawPrefix []byte) (io.Reader, []byte) {
+	fp := hashPrefix(rawPrefix)
+	if bytes.Equal(fp, fw.ignoredFingerprint) {
+		return nil, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		fw.logger.Warn("failed to get file info, will retry later",
+			slog.String("fileName", fw.filename),
+			slog.Any("error", err))
+		return nil, nil
+	}
+	// Compressed files are usually written all at once, for example when logrotate compresses a rotated file. Reading is put off until
+	// the file has not been modified for a while, so that it is not read while it is being written.
+	if state.size == 0 || time.Since(fi.ModTime()) < fw.compressedFileSettleTime() {
+		return nil, nil
+	}
+	r, err := newDecompressor(compression, f)
+	if err != nil {
+		fw.logger.Warn("file is compressed and cannot be read",
+			slog.String("fileName", fw.filename),
+			slog.String("compression", compression),
+			slog.Any("error", err))
+		fw.ignoredFingerprint = fp
+		return nil, nil
+	}
+	// Errors are returned again by the decompressor when the rest of the file is read
+	prefix := make([]byte, fingerprintSize)
+	n, _ := io.ReadFull(r, prefix)
+	prefix = prefix[:n]
+	return io.MultiReader(bytes.NewReader(prefix), r), prefix
+}
+
+func (fw *FileWatcher) compressedFileSettleTime() time.Duration {
+	return rotatedFileReads * fw.fileConfig.ReadInterval
+}
+
+// takeOver starts reading the file once the entry it was waiting for has been released.
+func (fw *FileWatcher) takeOver() {
+	state, err := getFileState(fw.file)
+	if err != nil {
+		fw.logger.Warn("failed to get state of file",
+			slog.String("fileName", fw.filename),
+			slog.Any("error", err))
+		return
+	}
+	state.compressed = fw.compression != ""
+	previousPath := fw.waitingFor.path
+	if !fw.registry.tryClaim(fw.waitingFor, fw.filename, state) {
+		return
+	}
+	fw.logger.Info("other file has been read, will continue reading where it stopped",
+		slog.String("fileName", fw.filename),
+		slog.String("otherFileName", previousPath))
+	entry := fw.waitingFor
+	fw.waitingFor = nil
+	fw.fileState = state
+	fw.lastSize = state.size
+	fw.start(entry, true)
+}
+
+// start begins reading the file as the claimed entry. If resumed is true, reading continues from the entry's offset using the entry's
+// source ID.
+func (fw *FileWatcher) start(e *fileEntry, resumed bool) {
+	fw.entry = e
+	fw.currentSourceId = e.sourceId
+	fw.currentOffset = 0
+	fw.fingerprint = e.fingerprint
+	fw.fingerprintSize = e.fingerprintSize
+	fw.lastCheckpoint = time.Time{}
+	fw.pendingOffset = 0
+	fw.savedOffset = -1
+	if resumed && fw.compression != "" {
+		// Compressed files cannot be seeked in, so the contents which have already been read are decompressed and skipped. If the
+		// file ends before the offset, or the contents cannot be decompressed, the file is finished when it is read.
+		if !e.complete {
+			_, _ = io.CopyN(io.Discard, fw.reader, e.offset)
 		}
-		if fw.file != nil {
-			fw.readToEnd()
+		fw.currentOffset = e.offset
+		fw.pendingOffset = e.offset
+	} else if resumed {
+		// A copy of a file may be smaller than the offset the file was read to, if the file was written to after it was copied
+		offset := min(e.offset, fw.fileState.size)
+		_, err := fw.file.Seek(offset, io.SeekStart)
+		if err != nil {
+			fw.logger.Warn("failed to seek to offset, will read file from the start",
+				slog.String("fileName", fw.filename),
+				slog.Int64("offset", offset),
+				slog.Any("error", err))
+		} else {
+			fw.currentOffset = offset
+			fw.pendingOffset = offset
 		}
+	} else if fw.compression == "" {
+		fw.logChangedSinceCheckpoint()
+	}
+	fw.logger.Info("opened file",
+		slog.String("fileName", fw.filename),
+		slog.String("sourceId", fw.currentSourceId),
+		slog.Int64("offset", fw.currentOffset))
+}
+
+// logChangedSinceCheckpoint logs why the checkpoint for the path could not be used, if there is one.
+func (fw *FileWatcher) logChangedSinceCheckpoint() {
+	if fw.registry.checkpoints == nil {
+		return
+	}
+	cp, err := fw.registry.checkpoints.Get(fw.hostName, fw.filename)
+	if err != nil {
+		fw.logger.Warn("failed to get checkpoint",
+			slog.String("fileName", fw.filename),
+			slog.Any("error", err))
+		return
+	}
+	if cp == nil {
+		return
+	}
+	reason, err := checkpointMismatch(cp, fw.file, fw.fileState)
+	if err != nil {
+		fw.logger.Warn("failed to compare file to checkpoint",
+			slog.String("fileName", fw.filename),
+			slog.Any("error", err))
+		return
+	}
+	if reason != "" {
+		fw.logger.Info("file has changed since the checkpoint was written, will read file from the start",
+			slog.String("fileName", fw.filename),
+			slog.String("reason", reason),
+			slog.Int64("checkpointOffset", cp.Offset),
+			slog.Int64("fileSize", fw.fileState.size))
+	}
+}
+
+// checkFile handles the file being truncated, or the path being moved or removed, since the file was last read.
+func (fw *FileWatcher) checkFile() {
+	fi, err := fw.file.Stat()
+	if err != nil {
+		fw.logger.Warn("failed to get file info",
+			slog.String("fileName", fw.filename),
+			slog.Any("error", err))
+		return
+	}
+	pi, err := os.Stat(fw.filename)
+	if err != nil || !os.SameFile(fi, pi) {
+		fw.logger.Info("file has been moved or removed, will read it until it is no longer written to",
+			slog.String("fileName", fw.filename),
+			slog.String("sourceId", fw.currentSourceId))
+		fw.read()
+		fw.drainInBackground()
+		return
+	}
+	truncated := fi.Size() < fw.currentOffset+int64(len(fw.workingBuf))
+	if !truncated && fi.Size() != fw.lastSize && fw.fingerprintSize > 0 {
+		// The file may have been truncated and written to again since it was last checked
+		fp, _, err := fingerprint(fw.file, fw.fingerprintSize)
+		truncated = err == nil && !bytes.Equal(fp, fw.fingerprint)
+	}
+	fw.lastSize = fi.Size()
+	if truncated {
+		fw.restart(fi.Size())
 	}
 }
 
-func (fw *FileWatcher) readToEnd() {
-	for read, err := fw.file.Read(fw.readBuf); read != 0; read, err = fw.file.Read(fw.readBuf) {
-		if err != nil && err != io.EOF {
-			fw.logger.Error("Unexpected error, will abort FileWatcher",
+// restart reads the file from the start with a new source ID after it has been truncated.
+func (fw *FileWatcher) restart(size int64) {
+	_, err := fw.file.Seek(0, io.SeekStart)
+	if err != nil {
+		fw.logger.Warn("failed to seek to start of truncated file, will reopen file",
+			slog.String("fileName", fw.filename),
+			slog.Any("error", err))
+		fw.close()
+		return
+	}
+	prefix, err := readPrefix(fw.file, fingerprintSize)
+	if err != nil {
+		fw.logger.Warn("failed to read start of truncated file, will reopen file",
+			slog.String("fileName", fw.filename),
+			slog.Any("error", err))
+		fw.close()
+		return
+	}
+	oldSourceId := fw.currentSourceId
+	fw.fileState.size = size
+	entry := fw.registry.replace(fw.entry, fw.currentOffset, fw.filename, fw.fileState, prefix)
+	fw.workingBuf = fw.workingBuf[:0]
+	fw.start(entry, false)
+	fw.logger.Info("file has been truncated, will read it from the start",
+		slog.String("fileName", fw.filename),
+		slog.String("oldSourceId", oldSourceId),
+		slog.String("sourceId", fw.currentSourceId))
+}
+
+// drainInBackground hands the open file over to a new FileWatcher which keeps reading it until nothing has been written to it for
+// rotatedFileReads read intervals. The file is released in the registry afterwards, so that a FileWatcher for the file's new path can
+// continue reading it.
+func (fw *FileWatcher) drainInBackground() {
+	d := &FileWatcher{
+		fileConfig: fw.fileConfig,
+		ctx:        fw.ctx,
+
+		filename: fw.filename,
+		hostName: fw.hostName,
+
+		eventPublisher: fw.eventPublisher,
+		file:           fw.file,
+		reader:         fw.reader,
+
+		currentSourceId: fw.currentSourceId,
+		currentOffset:   fw.currentOffset,
+		readBuf:         make([]byte, 4096),
+		workingBuf:      fw.workingBuf,
+		lastRead:        fw.lastRead,
+
+		registry: fw.registry,
+		entry:    fw.entry,
+
+		logger: fw.logger,
+	}
+	go d.drain()
+	fw.file = nil
+	fw.reader = nil
+	fw.entry = nil
+	fw.workingBuf = make([]byte, 0, 4096)
+}
+
+func (fw *FileWatcher) drain() {
+	ticker := time.NewTicker(fw.fileConfig.ReadInterval)
+	defer ticker.Stop()
+	for quietReads := 0; quietReads < rotatedFileReads; {
+		select {
+		case <-fw.ctx.Done():
+			fw.close()
+			return
+		case <-ticker.C:
+		}
+		read := fw.read()
+		fw.flushIfQuiet(read, time.Now())
+		if read > 0 {
+			quietReads = 0
+		} else {
+			quietReads++
+		}
+	}
+	if fw.fileConfig.FileParser.FlushTimeout() > 0 {
+		// The last multiline event of the file would otherwise be lost
+		fw.flushRemainder()
+	}
+	fw.logger.Info("finished reading moved or removed file",
+		slog.String("fileName", fw.filename),
+		slog.String("sourceId", fw.currentSourceId),
+		slog.Int64("offset", fw.currentOffset))
+	fw.close()
+}
+
+// close closes the file and releases it in the registry.
+func (fw *FileWatcher) close() {
+	if fw.file == nil {
+		return
+	}
+	if fw.entry != nil {
+		fw.registry.release(fw.entry, fw.currentOffset)
+		fw.entry = nil
+	}
+	fw.waitingFor = nil
+	fw.file.Close()
+	fw.file = nil
+	fw.reader = nil
+}
+
+// readCompressed reads a compressed file to its end and finishes it in the registry, so that it is not read again. The file is closed
+// afterwards, and the path is not opened again until it refers to another file.
+func (fw *FileWatcher) readCompressed() {
+	fi, err := fw.file.Stat()
+	if err != nil {
+		fw.logger.Warn("failed to get file info, will retry later",
+			slog.String("fileName", fw.filename),
+			slog.Any("error", err))
+		fw.close()
+		return
+	}
+	if fw.entry.complete {
+		fw.logger.Info("compressed file has already been read, will not read it again",
+			slog.String("fileName", fw.filename),
+			slog.String("sourceId", fw.currentSourceId))
+	} else {
+		_, err := fw.readToEnd()
+		if err != nil && time.Since(fi.ModTime()) < fw.compressedFileSettleTime() {
+			fw.logger.Info("failed to decompress file which has been modified recently, will read the rest of it later",
+				slog.String("fileName", fw.filename),
+				slog.Int64("offset", fw.currentOffset),
+				slog.Any("error", err))
+			fw.close()
+			return
+		}
+		if err != nil {
+			fw.logger.Warn("failed to decompress file, the rest of the file will not be read",
 				slog.String("fileName", fw.filename),
+				slog.Int64("offset", fw.currentOffset),
 				slog.Any("error", err))
-			break
 		}
-		fw.workingBuf = append(fw.workingBuf, fw.readBuf[:read]...)
-		if fw.fileConfig.FileParser.CanSplit(fw.workingBuf) {
-			fw.handleEvents()
+		// The file will not be written to again, so whatever follows the last event delimiter is the last event
+		fw.flushRemainder()
+		fw.logger.Info("finished reading compressed file",
+			slog.String("fileName", fw.filename),
+			slog.String("sourceId", fw.currentSourceId),
+			slog.Int64("offset", fw.currentOffset))
+	}
+	fw.registry.finish(fw.entry, fw.currentOffset)
+	fw.entry = nil
+	fw.file.Close()
+	fw.file = nil
+	fw.reader = nil
+	fw.completed = fi
+}
+
+// completedFileReplaced returns true if the path refers to another file than the compressed file which has been read to its end.
+func (fw *FileWatcher) completedFileReplaced() bool {
+	fi, err := os.Stat(fw.filename)
+	if err != nil || os.SameFile(fi, fw.completed) {
+		return false
+	}
+	fw.completed = nil
+	return true
+}
+
+// updateFingerprint extends the fingerprint of the file as it grows, until it covers fingerprintSize bytes.
+func (fw *FileWatcher) updateFingerprint() {
+	if fw.fingerprintSize >= fingerprintSize || fw.currentOffset+int64(len(fw.workingBuf)) <= fw.fingerprintSize {
+		return
+	}
+	fp, n, err := fingerprint(fw.file, fingerprintSize)
+	if err != nil {
+		fw.logger.Warn("failed to update fingerprint",
+			slog.String("fileName", fw.filename),
+			slog.Any("error", err))
+		return
+	}
+	fw.fingerprint = fp
+	fw.fingerprintSize = n
+	fw.registry.update(fw.entry, fp, n)
+}
+
+// checkpoint writes the offset that had been read when checkpoint was previously called, if checkpointInterval has passed since then.
+func (fw *FileWatcher) checkpoint(now time.Time) {
+	if fw.registry.checkpoints == nil || now.Sub(fw.lastCheckpoint) < fw.checkpointInterval {
+		return
+	}
+	if fw.pendingOffset != fw.savedOffset {
+		err := fw.writeCheckpoint(fw.pendingOffset, now)
+		if err != nil {
+			fw.logger.Warn("failed to write checkpoint",
+				slog.String("fileName", fw.filename),
+				slog.Int64("offset", fw.pendingOffset),
+				slog.Any("error", err))
+		} else {
+			fw.savedOffset = fw.pendingOffset
+		}
+	}
+	fw.pendingOffset = fw.currentOffset
+	fw.lastCheckpoint = now
+}
+
+func (fw *FileWatcher) writeCheckpoint(offset int64, now time.Time) error {
+	cp := checkpoints.Checkpoint{
+		Host:            fw.hostName,
+		Path:            fw.filename,
+		Fingerprint:     fw.fingerprint,
+		FingerprintSize: fw.fingerprintSize,
+		Offset:          offset,
+		Complete:        fw.completed != nil && offset == fw.currentOffset,
+		SourceId:        fw.currentSourceId,
+		Updated:         now,
+	}
+	if fw.fileState.hasIdentity {
+		cp.Device = fw.fileState.device
+		cp.Inode = fw.fileState.inode
+	}
+	return fw.registry.checkpoints.Put(cp)
+}
+
+// read reads the file until EOF and publishes the events in it, logging any error. Returns the number of bytes read.
+func (fw *FileWatcher) read() int64 {
+	total, err := fw.readToEnd()
+	if err != nil {
+		fw.logger.Error("got error when reading file",
+			slog.String("fileName", fw.filename),
+			slog.Any("error", err))
+	}
+	return total
+}
+
+// readToEnd reads the file until EOF and publishes the events in it. Returns the number of bytes read.
+func (fw *FileWatcher) readToEnd() (int64, error) {
+	total := int64(0)
+	for {
+		read, err := fw.reader.Read(fw.readBuf)
+		if read > 0 {
+			total += int64(read)
+			fw.workingBuf = append(fw.workingBuf, fw.readBuf[:read]...)
+			if fw.fileConfig.FileParser.CanSplit(fw.workingBuf) {
+				fw.handleEvents()
+			}
+		}
+		if err == io.EOF || (err == nil && read == 0) {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
 		}
 	}
 }
 
+// flushRemainder publishes the bytes after the last event which has been published as events, since nothing more will be appended to them.
+func (fw *FileWatcher) flushRemainder() {
+	if len(fw.workingBuf) == 0 {
+		return
+	}
+	s := string(fw.workingBuf)
+	fw.publish(fw.fileConfig.FileParser.Flush(s).Events)
+	fw.currentOffset += int64(len(s))
+	fw.workingBuf = fw.workingBuf[:0]
+}
+
+// flushIfQuiet flushes the remainder once nothing has been read for the parser's FlushTimeout, so that the last event of a file which
+// is not written to is not held back. read is the number of bytes which were just read.
+func (fw *FileWatcher) flushIfQuiet(read int64, now time.Time) {
+	if read > 0 {
+		fw.lastRead = now
+		return
+	}
+	timeout := fw.fileConfig.FileParser.FlushTimeout()
+	if timeout > 0 && len(fw.workingBuf) > 0 && now.Sub(fw.lastRead) >= timeout {
+		fw.flushRemainder()
+	}
+}
+
 func (fw *FileWatcher) handleEvents() {
 	s := string(fw.workingBuf)
 	// TODO: Maybe EventDelimiter should just be a string so we don't have to do this
 	// Currently the delimiter between each event could in theory have a different length every time
 	// so we need to look them up to get the offset right
 	splitResult := fw.fileConfig.FileParser.Split(s)
-	for _, res := range splitResult.Events {
+	fw.publish(splitResult.Events)
+	fw.currentOffset += int64(len(s) - len(splitResult.Remainder))
+	fw.workingBuf = fw.workingBuf[:0]
+	fw.workingBuf = append(fw.workingBuf, []byte(splitResult.Remainder)...)
+}
+
+// publish publishes events whose offsets are relative to currentOffset.
+func (fw *FileWatcher) publish(evts []parser.RawParserEvent) {
+	// A fingerprint of a shorter prefix is not included, since different files often start with the same header lines
+	var fp []byte
+	if fw.fingerprintSize >= fingerprintSize {
+		fp = fw.fingerprint
+	}
+	for _, res := range evts {
 		evt := events.RawEvent{
-			Raw:      res.Raw,
-			Host:     fw.hostName,
-			Source:   fw.filename,
-			SourceId: fw.currentSourceId,
-			Offset:   fw.currentOffset,
+			Raw:         res.Raw,
+			Host:        fw.hostName,
+			Source:      fw.filename,
+			SourceId:    fw.currentSourceId,
+			Offset:      fw.currentOffset + res.Offset,
+			Fingerprint: fp,
 		}
-		fw.eventPublisher.PublishEvent(evt, fw.fileConfig.TimeLayout, fw.fileConfig.FileParser)
-		fw.currentOffset += res.Offset
+		fw.eventPublisher.PublishEvent(evt, fw.fileConfig.TimeLayout, fw.fileConfig.FileParser, fw.fileConfig.IndexedFields, fw.fileConfig.Index)
 	}
-	fw.workingBuf = fw.workingBuf[:0]
-	fw.workingBuf = append(fw.workingBuf, []byte(splitResult.Remainder)...)
 }
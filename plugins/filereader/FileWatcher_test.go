@@ -0,0 +1,305 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filereader
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/checkpoints"
+	"github.com/jackbister/logsuck/pkg/logsuck/config"
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/indexedfiles"
+	"github.com/jackbister/logsuck/pkg/logsuck/parser"
+)
+
+func TestFileWatcherOffsets(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "log.txt")
+	writeFile(t, fileName, "aa\nb\nccc\ndddd\n")
+
+	pub, _ := runFileWatcher(t, fileName, nil, 4)
+
+	expected := []int64{0, 3, 5, 9}
+	for i, evt := range pub.get() {
+		if evt.Offset != expected[i] {
+			t.Fatalf("got unexpected offset for event %v with raw=%q, expected=%v, got=%v", i, evt.Raw, expected[i], evt.Offset)
+		}
+	}
+}
+
+func TestFileWatcherFingerprintsEvents(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "log.txt")
+	writeFile(t, fileName, "#Software: header\n")
+	pub, _ := runFileWatcher(t, fileName, nil, 1)
+	if fp := pub.get()[0].Fingerprint; fp != nil {
+		t.Fatalf("expected event read before the file could be fingerprinted to not have a fingerprint, got %x", fp)
+	}
+
+	appendFile(t, fileName, lines("a", 20))
+	waitForEvents(t, pub, 21)
+	appendFile(t, fileName, "last\n")
+	waitForEvents(t, pub, 22)
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("got error when reading file: %v", err)
+	}
+	evts := pub.get()
+	if fp := evts[len(evts)-1].Fingerprint; !bytes.Equal(fp, hashPrefix(b[:fingerprintSize])) {
+		t.Fatalf("expected event to have the fingerprint of the first %v bytes of the file, got %x", fingerprintSize, fp)
+	}
+}
+
+func TestFileWatcherResumesFromCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "log.txt")
+	repo, err := NewFileCheckpointRepository(filepath.Join(dir, "checkpoints.json"))
+	if err != nil {
+		t.Fatalf("got error when creating checkpoint repository: %v", err)
+	}
+	writeFile(t, fileName, "a\nb\n")
+	first, stop := runFileWatcher(t, fileName, repo, 2)
+	waitForCheckpoint(t, repo, fileName, 4)
+	stop()
+
+	appendFile(t, fileName, "c\n")
+	// A repository read from the state file is used to make sure that the checkpoint survives a restart
+	repo, err = NewFileCheckpointRepository(filepath.Join(dir, "checkpoints.json"))
+	if err != nil {
+		t.Fatalf("got error when reading checkpoint repository: %v", err)
+	}
+	second, _ := runFileWatcher(t, fileName, repo, 1)
+	waitForCheckpoint(t, repo, fileName, 6)
+
+	evts := second.get()
+	if evts[0].Raw != "c" || evts[0].Offset != 4 {
+		t.Fatalf("expected reading to resume at offset 4, got raw=%q offset=%v", evts[0].Raw, evts[0].Offset)
+	}
+	if evts[0].SourceId != first.get()[0].SourceId {
+		t.Fatalf("expected source ID to be kept after resuming, got %v and %v", first.get()[0].SourceId, evts[0].SourceId)
+	}
+}
+
+func TestFileWatcherDetectsChangedFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		change    func(t *testing.T, fileName string)
+		numEvents int
+	}{
+		{
+			name: "truncated",
+			change: func(t *testing.T, fileName string) {
+				writeFile(t, fileName, "d\n")
+			},
+			numEvents: 1,
+		},
+		{
+			name: "replaced",
+			change: func(t *testing.T, fileName string) {
+				err := os.Remove(fileName)
+				if err != nil {
+					t.Fatalf("got error when removing file: %v", err)
+				}
+				writeFile(t, fileName, "d\ne\nf\ng\n")
+			},
+			numEvents: 4,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fileName := filepath.Join(dir, "log.txt")
+			repo, err := NewFileCheckpointRepository(filepath.Join(dir, "checkpoints.json"))
+			if err != nil {
+				t.Fatalf("got error when creating checkpoint repository: %v", err)
+			}
+			writeFile(t, fileName, "a\nb\nc\n")
+			first, stop := runFileWatcher(t, fileName, repo, 3)
+			waitForCheckpoint(t, repo, fileName, 6)
+			stop()
+
+			tt.change(t, fileName)
+			second, _ := runFileWatcher(t, fileName, repo, tt.numEvents)
+
+			evts := second.get()
+			if evts[0].Raw != "d" || evts[0].Offset != 0 {
+				t.Fatalf("expected changed file to be read from the start, got raw=%q offset=%v", evts[0].Raw, evts[0].Offset)
+			}
+			if evts[0].SourceId == first.get()[0].SourceId {
+				t.Fatalf("expected changed file to get a new source ID, got %v", evts[0].SourceId)
+			}
+		})
+	}
+}
+
+func TestFileWatcherMultilineEvents(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "log.txt")
+	writeFile(t, fileName, "ERROR a\n\tat b\nINFO c\nERROR d\n\tat e\n")
+	fileParser := &parser.RegexFileParser{
+		Cfg: config.RegexParserConfig{
+			EventDelimiter: regexp.MustCompile("\n"),
+			Multiline: &config.MultilineConfig{
+				LineStartPattern: regexp.MustCompile("^[A-Z]+ "),
+				FlushTimeout:     200 * time.Millisecond,
+			},
+		},
+		Logger: slog.Default(),
+	}
+
+	start := time.Now()
+	pub, _ := runFileWatcherWithParser(t, fileName, fileParser, nil, 2)
+	// The last event is only published once the flush timeout has passed without anything being written to the file
+	waitForEvents(t, pub, 3)
+	if time.Since(start) < 200*time.Millisecond {
+		t.Fatalf("expected the last event to be published after the flush timeout")
+	}
+	evts := pub.get()
+	expected := []events.RawEvent{
+		{Raw: "ERROR a\n\tat b", Offset: 0},
+		{Raw: "INFO c", Offset: 14},
+		{Raw: "ERROR d\n\tat e", Offset: 21},
+	}
+	for i, e := range expected {
+		if evts[i].Raw != e.Raw || evts[i].Offset != e.Offset {
+			t.Fatalf("got unexpected event at index %v, expected raw=%q offset=%v, got raw=%q offset=%v", i, e.Raw, e.Offset, evts[i].Raw, evts[i].Offset)
+		}
+	}
+}
+
+type recordingPublisher struct {
+	mu   sync.Mutex
+	evts []events.RawEvent
+}
+
+func (p *recordingPublisher) PublishEvent(evt events.RawEvent, _ string, _ parser.FileParser, _ []string, _ string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.evts = append(p.evts, evt)
+}
+
+func (p *recordingPublisher) get() []events.RawEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ret := make([]events.RawEvent, len(p.evts))
+	copy(ret, p.evts)
+	return ret
+}
+
+// runFileWatcher starts a FileWatcher for the file and waits until it has published numEvents events. The returned function stops the
+// FileWatcher and waits for it to return. It is also called when the test finishes.
+func runFileWatcher(t *testing.T, fileName string, repo checkpoints.Repository, numEvents int) (*recordingPublisher, func()) {
+	t.Helper()
+	fileParser := &parser.RegexFileParser{
+		Cfg: config.RegexParserConfig{
+			EventDelimiter: regexp.MustCompile("\n"),
+		},
+		Logger: slog.Default(),
+	}
+	return runFileWatcherWithParser(t, fileName, fileParser, repo, numEvents)
+}
+
+// runFileWatcherWithParser is like runFileWatcher, but splits the file into events using fileParser.
+func runFileWatcherWithParser(t *testing.T, fileName string, fileParser parser.FileParser, repo checkpoints.Repository, numEvents int) (*recordingPublisher, func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}
+	t.Cleanup(stop)
+	pub := &recordingPublisher{}
+	fileConfig := indexedfiles.IndexedFileConfig{
+		Filename:     fileName,
+		FileParser:   fileParser,
+		ReadInterval: 10 * time.Millisecond,
+	}
+	registry, err := NewFileRegistry("localhost", repo, slog.Default())
+	if err != nil {
+		t.Fatalf("got error when creating FileRegistry: %v", err)
+	}
+	fw, err := NewFileWatcher(fileConfig, fileName, "localhost", pub, registry, ctx, *slog.Default())
+	if err != nil {
+		t.Fatalf("got error when creating FileWatcher: %v", err)
+	}
+	fw.checkpointInterval = 0
+	go func() {
+		fw.Start()
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(pub.get()) < numEvents {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v events, got %v", numEvents, len(pub.get()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(pub.get()) != numEvents {
+		t.Fatalf("expected %v events, got %v", numEvents, pub.get())
+	}
+	return pub, stop
+}
+
+func waitForCheckpoint(t *testing.T, repo checkpoints.Repository, fileName string, offset int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cp, err := repo.Get("localhost", fileName)
+		if err != nil {
+			t.Fatalf("got error when getting checkpoint: %v", err)
+		}
+		if cp != nil && cp.Offset == offset {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for checkpoint with offset=%v, got %+v", offset, cp)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func writeFile(t *testing.T, fileName string, s string) {
+	t.Helper()
+	err := os.WriteFile(fileName, []byte(s), 0644)
+	if err != nil {
+		t.Fatalf("got error when writing file: %v", err)
+	}
+}
+
+func appendFile(t *testing.T, fileName string, s string) {
+	t.Helper()
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("got error when opening file: %v", err)
+	}
+	defer f.Close()
+	_, err = f.WriteString(s)
+	if err != nil {
+		t.Fatalf("got error when appending to file: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filereader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecursiveGlob(t *testing.T) {
+	dir := t.TempDir()
+	mkdir(t, filepath.Join(dir, "a", "b"))
+	writeFile(t, filepath.Join(dir, "top.log"), lines("top", 1))
+	writeFile(t, filepath.Join(dir, "a", "b", "nested.log"), lines("nested", 1))
+	writeFile(t, filepath.Join(dir, "a", "b", "nested.txt"), lines("txt", 1))
+	pub := runGlobWatcher(t, filepath.Join(dir, "**", "*.log"), nil)
+	waitForEvents(t, pub, 2)
+
+	writeFile(t, filepath.Join(dir, "a", "created.log"), lines("created", 1))
+	// Files in directories created after the watcher has started are found as well
+	mkdir(t, filepath.Join(dir, "c", "d"))
+	writeFile(t, filepath.Join(dir, "c", "d", "new.log"), lines("new", 1))
+
+	evts := waitForEvents(t, pub, 4)
+	assertRaws(t, evts, splitLines(lines("top", 1)+lines("nested", 1)+lines("created", 1)+lines("new", 1)))
+}
+
+func TestGlobOnlyWatchesDirectoriesWhichCanMatch(t *testing.T) {
+	dir := t.TempDir()
+	mkdir(t, filepath.Join(dir, "other"))
+	writeFile(t, filepath.Join(dir, "other", "app.log"), lines("other", 1))
+	pub := runGlobWatcher(t, filepath.Join(dir, "app*", "*.log"), nil)
+
+	mkdir(t, filepath.Join(dir, "app1"))
+	writeFile(t, filepath.Join(dir, "app1", "app.log"), lines("app1", 1))
+	writeFile(t, filepath.Join(dir, "other", "new.log"), lines("new", 1))
+
+	evts := waitForEvents(t, pub, 1)
+	assertRaws(t, evts, splitLines(lines("app1", 1)))
+}
+
+func TestGlobExclude(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "app.log"), lines("app", 1))
+	writeFile(t, filepath.Join(dir, "app-debug.log"), lines("debug", 1))
+	mkdir(t, filepath.Join(dir, "old"))
+	writeFile(t, filepath.Join(dir, "old", "app.log"), lines("old", 1))
+	pub := runGlobWatcher(t, filepath.Join(dir, "**", "*.log"), nil, "*debug*", filepath.Join(dir, "old", "*"))
+	waitForEvents(t, pub, 1)
+
+	writeFile(t, filepath.Join(dir, "other-debug.log"), lines("debug2", 1))
+	writeFile(t, filepath.Join(dir, "old", "other.log"), lines("old2", 1))
+	writeFile(t, filepath.Join(dir, "other.log"), lines("other", 1))
+
+	evts := waitForEvents(t, pub, 2)
+	assertRaws(t, evts, splitLines(lines("app", 1)+lines("other", 1)))
+}
+
+func TestGlobExcludeUpdatedConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "app.log"), lines("app", 1))
+	writeFile(t, filepath.Join(dir, "app-debug.log"), lines("debug", 1))
+	pub, gw := startGlobWatcher(t, globWatcherConfig(filepath.Join(dir, "*.log")), nil)
+	waitForEvents(t, pub, 2)
+
+	gw.UpdateConfig(globWatcherConfig(filepath.Join(dir, "*.log"), "*debug*"))
+	// Neither files which are already being read nor new files are read if they are excluded by the new config
+	appendFile(t, filepath.Join(dir, "app-debug.log"), lines("debug2", 1))
+	writeFile(t, filepath.Join(dir, "other-debug.log"), lines("debug3", 1))
+	appendFile(t, filepath.Join(dir, "app.log"), lines("app2", 1))
+
+	evts := waitForEvents(t, pub, 3)
+	assertRaws(t, evts, splitLines(lines("app", 1)+lines("debug", 1)+lines("app2", 1)))
+}
+
+func mkdir(t *testing.T, dir string) {
+	t.Helper()
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatalf("got error when creating directory: %v", err)
+	}
+}
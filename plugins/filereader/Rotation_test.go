@@ -0,0 +1,324 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filereader
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/checkpoints"
+	"github.com/jackbister/logsuck/pkg/logsuck/config"
+	"github.com/jackbister/logsuck/pkg/logsuck/indexedfiles"
+	"github.com/jackbister/logsuck/pkg/logsuck/parser"
+)
+
+func TestRotationByRename(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "app.log")
+	writeFile(t, fileName, lines("a", 2))
+	pub := runGlobWatcher(t, filepath.Join(dir, "app.log*"), nil)
+	waitForEvents(t, pub, 2)
+
+	// The program writing the log keeps the old file open for a while after it has been renamed
+	writer, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("got error when opening file: %v", err)
+	}
+	defer writer.Close()
+	rename(t, fileName, fileName+".1")
+	writeString(t, writer, lines("b", 1))
+	writeFile(t, fileName, lines("c", 1))
+	waitForEvents(t, pub, 4)
+	// Written after the watcher for app.log has stopped reading the renamed file, so it is read by the watcher for app.log.1
+	writeString(t, writer, lines("d", 1))
+
+	evts := waitForEvents(t, pub, 5)
+	assertRaws(t, evts, splitLines(lines("a", 2)+lines("b", 1)+lines("c", 1)+lines("d", 1)))
+	assertSameSourceId(t, evts, "a", "b")
+	assertSameSourceId(t, evts, "a", "d")
+	assertDifferentSourceId(t, evts, "a", "c")
+}
+
+func TestRotationByCopyTruncate(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "app.log")
+	writeFile(t, fileName, lines("a", 2))
+	pub := runGlobWatcher(t, filepath.Join(dir, "app.log*"), nil)
+	waitForEvents(t, pub, 2)
+
+	// b is written right before the file is copied and truncated, so it may only be found in the copy
+	appendFile(t, fileName, lines("b", 1))
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("got error when reading file: %v", err)
+	}
+	writeFile(t, fileName+".1", string(b))
+	err = os.Truncate(fileName, 0)
+	if err != nil {
+		t.Fatalf("got error when truncating file: %v", err)
+	}
+	appendFile(t, fileName, lines("c", 1))
+
+	evts := waitForEvents(t, pub, 4)
+	assertRaws(t, evts, splitLines(lines("a", 2)+lines("b", 1)+lines("c", 1)))
+	assertSameSourceId(t, evts, "a", "b")
+	assertDifferentSourceId(t, evts, "a", "c")
+	for _, evt := range evts {
+		if strings.HasPrefix(evt.Raw, "c") && evt.Offset != 0 {
+			t.Fatalf("expected first event after truncation to have offset 0, got %v", evt.Offset)
+		}
+	}
+}
+
+func TestRotationWithCompression(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "app.log")
+	writeFile(t, fileName, lines("a", 2))
+	pub := runGlobWatcher(t, filepath.Join(dir, "app.log*"), nil)
+	waitForEvents(t, pub, 2)
+
+	rename(t, fileName, fileName+".1")
+	writeFile(t, fileName, lines("b", 1))
+	gzipFile(t, fileName+".1")
+
+	evts := waitForEvents(t, pub, 3)
+	assertRaws(t, evts, splitLines(lines("a", 2)+lines("b", 1)))
+}
+
+func TestRotationWhileStopped(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "app.log")
+	repo := &memoryCheckpoints{m: map[string]checkpoints.Checkpoint{}}
+	writeFile(t, fileName, lines("a", 2))
+	_, stop := runFileWatcher(t, fileName, repo, 2)
+	waitForCheckpoint(t, repo, fileName, int64(len(lines("a", 2))))
+	stop()
+
+	rename(t, fileName, fileName+".1")
+	writeFile(t, fileName, lines("b", 1))
+	pub := runGlobWatcher(t, filepath.Join(dir, "app.log*"), repo)
+
+	evts := waitForEvents(t, pub, 1)
+	assertRaws(t, evts, splitLines(lines("b", 1)))
+}
+
+// lines returns n lines starting with prefix which are long enough for files to be recognized by their fingerprint.
+func lines(prefix string, n int) string {
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		sb.WriteString(fmt.Sprintf("%-10s line %v of a log file which is long enough to be fingerprinted\n", prefix, i))
+	}
+	return sb.String()
+}
+
+func splitLines(s string) []string {
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// runGlobWatcher starts a GlobWatcher which is stopped when the test finishes. Files matching any of the exclude patterns are not read.
+func runGlobWatcher(t *testing.T, glob string, repo checkpoints.Repository, exclude ...string) *recordingPublisher {
+	t.Helper()
+	pub, _ := startGlobWatcher(t, globWatcherConfig(glob, exclude...), repo)
+	return pub
+}
+
+func globWatcherConfig(glob string, exclude ...string) indexedfiles.IndexedFileConfig {
+	return indexedfiles.IndexedFileConfig{
+		Filename: glob,
+		Exclude:  exclude,
+		FileParser: &parser.RegexFileParser{
+			Cfg: config.RegexParserConfig{
+				EventDelimiter: regexp.MustCompile("\n"),
+			},
+			Logger: slog.Default(),
+		},
+		ReadInterval: 10 * time.Millisecond,
+	}
+}
+
+// startGlobWatcher starts a GlobWatcher with the given config which is stopped when the test finishes.
+func startGlobWatcher(t *testing.T, fileConfig indexedfiles.IndexedFileConfig, repo checkpoints.Repository) (*recordingPublisher, *GlobWatcher) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	registry, err := NewFileRegistry("localhost", repo, slog.Default())
+	if err != nil {
+		t.Fatalf("got error when creating FileRegistry: %v", err)
+	}
+	pub := &recordingPublisher{}
+	gw, err := NewGlobWatcher(fileConfig, fileConfig.Filename, "localhost", pub, registry, ctx, *slog.Default())
+	if err != nil {
+		t.Fatalf("got error when creating GlobWatcher: %v", err)
+	}
+	err = gw.Start()
+	if err != nil {
+		t.Fatalf("got error when starting GlobWatcher: %v", err)
+	}
+	return pub, gw.(*GlobWatcher)
+}
+
+// waitForEvents waits until numEvents events have been published, and then waits a while longer to make sure that no more events are
+// published.
+func waitForEvents(t *testing.T, pub *recordingPublisher, numEvents int) []eventRaw {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(pub.get()) < numEvents {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v events, got %v", numEvents, pub.get())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(20 * rotatedFileReads * time.Millisecond)
+	evts := pub.get()
+	if len(evts) != numEvents {
+		t.Fatalf("expected %v events, got %v", numEvents, evts)
+	}
+	ret := make([]eventRaw, len(evts))
+	for i, evt := range evts {
+		ret[i] = eventRaw{Raw: evt.Raw, SourceId: evt.SourceId, Offset: evt.Offset}
+	}
+	return ret
+}
+
+type eventRaw struct {
+	Raw      string
+	SourceId string
+	Offset   int64
+}
+
+func assertRaws(t *testing.T, evts []eventRaw, expected []string) {
+	t.Helper()
+	got := make([]string, len(evts))
+	for i, evt := range evts {
+		got[i] = evt.Raw
+	}
+	sort.Strings(got)
+	sorted := append([]string{}, expected...)
+	sort.Strings(sorted)
+	if strings.Join(got, "\n") != strings.Join(sorted, "\n") {
+		t.Fatalf("got unexpected events, expected=%q, got=%q", sorted, got)
+	}
+}
+
+func sourceIdOf(t *testing.T, evts []eventRaw, prefix string) string {
+	t.Helper()
+	for _, evt := range evts {
+		if strings.HasPrefix(evt.Raw, prefix) {
+			return evt.SourceId
+		}
+	}
+	t.Fatalf("did not find event starting with %q in %v", prefix, evts)
+	return ""
+}
+
+func assertSameSourceId(t *testing.T, evts []eventRaw, prefix1, prefix2 string) {
+	t.Helper()
+	if sourceIdOf(t, evts, prefix1) != sourceIdOf(t, evts, prefix2) {
+		t.Fatalf("expected events starting with %q and %q to have the same source ID, got %v", prefix1, prefix2, evts)
+	}
+}
+
+func assertDifferentSourceId(t *testing.T, evts []eventRaw, prefix1, prefix2 string) {
+	t.Helper()
+	if sourceIdOf(t, evts, prefix1) == sourceIdOf(t, evts, prefix2) {
+		t.Fatalf("expected events starting with %q and %q to have different source IDs, got %v", prefix1, prefix2, evts)
+	}
+}
+
+func rename(t *testing.T, from, to string) {
+	t.Helper()
+	err := os.Rename(from, to)
+	if err != nil {
+		t.Fatalf("got error when renaming file: %v", err)
+	}
+}
+
+func writeString(t *testing.T, f *os.File, s string) {
+	t.Helper()
+	_, err := f.WriteString(s)
+	if err != nil {
+		t.Fatalf("got error when writing to file: %v", err)
+	}
+}
+
+// gzipFile compresses the file to fileName.gz and removes the file, like logrotate's compress option.
+func gzipFile(t *testing.T, fileName string) {
+	t.Helper()
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("got error when reading file: %v", err)
+	}
+	f, err := os.Create(fileName + ".gz")
+	if err != nil {
+		t.Fatalf("got error when creating compressed file: %v", err)
+	}
+	defer f.Close()
+	w := gzip.NewWriter(f)
+	_, err = w.Write(b)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		t.Fatalf("got error when compressing file: %v", err)
+	}
+	err = os.Remove(fileName)
+	if err != nil {
+		t.Fatalf("got error when removing file: %v", err)
+	}
+}
+
+type memoryCheckpoints struct {
+	mu sync.Mutex
+	m  map[string]checkpoints.Checkpoint
+}
+
+func (r *memoryCheckpoints) Get(host, path string) (*checkpoints.Checkpoint, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cp, ok := r.m[host+"/"+path]
+	if !ok {
+		return nil, nil
+	}
+	return &cp, nil
+}
+
+func (r *memoryCheckpoints) List(host string) ([]checkpoints.Checkpoint, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := []checkpoints.Checkpoint{}
+	for _, cp := range r.m {
+		if cp.Host == host {
+			ret = append(ret, cp)
+		}
+	}
+	return ret, nil
+}
+
+func (r *memoryCheckpoints) Put(c checkpoints.Checkpoint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.m[c.Host+"/"+c.Path] = c
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/config"
+	"github.com/jackbister/logsuck/pkg/logsuck/util"
+
+	"go.uber.org/dig"
+)
+
+// memoryConfigRepository keeps the latest configuration in memory. Like @logsuck/sqlite_config, it stores the configuration as JSON so
+// that callers can not modify the stored configuration.
+type memoryConfigRepository struct {
+	mu          sync.Mutex
+	jsonString  []byte
+	modified    time.Time
+	broadcaster util.Broadcaster[struct{}]
+
+	logger *slog.Logger
+}
+
+type MemoryConfigRepositoryParams struct {
+	dig.In
+
+	Cfg               *config.Config
+	ForceStaticConfig bool `name:"forceStaticConfig"`
+	Logger            *slog.Logger
+}
+
+// NewMemoryConfigRepository creates a repository containing the static configuration, unless the static configuration is forced in
+// which case the repository starts out empty.
+func NewMemoryConfigRepository(p MemoryConfigRepositoryParams) (config.Repository, error) {
+	ret := &memoryConfigRepository{logger: p.Logger}
+	if !p.ForceStaticConfig {
+		err := ret.upsertInternal(p.Cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize memoryConfigRepository: failed to upsert initial config: %w", err)
+		}
+	}
+	return ret, nil
+}
+
+func (r *memoryConfigRepository) Changes() <-chan struct{} {
+	return r.broadcaster.Subscribe()
+}
+
+func (r *memoryConfigRepository) Get() (*config.ConfigResponse, error) {
+	r.mu.Lock()
+	jsonString, modified := r.jsonString, r.modified
+	r.mu.Unlock()
+	if jsonString == nil {
+		return nil, errors.New("no config has been stored")
+	}
+	cfg, err := config.FromJSON(jsonString, r.logger)
+	if err != nil {
+		return nil, fmt.Errorf("got error when converting JSON config: %w", err)
+	}
+	return &config.ConfigResponse{
+		Cfg:      *cfg,
+		Modified: modified,
+	}, nil
+}
+
+func (r *memoryConfigRepository) Upsert(c *config.Config) error {
+	err := r.upsertInternal(c)
+	if err != nil {
+		return err
+	}
+	r.broadcaster.Broadcast(struct{}{})
+	return nil
+}
+
+func (r *memoryConfigRepository) upsertInternal(c *config.Config) error {
+	jsonString, err := config.ToJSON(c)
+	if err != nil {
+		return fmt.Errorf("failed to serialize config: %w", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.jsonString = jsonString
+	r.modified = time.Now()
+	return nil
+}
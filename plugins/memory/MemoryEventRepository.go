@@ -0,0 +1,279 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/search"
+
+	"go.uber.org/dig"
+)
+
+const filterStreamPageSize = 1000
+
+// memoryEventRepository keeps at most maxEvents events in memory. When more events are added, the events with the lowest IDs, which are
+// the events that were added first, are removed.
+type memoryEventRepository struct {
+	maxEvents int
+
+	metrics *events.IngestionMetrics
+	logger  *slog.Logger
+
+	mu sync.RWMutex
+	// evts is sorted by ID. Deleted events are kept until more than half of the events have been deleted, so that DeleteBatch does not
+	// have to move the other events every time.
+	evts       []memoryEvent
+	numDeleted int
+	nextId     int64
+	keys       map[dedupKey]struct{}
+}
+
+type memoryEvent struct {
+	events.EventWithId
+	deleted bool
+}
+
+// dedupKey is the key used to detect duplicate events, which is the same as the unique key of the Events table used by
+// @logsuck/sqlite_events.
+type dedupKey struct {
+	host      string
+	source    string
+	timestamp time.Time
+	offset    int64
+}
+
+func (evt *memoryEvent) key() dedupKey {
+	return dedupKey{host: evt.Host, source: evt.Source, timestamp: evt.Timestamp, offset: evt.Offset}
+}
+
+type MemoryEventRepositoryParams struct {
+	dig.In
+
+	Cfg     *Config
+	Metrics *events.IngestionMetrics `optional:"true"`
+	Logger  *slog.Logger
+}
+
+func NewMemoryEventRepository(p MemoryEventRepositoryParams) (events.Repository, error) {
+	if p.Cfg.MaxEvents <= 0 {
+		return nil, fmt.Errorf("maxEvents must be positive but is %v", p.Cfg.MaxEvents)
+	}
+	return &memoryEventRepository{
+		maxEvents: p.Cfg.MaxEvents,
+		metrics:   p.Metrics,
+		logger:    p.Logger,
+		nextId:    1,
+		keys:      map[dedupKey]struct{}{},
+	}, nil
+}
+
+func (repo *memoryEventRepository) AddBatch(evts []events.Event) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	duplicates := []events.Event{}
+	for _, evt := range evts {
+		index := evt.Index
+		if index == "" {
+			index = events.DefaultIndex
+		}
+		me := memoryEvent{
+			EventWithId: events.EventWithId{
+				Id:        repo.nextId,
+				Raw:       evt.Raw,
+				Timestamp: evt.Timestamp,
+				Host:      evt.Host,
+				SourceId:  evt.SourceId,
+				Source:    evt.Source,
+				Index:     index,
+				Offset:    evt.Offset,
+			},
+		}
+		k := me.key()
+		if _, ok := repo.keys[k]; ok {
+			duplicates = append(duplicates, evt)
+			continue
+		}
+		repo.keys[k] = struct{}{}
+		repo.evts = append(repo.evts, me)
+		repo.nextId++
+	}
+	repo.metrics.RecordBatch(evts, duplicates)
+	if len(duplicates) > 0 {
+		repo.logger.Info("Skipped adding events as they appear to be duplicates (same source, offset and timestamp as an existing event)",
+			slog.Int("numEvents", len(duplicates)))
+	}
+	numEvicted := 0
+	for len(repo.evts)-repo.numDeleted > repo.maxEvents {
+		if repo.evts[0].deleted {
+			repo.numDeleted--
+		} else {
+			delete(repo.keys, repo.evts[0].key())
+			numEvicted++
+		}
+		repo.evts[0] = memoryEvent{}
+		repo.evts = repo.evts[1:]
+	}
+	if numEvicted > 0 {
+		repo.logger.Info("removed the oldest events since the repository is full",
+			slog.Int("numEvents", numEvicted),
+			slog.Int("maxEvents", repo.maxEvents))
+	}
+	return nil
+}
+
+func (repo *memoryEventRepository) DeleteBatch(ids []int64) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	for _, id := range ids {
+		i, ok := repo.find(id)
+		if !ok {
+			continue
+		}
+		delete(repo.keys, repo.evts[i].key())
+		repo.evts[i] = memoryEvent{EventWithId: events.EventWithId{Id: id}, deleted: true}
+		repo.numDeleted++
+	}
+	if repo.numDeleted > len(repo.evts)/2 {
+		live := make([]memoryEvent, 0, len(repo.evts)-repo.numDeleted)
+		for _, evt := range repo.evts {
+			if !evt.deleted {
+				live = append(live, evt)
+			}
+		}
+		repo.evts = live
+		repo.numDeleted = 0
+	}
+	return nil
+}
+
+// find returns the position of the event with the given ID in evts, or false if it does not exist or has been deleted. The caller must
+// hold mu.
+func (repo *memoryEventRepository) find(id int64) (int, bool) {
+	i := sort.Search(len(repo.evts), func(i int) bool { return repo.evts[i].Id >= id })
+	if i < len(repo.evts) && repo.evts[i].Id == id && !repo.evts[i].deleted {
+		return i, true
+	}
+	return 0, false
+}
+
+func (repo *memoryEventRepository) FilterStream(srch *search.Search, searchStartTime, searchEndTime *time.Time, sortMode events.SortMode) <-chan []events.EventWithId {
+	ret := make(chan []events.EventWithId)
+	m := search.NewMatcher(srch)
+	repo.mu.RLock()
+	matching := []events.EventWithId{}
+	for _, evt := range repo.evts {
+		if evt.deleted ||
+			(searchStartTime != nil && evt.Timestamp.Before(*searchStartTime)) ||
+			(searchEndTime != nil && evt.Timestamp.After(*searchEndTime)) {
+			continue
+		}
+		if m.Matches(evt.Raw, evt.Host, evt.Source, evt.Index) {
+			matching = append(matching, evt.EventWithId)
+		}
+	}
+	repo.mu.RUnlock()
+	sortEvents(matching, sortMode == events.SortModeTimestampAsc)
+	go func() {
+		defer close(ret)
+		for len(matching) > 0 {
+			n := min(len(matching), filterStreamPageSize)
+			ret <- matching[:n:n]
+			matching = matching[n:]
+		}
+	}()
+	return ret
+}
+
+// sortEvents sorts the events by timestamp and then by ID.
+func sortEvents(evts []events.EventWithId, asc bool) {
+	sort.Slice(evts, func(i, j int) bool {
+		if !evts[i].Timestamp.Equal(evts[j].Timestamp) {
+			return evts[i].Timestamp.Before(evts[j].Timestamp) == asc
+		}
+		return (evts[i].Id < evts[j].Id) == asc
+	})
+}
+
+func (repo *memoryEventRepository) GetByIds(ids []int64, sortMode events.SortMode) ([]events.EventWithId, error) {
+	repo.mu.RLock()
+	ret := make([]events.EventWithId, 0, len(ids))
+	seen := make(map[int64]struct{}, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		if i, ok := repo.find(id); ok {
+			ret = append(ret, repo.evts[i].EventWithId)
+		}
+	}
+	repo.mu.RUnlock()
+	if sortMode == events.SortModeTimestampDesc || sortMode == events.SortModeTimestampAsc {
+		sortEvents(ret, sortMode == events.SortModeTimestampAsc)
+	}
+	return ret, nil
+}
+
+// GetSurroundingEvents returns the count/2 events from the same source with offsets after the event, followed by the event itself and
+// the events with offsets before it, up to count/2 events, sorted by descending offset.
+func (repo *memoryEventRepository) GetSurroundingEvents(id int64, count int) ([]events.EventWithId, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	i, ok := repo.find(id)
+	if !ok {
+		return nil, fmt.Errorf("got error when getting source_id and offset for eventId=%v: event not found", id)
+	}
+	sourceId, baseOffset := repo.evts[i].SourceId, repo.evts[i].Offset
+	up := []memoryEvent{}
+	down := []memoryEvent{}
+	for _, evt := range repo.evts {
+		if evt.deleted || evt.SourceId != sourceId {
+			continue
+		}
+		if evt.Offset <= baseOffset {
+			up = append(up, evt)
+		} else {
+			down = append(down, evt)
+		}
+	}
+	sortByOffset(up, false)
+	sortByOffset(down, true)
+	up = up[:min(len(up), count/2)]
+	down = down[:min(len(down), count/2)]
+	ret := make([]events.EventWithId, 0, len(up)+len(down))
+	// down contains the closest events after the base event, which are returned by descending offset like the other events
+	for i := len(down) - 1; i >= 0; i-- {
+		ret = append(ret, down[i].EventWithId)
+	}
+	for _, evt := range up {
+		ret = append(ret, evt.EventWithId)
+	}
+	return ret, nil
+}
+
+func sortByOffset(evts []memoryEvent, asc bool) {
+	sort.Slice(evts, func(i, j int) bool {
+		if evts[i].Offset != evts[j].Offset {
+			return (evts[i].Offset < evts[j].Offset) == asc
+		}
+		return (evts[i].Id < evts[j].Id) == asc
+	})
+}
@@ -0,0 +1,259 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"fmt"
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/search"
+)
+
+func TestAddBatchAndGetByIds(t *testing.T) {
+	repo := createEventRepo(t, 100)
+	err := repo.AddBatch([]events.Event{
+		newEvent("first event", 0, 0),
+		newEvent("second event", 1, 10),
+		newEvent("third event", 2, 20),
+	})
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	evts, err := repo.GetByIds([]int64{3, 1}, events.SortModePreserveArgOrder)
+	if err != nil {
+		t.Fatalf("got error when getting events: %v", err)
+	}
+	assertRaws(t, evts, "third event", "first event")
+	if evts[1].Host != "localhost" || evts[1].Source != "log.txt" || evts[1].SourceId != "source-1" || evts[1].Index != events.DefaultIndex {
+		t.Fatalf("got unexpected event=%+v", evts[1])
+	}
+
+	evts, err = repo.GetByIds([]int64{1, 2, 3, 4}, events.SortModeTimestampDesc)
+	if err != nil {
+		t.Fatalf("got error when getting events: %v", err)
+	}
+	assertRaws(t, evts, "third event", "second event", "first event")
+	evts, err = repo.GetByIds([]int64{3, 2, 1}, events.SortModeTimestampAsc)
+	if err != nil {
+		t.Fatalf("got error when getting events: %v", err)
+	}
+	assertRaws(t, evts, "first event", "second event", "third event")
+}
+
+func TestAddBatchSkipsDuplicates(t *testing.T) {
+	repo := createEventRepo(t, 100)
+	repo.AddBatch([]events.Event{newEvent("an event", 0, 0), newEvent("an event", 0, 0)})
+	repo.AddBatch([]events.Event{newEvent("an event", 0, 0), newEvent("another event", 1, 10)})
+
+	evts := filter(repo, &search.Search{}, events.SortModeTimestampAsc)
+	assertRaws(t, evts, "an event", "another event")
+
+	repo.DeleteBatch([]int64{evts[0].Id})
+	repo.AddBatch([]events.Event{newEvent("an event", 0, 0)})
+	evts = filter(repo, &search.Search{}, events.SortModeTimestampAsc)
+	assertRaws(t, evts, "an event", "another event")
+}
+
+func TestAddBatchEvictsOldestEvents(t *testing.T) {
+	repo := createEventRepo(t, 3)
+	repo.AddBatch([]events.Event{newEvent("event 0", 0, 0), newEvent("event 1", 1, 10)})
+	repo.DeleteBatch([]int64{2})
+	repo.AddBatch([]events.Event{newEvent("event 2", 2, 20), newEvent("event 3", 3, 30), newEvent("event 4", 4, 40)})
+
+	assertRaws(t, filter(repo, &search.Search{}, events.SortModeTimestampAsc), "event 2", "event 3", "event 4")
+
+	// The evicted event is no longer considered a duplicate
+	repo.AddBatch([]events.Event{newEvent("event 0", 0, 0)})
+	assertRaws(t, filter(repo, &search.Search{}, events.SortModeTimestampAsc), "event 0", "event 3", "event 4")
+}
+
+func TestFilterStream(t *testing.T) {
+	repo := createEventRepo(t, 100)
+	evts := []events.Event{
+		newEvent("NullPointerException in handler", 0, 0),
+		newEvent("user logged in", 1, 10),
+		newEvent("user logged out", 2, 20),
+		newEvent("otherwise fine", 3, 30),
+		newEvent("error: disk full", 4, 40),
+	}
+	evts[3].Host = "otherhost"
+	evts[4].Source = "errors.log"
+	evts[4].Index = "security"
+	err := repo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		srch     search.Search
+		expected []string
+	}{
+		{"all", search.Search{}, []string{"NullPointerException in handler", "user logged in", "user logged out", "otherwise fine", "error: disk full"}},
+		{"word", search.Search{Fragments: set("user")}, []string{"user logged in", "user logged out"}},
+		{"whole word only", search.Search{Fragments: set("wise")}, []string{}},
+		{"case insensitive", search.Search{Fragments: set("USER", "In")}, []string{"user logged in"}},
+		{"prefix", search.Search{Fragments: set("null*")}, []string{"NullPointerException in handler"}},
+		{"suffix", search.Search{Fragments: set("*exception")}, []string{"NullPointerException in handler"}},
+		{"infix", search.Search{Fragments: set("*wise*")}, []string{"otherwise fine"}},
+		{"punctuation", search.Search{Fragments: set("error:")}, []string{"error: disk full"}},
+		{"not fragment", search.Search{Fragments: set("user"), NotFragments: set("out")}, []string{"user logged in"}},
+		{"host", search.Search{Hosts: set("otherhost")}, []string{"otherwise fine"}},
+		{"not host", search.Search{Fragments: set("*i*"), NotHosts: set("otherhost")}, []string{"NullPointerException in handler", "user logged in", "error: disk full"}},
+		{"source", search.Search{Sources: set("errors*")}, []string{"error: disk full"}},
+		{"not source", search.Search{NotSources: set("log.txt")}, []string{"error: disk full"}},
+		{"index", search.Search{Indexes: set("security")}, []string{"error: disk full"}},
+		{"index wildcard", search.Search{Indexes: set("sec*")}, []string{"error: disk full"}},
+		{"not index", search.Search{NotIndexes: set("main")}, []string{"error: disk full"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertRaws(t, filter(repo, &tt.srch, events.SortModeTimestampAsc), tt.expected...)
+		})
+	}
+
+	startTime, endTime := testTime(1), testTime(3)
+	res := collect(repo.FilterStream(&search.Search{}, &startTime, &endTime, events.SortModeTimestampDesc))
+	assertRaws(t, res, "otherwise fine", "user logged out", "user logged in")
+}
+
+func TestFilterStreamPages(t *testing.T) {
+	repo := createEventRepo(t, 5000)
+	evts := make([]events.Event, 2500)
+	for i := range evts {
+		evts[i] = newEvent(fmt.Sprintf("event %v", i), time.Duration(i), int64(i))
+	}
+	repo.AddBatch(evts)
+
+	numPages := 0
+	var prev *events.EventWithId
+	for page := range repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampDesc) {
+		numPages++
+		for i := range page {
+			if prev != nil && !page[i].Timestamp.Before(prev.Timestamp) {
+				t.Fatalf("got events out of order, %v came after %v", page[i].Raw, prev.Raw)
+			}
+			prev = &page[i]
+		}
+	}
+	if numPages != 3 {
+		t.Fatalf("expected 3 pages but got %v", numPages)
+	}
+}
+
+func TestDeleteBatch(t *testing.T) {
+	repo := createEventRepo(t, 100)
+	repo.AddBatch([]events.Event{newEvent("first event", 0, 0), newEvent("second event", 1, 10), newEvent("third event", 2, 20)})
+
+	err := repo.DeleteBatch([]int64{1, 3, 4})
+	if err != nil {
+		t.Fatalf("got error when deleting events: %v", err)
+	}
+	assertRaws(t, filter(repo, &search.Search{Fragments: set("event")}, events.SortModeTimestampAsc), "second event")
+	evts, err := repo.GetByIds([]int64{1, 2, 3}, events.SortModeTimestampAsc)
+	if err != nil {
+		t.Fatalf("got error when getting events: %v", err)
+	}
+	assertRaws(t, evts, "second event")
+}
+
+func TestGetSurroundingEvents(t *testing.T) {
+	repo := createEventRepo(t, 100)
+	evts := []events.Event{}
+	for i := 0; i < 10; i++ {
+		evts = append(evts, newEvent(fmt.Sprintf("line %v", i), time.Duration(i), int64(i*10)))
+	}
+	other := newEvent("other file", 5, 50)
+	other.Source = "other.txt"
+	other.SourceId = "source-2"
+	evts = append(evts, other)
+	repo.AddBatch(evts)
+
+	res, err := repo.GetSurroundingEvents(5, 4)
+	if err != nil {
+		t.Fatalf("got error when getting surrounding events: %v", err)
+	}
+	assertRaws(t, res, "line 6", "line 5", "line 4", "line 3")
+
+	_, err = repo.GetSurroundingEvents(100, 4)
+	if err == nil {
+		t.Fatalf("expected error when getting surrounding events of an event which does not exist")
+	}
+}
+
+func createEventRepo(t *testing.T, maxEvents int) events.Repository {
+	repo, err := NewMemoryEventRepository(MemoryEventRepositoryParams{
+		Cfg:    &Config{MaxEvents: maxEvents, MaxJobs: 100},
+		Logger: slog.Default(),
+	})
+	if err != nil {
+		t.Fatalf("got error when creating repository: %v", err)
+	}
+	return repo
+}
+
+func testTime(d time.Duration) time.Time {
+	return time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC).Add(d)
+}
+
+func newEvent(raw string, d time.Duration, offset int64) events.Event {
+	return events.Event{
+		Raw:       raw,
+		Timestamp: testTime(d),
+		Host:      "localhost",
+		Source:    "log.txt",
+		SourceId:  "source-1",
+		Offset:    offset,
+	}
+}
+
+func filter(repo events.Repository, srch *search.Search, sortMode events.SortMode) []events.EventWithId {
+	return collect(repo.FilterStream(srch, nil, nil, sortMode))
+}
+
+func collect(c <-chan []events.EventWithId) []events.EventWithId {
+	ret := []events.EventWithId{}
+	for page := range c {
+		ret = append(ret, page...)
+	}
+	return ret
+}
+
+func set(values ...string) map[string]struct{} {
+	ret := map[string]struct{}{}
+	for _, v := range values {
+		ret[v] = struct{}{}
+	}
+	return ret
+}
+
+func assertRaws(t *testing.T, evts []events.EventWithId, expected ...string) {
+	t.Helper()
+	raws := make([]string, len(evts))
+	for i, evt := range evts {
+		raws[i] = evt.Raw
+	}
+	if len(expected) == 0 {
+		expected = []string{}
+	}
+	if !reflect.DeepEqual(raws, expected) {
+		t.Fatalf("got unexpected events, expected %v but got %v", expected, raws)
+	}
+}
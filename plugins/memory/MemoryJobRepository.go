@@ -0,0 +1,311 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/jobs"
+	"github.com/jackbister/logsuck/pkg/logsuck/pipeline"
+
+	"go.uber.org/dig"
+)
+
+// memoryJobRepository keeps at most maxJobs jobs in memory. When a new job is inserted and the repository is full, the oldest jobs which
+// are not running are removed along with their results.
+type memoryJobRepository struct {
+	maxJobs int
+
+	mu     sync.Mutex
+	nextId int64
+	jobs   map[int64]*memoryJob
+}
+
+type memoryJob struct {
+	job          jobs.Job
+	results      []events.EventIdAndTimestamp
+	tableResults []jobs.TableRow
+	// fieldValues maps field names to values to the number of occurrences of the value
+	fieldValues map[string]map[string]int
+}
+
+type MemoryJobRepositoryParams struct {
+	dig.In
+
+	Cfg *Config
+}
+
+func NewMemoryJobRepository(p MemoryJobRepositoryParams) (jobs.Repository, error) {
+	if p.Cfg.MaxJobs <= 0 {
+		return nil, fmt.Errorf("maxJobs must be positive but is %v", p.Cfg.MaxJobs)
+	}
+	return &memoryJobRepository{
+		maxJobs: p.Cfg.MaxJobs,
+		nextId:  1,
+		jobs:    map[int64]*memoryJob{},
+	}, nil
+}
+
+// get returns the job with the given ID. The caller must hold mu.
+func (repo *memoryJobRepository) get(id int64) (*memoryJob, error) {
+	j, ok := repo.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("jobId=%v not found", id)
+	}
+	return j, nil
+}
+
+func (repo *memoryJobRepository) AddResults(id int64, evts []events.EventIdAndTimestamp) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	j, err := repo.get(id)
+	if err != nil {
+		return fmt.Errorf("error adding results to jobId=%v: %w", id, err)
+	}
+	j.results = append(j.results, evts...)
+	return nil
+}
+
+func (repo *memoryJobRepository) AddTableResults(id int64, tableRows []jobs.TableRow) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	j, err := repo.get(id)
+	if err != nil {
+		return fmt.Errorf("error adding table results to jobId=%v: %w", id, err)
+	}
+	for _, r := range tableRows {
+		values := make(map[string]string, len(r.Values))
+		for k, v := range r.Values {
+			values[k] = v
+		}
+		j.tableResults = append(j.tableResults, jobs.TableRow{RowNumber: r.RowNumber, Values: values})
+	}
+	return nil
+}
+
+func (repo *memoryJobRepository) AddFieldStats(id int64, fields []jobs.FieldStats) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	j, err := repo.get(id)
+	if err != nil {
+		return fmt.Errorf("error when adding stats to jobId=%v: %w", id, err)
+	}
+	for _, f := range fields {
+		values, ok := j.fieldValues[f.Key]
+		if !ok {
+			values = map[string]int{}
+			j.fieldValues[f.Key] = values
+		}
+		values[f.Value] += f.Occurrences
+	}
+	return nil
+}
+
+func (repo *memoryJobRepository) Get(id int64) (*jobs.Job, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	j, err := repo.get(id)
+	if err != nil {
+		return nil, err
+	}
+	job := j.job
+	job.ColumnOrder = append([]string(nil), j.job.ColumnOrder...)
+	return &job, nil
+}
+
+func (repo *memoryJobRepository) GetResults(id int64, sortMode events.SortMode, skip int, take int) ([]int64, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	j, err := repo.get(id)
+	if err != nil {
+		return nil, fmt.Errorf("error when getting results for jobId=%v, skip=%v, take=%v: %w", id, skip, take, err)
+	}
+	asc := sortMode == events.SortModeTimestampAsc
+	sort.Slice(j.results, func(a, b int) bool {
+		ra, rb := j.results[a], j.results[b]
+		if !ra.Timestamp.Equal(rb.Timestamp) {
+			return ra.Timestamp.Before(rb.Timestamp) == asc
+		}
+		return (ra.Id < rb.Id) == asc
+	})
+	start, end := page(len(j.results), skip, take)
+	ids := make([]int64, 0, end-start)
+	for _, r := range j.results[start:end] {
+		ids = append(ids, r.Id)
+	}
+	return ids, nil
+}
+
+func (repo *memoryJobRepository) GetTableResults(id int64, skip int, take int) ([]jobs.TableRow, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	j, err := repo.get(id)
+	if err != nil {
+		return nil, fmt.Errorf("error when getting table results for jobId=%v, skip=%v, take=%v: %w", id, skip, take, err)
+	}
+	sort.SliceStable(j.tableResults, func(a, b int) bool {
+		return j.tableResults[a].RowNumber < j.tableResults[b].RowNumber
+	})
+	start, end := page(len(j.tableResults), skip, take)
+	ret := make([]jobs.TableRow, 0, end-start)
+	for _, r := range j.tableResults[start:end] {
+		values := make(map[string]string, len(r.Values))
+		for k, v := range r.Values {
+			values[k] = v
+		}
+		ret = append(ret, jobs.TableRow{RowNumber: r.RowNumber, Values: values})
+	}
+	return ret, nil
+}
+
+// page returns the start and end of the part of a slice of length n which is selected by skip and take.
+func page(n, skip, take int) (int, int) {
+	start := min(max(skip, 0), n)
+	end := min(start+max(take, 0), n)
+	return start, end
+}
+
+func (repo *memoryJobRepository) GetFieldOccurences(id int64) (map[string]int, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	j, err := repo.get(id)
+	if err != nil {
+		return nil, fmt.Errorf("error when getting field occurrences for jobId=%v: %w", id, err)
+	}
+	m := make(map[string]int, len(j.fieldValues))
+	for k, values := range j.fieldValues {
+		m[k] = len(values)
+	}
+	return m, nil
+}
+
+func (repo *memoryJobRepository) GetFieldValues(id int64, fieldName string) (map[string]int, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	j, err := repo.get(id)
+	if err != nil {
+		return nil, fmt.Errorf("error when getting field values for jobId=%v and fieldName=%v: %w", id, fieldName, err)
+	}
+	m := make(map[string]int, len(j.fieldValues[fieldName]))
+	for v, count := range j.fieldValues[fieldName] {
+		m[v] = count
+	}
+	return m, nil
+}
+
+func (repo *memoryJobRepository) GetNumMatchedEvents(id int64) (int64, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	j, err := repo.get(id)
+	if err != nil {
+		return 0, fmt.Errorf("error when getting number of matched events for jobId=%v: %w", id, err)
+	}
+	if j.job.OutputType == pipeline.PipeTypeTable {
+		return int64(len(j.tableResults)), nil
+	}
+	return int64(len(j.results)), nil
+}
+
+func (repo *memoryJobRepository) GetRecentFieldOccurences(numJobs int) (map[string]int, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	m := map[string]int{}
+	for _, j := range repo.recent(numJobs) {
+		for k, values := range j.fieldValues {
+			for _, count := range values {
+				m[k] += count
+			}
+		}
+	}
+	return m, nil
+}
+
+func (repo *memoryJobRepository) GetRecentFieldValues(numJobs int, fieldName string) (map[string]int, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	m := map[string]int{}
+	for _, j := range repo.recent(numJobs) {
+		for v, count := range j.fieldValues[fieldName] {
+			m[v] += count
+		}
+	}
+	return m, nil
+}
+
+// recent returns the numJobs jobs with the highest IDs. The caller must hold mu.
+func (repo *memoryJobRepository) recent(numJobs int) []*memoryJob {
+	ids := repo.sortedIds()
+	ret := make([]*memoryJob, 0, min(max(numJobs, 0), len(ids)))
+	for i := len(ids) - 1; i >= 0 && len(ret) < numJobs; i-- {
+		ret = append(ret, repo.jobs[ids[i]])
+	}
+	return ret
+}
+
+// sortedIds returns the IDs of all jobs in ascending order. The caller must hold mu.
+func (repo *memoryJobRepository) sortedIds() []int64 {
+	ids := make([]int64, 0, len(repo.jobs))
+	for id := range repo.jobs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (repo *memoryJobRepository) Insert(query string, startTime, endTime *time.Time, sortMode events.SortMode, outputType pipeline.PipeType, columnOrder []string) (*int64, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	id := repo.nextId
+	repo.nextId++
+	repo.jobs[id] = &memoryJob{
+		job: jobs.Job{
+			Id:          id,
+			State:       jobs.StateRunning,
+			Query:       query,
+			StartTime:   startTime,
+			EndTime:     endTime,
+			SortMode:    sortMode,
+			OutputType:  outputType,
+			ColumnOrder: append([]string(nil), columnOrder...),
+		},
+		fieldValues: map[string]map[string]int{},
+	}
+	if len(repo.jobs) > repo.maxJobs {
+		for _, oldId := range repo.sortedIds() {
+			if len(repo.jobs) <= repo.maxJobs {
+				break
+			}
+			if repo.jobs[oldId].job.State != jobs.StateRunning {
+				delete(repo.jobs, oldId)
+			}
+		}
+	}
+	return &id, nil
+}
+
+func (repo *memoryJobRepository) UpdateState(id int64, state jobs.State) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	j, err := repo.get(id)
+	if err != nil {
+		return fmt.Errorf("error when updating jobId=%v to state=%v: %w", id, state, err)
+	}
+	j.job.State = state
+	return nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/jobs"
+	"github.com/jackbister/logsuck/pkg/logsuck/pipeline"
+)
+
+func TestJobResults(t *testing.T) {
+	repo := createJobRepo(t, 10)
+	id := insertJob(t, repo, pipeline.PipeTypeEvents)
+	job, err := repo.Get(id)
+	if err != nil {
+		t.Fatalf("got error when getting job: %v", err)
+	}
+	if job.Id != id || job.State != jobs.StateRunning || job.Query != "search" {
+		t.Fatalf("got unexpected job=%+v", job)
+	}
+
+	repo.AddResults(id, []events.EventIdAndTimestamp{{Id: 1, Timestamp: testTime(1)}, {Id: 3, Timestamp: testTime(0)}})
+	repo.AddResults(id, []events.EventIdAndTimestamp{{Id: 2, Timestamp: testTime(1)}})
+
+	ids, err := repo.GetResults(id, events.SortModeTimestampDesc, 0, 10)
+	if err != nil {
+		t.Fatalf("got error when getting results: %v", err)
+	}
+	if !reflect.DeepEqual(ids, []int64{2, 1, 3}) {
+		t.Fatalf("got unexpected ids=%v", ids)
+	}
+	ids, _ = repo.GetResults(id, events.SortModeTimestampAsc, 1, 1)
+	if !reflect.DeepEqual(ids, []int64{1}) {
+		t.Fatalf("got unexpected ids=%v", ids)
+	}
+	ids, _ = repo.GetResults(id, events.SortModeTimestampAsc, 5, 1)
+	if len(ids) != 0 {
+		t.Fatalf("expected no ids when skipping all results but got %v", ids)
+	}
+	numMatched, err := repo.GetNumMatchedEvents(id)
+	if err != nil || numMatched != 3 {
+		t.Fatalf("expected 3 matched events but got numMatched=%v, err=%v", numMatched, err)
+	}
+
+	err = repo.UpdateState(id, jobs.StateFinished)
+	if err != nil {
+		t.Fatalf("got error when updating state: %v", err)
+	}
+	job, _ = repo.Get(id)
+	if job.State != jobs.StateFinished {
+		t.Fatalf("expected state to be finished but got %v", job.State)
+	}
+
+	_, err = repo.Get(id + 1)
+	if err == nil {
+		t.Fatalf("expected error when getting job which does not exist")
+	}
+}
+
+func TestJobTableResults(t *testing.T) {
+	repo := createJobRepo(t, 10)
+	id := insertJob(t, repo, pipeline.PipeTypeTable)
+	repo.AddTableResults(id, []jobs.TableRow{{RowNumber: 1, Values: map[string]string{"a": "2"}}, {RowNumber: 0, Values: map[string]string{"a": "1"}}})
+	repo.AddTableResults(id, []jobs.TableRow{{RowNumber: 2, Values: map[string]string{"a": "3"}}})
+
+	rows, err := repo.GetTableResults(id, 1, 5)
+	if err != nil {
+		t.Fatalf("got error when getting table results: %v", err)
+	}
+	expected := []jobs.TableRow{{RowNumber: 1, Values: map[string]string{"a": "2"}}, {RowNumber: 2, Values: map[string]string{"a": "3"}}}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Fatalf("got unexpected rows=%v, expected %v", rows, expected)
+	}
+	numMatched, _ := repo.GetNumMatchedEvents(id)
+	if numMatched != 3 {
+		t.Fatalf("expected 3 matched rows but got %v", numMatched)
+	}
+}
+
+func TestJobFieldStats(t *testing.T) {
+	repo := createJobRepo(t, 10)
+	first := insertJob(t, repo, pipeline.PipeTypeEvents)
+	second := insertJob(t, repo, pipeline.PipeTypeEvents)
+	third := insertJob(t, repo, pipeline.PipeTypeEvents)
+	repo.AddFieldStats(first, []jobs.FieldStats{{Key: "level", Value: "ERROR", Occurrences: 100}})
+	repo.AddFieldStats(second, []jobs.FieldStats{{Key: "level", Value: "INFO", Occurrences: 2}, {Key: "user", Value: "jack", Occurrences: 1}})
+	repo.AddFieldStats(third, []jobs.FieldStats{{Key: "level", Value: "INFO", Occurrences: 1}, {Key: "level", Value: "WARN", Occurrences: 1}})
+	repo.AddFieldStats(third, []jobs.FieldStats{{Key: "level", Value: "INFO", Occurrences: 3}})
+
+	occurrences, err := repo.GetFieldOccurences(third)
+	if err != nil {
+		t.Fatalf("got error when getting field occurrences: %v", err)
+	}
+	if !reflect.DeepEqual(occurrences, map[string]int{"level": 2}) {
+		t.Fatalf("got unexpected occurrences=%v", occurrences)
+	}
+	values, err := repo.GetFieldValues(third, "level")
+	if err != nil {
+		t.Fatalf("got error when getting field values: %v", err)
+	}
+	if !reflect.DeepEqual(values, map[string]int{"INFO": 4, "WARN": 1}) {
+		t.Fatalf("got unexpected values=%v", values)
+	}
+
+	occurrences, _ = repo.GetRecentFieldOccurences(2)
+	if !reflect.DeepEqual(occurrences, map[string]int{"level": 7, "user": 1}) {
+		t.Fatalf("got unexpected recent occurrences=%v", occurrences)
+	}
+	values, _ = repo.GetRecentFieldValues(2, "level")
+	if !reflect.DeepEqual(values, map[string]int{"INFO": 6, "WARN": 1}) {
+		t.Fatalf("got unexpected recent values=%v", values)
+	}
+}
+
+func TestInsertEvictsOldestFinishedJobs(t *testing.T) {
+	repo := createJobRepo(t, 2)
+	running := insertJob(t, repo, pipeline.PipeTypeEvents)
+	finished := insertJob(t, repo, pipeline.PipeTypeEvents)
+	repo.UpdateState(finished, jobs.StateFinished)
+	newest := insertJob(t, repo, pipeline.PipeTypeEvents)
+
+	if _, err := repo.Get(running); err != nil {
+		t.Fatalf("expected running job to be kept but got error: %v", err)
+	}
+	if _, err := repo.Get(finished); err == nil {
+		t.Fatalf("expected finished job to be removed")
+	}
+	if _, err := repo.Get(newest); err != nil {
+		t.Fatalf("expected newest job to be kept but got error: %v", err)
+	}
+}
+
+func createJobRepo(t *testing.T, maxJobs int) jobs.Repository {
+	repo, err := NewMemoryJobRepository(MemoryJobRepositoryParams{Cfg: &Config{MaxEvents: 100, MaxJobs: maxJobs}})
+	if err != nil {
+		t.Fatalf("got error when creating repository: %v", err)
+	}
+	return repo
+}
+
+func insertJob(t *testing.T, repo jobs.Repository, outputType pipeline.PipeType) int64 {
+	id, err := repo.Insert("search", nil, nil, events.SortModeTimestampDesc, outputType, []string{})
+	if err != nil {
+		t.Fatalf("got error when inserting job: %v", err)
+	}
+	return *id
+}
@@ -0,0 +1,95 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/jackbister/logsuck/pkg/logsuck"
+	"github.com/jackbister/logsuck/pkg/logsuck/config"
+
+	"go.uber.org/dig"
+)
+
+const pluginName = "@logsuck/memory"
+
+//go:embed memory.schema.json
+var schemaString string
+
+type Config struct {
+	// MaxEvents is the maximum number of events kept by the events repository.
+	MaxEvents int
+
+	// MaxJobs is the maximum number of jobs kept by the jobs repository.
+	MaxJobs int
+}
+
+// IsConfigured returns true if the configuration contains a configuration for this plugin, which means the plugin should be used to
+// store events, jobs and configuration instead of the SQLite plugins.
+func IsConfigured(cfg *config.Config) bool {
+	_, ok := cfg.Plugins[pluginName]
+	return ok
+}
+
+var Plugin = logsuck.Plugin{
+	Name: pluginName,
+	Provide: func(c *dig.Container, logger *slog.Logger) error {
+		err := c.Provide(NewMemoryEventRepository)
+		if err != nil {
+			return err
+		}
+		err = c.Provide(NewMemoryJobRepository)
+		if err != nil {
+			return err
+		}
+		err = c.Provide(NewMemoryConfigRepository)
+		if err != nil {
+			return err
+		}
+		err = c.Provide(func(cfg *config.Config) *Config {
+			ret := Config{
+				MaxEvents: 100000,
+				MaxJobs:   100,
+			}
+			cfgMap, ok := cfg.Plugins[pluginName].(map[string]any)
+			if !ok {
+				return &ret
+			}
+			// Numbers in the configuration are unmarshaled as float64
+			if me, ok := cfgMap["maxEvents"].(float64); ok {
+				ret.MaxEvents = int(me)
+			}
+			if mj, ok := cfgMap["maxJobs"].(float64); ok {
+				ret.MaxJobs = int(mj)
+			}
+			return &ret
+		})
+		if err != nil {
+			return err
+		}
+		return nil
+	},
+	JsonSchema: func() (map[string]any, error) {
+		ret := map[string]any{}
+		err := json.Unmarshal([]byte(schemaString), &ret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal memory JSON schema: %w", err)
+		}
+		return ret, nil
+	},
+}
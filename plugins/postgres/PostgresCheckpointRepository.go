@@ -0,0 +1,104 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/checkpoints"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/dig"
+)
+
+type PostgresCheckpointRepository struct {
+	pool *pgxpool.Pool
+}
+
+type PostgresCheckpointRepositoryParams struct {
+	dig.In
+
+	Ctx  context.Context
+	Pool *pgxpool.Pool
+}
+
+func NewPostgresCheckpointRepository(p PostgresCheckpointRepositoryParams) (checkpoints.Repository, error) {
+	_, err := p.Pool.Exec(p.Ctx, "CREATE TABLE IF NOT EXISTS FileCheckpoints (host TEXT NOT NULL, path TEXT NOT NULL, device BIGINT NOT NULL, inode BIGINT NOT NULL, fingerprint BYTEA, fingerprint_size BIGINT NOT NULL, \"offset\" BIGINT NOT NULL, source_id TEXT NOT NULL, updated TIMESTAMP NOT NULL, PRIMARY KEY(host, path));")
+	if err != nil {
+		return nil, fmt.Errorf("error when creating FileCheckpoints table: %w", err)
+	}
+	_, err = p.Pool.Exec(p.Ctx, "ALTER TABLE FileCheckpoints ADD COLUMN IF NOT EXISTS complete BOOLEAN NOT NULL DEFAULT FALSE;")
+	if err != nil {
+		return nil, fmt.Errorf("error when adding complete column to FileCheckpoints table: %w", err)
+	}
+	return &PostgresCheckpointRepository{
+		pool: p.Pool,
+	}, nil
+}
+
+func (repo *PostgresCheckpointRepository) Get(host, path string) (*checkpoints.Checkpoint, error) {
+	row := repo.pool.QueryRow(context.TODO(), "SELECT device, inode, fingerprint, fingerprint_size, \"offset\", complete, source_id, updated FROM FileCheckpoints WHERE host = $1 AND path = $2;", host, path)
+	ret := checkpoints.Checkpoint{Host: host, Path: path}
+	var device, inode int64
+	err := row.Scan(&device, &inode, &ret.Fingerprint, &ret.FingerprintSize, &ret.Offset, &ret.Complete, &ret.SourceId, &ret.Updated)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting checkpoint for host=%v, path=%v: %w", host, path, err)
+	}
+	ret.Device = uint64(device)
+	ret.Inode = uint64(inode)
+	return &ret, nil
+}
+
+func (repo *PostgresCheckpointRepository) List(host string) ([]checkpoints.Checkpoint, error) {
+	rows, err := repo.pool.Query(context.TODO(), "SELECT path, device, inode, fingerprint, fingerprint_size, \"offset\", complete, source_id, updated FROM FileCheckpoints WHERE host = $1 ORDER BY path;", host)
+	if err != nil {
+		return nil, fmt.Errorf("error listing checkpoints for host=%v: %w", host, err)
+	}
+	defer rows.Close()
+	ret := []checkpoints.Checkpoint{}
+	for rows.Next() {
+		cp := checkpoints.Checkpoint{Host: host}
+		var device, inode int64
+		err = rows.Scan(&cp.Path, &device, &inode, &cp.Fingerprint, &cp.FingerprintSize, &cp.Offset, &cp.Complete, &cp.SourceId, &cp.Updated)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning checkpoint for host=%v: %w", host, err)
+		}
+		cp.Device = uint64(device)
+		cp.Inode = uint64(inode)
+		ret = append(ret, cp)
+	}
+	return ret, rows.Err()
+}
+
+func (repo *PostgresCheckpointRepository) Put(c checkpoints.Checkpoint) error {
+	updated := c.Updated
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	_, err := repo.pool.Exec(context.TODO(), "INSERT INTO FileCheckpoints (host, path, device, inode, fingerprint, fingerprint_size, \"offset\", complete, source_id, updated) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) "+
+		"ON CONFLICT (host, path) DO UPDATE SET device = excluded.device, inode = excluded.inode, fingerprint = excluded.fingerprint, fingerprint_size = excluded.fingerprint_size, "+
+		"\"offset\" = excluded.\"offset\", complete = excluded.complete, source_id = excluded.source_id, updated = excluded.updated;",
+		c.Host, c.Path, int64(c.Device), int64(c.Inode), c.Fingerprint, c.FingerprintSize, c.Offset, c.Complete, c.SourceId, updated)
+	if err != nil {
+		return fmt.Errorf("error putting checkpoint for host=%v, path=%v: %w", c.Host, c.Path, err)
+	}
+	return nil
+}
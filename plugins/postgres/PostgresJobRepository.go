@@ -144,8 +144,12 @@ func (repo *PostgresJobRepository) Get(id int64) (*jobs.Job, error) {
 	return &job, nil
 }
 
-func (repo *PostgresJobRepository) GetResults(jobId int64, skip int, take int) ([]int64, error) {
-	res, err := repo.pool.Query(context.TODO(), "SELECT event_id FROM JobResults WHERE job_id=$1 ORDER BY timestamp DESC LIMIT $2 OFFSET $3;", jobId, take, skip)
+func (repo *PostgresJobRepository) GetResults(jobId int64, sortMode events.SortMode, skip int, take int) ([]int64, error) {
+	order := "DESC"
+	if sortMode == events.SortModeTimestampAsc {
+		order = "ASC"
+	}
+	res, err := repo.pool.Query(context.TODO(), "SELECT event_id FROM JobResults WHERE job_id=$1 ORDER BY timestamp "+order+", event_id "+order+" LIMIT $2 OFFSET $3;", jobId, take, skip)
 	if err != nil {
 		return nil, fmt.Errorf("error when getting results for jobId=%v, skip=%v, take=%v: %w", jobId, skip, take, err)
 	}
@@ -252,6 +256,44 @@ func (repo *PostgresJobRepository) GetNumMatchedEvents(id int64) (int64, error)
 	return count, nil
 }
 
+func (repo *PostgresJobRepository) GetRecentFieldOccurences(numJobs int) (map[string]int, error) {
+	res, err := repo.pool.Query(context.TODO(), "SELECT key, SUM(occurrences) FROM JobFieldValues WHERE job_id IN (SELECT id FROM Jobs ORDER BY id DESC LIMIT $1) GROUP BY key;", numJobs)
+	if err != nil {
+		return nil, fmt.Errorf("error when getting field occurrences for numJobs=%v: %w", numJobs, err)
+	}
+	defer res.Close()
+	m := map[string]int{}
+	for res.Next() {
+		var key string
+		var count int
+		err = res.Scan(&key, &count)
+		if err != nil {
+			return nil, fmt.Errorf("error reading field occurences for numJobs=%v: %w", numJobs, err)
+		}
+		m[key] = count
+	}
+	return m, nil
+}
+
+func (repo *PostgresJobRepository) GetRecentFieldValues(numJobs int, fieldName string) (map[string]int, error) {
+	res, err := repo.pool.Query(context.TODO(), "SELECT value, SUM(occurrences) FROM JobFieldValues WHERE job_id IN (SELECT id FROM Jobs ORDER BY id DESC LIMIT $1) AND key=$2 GROUP BY value;", numJobs, fieldName)
+	if err != nil {
+		return nil, fmt.Errorf("error when getting field values for numJobs=%v and fieldName=%v: %w", numJobs, fieldName, err)
+	}
+	defer res.Close()
+	m := map[string]int{}
+	for res.Next() {
+		var value string
+		var count int
+		err = res.Scan(&value, &count)
+		if err != nil {
+			return nil, fmt.Errorf("error reading field values for numJobs=%v and fieldName=%v: %w", numJobs, fieldName, err)
+		}
+		m[value] = count
+	}
+	return m, nil
+}
+
 func (repo *PostgresJobRepository) Insert(query string, startTime, endTime *time.Time, sortMode events.SortMode, outputType pipeline.PipeType, columnOrder []string) (*int64, error) {
 	columnOrderJson, err := json.Marshal(columnOrder)
 	if err != nil {
@@ -33,6 +33,10 @@ var Plugin = logsuck.Plugin{
 		if err != nil {
 			return err
 		}
+		err = c.Provide(NewPostgresCheckpointRepository)
+		if err != nil {
+			return err
+		}
 		return nil
 	},
 }
@@ -36,14 +36,16 @@ const filterStreamPageSize = 1000
 type postgresEventRepository struct {
 	conn *pgxpool.Pool
 
-	logger *slog.Logger
+	metrics *events.IngestionMetrics
+	logger  *slog.Logger
 }
 
 type PostgresEventRepositoryParams struct {
 	dig.In
 
-	Conn   *pgxpool.Pool
-	Logger *slog.Logger
+	Conn    *pgxpool.Pool
+	Metrics *events.IngestionMetrics `optional:"true"`
+	Logger  *slog.Logger
 }
 
 func NewPostgresEventRepository(p PostgresEventRepositoryParams) (events.Repository, error) {
@@ -55,6 +57,10 @@ func NewPostgresEventRepository(p PostgresEventRepositoryParams) (events.Reposit
 	if err != nil {
 		return nil, fmt.Errorf("error creating events timestamp index: %w", err)
 	}
+	_, err = p.Conn.Exec(context.TODO(), "ALTER TABLE Events ADD COLUMN IF NOT EXISTS index_name TEXT NOT NULL DEFAULT 'main';")
+	if err != nil {
+		return nil, fmt.Errorf("error adding index_name column to events table: %w", err)
+	}
 
 	_, err = p.Conn.Exec(context.TODO(), "CREATE TABLE IF NOT EXISTS EventRaws (event_id BIGINT NOT NULL PRIMARY KEY, raw TEXT, source TEXT, host TEXT);")
 	if err != nil {
@@ -64,25 +70,41 @@ func NewPostgresEventRepository(p PostgresEventRepositoryParams) (events.Reposit
 	if err != nil {
 		return nil, fmt.Errorf("error creating eventraws index: %w", err)
 	}
+	_, err = p.Conn.Exec(context.TODO(), "CREATE TABLE IF NOT EXISTS EventFields (event_id BIGINT NOT NULL, key TEXT NOT NULL, value TEXT NOT NULL, PRIMARY KEY(event_id, key));")
+	if err != nil {
+		return nil, fmt.Errorf("error creating eventfields table: %w", err)
+	}
+	_, err = p.Conn.Exec(context.TODO(), "CREATE INDEX IF NOT EXISTS IX_EventFields_Key_Value ON EventFields(key, value);")
+	if err != nil {
+		return nil, fmt.Errorf("error creating eventfields key/value index: %w", err)
+	}
+	// The version of fields which were saved before the column was added is unknown, so it is NULL and the fields are not used by searches
+	_, err = p.Conn.Exec(context.TODO(), "ALTER TABLE EventFields ADD COLUMN IF NOT EXISTS version TEXT;")
+	if err != nil {
+		return nil, fmt.Errorf("error adding version column to eventfields table: %w", err)
+	}
 	return &postgresEventRepository{
-		conn:   p.Conn,
-		logger: p.Logger,
+		conn:    p.Conn,
+		metrics: p.Metrics,
+		logger:  p.Logger,
 	}, nil
 }
 
-func (repo *postgresEventRepository) AddBatch(events []events.Event) error {
+func (repo *postgresEventRepository) AddBatch(evts []events.Event) error {
 	startTime := time.Now()
 	tx, err := repo.conn.BeginTx(context.TODO(), pgx.TxOptions{})
 	if err != nil {
 		return fmt.Errorf("error starting transaction for adding event: %w", err)
 	}
 	numberOfDuplicates := map[string]int64{}
-	for _, evt := range events {
-		res := tx.QueryRow(context.TODO(), "INSERT INTO Events(host, source, source_id, timestamp, \"offset\") VALUES($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING RETURNING id;", evt.Host, evt.Source, evt.SourceId, evt.Timestamp, evt.Offset)
+	duplicates := []events.Event{}
+	for _, evt := range evts {
+		res := tx.QueryRow(context.TODO(), "INSERT INTO Events(host, source, source_id, timestamp, \"offset\", index_name) VALUES($1, $2, $3, $4, $5, $6) ON CONFLICT DO NOTHING RETURNING id;", evt.Host, evt.Source, evt.SourceId, evt.Timestamp, evt.Offset, indexName(evt))
 		var id int64
 		err := res.Scan(&id)
 		if err == pgx.ErrNoRows {
 			numberOfDuplicates[evt.Source]++
+			duplicates = append(duplicates, evt)
 			continue
 		}
 		if err != nil {
@@ -94,23 +116,32 @@ func (repo *postgresEventRepository) AddBatch(events []events.Event) error {
 			tx.Rollback(context.TODO())
 			return fmt.Errorf("error executing add raw statement: %w", err)
 		}
+		for k, v := range evt.IndexedFields {
+			_, err = tx.Exec(context.TODO(), "INSERT INTO EventFields (event_id, key, value, version) VALUES ($1, $2, $3, $4);", id, k, v, fieldsVersion(evt))
+			if err != nil {
+				tx.Rollback(context.TODO())
+				return fmt.Errorf("error executing add field statement: %w", err)
+			}
+		}
 	}
 	err = tx.Commit(context.TODO())
 	if err != nil {
 		// TODO: Hmm?
 	}
+	repo.metrics.RecordBatch(evts, duplicates)
 	for k, v := range numberOfDuplicates {
 		repo.logger.Info("Skipped adding events because they appear to be duplicates (same source, offset and timestamp as an existing event)",
 			slog.Int64("numEvents", v), slog.String("source", k))
 	}
 	repo.logger.Info("added events",
-		slog.Int("numEvents", len(events)),
+		slog.Int("numEvents", len(evts)),
 		slog.Duration("duration", time.Since(startTime)))
 	return nil
 }
 
 var delSbBase = "DELETE FROM Events WHERE ID IN ("
 var delRawSbBase = "DELETE FROM EventRaws WHERE event_id IN ("
+var delFieldsSbBase = "DELETE FROM EventFields WHERE event_id IN ("
 var delSbSuffix = ")"
 
 func (repo *postgresEventRepository) DeleteBatch(ids []int64) error {
@@ -119,21 +150,27 @@ func (repo *postgresEventRepository) DeleteBatch(ids []int64) error {
 	}
 	var sb strings.Builder
 	var rsb strings.Builder
+	var fsb strings.Builder
 	sb.WriteString(delSbBase)
 	rsb.WriteString(delRawSbBase)
+	fsb.WriteString(delFieldsSbBase)
 	for i := range ids {
 		str := "$" + strconv.Itoa(i+1)
 		sb.WriteString(str)
 		rsb.WriteString(str)
+		fsb.WriteString(str)
 		if i != len(ids)-1 {
 			sb.WriteString(", ")
 			rsb.WriteString(", ")
+			fsb.WriteString(", ")
 		}
 	}
 	sb.WriteString(delSbSuffix)
 	rsb.WriteString(delSbSuffix)
+	fsb.WriteString(delSbSuffix)
 	deleteQuery := sb.String()
 	deleteRawQuery := rsb.String()
+	deleteFieldsQuery := fsb.String()
 
 	// yuck
 	args := make([]interface{}, len(ids))
@@ -156,6 +193,11 @@ func (repo *postgresEventRepository) DeleteBatch(ids []int64) error {
 		tx.Rollback(context.TODO())
 		return fmt.Errorf("failed to delete numIds=%v from EventRaws table: %w", len(ids), err)
 	}
+	_, err = tx.Exec(context.TODO(), deleteFieldsQuery, args...)
+	if err != nil {
+		tx.Rollback(context.TODO())
+		return fmt.Errorf("failed to delete numIds=%v from EventFields table: %w", len(ids), err)
+	}
 	err = tx.Commit(context.TODO())
 	if err != nil {
 		// I have no idea what you are supposed to do here. rollback or nah?
@@ -164,7 +206,7 @@ func (repo *postgresEventRepository) DeleteBatch(ids []int64) error {
 	return nil
 }
 
-func (repo *postgresEventRepository) FilterStream(srch *search.Search, searchStartTime, searchEndTime *time.Time) <-chan []events.EventWithId {
+func (repo *postgresEventRepository) FilterStream(srch *search.Search, searchStartTime, searchEndTime *time.Time, sortMode events.SortMode) <-chan []events.EventWithId {
 	startTime := time.Now()
 	ret := make(chan []events.EventWithId)
 	go func() {
@@ -176,65 +218,15 @@ func (repo *postgresEventRepository) FilterStream(srch *search.Search, searchSta
 			repo.logger.Error("error when getting max(id) from Events table in FilterStream", slog.Any("error", err))
 			return
 		}
-		var lastTimestamp string
+		var matcher *search.Matcher
+		if _, exact := createTsQueries(srch); !exact {
+			matcher = search.NewMatcher(srch)
+		}
+		var cursor *filterStreamCursor
 		for {
-			stmt := "SELECT e.id, e.host, e.source, e.source_id, e.timestamp, r.raw FROM Events e INNER JOIN EventRaws r ON r.event_id = e.id WHERE e.id <= " + strconv.FormatInt(maxID, 10)
-			if searchStartTime != nil {
-				stmt += " AND e.timestamp >= '" + searchStartTime.Format(time.RFC3339Nano) + "'"
-			}
-			if searchEndTime != nil {
-				stmt += " AND e.timestamp <= '" + searchEndTime.Format(time.RFC3339Nano) + "'"
-			}
-			if lastTimestamp != "" {
-				stmt += " AND e.timestamp < '" + lastTimestamp + "'"
-			}
-			includes := map[string][]string{}
-			nots := map[string][]string{}
-			hostIncludes := make([]string, 0, len(srch.Hosts))
-			for h := range srch.Hosts {
-				hostIncludes = append(hostIncludes, h)
-			}
-			includes["host"] = hostIncludes
-			hostNots := make([]string, 0, len(srch.NotHosts))
-			for h := range srch.NotHosts {
-				hostNots = append(hostNots, h)
-			}
-			nots["host"] = hostNots
-			sourceIncludes := make([]string, 0, len(srch.Sources))
-			for s := range srch.Sources {
-				sourceIncludes = append(sourceIncludes, s)
-			}
-			includes["source"] = sourceIncludes
-			sourceNots := make([]string, 0, len(srch.NotSources))
-			for s := range srch.NotSources {
-				sourceNots = append(sourceNots, s)
-			}
-			nots["source"] = sourceNots
-			rawIncludes := make([]string, 0, len(srch.Fragments))
-			for f := range srch.Fragments {
-				rawIncludes = append(rawIncludes, f)
-			}
-			includes["raw"] = rawIncludes
-			rawNots := make([]string, 0, len(srch.NotFragments))
-			for f := range srch.NotFragments {
-				rawNots = append(rawNots, f)
-			}
-			nots["raw"] = rawNots
-
-			matchStrings := map[string]string{
-				"raw":    CreateMatchString(includes["raw"], nots["raw"]),
-				"host":   CreateMatchString(includes["host"], nots["host"]),
-				"source": CreateMatchString(includes["source"], nots["source"]),
-			}
-
-			for k, v := range matchStrings {
-				if len(v) > 0 {
-					stmt += " AND to_tsvector('simple', r." + k + ") @@ to_tsquery('simple', '" + v + "')"
-				}
-			}
-			stmt += " ORDER BY e.timestamp DESC LIMIT " + strconv.Itoa(filterStreamPageSize)
-			repo.logger.Info("executing SQL statement", slog.String("stmt", stmt))
-			res, err := repo.conn.Query(context.TODO(), stmt)
+			stmt, args := buildFilterStreamStatement(srch, searchStartTime, searchEndTime, maxID, sortMode, cursor)
+			repo.logger.Info("executing SQL statement", slog.String("stmt", stmt), slog.Any("args", args))
+			res, err := repo.conn.Query(context.TODO(), stmt, args...)
 			if err != nil {
 				repo.logger.Error("error when getting filtered events in FilterStream", slog.Any("error", err))
 				return
@@ -244,14 +236,17 @@ func (repo *postgresEventRepository) FilterStream(srch *search.Search, searchSta
 
 			for res.Next() {
 				var evt events.EventWithId
-				err := res.Scan(&evt.Id, &evt.Host, &evt.Source, &evt.SourceId, &evt.Timestamp, &evt.Raw)
+				err := res.Scan(&evt.Id, &evt.Host, &evt.Source, &evt.SourceId, &evt.Index, &evt.Timestamp, &evt.Offset, &evt.Raw)
 				if err != nil {
 					repo.logger.Warn("error when scanning result in FilterStream", slog.Any("error", err))
 				} else {
 					evts = append(evts, evt)
 				}
 				eventsInPage++
-				lastTimestamp = evt.Timestamp.Format(time.RFC3339Nano)
+				cursor = &filterStreamCursor{timestamp: evt.Timestamp, id: evt.Id}
+			}
+			if matcher != nil {
+				evts = filterMatching(matcher, evts)
 			}
 			ret <- evts
 			if eventsInPage < filterStreamPageSize {
@@ -265,24 +260,328 @@ func (repo *postgresEventRepository) FilterStream(srch *search.Search, searchSta
 	return ret
 }
 
-func CreateMatchString(includes, nots []string) string {
-	matchString := ""
-	for i, s := range includes {
-		matchString += strings.ReplaceAll(s, "*", ":*")
-		if i != len(includes)-1 {
-			matchString += " & "
+func (repo *postgresEventRepository) ExplainFilter(srch *search.Search, searchStartTime, searchEndTime *time.Time, sortMode events.SortMode) (*events.FilterExplanation, error) {
+	var maxID *int64
+	err := repo.conn.QueryRow(context.TODO(), "SELECT MAX(id) FROM Events;").Scan(&maxID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get max(id) from Events table: %w", err)
+	}
+	if maxID == nil {
+		maxID = new(int64)
+	}
+	pushedDown := []string{}
+	if searchStartTime != nil {
+		pushedDown = append(pushedDown, "_time>="+searchStartTime.Format(time.RFC3339Nano))
+	}
+	if searchEndTime != nil {
+		pushedDown = append(pushedDown, "_time<="+searchEndTime.Format(time.RFC3339Nano))
+	}
+	if _, exact := createTsQueries(srch); exact {
+		pushedDown = append(pushedDown, srch.DescribeFragments()...)
+		pushedDown = append(pushedDown, srch.DescribeSourcesAndHosts()...)
+	} else {
+		// The full-text search only finds candidates which are checked by FilterStream before they are returned
+		for _, f := range append(srch.DescribeFragments(), srch.DescribeSourcesAndHosts()...) {
+			pushedDown = append(pushedDown, f+" (candidates)")
+		}
+	}
+	pushedDown = append(pushedDown, srch.DescribeIndexes()...)
+	if len(srch.IndexedFieldsVersions) > 0 {
+		for _, k := range sortedFieldKeys(srch.Fields) {
+			if !isColumnField(k) {
+				pushedDown = append(pushedDown, describeIndexedField(k, srch.Fields[k], false))
+			}
+		}
+		for _, k := range sortedFieldKeys(srch.NotFields) {
+			if values := literalValues(srch.NotFields[k]); !isColumnField(k) && len(values) > 0 {
+				pushedDown = append(pushedDown, describeIndexedField(k, values, true))
+			}
+		}
+	}
+	stmt, args := buildFilterStreamStatement(srch, searchStartTime, searchEndTime, *maxID, sortMode, nil)
+	return &events.FilterExplanation{
+		Statement:         stmt,
+		Parameters:        args,
+		PushedDownFilters: pushedDown,
+	}, nil
+}
+
+// filterStreamCursor is the position of the last event in the previous page of FilterStream.
+// Since many events can have the same timestamp, the ID is used to decide where the next page starts among events with the same timestamp.
+type filterStreamCursor struct {
+	timestamp time.Time
+	id        int64
+}
+
+// buildFilterStreamStatement creates the statement and parameters used by FilterStream to retrieve a page of events.
+// cursor is the position of the last event in the previous page, or nil if this is the first page.
+func buildFilterStreamStatement(srch *search.Search, searchStartTime, searchEndTime *time.Time, maxID int64, sortMode events.SortMode, cursor *filterStreamCursor) (string, []any) {
+	var qb queryBuilder
+	qb.where("e.id <= ?", maxID)
+	if searchStartTime != nil {
+		qb.where("e.timestamp >= ?", *searchStartTime)
+	}
+	if searchEndTime != nil {
+		qb.where("e.timestamp <= ?", *searchEndTime)
+	}
+	order := "DESC"
+	if sortMode == events.SortModeTimestampAsc {
+		order = "ASC"
+	}
+	if cursor != nil {
+		if order == "ASC" {
+			qb.where("(e.timestamp, e.id) > (?, ?)", cursor.timestamp, cursor.id)
+		} else {
+			qb.where("(e.timestamp, e.id) < (?, ?)", cursor.timestamp, cursor.id)
+		}
+	}
+
+	tsQueries, _ := createTsQueries(srch)
+	for _, q := range tsQueries {
+		qb.where("to_tsvector('simple', r."+q.column+") @@ to_tsquery('simple', ?)", q.tsQuery)
+	}
+
+	addIndexConditions(&qb, srch)
+	addIndexedFieldConditions(&qb, srch)
+	return qb.build("SELECT e.id, e.host, e.source, e.source_id, e.index_name, e.timestamp, e.\"offset\", r.raw FROM Events e INNER JOIN EventRaws r ON r.event_id = e.id",
+		" ORDER BY e.timestamp "+order+", e.id "+order+" LIMIT "+strconv.Itoa(filterStreamPageSize))
+}
+
+type columnTsQuery struct {
+	column  string
+	tsQuery string
+}
+
+// createTsQueries creates the tsqueries for the fragments, hosts and sources of the search. Columns without anything to match are left
+// out. Returns false if the tsqueries only narrow down the candidates, in which case the events must be checked by a search.Matcher.
+func createTsQueries(srch *search.Search) ([]columnTsQuery, bool) {
+	columns := []struct {
+		column   string
+		includes map[string]struct{}
+		nots     map[string]struct{}
+	}{
+		{"raw", srch.Fragments, srch.NotFragments},
+		{"host", srch.Hosts, srch.NotHosts},
+		{"source", srch.Sources, srch.NotSources},
+	}
+	ret := make([]columnTsQuery, 0, len(columns))
+	allExact := true
+	for _, c := range columns {
+		tsQuery, exact := createTsQuery(sortedSetKeys(c.includes), sortedSetKeys(c.nots))
+		allExact = allExact && exact
+		if len(tsQuery) > 0 {
+			ret = append(ret, columnTsQuery{column: c.column, tsQuery: tsQuery})
+		}
+	}
+	return ret, allExact
+}
+
+// addIndexConditions adds conditions which only include events from the Indexes of the search and exclude events from its NotIndexes.
+func addIndexConditions(qb *queryBuilder, srch *search.Search) {
+	if len(srch.Indexes) > 0 {
+		conditions, args := indexConditions(sortedSetKeys(srch.Indexes))
+		qb.where("("+strings.Join(conditions, " OR ")+")", args...)
+	}
+	if len(srch.NotIndexes) > 0 {
+		conditions, args := indexConditions(sortedSetKeys(srch.NotIndexes))
+		qb.where("NOT ("+strings.Join(conditions, " OR ")+")", args...)
+	}
+}
+
+// indexConditions returns conditions matching events in any of the given indexes. Names without wildcards are matched using IN, while
+// names with wildcards are converted to LIKE patterns.
+func indexConditions(names []string) ([]string, []any) {
+	conditions := []string{}
+	args := []any{}
+	literals := literalValues(names)
+	if len(literals) > 0 {
+		conditions = append(conditions, "e.index_name IN ("+placeholders(len(literals))+")")
+		for _, l := range literals {
+			args = append(args, l)
+		}
+	}
+	for _, n := range names {
+		if strings.Contains(n, "*") {
+			escaped := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(strings.ToLower(n))
+			conditions = append(conditions, "e.index_name LIKE ? ESCAPE '\\'")
+			args = append(args, strings.ReplaceAll(escaped, "*", "%"))
+		}
+	}
+	return conditions, args
+}
+
+// indexName returns the name of the index the event should be stored in.
+func indexName(evt events.Event) string {
+	if evt.Index == "" {
+		return events.DefaultIndex
+	}
+	return evt.Index
+}
+
+// isColumnField returns true if the field is stored in its own column instead of being extracted from the raw event.
+func isColumnField(key string) bool {
+	return key == "host" || key == "source" || key == "index"
+}
+
+// addIndexedFieldConditions adds conditions which exclude events based on their indexed fields.
+// Events which do not have a field indexed are not excluded by the conditions, and the exact field values are still checked after the
+// fields have been extracted. Only fields which were extracted with one of the IndexedFieldsVersions of the search are used, since the
+// values of fields extracted with another version may be stale.
+func addIndexedFieldConditions(qb *queryBuilder, srch *search.Search) {
+	if len(srch.IndexedFieldsVersions) == 0 {
+		return
+	}
+	versions := sortedSetKeys(srch.IndexedFieldsVersions)
+	for _, k := range sortedFieldKeys(srch.Fields) {
+		if isColumnField(k) {
+			continue
+		}
+		patterns := make([]string, len(srch.Fields[k]))
+		args := make([]any, 0, len(srch.Fields[k])+len(versions)+1)
+		args = append(args, k)
+		args = appendStrings(args, versions)
+		for i, v := range srch.Fields[k] {
+			patterns[i] = "f.value LIKE ? ESCAPE '\\'"
+			args = append(args, fieldValueToLikePattern(v))
+		}
+		qb.where("NOT EXISTS (SELECT 1 FROM EventFields f WHERE f.event_id = e.id AND f.key = ? AND f.version IN ("+placeholders(len(versions))+") AND NOT ("+strings.Join(patterns, " OR ")+"))", args...)
+	}
+	for _, k := range sortedFieldKeys(srch.NotFields) {
+		if isColumnField(k) {
+			continue
+		}
+		values := literalValues(srch.NotFields[k])
+		if len(values) == 0 {
+			continue
+		}
+		args := make([]any, 0, len(values)+len(versions)+1)
+		args = append(args, k)
+		args = appendStrings(args, versions)
+		args = appendStrings(args, values)
+		qb.where("NOT EXISTS (SELECT 1 FROM EventFields f WHERE f.event_id = e.id AND f.key = ? AND f.version IN ("+placeholders(len(versions))+") AND f.value IN ("+placeholders(len(values))+"))", args...)
+	}
+}
+
+func describeIndexedField(key string, values []string, not bool) string {
+	op := "="
+	if not {
+		op = "!="
+	}
+	if len(values) == 1 {
+		return key + op + values[0] + " (indexed field)"
+	}
+	op = " IN "
+	if not {
+		op = " NOT IN "
+	}
+	return key + op + "(" + strings.Join(values, ", ") + ") (indexed field)"
+}
+
+// fieldValueToLikePattern converts a field value from a search to a LIKE pattern which matches all values containing it.
+func fieldValueToLikePattern(value string) string {
+	escaped := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(strings.ToLower(value))
+	return "%" + strings.ReplaceAll(escaped, "*", "%") + "%"
+}
+
+// literalValues returns the lowercased values which do not contain wildcards.
+func literalValues(values []string) []string {
+	ret := make([]string, 0, len(values))
+	for _, v := range values {
+		if !strings.Contains(v, "*") {
+			ret = append(ret, strings.ToLower(v))
+		}
+	}
+	return ret
+}
+
+func appendStrings(args []any, values []string) []any {
+	for _, v := range values {
+		args = append(args, v)
+	}
+	return args
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func sortedSetKeys(m map[string]struct{}) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func sortedFieldKeys(m map[string][]string) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// fieldsVersion returns the value of the version column for the indexed fields of the event, which is NULL if the version is unknown.
+func fieldsVersion(evt events.Event) any {
+	if evt.IndexedFieldsVersion == "" {
+		return nil
+	}
+	return evt.IndexedFieldsVersion
+}
+
+func (repo *postgresEventRepository) GetIndexedFields(ids []int64) (map[int64]events.StoredFields, error) {
+	ret := make(map[int64]events.StoredFields, len(ids))
+	if len(ids) == 0 {
+		return ret, nil
+	}
+	rows, err := repo.conn.Query(context.TODO(), "SELECT event_id, key, value, version FROM EventFields WHERE event_id = ANY($1);", ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get indexed fields for numIds=%v: %w", len(ids), err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var key, value string
+		var version *string
+		err = rows.Scan(&id, &key, &value, &version)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan indexed field: %w", err)
+		}
+		sf, ok := ret[id]
+		if !ok {
+			sf = events.StoredFields{Fields: map[string]string{}}
+			if version != nil {
+				sf.Version = *version
+			}
 		}
+		sf.Fields[key] = value
+		ret[id] = sf
 	}
-	if len(matchString) > 0 && len(nots) > 0 {
-		matchString += "& "
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get indexed fields for numIds=%v: %w", len(ids), err)
+	}
+	return ret, nil
+}
+
+func (repo *postgresEventRepository) GetIndexedFieldValueCounts(fieldName string, limit int) (map[string]int, error) {
+	rows, err := repo.conn.Query(context.TODO(), "SELECT value, COUNT(*) FROM EventFields WHERE key = $1 GROUP BY value ORDER BY COUNT(*) DESC LIMIT $2;", fieldName, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get value counts for indexed field with fieldName=%v: %w", fieldName, err)
 	}
-	for i, s := range nots {
-		matchString += "! " + strings.ReplaceAll(s, "*", ":*")
-		if i != len(nots)-1 {
-			matchString += " & "
+	defer rows.Close()
+	ret := map[string]int{}
+	for rows.Next() {
+		var value string
+		var count int
+		err = rows.Scan(&value, &count)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan value count for indexed field with fieldName=%v: %w", fieldName, err)
 		}
+		ret[value] = count
 	}
-	return matchString
+	return ret, nil
 }
 
 func (repo *postgresEventRepository) GetByIds(ids []int64, sortMode events.SortMode) ([]events.EventWithId, error) {
@@ -291,7 +590,7 @@ func (repo *postgresEventRepository) GetByIds(ids []int64, sortMode events.SortM
 	}
 	ret := make([]events.EventWithId, 0, len(ids))
 	// TODO: I'm PRETTY sure this code is garbage
-	stmt := "SELECT e.id, e.host, e.source, e.source_id, e.timestamp, r.raw FROM Events e INNER JOIN EventRaws r ON r.event_id = e.id WHERE e.id IN ("
+	stmt := "SELECT e.id, e.host, e.source, e.source_id, e.index_name, e.timestamp, e.\"offset\", r.raw FROM Events e INNER JOIN EventRaws r ON r.event_id = e.id WHERE e.id IN ("
 	for i, id := range ids {
 		if i == len(ids)-1 {
 			stmt += strconv.FormatInt(id, 10)
@@ -302,7 +601,9 @@ func (repo *postgresEventRepository) GetByIds(ids []int64, sortMode events.SortM
 	stmt += ")"
 
 	if sortMode == events.SortModeTimestampDesc {
-		stmt += " ORDER BY e.timestamp DESC;"
+		stmt += " ORDER BY e.timestamp DESC, e.id DESC;"
+	} else if sortMode == events.SortModeTimestampAsc {
+		stmt += " ORDER BY e.timestamp ASC, e.id ASC;"
 	} else {
 		stmt += ";"
 	}
@@ -316,7 +617,7 @@ func (repo *postgresEventRepository) GetByIds(ids []int64, sortMode events.SortM
 	idx := 0
 	for res.Next() {
 		ret = append(ret, events.EventWithId{})
-		err = res.Scan(&ret[idx].Id, &ret[idx].Host, &ret[idx].Source, &ret[idx].SourceId, &ret[idx].Timestamp, &ret[idx].Raw)
+		err = res.Scan(&ret[idx].Id, &ret[idx].Host, &ret[idx].Source, &ret[idx].SourceId, &ret[idx].Index, &ret[idx].Timestamp, &ret[idx].Offset, &ret[idx].Raw)
 		if err != nil {
 			return nil, fmt.Errorf("error when scanning row in GetByIds: %w", err)
 		}
@@ -337,8 +638,8 @@ func (repo *postgresEventRepository) GetByIds(ids []int64, sortMode events.SortM
 }
 
 const surroundingBaseSQL = "SELECT source_id, \"offset\" FROM Events WHERE id=$1"
-const surroundingUpSQL = "SELECT e.id, e.host, e.source, e.source_id, e.timestamp, r.raw FROM Events e INNER JOIN EventRaws r ON r.event_id = e.id WHERE e.source_id=$1 AND e.\"offset\"<=$2 ORDER BY e.\"offset\" DESC LIMIT $3"
-const surroundingDownSQL = "SELECT id, host, source, source_id, timestamp, raw FROM (SELECT e.id, e.host, e.source, e.source_id, e.timestamp, e.\"offset\", r.raw FROM Events e INNER JOIN EventRaws r ON r.event_id = e.id WHERE e.source_id=$1 AND e.\"offset\">$2 ORDER BY e.\"offset\" ASC LIMIT $3) x ORDER BY \"offset\" DESC"
+const surroundingUpSQL = "SELECT e.id, e.host, e.source, e.source_id, e.index_name, e.timestamp, e.\"offset\", r.raw FROM Events e INNER JOIN EventRaws r ON r.event_id = e.id WHERE e.source_id=$1 AND e.\"offset\"<=$2 ORDER BY e.\"offset\" DESC LIMIT $3"
+const surroundingDownSQL = "SELECT id, host, source, source_id, index_name, timestamp, \"offset\", raw FROM (SELECT e.id, e.host, e.source, e.source_id, e.index_name, e.timestamp, e.\"offset\", r.raw FROM Events e INNER JOIN EventRaws r ON r.event_id = e.id WHERE e.source_id=$1 AND e.\"offset\">$2 ORDER BY e.\"offset\" ASC LIMIT $3) x ORDER BY \"offset\" DESC"
 
 func (repo *postgresEventRepository) GetSurroundingEvents(id int64, count int) ([]events.EventWithId, error) {
 	row := repo.conn.QueryRow(context.TODO(), surroundingBaseSQL, id)
@@ -369,7 +670,7 @@ func queryAndScan(conn *pgxpool.Pool, query string, sourceId string, baseOffset
 	}
 	for rows.Next() {
 		var evt events.EventWithId
-		err := rows.Scan(&evt.Id, &evt.Host, &evt.Source, &evt.SourceId, &evt.Timestamp, &evt.Raw)
+		err := rows.Scan(&evt.Id, &evt.Host, &evt.Source, &evt.SourceId, &evt.Index, &evt.Timestamp, &evt.Offset, &evt.Raw)
 		if err != nil {
 			return nil, err
 		}
@@ -377,3 +678,15 @@ func queryAndScan(conn *pgxpool.Pool, query string, sourceId string, baseOffset
 	}
 	return ret, nil
 }
+
+// filterMatching removes the events which do not match from evts, reusing its backing array. It is used by FilterStream when the tsqueries
+// only narrow down the candidates.
+func filterMatching(m *search.Matcher, evts []events.EventWithId) []events.EventWithId {
+	ret := evts[:0]
+	for _, evt := range evts {
+		if m.Matches(evt.Raw, evt.Host, evt.Source, evt.Index) {
+			ret = append(ret, evt)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,106 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres_events
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// queryBuilder builds an SQL statement where all values are passed as bound parameters instead of being part of the statement.
+type queryBuilder struct {
+	conditions []string
+	args       []any
+}
+
+// where adds a condition to the statement. The condition must use ? placeholders for all values, and args must contain one value per
+// placeholder. The placeholders are replaced with numbered parameters ($1, $2 etc.) when the condition is added.
+func (qb *queryBuilder) where(condition string, args ...any) {
+	for _, arg := range args {
+		qb.args = append(qb.args, arg)
+		condition = strings.Replace(condition, "?", "$"+strconv.Itoa(len(qb.args)), 1)
+	}
+	qb.conditions = append(qb.conditions, condition)
+}
+
+// build returns the statement and its parameters. The conditions are combined using AND and placed between selectFrom and suffix.
+func (qb *queryBuilder) build(selectFrom string, suffix string) (string, []any) {
+	stmt := selectFrom
+	if len(qb.conditions) > 0 {
+		stmt += " WHERE " + strings.Join(qb.conditions, " AND ")
+	}
+	return stmt + suffix, qb.args
+}
+
+// createTsQuery creates a query for to_tsquery which matches all of the includes and none of the nots.
+// Values are converted to terms using tsQueryTerm, so quotes and operators in the values are never interpreted as query syntax.
+// Returns an empty string if there is nothing to match, and false if any of the values could not be converted to a term, which means that
+// the query only narrows down the candidates and the events it matches must be checked.
+func createTsQuery(includes, nots []string) (string, bool) {
+	exact := true
+	terms := make([]string, 0, len(includes)+len(nots))
+	for _, s := range includes {
+		if term, ok := tsQueryTerm(s); ok {
+			terms = append(terms, term)
+		} else {
+			exact = false
+		}
+	}
+	for _, s := range nots {
+		if term, ok := tsQueryTerm(s); ok {
+			terms = append(terms, "!("+term+")")
+		} else {
+			exact = false
+		}
+	}
+	return strings.Join(terms, " & "), exact
+}
+
+// tsQueryTerm converts a value from a search to a term for to_tsquery, for example "Hello, world*" becomes 'hello' <-> 'world':*.
+// The value is split into words consisting of letters and digits, and the words are quoted and joined using the followed by operator
+// so that they are matched as a phrase. A * at the end of the value makes the last word a prefix match, any other characters are dropped.
+// Returns false if the value does not contain any words, or if it contains a * anywhere but at the end. A * at the start of a word would
+// need a suffix match, and a * within a phrase would need to match any number of words, which to_tsquery cannot do.
+func tsQueryTerm(value string) (string, bool) {
+	if i := strings.IndexByte(value, '*'); i != -1 && i != len(value)-1 {
+		return "", false
+	}
+	words := []string{}
+	var sb strings.Builder
+	endWord := func(prefix bool) {
+		if sb.Len() == 0 {
+			return
+		}
+		word := "'" + sb.String() + "'"
+		if prefix {
+			word += ":*"
+		}
+		words = append(words, word)
+		sb.Reset()
+	}
+	for _, r := range value {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			sb.WriteRune(unicode.ToLower(r))
+		} else {
+			endWord(r == '*')
+		}
+	}
+	endWord(false)
+	if len(words) == 0 {
+		return "", false
+	}
+	return strings.Join(words, " <-> "), true
+}
@@ -0,0 +1,139 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres_events
+
+import (
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/parser"
+)
+
+var tsQueryTermTests = []struct {
+	value    string
+	expected string
+	ok       bool
+}{
+	{"hello", "'hello'", true},
+	{"Hello, World*", "'hello' <-> 'world':*", true},
+	{"it's", "'it' <-> 's'", true},
+	{"a & !b | c", "'a' <-> 'b' <-> 'c'", true},
+	// Leading and interior wildcards can not be pushed down, so the events are checked by a search.Matcher instead
+	{"*access*", "", false},
+	{"*Exception", "", false},
+	{"foo*bar", "", false},
+	{"Null*Pointer*", "", false},
+	{"héllo", "'héllo'", true},
+	{"***", "", false},
+	{"'); DROP TABLE Events; --", "'drop' <-> 'table' <-> 'events'", true},
+}
+
+func TestTsQueryTerm(t *testing.T) {
+	for _, tt := range tsQueryTermTests {
+		term, ok := tsQueryTerm(tt.value)
+		if ok != tt.ok {
+			t.Fatalf("got unexpected ok for value=%v, expected=%v, got=%v", tt.value, tt.ok, ok)
+		}
+		if ok && term != tt.expected {
+			t.Fatalf("got unexpected term for value=%v, expected=%v, got=%v", tt.value, tt.expected, term)
+		}
+	}
+}
+
+func TestCreateTsQuery(t *testing.T) {
+	got, exact := createTsQuery([]string{"a", "b*"}, []string{"c d"})
+	expected := "'a' & 'b':* & !('c' <-> 'd')"
+	if got != expected || !exact {
+		t.Fatalf("got unexpected tsquery, expected=%v (exact), got=%v (exact=%v)", expected, got, exact)
+	}
+	got, exact = createTsQuery([]string{"a", "*b"}, []string{"!"})
+	expected = "'a'"
+	if got != expected || exact {
+		t.Fatalf("got unexpected tsquery, expected=%v (not exact), got=%v (exact=%v)", expected, got, exact)
+	}
+}
+
+func TestFilterStreamStatementWildcards(t *testing.T) {
+	srch, err := parser.Parse("hello *access*")
+	if err != nil {
+		t.Fatalf("got error when parsing search: %v", err)
+	}
+	stmt, args := buildFilterStreamStatement(srch, nil, nil, 1, events.SortModeTimestampDesc, nil)
+	if !reflect.DeepEqual(args, []any{int64(1), "'hello'"}) {
+		t.Fatalf("expected only hello to be pushed down, got stmt=%v, args=%v", stmt, args)
+	}
+	if _, exact := createTsQueries(srch); exact {
+		t.Fatalf("expected the tsqueries to not be exact when *access* is not pushed down")
+	}
+}
+
+var placeholderRegexp = regexp.MustCompile(`\$(\d+)`)
+var lexemeRegexp = regexp.MustCompile(`'[^'\\]+'`)
+var tsQueryPlaceholderRegexp = regexp.MustCompile(`to_tsquery\('simple', \$(\d+)\)`)
+
+func FuzzFilterStreamStatement(f *testing.F) {
+	for _, s := range []string{
+		"hello",
+		"don't",
+		"\"it's ok\"",
+		"NOT bye",
+		"a & b | !c <-> d:*",
+		"x=y'z",
+		"source=*'* host=\"a\\\"b\"",
+		"userid IN (1, *2, '3')",
+		"NOT \"a -b\" x!=\"%_\\\\\"",
+		"*",
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, searchString string) {
+		srch, err := parser.Parse(searchString)
+		if err != nil {
+			return
+		}
+		startTime := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+		stmt, args := buildFilterStreamStatement(srch, &startTime, nil, 1, events.SortModeTimestampDesc, &filterStreamCursor{timestamp: startTime, id: 1})
+
+		// Every value must be passed as a parameter, so the only quotes in the statement should be the ones in the static parts
+		withoutStatic := strings.NewReplacer("'simple'", "", "'\\'", "").Replace(stmt)
+		if strings.Contains(withoutStatic, "'") {
+			t.Fatalf("got unexpected quote in statement for searchString=%q, stmt=%v", searchString, stmt)
+		}
+		placeholders := placeholderRegexp.FindAllStringSubmatch(stmt, -1)
+		for i, p := range placeholders {
+			if p[1] != strconv.Itoa(i+1) {
+				t.Fatalf("got unexpected placeholder for searchString=%q, expected=$%v, got=%v, stmt=%v", searchString, i+1, p[0], stmt)
+			}
+		}
+		if len(placeholders) != len(args) {
+			t.Fatalf("got mismatching number of placeholders and parameters for searchString=%q, stmt=%v, args=%v", searchString, stmt, args)
+		}
+
+		// The tsqueries may only consist of quoted lexemes and operators
+		for _, m := range tsQueryPlaceholderRegexp.FindAllStringSubmatch(stmt, -1) {
+			i, _ := strconv.Atoi(m[1])
+			tsQuery := args[i-1].(string)
+			operators := lexemeRegexp.ReplaceAllString(tsQuery, "")
+			if strings.Trim(operators, " &!()<->:*") != "" {
+				t.Fatalf("got unexpected characters in tsquery for searchString=%q, tsquery=%v", searchString, tsQuery)
+			}
+		}
+	})
+}
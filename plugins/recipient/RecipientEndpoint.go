@@ -18,7 +18,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
-	"path/filepath"
 	"strings"
 	"time"
 
@@ -101,17 +100,7 @@ func (er *RecipientEndpoint) Start() error {
 				continue
 			}
 			for i, ifc := range indexedFileConfigs {
-				absGlob, err := filepath.Abs(ifc.Filename)
-				if err != nil {
-					// TODO:
-					continue
-				}
-				absSource, err := filepath.Abs(evt.Source)
-				if err != nil {
-					// TODO:
-					continue
-				}
-				if m, err := filepath.Match(absGlob, absSource); err == nil && m {
+				if ifc.Matches(evt.Source) {
 					sourceToConfig[evt.Source] = &indexedFileConfigs[i]
 					goto nextfile
 				}
@@ -121,11 +110,12 @@ func (er *RecipientEndpoint) Start() error {
 		processed := make([]events.Event, len(req.Events))
 		for i, evt := range req.Events {
 			processed[i] = events.Event{
-				Raw:      evt.Raw,
-				Host:     evt.Host,
-				Source:   evt.Source,
-				SourceId: evt.SourceId,
-				Offset:   evt.Offset,
+				Raw:         evt.Raw,
+				Host:        evt.Host,
+				Source:      evt.Source,
+				SourceId:    evt.SourceId,
+				Offset:      evt.Offset,
+				Fingerprint: evt.Fingerprint,
 			}
 
 			ifc, ok := sourceToConfig[evt.Source]
@@ -153,6 +143,9 @@ func (er *RecipientEndpoint) Start() error {
 					slog.Any("fields", fields))
 				processed[i].Timestamp = time.Now()
 			}
+			processed[i].IndexedFields = events.SelectIndexedFields(fields, ifc.IndexedFields)
+			processed[i].IndexedFieldsVersion = parser.ExtractorVersion(ifc.FileParser, ifc.IndexedFields)
+			processed[i].Index = ifc.Index
 		}
 		err = er.repo.AddBatch(processed)
 		if err != nil {
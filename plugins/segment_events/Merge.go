@@ -0,0 +1,281 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package segment_events
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Every AddBatch creates new segments, so without merging the number of segments, and the number of files searches have to read, would
+// grow with every batch. Segments are merged using a tiered policy: the segments of a bucket are grouped into levels by their number of
+// events, and when a level has mergeFactor segments they are merged into one segment on the next level. This means each event is only
+// rewritten a few times. Buckets which no longer receive events are merged into a single segment, and segments where at least half of the
+// events have been deleted are rewritten on their own to free the space used by the deleted events.
+
+// mergeFactor is the number of segments on the same level which are merged together.
+const mergeFactor = 8
+
+// levelBaseDocs is the largest number of events in a segment on the lowest level.
+const levelBaseDocs = 1000
+
+// mergeInterval is how often the segments are checked for merges when no events are being added, so that buckets which stop receiving
+// events are eventually merged into a single segment.
+const mergeInterval = time.Minute
+
+func (repo *segmentEventRepository) triggerMerge() {
+	select {
+	case repo.mergeCh <- struct{}{}:
+	default:
+	}
+}
+
+func (repo *segmentEventRepository) mergeLoop() {
+	defer repo.mergeWg.Done()
+	ticker := time.NewTicker(mergeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-repo.stopCh:
+			return
+		case <-repo.mergeCh:
+		case <-ticker.C:
+		}
+		repo.mergeAll(time.Now())
+	}
+}
+
+// mergeAll merges segments until there is nothing left to merge or the repository is closed.
+func (repo *segmentEventRepository) mergeAll(now time.Time) {
+	for {
+		select {
+		case <-repo.stopCh:
+			return
+		default:
+		}
+		segs := repo.findMerge(now)
+		if segs == nil {
+			return
+		}
+		err := repo.mergeSegments(segs)
+		releaseAll([][]*segment{segs})
+		if err != nil {
+			repo.logger.Error("failed to merge segments", slog.Any("error", err))
+			return
+		}
+	}
+}
+
+// findMerge returns the segments which should be merged next after acquiring a reference to each of them, or nil if there is nothing to
+// merge.
+func (repo *segmentEventRepository) findMerge(now time.Time) []*segment {
+	snap := repo.snapshot(nil)
+	var ret []*segment
+	for _, segs := range snap {
+		ret = repo.mergeCandidates(segs, now)
+		if ret != nil {
+			break
+		}
+	}
+	for _, segs := range snap {
+		for _, s := range segs {
+			if !containsSegment(ret, s) {
+				s.release()
+			}
+		}
+	}
+	return ret
+}
+
+// mergeCandidates returns the segments of a bucket which should be merged, or nil if none should be merged.
+func (repo *segmentEventRepository) mergeCandidates(segs []*segment, now time.Time) []*segment {
+	if len(segs) == 0 {
+		return nil
+	}
+	if _, end := repo.bucketRange(segs[0].bucket); len(segs) > 1 && end+int64(repo.bucketDuration) < now.UnixNano() {
+		return segs
+	}
+	levels := map[int][]*segment{}
+	for _, s := range segs {
+		l := level(s.liveDocs())
+		levels[l] = append(levels[l], s)
+		if len(levels[l]) == mergeFactor {
+			return levels[l]
+		}
+	}
+	for _, s := range segs {
+		if needsPurge(s) {
+			return []*segment{s}
+		}
+	}
+	return nil
+}
+
+func level(numDocs int) int {
+	ret := 0
+	for n := numDocs / levelBaseDocs; n > 0; n /= mergeFactor {
+		ret++
+	}
+	return ret
+}
+
+// needsPurge returns true if at least half of the events in the segment have been deleted.
+func needsPurge(s *segment) bool {
+	live := s.liveDocs()
+	return live < s.numDocs() && live*2 <= s.numDocs()
+}
+
+func containsSegment(segs []*segment, s *segment) bool {
+	for _, s2 := range segs {
+		if s2 == s {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeSegments writes the events which have not been deleted from the segments, which must belong to the same bucket, to a new segment
+// and replaces the segments with it. The caller must hold a reference to each segment. Nothing is done if any of the segments has been
+// removed from the repository while the new segment was being written.
+func (repo *segmentEventRepository) mergeSegments(segs []*segment) error {
+	startTime := time.Now()
+	bucket := segs[0].bucket
+	deleted := make(map[*segment][]bool, len(segs))
+	newDocs := make(map[*segment][]int32, len(segs))
+	refs := []eventRef{}
+	for _, s := range segs {
+		deleted[s] = s.copyDeleted()
+		newDocs[s] = make([]int32, s.numDocs())
+		for d := range s.ids {
+			newDocs[s][d] = -1
+			if !deleted[s][d] {
+				refs = append(refs, eventRef{seg: s, doc: uint32(d)})
+			}
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].id() < refs[j].id() })
+
+	repo.writeMu.Lock()
+	name := segmentName(bucket, repo.nextSeq)
+	repo.nextSeq++
+	repo.writeMu.Unlock()
+	tmpPath := filepath.Join(repo.dir, name+tmpExt)
+	if len(refs) > 0 {
+		replaces := make([]string, len(segs))
+		for i, s := range segs {
+			replaces[i] = s.name
+		}
+		err := writeMergedSegment(tmpPath, refs, newDocs, replaces)
+		if err != nil {
+			return fmt.Errorf("failed to write merged segment=%v: %w", name, err)
+		}
+	}
+
+	repo.writeMu.Lock()
+	defer repo.writeMu.Unlock()
+	repo.mu.RLock()
+	current := repo.buckets[bucket]
+	repo.mu.RUnlock()
+	for _, s := range segs {
+		if !containsSegment(current, s) {
+			os.Remove(tmpPath)
+			return nil
+		}
+	}
+	// Events may have been deleted from the segments while the merged segment was written, so those tombstones are copied to the merged
+	// segment before it replaces the segments
+	var tombstones []byte
+	numDeleted := 0
+	for _, s := range segs {
+		for d, del := range s.copyDeleted() {
+			if del && !deleted[s][d] && newDocs[s][d] >= 0 {
+				tombstones = binary.LittleEndian.AppendUint32(tombstones, uint32(newDocs[s][d]))
+				numDeleted++
+			}
+		}
+	}
+	if numDeleted == len(refs) {
+		os.Remove(tmpPath)
+		repo.removeSegments(segs)
+		repo.logger.Info("removed segments without events",
+			slog.Int("numSegments", len(segs)))
+		return nil
+	}
+	tombstonesPath := filepath.Join(repo.dir, name+tombstonesExt)
+	if len(tombstones) > 0 {
+		err := appendTombstones(tombstonesPath, tombstones)
+		if err != nil {
+			os.Remove(tmpPath)
+			return fmt.Errorf("failed to copy tombstones to merged segment=%v: %w", name, err)
+		}
+	}
+	merged, err := repo.installSegment(tmpPath, name)
+	if err != nil {
+		os.Remove(tombstonesPath)
+		return err
+	}
+	repo.mu.Lock()
+	newSegs := []*segment{merged}
+	for _, s := range repo.buckets[bucket] {
+		if !containsSegment(segs, s) {
+			newSegs = append(newSegs, s)
+		}
+	}
+	sortSegments(newSegs)
+	repo.buckets[bucket] = newSegs
+	repo.mu.Unlock()
+	for _, s := range segs {
+		s.retire()
+	}
+	repo.logger.Info("merged segments",
+		slog.String("segment", name),
+		slog.Int("numSegments", len(segs)),
+		slog.Int("numEvents", len(refs)-numDeleted),
+		slog.Duration("duration", time.Since(startTime)))
+	return nil
+}
+
+// writeMergedSegment writes the events to a new segment at path, recording the document number of each event in the new segment in
+// newDocs.
+func writeMergedSegment(path string, refs []eventRef, newDocs map[*segment][]int32, replaces []string) error {
+	sw, err := newSegmentWriter(path)
+	if err != nil {
+		return err
+	}
+	cache := blockCache{}
+	for _, r := range refs {
+		// Each segment is read in order, so only the block currently being read from each segment needs to be cached
+		if len(cache) > 2*len(newDocs) {
+			cache = blockCache{}
+		}
+		raw, err := cache.raw(r.seg, r.doc)
+		if err != nil {
+			sw.abort()
+			return err
+		}
+		newDocs[r.seg][r.doc] = int32(sw.numDocs())
+		err = sw.add(r.seg.doc(r.doc, raw))
+		if err != nil {
+			sw.abort()
+			return err
+		}
+	}
+	return sw.finish(replaces)
+}
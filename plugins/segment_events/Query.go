@@ -0,0 +1,336 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package segment_events
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/search"
+)
+
+// tokenize calls fn with each term in s. A term is a run of the characters matched by \w, that is ASCII letters, digits and underscores,
+// converted to lower case. This means that a fragment without wildcards matches an event exactly when the event contains the terms of the
+// fragment, in the same way as the regular expressions created by search.CompileFragment decide whether a fragment is a whole word.
+// Terms longer than maxTermLength are skipped.
+func tokenize(s string, fn func(term string)) {
+	start := -1
+	lower := false
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) && isWordByte(s[i]) {
+			if start < 0 {
+				start = i
+				lower = true
+			}
+			if 'A' <= s[i] && s[i] <= 'Z' {
+				lower = false
+			}
+			continue
+		}
+		if start >= 0 && i-start <= maxTermLength {
+			if lower {
+				fn(s[start:i])
+			} else {
+				fn(strings.ToLower(s[start:i]))
+			}
+		}
+		start = -1
+	}
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// fragmentQuery describes how the events matching a fragment are found.
+type fragmentQuery struct {
+	// rex matches the raw events which contain the fragment. It is nil if the fragment could not be compiled, in which case the
+	// fragment does not affect which events are returned.
+	rex *regexp.Regexp
+	// terms are terms which every matching event contains.
+	terms []string
+	// prefixes are prefixes of terms which every matching event contains.
+	prefixes []string
+	// exact is true if the events containing terms are exactly the events matching the fragment, so rex does not need to be checked.
+	exact bool
+}
+
+// newFragmentQuery finds the terms in each part of the fragment between wildcards. A term which is surrounded by word boundaries in the
+// fragment, like "error" in "error*" or "*an error", must be a term in the event, while a term which is only preceded by a word boundary,
+// like "null" in "null*", must be the prefix of a term in the event. Other terms, like "exception" in "*exception", can not be looked up
+// in the term dictionary, so those fragments are matched by reading the raw events.
+func newFragmentQuery(frag string) fragmentQuery {
+	rex, err := search.CompileFragment(frag)
+	ret := fragmentQuery{rex: rex}
+	if err != nil {
+		return ret
+	}
+	parts := strings.Split(frag, "*")
+	numTokens := 0
+	for i, p := range parts {
+		start := -1
+		for j := 0; j <= len(p); j++ {
+			if j < len(p) && isWordByte(p[j]) {
+				if start < 0 {
+					start = j
+				}
+				continue
+			}
+			if start < 0 {
+				continue
+			}
+			numTokens++
+			token := strings.ToLower(p[start:j])
+			leftBounded := start > 0 || i == 0
+			rightBounded := j < len(p) || i == len(parts)-1
+			if leftBounded && rightBounded && len(token) <= maxTermLength {
+				ret.terms = append(ret.terms, token)
+			} else if leftBounded && len(token) <= maxTermLength {
+				ret.prefixes = append(ret.prefixes, token)
+			}
+			start = -1
+		}
+	}
+	ret.exact = len(parts) == 1 && numTokens == 1 && len(ret.terms) == 1 && len(ret.terms[0]) == len(frag)
+	return ret
+}
+
+// query is a search compiled to be executed against segments.
+type query struct {
+	fragments    []fragmentQuery
+	notFragments []fragmentQuery
+
+	// matcher decides which hosts, sources and indexes are allowed
+	matcher *search.Matcher
+
+	// startTime and endTime are the time range of the search in nanoseconds since the Unix epoch, inclusive
+	startTime int64
+	endTime   int64
+}
+
+func newQuery(srch *search.Search, searchStartTime, searchEndTime *time.Time) *query {
+	q := &query{
+		matcher:   search.NewMatcher(srch),
+		startTime: minTimestamp,
+		endTime:   maxTimestamp,
+	}
+	for _, f := range sortedSetKeys(srch.Fragments) {
+		if fq := newFragmentQuery(f); fq.rex != nil {
+			q.fragments = append(q.fragments, fq)
+		}
+	}
+	for _, f := range sortedSetKeys(srch.NotFragments) {
+		if fq := newFragmentQuery(f); fq.rex != nil {
+			q.notFragments = append(q.notFragments, fq)
+		}
+	}
+	if searchStartTime != nil {
+		q.startTime = searchStartTime.UnixNano()
+	}
+	if searchEndTime != nil {
+		q.endTime = searchEndTime.UnixNano()
+	}
+	return q
+}
+
+const minTimestamp = -1 << 63
+const maxTimestamp = 1<<63 - 1
+
+// needsRaw returns true if the raw events must be checked to decide whether they match the fragments.
+func (q *query) needsRaw() bool {
+	for _, f := range q.fragments {
+		if !f.exact {
+			return true
+		}
+	}
+	for _, f := range q.notFragments {
+		if !f.exact {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesRaw returns true if the raw event matches the fragments which are not exact.
+func (q *query) matchesRaw(raw string) bool {
+	for _, f := range q.fragments {
+		if !f.exact && !f.rex.MatchString(raw) {
+			return false
+		}
+	}
+	for _, f := range q.notFragments {
+		if !f.exact && f.rex.MatchString(raw) {
+			return false
+		}
+	}
+	return true
+}
+
+// candidates returns the document numbers of the events in the segment which match the terms of the fragments and are not excluded by
+// the exact not fragments, in ascending order. All events in the segment are candidates if the fragments do not have any terms, which
+// is signaled by returning false.
+func (q *query) candidates(s *segment) ([]uint32, bool, error) {
+	var ret []uint32
+	constrained := false
+	for _, f := range q.fragments {
+		for _, t := range f.terms {
+			i, ok := s.findTerm(t)
+			if !ok {
+				return nil, true, nil
+			}
+			p, err := s.readPostings(i)
+			if err != nil {
+				return nil, true, err
+			}
+			ret, constrained = intersectPostings(ret, p, constrained), true
+		}
+		for _, prefix := range f.prefixes {
+			p, err := prefixPostings(s, prefix)
+			if err != nil {
+				return nil, true, err
+			}
+			ret, constrained = intersectPostings(ret, p, constrained), true
+		}
+	}
+	var excluded []uint32
+	for _, f := range q.notFragments {
+		if !f.exact {
+			continue
+		}
+		i, ok := s.findTerm(f.terms[0])
+		if !ok {
+			continue
+		}
+		p, err := s.readPostings(i)
+		if err != nil {
+			return nil, true, err
+		}
+		excluded = unionPostings(excluded, p)
+	}
+	if len(excluded) == 0 {
+		return ret, constrained, nil
+	}
+	if !constrained {
+		ret = make([]uint32, s.numDocs())
+		for i := range ret {
+			ret[i] = uint32(i)
+		}
+	}
+	return subtractPostings(ret, excluded), true, nil
+}
+
+// prefixPostings returns the document numbers of the events in the segment containing a term starting with prefix.
+func prefixPostings(s *segment, prefix string) ([]uint32, error) {
+	var ret []uint32
+	for i := sort.SearchStrings(s.terms, prefix); i < len(s.terms) && strings.HasPrefix(s.terms[i], prefix); i++ {
+		p, err := s.readPostings(i)
+		if err != nil {
+			return nil, err
+		}
+		ret = unionPostings(ret, p)
+	}
+	return ret, nil
+}
+
+// intersectPostings returns the document numbers in both a and b. a is ignored if it is not constrained yet.
+func intersectPostings(a, b []uint32, constrained bool) []uint32 {
+	if !constrained {
+		return b
+	}
+	ret := a[:0]
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i] < b[j] {
+			i++
+		} else if a[i] > b[j] {
+			j++
+		} else {
+			ret = append(ret, a[i])
+			i++
+			j++
+		}
+	}
+	return ret
+}
+
+func unionPostings(a, b []uint32) []uint32 {
+	ret := make([]uint32, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		if j == len(b) || (i < len(a) && a[i] < b[j]) {
+			ret = append(ret, a[i])
+			i++
+		} else if i == len(a) || b[j] < a[i] {
+			ret = append(ret, b[j])
+			j++
+		} else {
+			ret = append(ret, a[i])
+			i++
+			j++
+		}
+	}
+	return ret
+}
+
+// subtractPostings returns the document numbers in a which are not in b.
+func subtractPostings(a, b []uint32) []uint32 {
+	ret := a[:0]
+	j := 0
+	for _, d := range a {
+		for j < len(b) && b[j] < d {
+			j++
+		}
+		if j == len(b) || b[j] != d {
+			ret = append(ret, d)
+		}
+	}
+	return ret
+}
+
+// dictionaryFilter decides which values in the dictionary of a segment are allowed as the host, source and index of a matching event.
+type dictionaryFilter struct {
+	hosts   []bool
+	sources []bool
+	indexes []bool
+}
+
+func (q *query) dictionaryFilter(s *segment) dictionaryFilter {
+	ret := dictionaryFilter{
+		hosts:   make([]bool, len(s.strs)),
+		sources: make([]bool, len(s.strs)),
+		indexes: make([]bool, len(s.strs)),
+	}
+	for i, str := range s.strs {
+		ret.hosts[i] = q.matcher.MatchesHost(str)
+		ret.sources[i] = q.matcher.MatchesSource(str)
+		ret.indexes[i] = q.matcher.MatchesIndex(str)
+	}
+	return ret
+}
+
+func (f dictionaryFilter) matches(s *segment, doc uint32) bool {
+	return f.hosts[s.hosts[doc]] && f.sources[s.sources[doc]] && f.indexes[s.indexes[doc]]
+}
+
+func sortedSetKeys(m map[string]struct{}) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
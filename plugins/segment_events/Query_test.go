@@ -0,0 +1,58 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package segment_events
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	terms := []string{}
+	tokenize("2024-03-01 ERROR [main] user_id=42 said héllo", func(term string) {
+		terms = append(terms, term)
+	})
+	expected := []string{"2024", "03", "01", "error", "main", "user_id", "42", "said", "h", "llo"}
+	if !reflect.DeepEqual(terms, expected) {
+		t.Fatalf("got unexpected terms, expected %v but got %v", expected, terms)
+	}
+}
+
+func TestNewFragmentQuery(t *testing.T) {
+	tests := []struct {
+		frag     string
+		terms    []string
+		prefixes []string
+		exact    bool
+	}{
+		{"Error", []string{"error"}, nil, true},
+		{"error:", []string{"error"}, nil, false},
+		{"user_id=42", []string{"user_id", "42"}, nil, false},
+		{"Null*", nil, []string{"null"}, false},
+		{"*Exception", nil, nil, false},
+		{"*an error", []string{"error"}, nil, false},
+		{"user*logged in", []string{"in"}, []string{"user"}, false},
+		{"*", nil, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.frag, func(t *testing.T) {
+			q := newFragmentQuery(tt.frag)
+			if !reflect.DeepEqual(q.terms, tt.terms) || !reflect.DeepEqual(q.prefixes, tt.prefixes) || q.exact != tt.exact {
+				t.Fatalf("got unexpected query, expected terms=%v prefixes=%v exact=%v but got terms=%v prefixes=%v exact=%v",
+					tt.terms, tt.prefixes, tt.exact, q.terms, q.prefixes, q.exact)
+			}
+		})
+	}
+}
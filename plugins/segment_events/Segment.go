@@ -0,0 +1,864 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package segment_events
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+)
+
+// A segment is an immutable file containing the events from one bucket which were added in the same batch, or which were merged from
+// other segments of the same bucket. The file consists of:
+//
+//   - segmentMagic
+//   - the raw events, in blocks of up to maxBlockSize uncompressed bytes compressed using DEFLATE
+//   - the postings lists, each of which contains the document numbers of the events containing a term as delta encoded uvarints
+//   - the metadata, compressed using DEFLATE, which contains the names of the segments this segment replaces, a dictionary of the hosts,
+//     sources, source IDs and indexes, the columns of the events, the locations of the blocks and the sorted term dictionary
+//   - a footer containing the location of the metadata followed by segmentMagic
+//
+// The document number of an event is its position in the segment. Events are stored in ascending ID order. The metadata is kept in memory
+// while the segment is open, while the blocks and postings lists are read from the file when they are needed.
+//
+// Events are never removed from a segment file. Deleted events are instead recorded in a tombstone file next to the segment, which
+// contains the document number of each deleted event as a little-endian uint32, and are left out when segments are merged.
+
+const segmentMagic = "LSSEG001"
+const segmentExt = ".seg"
+const tombstonesExt = ".del"
+const tmpExt = ".tmp"
+
+// maxBlockSize is the number of uncompressed bytes after which a new block is started. Reading a single event requires decompressing its
+// whole block, so larger blocks compress better but make GetByIds and GetSurroundingEvents slower.
+const maxBlockSize = 64 * 1024
+
+// maxTermLength is the length of the longest term which is added to the term dictionary. Longer words, which are usually things like
+// base64 data, would mostly make the dictionary larger, so fragments containing them are matched by reading the raw events instead.
+const maxTermLength = 64
+
+// segmentDoc is an event being written to a segment.
+type segmentDoc struct {
+	id        int64
+	raw       string
+	timestamp int64
+	offset    int64
+	host      string
+	source    string
+	sourceId  string
+	index     string
+}
+
+func newSegmentDoc(id int64, evt events.Event) segmentDoc {
+	index := evt.Index
+	if index == "" {
+		index = events.DefaultIndex
+	}
+	return segmentDoc{
+		id:        id,
+		raw:       evt.Raw,
+		timestamp: evt.Timestamp.UnixNano(),
+		offset:    evt.Offset,
+		host:      evt.Host,
+		source:    evt.Source,
+		sourceId:  evt.SourceId,
+		index:     index,
+	}
+}
+
+// blockLoc is the location of a compressed block in a segment file. firstDoc is the document number of the first event in the block.
+type blockLoc struct {
+	firstDoc uint32
+	offset   int64
+	length   int64
+}
+
+// postingsLoc is the location of a postings list in a segment file.
+type postingsLoc struct {
+	offset int64
+	length int64
+}
+
+// segmentWriter writes a segment file. The events must be added in ascending ID order.
+type segmentWriter struct {
+	path string
+	f    *os.File
+	w    *bufio.Writer
+	pos  int64
+
+	strs     []string
+	strIndex map[string]uint32
+
+	ids        []int64
+	timestamps []int64
+	offsets    []int64
+	hosts      []uint32
+	sources    []uint32
+	sourceIds  []uint32
+	indexes    []uint32
+
+	blocks     []blockLoc
+	block      bytes.Buffer
+	blockFirst uint32
+
+	postings map[string][]uint32
+}
+
+func newSegmentWriter(path string) (*segmentWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create segment file: %w", err)
+	}
+	sw := &segmentWriter{
+		path:     path,
+		f:        f,
+		w:        bufio.NewWriterSize(f, 256*1024),
+		strIndex: map[string]uint32{},
+		postings: map[string][]uint32{},
+	}
+	err = sw.write([]byte(segmentMagic))
+	if err != nil {
+		sw.abort()
+		return nil, err
+	}
+	return sw, nil
+}
+
+func (sw *segmentWriter) write(b []byte) error {
+	n, err := sw.w.Write(b)
+	sw.pos += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write segment file: %w", err)
+	}
+	return nil
+}
+
+func (sw *segmentWriter) str(s string) uint32 {
+	if i, ok := sw.strIndex[s]; ok {
+		return i
+	}
+	i := uint32(len(sw.strs))
+	sw.strs = append(sw.strs, s)
+	sw.strIndex[s] = i
+	return i
+}
+
+func (sw *segmentWriter) add(doc segmentDoc) error {
+	docNum := uint32(len(sw.ids))
+	sw.ids = append(sw.ids, doc.id)
+	sw.timestamps = append(sw.timestamps, doc.timestamp)
+	sw.offsets = append(sw.offsets, doc.offset)
+	sw.hosts = append(sw.hosts, sw.str(doc.host))
+	sw.sources = append(sw.sources, sw.str(doc.source))
+	sw.sourceIds = append(sw.sourceIds, sw.str(doc.sourceId))
+	sw.indexes = append(sw.indexes, sw.str(doc.index))
+	tokenize(doc.raw, func(term string) {
+		p := sw.postings[term]
+		if len(p) > 0 && p[len(p)-1] == docNum {
+			return
+		}
+		if p == nil {
+			// The term is a substring of the raw event, so it is copied to avoid keeping the whole event in memory
+			term = strings.Clone(term)
+		}
+		sw.postings[term] = append(p, docNum)
+	})
+	if sw.block.Len() == 0 {
+		sw.blockFirst = docNum
+	}
+	sw.block.Write(binary.AppendUvarint(nil, uint64(len(doc.raw))))
+	sw.block.WriteString(doc.raw)
+	if sw.block.Len() >= maxBlockSize {
+		return sw.flushBlock()
+	}
+	return nil
+}
+
+func (sw *segmentWriter) flushBlock() error {
+	if sw.block.Len() == 0 {
+		return nil
+	}
+	compressed, err := compress(sw.block.Bytes())
+	if err != nil {
+		return err
+	}
+	sw.blocks = append(sw.blocks, blockLoc{firstDoc: sw.blockFirst, offset: sw.pos, length: int64(len(compressed))})
+	sw.block.Reset()
+	return sw.write(compressed)
+}
+
+// finish writes the postings lists, metadata and footer and closes the file. replaces are the names of the segments which this segment
+// replaces, which are removed if they still exist when the repository is opened.
+func (sw *segmentWriter) finish(replaces []string) error {
+	err := sw.flushBlock()
+	if err != nil {
+		sw.abort()
+		return err
+	}
+	terms := make([]string, 0, len(sw.postings))
+	for t := range sw.postings {
+		terms = append(terms, t)
+	}
+	sort.Strings(terms)
+	locs := make([]postingsLoc, len(terms))
+	for i, t := range terms {
+		var buf []byte
+		prev := uint32(0)
+		for _, d := range sw.postings[t] {
+			buf = binary.AppendUvarint(buf, uint64(d-prev))
+			prev = d
+		}
+		locs[i] = postingsLoc{offset: sw.pos, length: int64(len(buf))}
+		err = sw.write(buf)
+		if err != nil {
+			sw.abort()
+			return err
+		}
+	}
+
+	var meta []byte
+	meta = appendStrings(meta, replaces)
+	meta = appendStrings(meta, sw.strs)
+	meta = binary.AppendUvarint(meta, uint64(len(sw.ids)))
+	prevId, prevTs := int64(0), int64(0)
+	for i := range sw.ids {
+		meta = binary.AppendVarint(meta, sw.ids[i]-prevId)
+		meta = binary.AppendVarint(meta, sw.timestamps[i]-prevTs)
+		meta = binary.AppendVarint(meta, sw.offsets[i])
+		meta = binary.AppendUvarint(meta, uint64(sw.hosts[i]))
+		meta = binary.AppendUvarint(meta, uint64(sw.sources[i]))
+		meta = binary.AppendUvarint(meta, uint64(sw.sourceIds[i]))
+		meta = binary.AppendUvarint(meta, uint64(sw.indexes[i]))
+		prevId, prevTs = sw.ids[i], sw.timestamps[i]
+	}
+	meta = binary.AppendUvarint(meta, uint64(len(sw.blocks)))
+	for _, b := range sw.blocks {
+		meta = binary.AppendUvarint(meta, uint64(b.firstDoc))
+		meta = binary.AppendUvarint(meta, uint64(b.offset))
+		meta = binary.AppendUvarint(meta, uint64(b.length))
+	}
+	meta = binary.AppendUvarint(meta, uint64(len(terms)))
+	prevTerm := ""
+	for i, t := range terms {
+		// Terms are sorted, so only the part after the prefix shared with the previous term is stored
+		shared := sharedPrefixLength(prevTerm, t)
+		meta = binary.AppendUvarint(meta, uint64(shared))
+		meta = appendString(meta, t[shared:])
+		meta = binary.AppendUvarint(meta, uint64(locs[i].offset))
+		meta = binary.AppendUvarint(meta, uint64(locs[i].length))
+		prevTerm = t
+	}
+	compressed, err := compress(meta)
+	if err != nil {
+		sw.abort()
+		return err
+	}
+	metaOffset := sw.pos
+	err = sw.write(compressed)
+	if err == nil {
+		footer := binary.LittleEndian.AppendUint64(nil, uint64(metaOffset))
+		footer = binary.LittleEndian.AppendUint64(footer, uint64(len(compressed)))
+		err = sw.write(append(footer, segmentMagic...))
+	}
+	if err == nil {
+		err = sw.w.Flush()
+	}
+	if err == nil {
+		err = sw.f.Sync()
+	}
+	if err != nil {
+		sw.abort()
+		return fmt.Errorf("failed to write segment file: %w", err)
+	}
+	err = sw.f.Close()
+	if err != nil {
+		os.Remove(sw.path)
+		return fmt.Errorf("failed to close segment file: %w", err)
+	}
+	return nil
+}
+
+// abort closes and removes the file being written.
+func (sw *segmentWriter) abort() {
+	sw.f.Close()
+	os.Remove(sw.path)
+}
+
+func (sw *segmentWriter) numDocs() int {
+	return len(sw.ids)
+}
+
+// segment is an open segment file.
+type segment struct {
+	name   string
+	dir    string
+	bucket int64
+	seq    int64
+	file   *os.File
+	size   int64
+
+	replaces []string
+
+	strs     []string
+	strIndex map[string]uint32
+
+	ids        []int64
+	timestamps []int64
+	offsets    []int64
+	hosts      []uint32
+	sources    []uint32
+	sourceIds  []uint32
+	indexes    []uint32
+
+	blocks []blockLoc
+
+	terms    []string
+	postings []postingsLoc
+
+	// tombstonesMu protects deleted, numDeleted and tombstonesSize, which change when events are deleted
+	tombstonesMu   sync.RWMutex
+	deleted        []bool
+	numDeleted     int
+	tombstonesSize int64
+
+	// refs is the number of references to the segment. The repository holds one reference while the segment is in use, and each search
+	// holds one while it reads the segment. The file is closed when there are no references left, and removed if the segment is retired.
+	refs    atomic.Int32
+	retired atomic.Bool
+}
+
+// segmentName returns the name of the segment with the given bucket and sequence number.
+func segmentName(bucket int64, seq int64) string {
+	return strconv.FormatInt(bucket, 10) + "_" + strconv.FormatInt(seq, 10)
+}
+
+// parseSegmentName returns the bucket and sequence number of the segment with the given name.
+func parseSegmentName(name string) (int64, int64, error) {
+	bucketStr, seqStr, ok := strings.Cut(name, "_")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid segment name=%v", name)
+	}
+	bucket, err := strconv.ParseInt(bucketStr, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid bucket in segment name=%v: %w", name, err)
+	}
+	seq, err := strconv.ParseInt(seqStr, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid sequence number in segment name=%v: %w", name, err)
+	}
+	return bucket, seq, nil
+}
+
+func (s *segment) path() string {
+	return filepath.Join(s.dir, s.name+segmentExt)
+}
+
+func (s *segment) tombstonesPath() string {
+	return filepath.Join(s.dir, s.name+tombstonesExt)
+}
+
+// openSegment opens the segment with the given name in dir and reads its metadata and tombstones.
+func openSegment(dir, name string) (*segment, error) {
+	bucket, seq, err := parseSegmentName(name)
+	if err != nil {
+		return nil, err
+	}
+	s := &segment{name: name, dir: dir, bucket: bucket, seq: seq}
+	s.file, err = os.Open(s.path())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open segment=%v: %w", name, err)
+	}
+	err = s.readMetadata()
+	if err == nil {
+		err = s.readTombstones()
+	}
+	if err != nil {
+		s.file.Close()
+		return nil, fmt.Errorf("failed to read segment=%v: %w", name, err)
+	}
+	s.refs.Store(1)
+	return s, nil
+}
+
+func (s *segment) readMetadata() error {
+	stat, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	s.size = stat.Size()
+	footerSize := int64(16 + len(segmentMagic))
+	if s.size < int64(len(segmentMagic))+footerSize {
+		return errors.New("file is too small to be a segment")
+	}
+	footer := make([]byte, footerSize)
+	_, err = s.file.ReadAt(footer, s.size-footerSize)
+	if err != nil {
+		return err
+	}
+	if string(footer[16:]) != segmentMagic {
+		return errors.New("file does not end with the segment magic number, it may have been truncated")
+	}
+	metaOffset := int64(binary.LittleEndian.Uint64(footer[0:8]))
+	metaLength := int64(binary.LittleEndian.Uint64(footer[8:16]))
+	if metaOffset < 0 || metaLength < 0 || metaOffset+metaLength > s.size-footerSize {
+		return errors.New("footer contains an invalid metadata location")
+	}
+	compressed := make([]byte, metaLength)
+	_, err = s.file.ReadAt(compressed, metaOffset)
+	if err != nil {
+		return err
+	}
+	meta, err := decompress(compressed)
+	if err != nil {
+		return err
+	}
+	r := metaReader{buf: meta}
+	s.replaces = r.strings()
+	s.strs = r.strings()
+	s.strIndex = make(map[string]uint32, len(s.strs))
+	for i, str := range s.strs {
+		s.strIndex[str] = uint32(i)
+	}
+	numDocs := r.length()
+	s.ids = make([]int64, numDocs)
+	s.timestamps = make([]int64, numDocs)
+	s.offsets = make([]int64, numDocs)
+	s.hosts = make([]uint32, numDocs)
+	s.sources = make([]uint32, numDocs)
+	s.sourceIds = make([]uint32, numDocs)
+	s.indexes = make([]uint32, numDocs)
+	prevId, prevTs := int64(0), int64(0)
+	for i := 0; i < numDocs && r.err == nil; i++ {
+		s.ids[i] = prevId + r.varint()
+		s.timestamps[i] = prevTs + r.varint()
+		s.offsets[i] = r.varint()
+		s.hosts[i] = r.str(len(s.strs))
+		s.sources[i] = r.str(len(s.strs))
+		s.sourceIds[i] = r.str(len(s.strs))
+		s.indexes[i] = r.str(len(s.strs))
+		prevId, prevTs = s.ids[i], s.timestamps[i]
+	}
+	numBlocks := r.length()
+	s.blocks = make([]blockLoc, numBlocks)
+	for i := 0; i < numBlocks && r.err == nil; i++ {
+		s.blocks[i] = blockLoc{firstDoc: uint32(r.uvarint()), offset: int64(r.uvarint()), length: int64(r.uvarint())}
+	}
+	numTerms := r.length()
+	s.terms = make([]string, numTerms)
+	s.postings = make([]postingsLoc, numTerms)
+	prevTerm := ""
+	for i := 0; i < numTerms && r.err == nil; i++ {
+		shared := int(r.uvarint())
+		if shared > len(prevTerm) {
+			r.err = errors.New("invalid term dictionary")
+			break
+		}
+		s.terms[i] = prevTerm[:shared] + r.string()
+		s.postings[i] = postingsLoc{offset: int64(r.uvarint()), length: int64(r.uvarint())}
+		prevTerm = s.terms[i]
+	}
+	if r.err != nil {
+		return fmt.Errorf("failed to read metadata: %w", r.err)
+	}
+	s.deleted = make([]bool, numDocs)
+	return nil
+}
+
+func (s *segment) readTombstones() error {
+	b, err := os.ReadFile(s.tombstonesPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read tombstones: %w", err)
+	}
+	// A partially written tombstone at the end of the file is ignored
+	s.tombstonesSize = int64(len(b))
+	for i := 0; i+4 <= len(b); i += 4 {
+		doc := binary.LittleEndian.Uint32(b[i:])
+		if int(doc) < len(s.deleted) && !s.deleted[doc] {
+			s.deleted[doc] = true
+			s.numDeleted++
+		}
+	}
+	return nil
+}
+
+func (s *segment) numDocs() int {
+	return len(s.ids)
+}
+
+func (s *segment) isDeleted(doc uint32) bool {
+	s.tombstonesMu.RLock()
+	defer s.tombstonesMu.RUnlock()
+	return s.deleted[doc]
+}
+
+// liveDocs returns the number of events in the segment which have not been deleted.
+func (s *segment) liveDocs() int {
+	s.tombstonesMu.RLock()
+	defer s.tombstonesMu.RUnlock()
+	return len(s.ids) - s.numDeleted
+}
+
+// copyDeleted returns a copy of the deleted flags of the events in the segment.
+func (s *segment) copyDeleted() []bool {
+	s.tombstonesMu.RLock()
+	defer s.tombstonesMu.RUnlock()
+	ret := make([]bool, len(s.deleted))
+	copy(ret, s.deleted)
+	return ret
+}
+
+// delete records the events with the given document numbers as deleted and returns the number of events which were not already deleted.
+func (s *segment) delete(docs []uint32) (int, error) {
+	s.tombstonesMu.Lock()
+	defer s.tombstonesMu.Unlock()
+	var buf []byte
+	for _, d := range docs {
+		if !s.deleted[d] {
+			buf = binary.LittleEndian.AppendUint32(buf, d)
+		}
+	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	err := appendTombstones(s.tombstonesPath(), buf)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, d := range docs {
+		if !s.deleted[d] {
+			s.deleted[d] = true
+			n++
+		}
+	}
+	s.numDeleted += n
+	s.tombstonesSize += int64(len(buf))
+	return n, nil
+}
+
+func appendTombstones(path string, buf []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open tombstone file: %w", err)
+	}
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write tombstones: %w", err)
+	}
+	return nil
+}
+
+// storageSize returns the size of the segment file and its tombstone file.
+func (s *segment) storageSize() int64 {
+	s.tombstonesMu.RLock()
+	defer s.tombstonesMu.RUnlock()
+	return s.size + s.tombstonesSize
+}
+
+// findDoc returns the document number of the event with the given ID, or false if the segment does not contain it.
+func (s *segment) findDoc(id int64) (uint32, bool) {
+	if len(s.ids) == 0 || id < s.ids[0] || id > s.ids[len(s.ids)-1] {
+		return 0, false
+	}
+	i := sort.Search(len(s.ids), func(i int) bool { return s.ids[i] >= id })
+	if i < len(s.ids) && s.ids[i] == id {
+		return uint32(i), true
+	}
+	return 0, false
+}
+
+// findTerm returns the index of the term in the term dictionary, or false if no event in the segment contains the term.
+func (s *segment) findTerm(term string) (int, bool) {
+	i := sort.SearchStrings(s.terms, term)
+	return i, i < len(s.terms) && s.terms[i] == term
+}
+
+// readPostings returns the document numbers of the events containing the term at index i in the term dictionary in ascending order.
+func (s *segment) readPostings(i int) ([]uint32, error) {
+	loc := s.postings[i]
+	buf := make([]byte, loc.length)
+	_, err := s.file.ReadAt(buf, loc.offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read postings of term=%v in segment=%v: %w", s.terms[i], s.name, err)
+	}
+	ret := []uint32{}
+	prev := uint64(0)
+	for len(buf) > 0 {
+		d, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid postings of term=%v in segment=%v", s.terms[i], s.name)
+		}
+		prev += d
+		ret = append(ret, uint32(prev))
+		buf = buf[n:]
+	}
+	return ret, nil
+}
+
+// blockOf returns the index of the block containing the event with the given document number.
+func (s *segment) blockOf(doc uint32) int {
+	return sort.Search(len(s.blocks), func(i int) bool { return s.blocks[i].firstDoc > doc }) - 1
+}
+
+// readBlock returns the raw events in the block with the given index.
+func (s *segment) readBlock(i int) ([]string, error) {
+	loc := s.blocks[i]
+	compressed := make([]byte, loc.length)
+	_, err := s.file.ReadAt(compressed, loc.offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read block=%v in segment=%v: %w", i, s.name, err)
+	}
+	data, err := decompress(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress block=%v in segment=%v: %w", i, s.name, err)
+	}
+	ret := []string{}
+	for len(data) > 0 {
+		l, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < l {
+			return nil, fmt.Errorf("invalid block=%v in segment=%v", i, s.name)
+		}
+		ret = append(ret, string(data[n:n+int(l)]))
+		data = data[n+int(l):]
+	}
+	return ret, nil
+}
+
+// event returns the event with the given document number, with raw as its raw event.
+func (s *segment) event(doc uint32, raw string) events.EventWithId {
+	return events.EventWithId{
+		Id:        s.ids[doc],
+		Raw:       raw,
+		Timestamp: time.Unix(0, s.timestamps[doc]).UTC(),
+		Host:      s.strs[s.hosts[doc]],
+		Source:    s.strs[s.sources[doc]],
+		SourceId:  s.strs[s.sourceIds[doc]],
+		Index:     s.strs[s.indexes[doc]],
+		Offset:    s.offsets[doc],
+	}
+}
+
+// doc returns the event with the given document number as a segmentDoc, which is used when merging segments.
+func (s *segment) doc(doc uint32, raw string) segmentDoc {
+	return segmentDoc{
+		id:        s.ids[doc],
+		raw:       raw,
+		timestamp: s.timestamps[doc],
+		offset:    s.offsets[doc],
+		host:      s.strs[s.hosts[doc]],
+		source:    s.strs[s.sources[doc]],
+		sourceId:  s.strs[s.sourceIds[doc]],
+		index:     s.strs[s.indexes[doc]],
+	}
+}
+
+func (s *segment) acquire() {
+	s.refs.Add(1)
+}
+
+// release drops a reference to the segment. The file is closed when the last reference is dropped, and removed together with its
+// tombstones if the segment has been retired.
+func (s *segment) release() {
+	if s.refs.Add(-1) > 0 {
+		return
+	}
+	s.file.Close()
+	if s.retired.Load() {
+		os.Remove(s.path())
+		os.Remove(s.tombstonesPath())
+	}
+}
+
+// retire drops the reference held by the repository after the segment has been removed from it, so that the segment is removed once no
+// search is reading it.
+func (s *segment) retire() {
+	s.retired.Store(true)
+	s.release()
+}
+
+// blockCache caches the decompressed blocks read while handling one call to the repository.
+type blockCache map[blockKey][]string
+
+type blockKey struct {
+	seg   *segment
+	block int
+}
+
+// raw returns the raw event with the given document number in the segment.
+func (c blockCache) raw(s *segment, doc uint32) (string, error) {
+	b := s.blockOf(doc)
+	if b < 0 {
+		return "", fmt.Errorf("no block contains doc=%v in segment=%v", doc, s.name)
+	}
+	k := blockKey{seg: s, block: b}
+	raws, ok := c[k]
+	if !ok {
+		var err error
+		raws, err = s.readBlock(b)
+		if err != nil {
+			return "", err
+		}
+		c[k] = raws
+	}
+	i := int(doc - s.blocks[b].firstDoc)
+	if i >= len(raws) {
+		return "", fmt.Errorf("block=%v in segment=%v is missing doc=%v", b, s.name, doc)
+	}
+	return raws[i], nil
+}
+
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create flate writer: %w", err)
+	}
+	_, err = w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	ret, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %w", err)
+	}
+	return ret, nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendStrings(buf []byte, strs []string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(strs)))
+	for _, s := range strs {
+		buf = appendString(buf, s)
+	}
+	return buf
+}
+
+func sharedPrefixLength(a, b string) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// metaReader reads the metadata of a segment. The first error is kept in err, after which every read returns the zero value.
+type metaReader struct {
+	buf []byte
+	err error
+}
+
+func (r *metaReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errors.New("invalid uvarint")
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *metaReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = errors.New("invalid varint")
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+// length reads a length and checks that it is not larger than the remaining metadata, since every element takes at least one byte.
+func (r *metaReader) length() int {
+	l := r.uvarint()
+	if l > uint64(len(r.buf)) {
+		r.err = errors.New("invalid length")
+		return 0
+	}
+	return int(l)
+}
+
+// str reads an index into a dictionary with n strings.
+func (r *metaReader) str(n int) uint32 {
+	v := r.uvarint()
+	if v >= uint64(n) {
+		r.err = errors.New("invalid dictionary index")
+		return 0
+	}
+	return uint32(v)
+}
+
+func (r *metaReader) string() string {
+	l := r.length()
+	if r.err != nil {
+		return ""
+	}
+	s := string(r.buf[:l])
+	r.buf = r.buf[l:]
+	return s
+}
+
+func (r *metaReader) strings() []string {
+	n := r.length()
+	ret := make([]string, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		ret = append(ret, r.string())
+	}
+	return ret
+}
@@ -0,0 +1,760 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package segment_events
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/search"
+
+	"go.uber.org/dig"
+)
+
+const filterStreamPageSize = 1000
+
+// dedupCacheBuckets is the number of buckets whose dedup keys are kept in memory. Events are almost always added to the newest buckets,
+// so the keys of older buckets are only loaded again when old events are read again, for example after a restart.
+const dedupCacheBuckets = 4
+
+// segmentEventRepository stores events in segment files, see Segment.go. Each AddBatch writes one new segment for each bucket the events
+// in the batch belong to, and segments of the same bucket are merged in the background, see Merge.go.
+type segmentEventRepository struct {
+	dir            string
+	bucketDuration time.Duration
+
+	metrics *events.IngestionMetrics
+	logger  *slog.Logger
+
+	// writeMu serializes the operations which change the segments, and protects nextId, nextSeq and dedup
+	writeMu sync.Mutex
+	nextId  int64
+	nextSeq int64
+	dedup   dedupCache
+
+	// mu protects buckets. It is only held while the segments are being looked up or replaced, so searches are not blocked while a
+	// segment is being written.
+	mu      sync.RWMutex
+	buckets map[int64][]*segment
+
+	mergeCh  chan struct{}
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	mergeWg  sync.WaitGroup
+}
+
+type SegmentEventRepositoryParams struct {
+	dig.In
+
+	Cfg     *Config
+	Metrics *events.IngestionMetrics `optional:"true"`
+	Logger  *slog.Logger
+}
+
+// NewSegmentEventRepository opens the segments in the configured directory, creating the directory if it does not exist, and starts
+// merging segments in the background.
+func NewSegmentEventRepository(p SegmentEventRepositoryParams) (events.Repository, error) {
+	repo, err := newSegmentEventRepository(p.Cfg, p.Logger)
+	if err != nil {
+		return nil, err
+	}
+	repo.metrics = p.Metrics
+	repo.mergeWg.Add(1)
+	go repo.mergeLoop()
+	return repo, nil
+}
+
+func newSegmentEventRepository(cfg *Config, logger *slog.Logger) (*segmentEventRepository, error) {
+	if cfg.BucketHours <= 0 {
+		return nil, fmt.Errorf("bucketHours must be positive but is %v", cfg.BucketHours)
+	}
+	repo := &segmentEventRepository{
+		dir:            cfg.Directory,
+		bucketDuration: time.Duration(cfg.BucketHours) * time.Hour,
+		logger:         logger,
+		nextId:         1,
+		nextSeq:        1,
+		buckets:        map[int64][]*segment{},
+		mergeCh:        make(chan struct{}, 1),
+		stopCh:         make(chan struct{}),
+	}
+	err := repo.open()
+	if err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// open reads the segments in the directory. Leftovers from writes which were interrupted by a crash are removed: temporary files,
+// tombstones without a segment and segments which were replaced by a merged segment.
+func (repo *segmentEventRepository) open() error {
+	err := os.MkdirAll(repo.dir, 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create segment directory=%v: %w", repo.dir, err)
+	}
+	entries, err := os.ReadDir(repo.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read segment directory=%v: %w", repo.dir, err)
+	}
+	segments := map[string]*segment{}
+	tombstones := []string{}
+	for _, e := range entries {
+		name := e.Name()
+		switch filepath.Ext(name) {
+		case tmpExt:
+			os.Remove(filepath.Join(repo.dir, name))
+		case tombstonesExt:
+			tombstones = append(tombstones, strings.TrimSuffix(name, tombstonesExt))
+		case segmentExt:
+			s, err := openSegment(repo.dir, strings.TrimSuffix(name, segmentExt))
+			if err != nil {
+				for _, s := range segments {
+					s.release()
+				}
+				return err
+			}
+			segments[s.name] = s
+		}
+	}
+	for _, s := range segments {
+		for _, r := range s.replaces {
+			if replaced, ok := segments[r]; ok {
+				repo.logger.Info("removing segment which was replaced by a merged segment",
+					slog.String("segment", r),
+					slog.String("mergedSegment", s.name))
+				delete(segments, r)
+				replaced.retire()
+			}
+		}
+	}
+	for _, t := range tombstones {
+		if _, ok := segments[t]; !ok {
+			os.Remove(filepath.Join(repo.dir, t+tombstonesExt))
+		}
+	}
+	numEvents := 0
+	for _, s := range segments {
+		if s.liveDocs() == 0 {
+			s.retire()
+			continue
+		}
+		repo.buckets[s.bucket] = append(repo.buckets[s.bucket], s)
+		if len(s.ids) > 0 {
+			repo.nextId = max(repo.nextId, s.ids[len(s.ids)-1]+1)
+		}
+		repo.nextSeq = max(repo.nextSeq, s.seq+1)
+		numEvents += s.liveDocs()
+	}
+	for b := range repo.buckets {
+		sortSegments(repo.buckets[b])
+	}
+	repo.logger.Info("opened segments",
+		slog.String("directory", repo.dir),
+		slog.Int("numSegments", len(segments)),
+		slog.Int("numEvents", numEvents))
+	return nil
+}
+
+func sortSegments(segs []*segment) {
+	sort.Slice(segs, func(i, j int) bool { return segs[i].seq < segs[j].seq })
+}
+
+// close stops merging segments and closes the segment files. It is used by tests, since the repository is otherwise used until Logsuck
+// exits.
+func (repo *segmentEventRepository) close() {
+	repo.stopOnce.Do(func() {
+		close(repo.stopCh)
+	})
+	repo.mergeWg.Wait()
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	for _, segs := range repo.buckets {
+		for _, s := range segs {
+			s.release()
+		}
+	}
+	repo.buckets = map[int64][]*segment{}
+}
+
+// bucketOf returns the start of the bucket containing the timestamp, in seconds since the Unix epoch. Buckets are counted from the Unix
+// epoch, so buckets which are a whole number of days start at midnight UTC.
+func (repo *segmentEventRepository) bucketOf(timestamp int64) int64 {
+	d := int64(repo.bucketDuration)
+	b := timestamp / d
+	if timestamp%d < 0 {
+		b--
+	}
+	return b * (d / int64(time.Second))
+}
+
+// bucketRange returns the first and last timestamp of the bucket in nanoseconds since the Unix epoch.
+func (repo *segmentEventRepository) bucketRange(bucket int64) (int64, int64) {
+	start := bucket * int64(time.Second)
+	return start, start + int64(repo.bucketDuration) - 1
+}
+
+// snapshot returns the segments of the buckets for which include returns true, sorted by bucket in ascending order, after acquiring a
+// reference to each segment. The segments must be released using releaseAll.
+func (repo *segmentEventRepository) snapshot(include func(bucket int64) bool) [][]*segment {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	buckets := make([]int64, 0, len(repo.buckets))
+	for b := range repo.buckets {
+		if include == nil || include(b) {
+			buckets = append(buckets, b)
+		}
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+	ret := make([][]*segment, len(buckets))
+	for i, b := range buckets {
+		ret[i] = append([]*segment{}, repo.buckets[b]...)
+		for _, s := range ret[i] {
+			s.acquire()
+		}
+	}
+	return ret
+}
+
+func releaseAll(buckets [][]*segment) {
+	for _, segs := range buckets {
+		for _, s := range segs {
+			s.release()
+		}
+	}
+}
+
+func (repo *segmentEventRepository) AddBatch(evts []events.Event) error {
+	startTime := time.Now()
+	repo.writeMu.Lock()
+	defer repo.writeMu.Unlock()
+	byBucket := map[int64][]segmentDoc{}
+	// The keys of a bucket may be evicted from the cache while the batch is handled if the batch spans many buckets, so the keys in the
+	// batch are also kept separately
+	batchKeys := make(map[dedupKey]struct{}, len(evts))
+	duplicates := []events.Event{}
+	for _, evt := range evts {
+		doc := newSegmentDoc(0, evt)
+		bucket := repo.bucketOf(doc.timestamp)
+		keys := repo.dedupKeys(bucket)
+		k := keyOf(doc)
+		_, inBucket := keys[k]
+		_, inBatch := batchKeys[k]
+		if inBucket || inBatch {
+			duplicates = append(duplicates, evt)
+			continue
+		}
+		keys[k] = struct{}{}
+		batchKeys[k] = struct{}{}
+		doc.id = repo.nextId
+		repo.nextId++
+		byBucket[bucket] = append(byBucket[bucket], doc)
+	}
+	if len(duplicates) > 0 {
+		repo.logger.Info("Skipped adding events as they appear to be duplicates (same source, offset and timestamp as an existing event)",
+			slog.Int("numEvents", len(duplicates)))
+	}
+	buckets := make([]int64, 0, len(byBucket))
+	for b := range byBucket {
+		buckets = append(buckets, b)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+	for i, b := range buckets {
+		s, err := repo.writeSegment(b, byBucket[b], nil)
+		if err != nil {
+			// The dedup keys of the events which were not written are dropped so that the events can be added again
+			for _, b := range buckets[i:] {
+				repo.dedup.remove(b)
+			}
+			return fmt.Errorf("error adding event batch: %w", err)
+		}
+		repo.mu.Lock()
+		repo.buckets[b] = append(repo.buckets[b], s)
+		repo.mu.Unlock()
+		if keys, ok := repo.dedup.get(b); ok {
+			for _, d := range byBucket[b] {
+				keys[keyOf(d)] = struct{}{}
+			}
+		}
+	}
+	repo.metrics.RecordBatch(evts, duplicates)
+	repo.logger.Info("added events",
+		slog.Int("numEvents", len(evts)-len(duplicates)),
+		slog.Int("numSegments", len(buckets)),
+		slog.Duration("duration", time.Since(startTime)))
+	repo.triggerMerge()
+	return nil
+}
+
+// writeSegment writes the documents, which must be sorted by ID, to a new segment in the bucket and opens it. The segment is not added
+// to the repository.
+func (repo *segmentEventRepository) writeSegment(bucket int64, docs []segmentDoc, replaces []string) (*segment, error) {
+	name := segmentName(bucket, repo.nextSeq)
+	repo.nextSeq++
+	tmpPath := filepath.Join(repo.dir, name+tmpExt)
+	sw, err := newSegmentWriter(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range docs {
+		err = sw.add(d)
+		if err != nil {
+			sw.abort()
+			return nil, err
+		}
+	}
+	err = sw.finish(replaces)
+	if err != nil {
+		return nil, err
+	}
+	return repo.installSegment(tmpPath, name)
+}
+
+// installSegment renames a segment which has been written to tmpPath to its final name and opens it.
+func (repo *segmentEventRepository) installSegment(tmpPath, name string) (*segment, error) {
+	err := os.Rename(tmpPath, filepath.Join(repo.dir, name+segmentExt))
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to rename segment=%v: %w", name, err)
+	}
+	s, err := openSegment(repo.dir, name)
+	if err != nil {
+		os.Remove(filepath.Join(repo.dir, name+segmentExt))
+		return nil, err
+	}
+	return s, nil
+}
+
+func (repo *segmentEventRepository) DeleteBatch(ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	repo.writeMu.Lock()
+	defer repo.writeMu.Unlock()
+	snap := repo.snapshot(nil)
+	defer releaseAll(snap)
+	toDelete := map[*segment][]uint32{}
+	for _, id := range ids {
+		if s, doc, ok := findEvent(snap, id); ok {
+			toDelete[s] = append(toDelete[s], doc)
+		}
+	}
+	emptied := []*segment{}
+	for s, docs := range toDelete {
+		_, err := s.delete(docs)
+		if err != nil {
+			return fmt.Errorf("failed to delete numIds=%v: %w", len(ids), err)
+		}
+		if keys, ok := repo.dedup.get(s.bucket); ok {
+			for _, d := range docs {
+				delete(keys, keyOf(s.doc(d, "")))
+			}
+		}
+		if s.liveDocs() == 0 {
+			emptied = append(emptied, s)
+		}
+	}
+	// Segments where every event has been deleted are removed right away instead of waiting for them to be merged
+	repo.removeSegments(emptied)
+	for s := range toDelete {
+		if needsPurge(s) {
+			repo.triggerMerge()
+			break
+		}
+	}
+	return nil
+}
+
+// removeSegments removes the segments from the repository and retires them.
+func (repo *segmentEventRepository) removeSegments(segs []*segment) {
+	if len(segs) == 0 {
+		return
+	}
+	repo.mu.Lock()
+	for _, s := range segs {
+		repo.buckets[s.bucket] = withoutSegment(repo.buckets[s.bucket], s)
+		if len(repo.buckets[s.bucket]) == 0 {
+			delete(repo.buckets, s.bucket)
+		}
+	}
+	repo.mu.Unlock()
+	for _, s := range segs {
+		s.retire()
+	}
+}
+
+func withoutSegment(segs []*segment, s *segment) []*segment {
+	ret := make([]*segment, 0, len(segs))
+	for _, s2 := range segs {
+		if s2 != s {
+			ret = append(ret, s2)
+		}
+	}
+	return ret
+}
+
+// findEvent returns the segment and document number of the event with the given ID, or false if it does not exist or has been deleted.
+func findEvent(snap [][]*segment, id int64) (*segment, uint32, bool) {
+	for _, segs := range snap {
+		for _, s := range segs {
+			if doc, ok := s.findDoc(id); ok {
+				if s.isDeleted(doc) {
+					return nil, 0, false
+				}
+				return s, doc, true
+			}
+		}
+	}
+	return nil, 0, false
+}
+
+// eventRef refers to an event in a segment.
+type eventRef struct {
+	seg *segment
+	doc uint32
+}
+
+func (r eventRef) timestamp() int64 {
+	return r.seg.timestamps[r.doc]
+}
+
+func (r eventRef) id() int64 {
+	return r.seg.ids[r.doc]
+}
+
+func (repo *segmentEventRepository) FilterStream(srch *search.Search, searchStartTime, searchEndTime *time.Time, sortMode events.SortMode) <-chan []events.EventWithId {
+	startTime := time.Now()
+	ret := make(chan []events.EventWithId)
+	q := newQuery(srch, searchStartTime, searchEndTime)
+	snap := repo.snapshot(func(bucket int64) bool {
+		start, end := repo.bucketRange(bucket)
+		return end >= q.startTime && start <= q.endTime
+	})
+	go func() {
+		defer close(ret)
+		defer releaseAll(snap)
+		asc := sortMode == events.SortModeTimestampAsc
+		needsRaw := q.needsRaw()
+		page := make([]events.EventWithId, 0, filterStreamPageSize)
+		// Buckets do not overlap, so sorting the events within each bucket sorts all events
+		for i := range snap {
+			segs := snap[i]
+			if !asc {
+				segs = snap[len(snap)-1-i]
+			}
+			refs, err := q.matchingRefs(segs)
+			if err != nil {
+				repo.logger.Error("error when getting filtered events in FilterStream", slog.Any("error", err))
+				return
+			}
+			sortRefs(refs, asc)
+			cache := blockCache{}
+			for j, r := range refs {
+				raw, err := cache.raw(r.seg, r.doc)
+				if err != nil {
+					repo.logger.Error("error when reading events in FilterStream", slog.Any("error", err))
+					return
+				}
+				if needsRaw && !q.matchesRaw(raw) {
+					continue
+				}
+				page = append(page, r.seg.event(r.doc, raw))
+				if len(page) == filterStreamPageSize {
+					ret <- page
+					page = make([]events.EventWithId, 0, filterStreamPageSize)
+				}
+				if j%filterStreamPageSize == filterStreamPageSize-1 {
+					// The blocks are only cached while reading one page worth of events to limit the memory used by large searches
+					cache = blockCache{}
+				}
+			}
+		}
+		if len(page) > 0 {
+			ret <- page
+		}
+		repo.logger.Info("segment search completed",
+			slog.Duration("duration", time.Since(startTime)))
+	}()
+	return ret
+}
+
+// matchingRefs returns the events in the segments which are in the time range of the query, match its hosts, sources and indexes and
+// are candidates for its fragments.
+func (q *query) matchingRefs(segs []*segment) ([]eventRef, error) {
+	refs := []eventRef{}
+	for _, s := range segs {
+		docs, constrained, err := q.candidates(s)
+		if err != nil {
+			return nil, err
+		}
+		filter := q.dictionaryFilter(s)
+		deleted := s.copyDeleted()
+		add := func(d uint32) {
+			ts := s.timestamps[d]
+			if !deleted[d] && ts >= q.startTime && ts <= q.endTime && filter.matches(s, d) {
+				refs = append(refs, eventRef{seg: s, doc: d})
+			}
+		}
+		if constrained {
+			for _, d := range docs {
+				add(d)
+			}
+		} else {
+			for d := 0; d < s.numDocs(); d++ {
+				add(uint32(d))
+			}
+		}
+	}
+	return refs, nil
+}
+
+// sortRefs sorts the events by timestamp and then by ID.
+func sortRefs(refs []eventRef, asc bool) {
+	sort.Slice(refs, func(i, j int) bool {
+		ti, tj := refs[i].timestamp(), refs[j].timestamp()
+		if ti != tj {
+			return (ti < tj) == asc
+		}
+		return (refs[i].id() < refs[j].id()) == asc
+	})
+}
+
+func (repo *segmentEventRepository) GetByIds(ids []int64, sortMode events.SortMode) ([]events.EventWithId, error) {
+	snap := repo.snapshot(nil)
+	defer releaseAll(snap)
+	refs := make([]eventRef, 0, len(ids))
+	seen := make(map[int64]struct{}, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		if s, doc, ok := findEvent(snap, id); ok {
+			refs = append(refs, eventRef{seg: s, doc: doc})
+		}
+	}
+	if sortMode == events.SortModeTimestampDesc || sortMode == events.SortModeTimestampAsc {
+		sortRefs(refs, sortMode == events.SortModeTimestampAsc)
+	}
+	ret, err := readEvents(refs)
+	if err != nil {
+		return nil, fmt.Errorf("error when reading events in GetByIds: %w", err)
+	}
+	return ret, nil
+}
+
+func readEvents(refs []eventRef) ([]events.EventWithId, error) {
+	cache := blockCache{}
+	ret := make([]events.EventWithId, len(refs))
+	for i, r := range refs {
+		raw, err := cache.raw(r.seg, r.doc)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = r.seg.event(r.doc, raw)
+	}
+	return ret, nil
+}
+
+// GetSurroundingEvents returns the count/2 events from the same source with offsets after the event, followed by the event itself and
+// the events with offsets before it, up to count/2 events, sorted by descending offset.
+func (repo *segmentEventRepository) GetSurroundingEvents(id int64, count int) ([]events.EventWithId, error) {
+	snap := repo.snapshot(nil)
+	defer releaseAll(snap)
+	base, baseDoc, ok := findEvent(snap, id)
+	if !ok {
+		return nil, fmt.Errorf("got error when getting source_id and offset for eventId=%v: %w", id, errEventNotFound)
+	}
+	sourceId := base.strs[base.sourceIds[baseDoc]]
+	baseOffset := base.offsets[baseDoc]
+	up := []eventRef{}
+	down := []eventRef{}
+	for _, segs := range snap {
+		for _, s := range segs {
+			si, ok := s.strIndex[sourceId]
+			if !ok {
+				continue
+			}
+			deleted := s.copyDeleted()
+			for d := range s.ids {
+				if s.sourceIds[d] != si || deleted[d] {
+					continue
+				}
+				if s.offsets[d] <= baseOffset {
+					up = append(up, eventRef{seg: s, doc: uint32(d)})
+				} else {
+					down = append(down, eventRef{seg: s, doc: uint32(d)})
+				}
+			}
+		}
+	}
+	sortByOffset(up, false)
+	sortByOffset(down, true)
+	up = up[:min(len(up), count/2)]
+	down = down[:min(len(down), count/2)]
+	// down contains the closest events after the base event, which are returned by descending offset like the other events
+	for i, j := 0, len(down)-1; i < j; i, j = i+1, j-1 {
+		down[i], down[j] = down[j], down[i]
+	}
+	ret, err := readEvents(append(down, up...))
+	if err != nil {
+		return nil, fmt.Errorf("got error when reading surrounding events for eventId=%v: %w", id, err)
+	}
+	return ret, nil
+}
+
+var errEventNotFound = errors.New("event not found")
+
+func sortByOffset(refs []eventRef, asc bool) {
+	sort.Slice(refs, func(i, j int) bool {
+		oi, oj := refs[i].seg.offsets[refs[i].doc], refs[j].seg.offsets[refs[j].doc]
+		if oi != oj {
+			return (oi < oj) == asc
+		}
+		return (refs[i].id() < refs[j].id()) == asc
+	})
+}
+
+// DeletePartitionsBefore removes the buckets which end before endTime. Each bucket is a partition.
+func (repo *segmentEventRepository) DeletePartitionsBefore(endTime time.Time) (int, error) {
+	repo.writeMu.Lock()
+	defer repo.writeMu.Unlock()
+	end := endTime.UnixNano()
+	toRemove := []*segment{}
+	buckets := map[int64]struct{}{}
+	repo.mu.RLock()
+	for b, segs := range repo.buckets {
+		if _, bucketEnd := repo.bucketRange(b); bucketEnd < end {
+			toRemove = append(toRemove, segs...)
+			buckets[b] = struct{}{}
+		}
+	}
+	repo.mu.RUnlock()
+	repo.removeSegments(toRemove)
+	for b := range buckets {
+		repo.dedup.remove(b)
+	}
+	return len(buckets), nil
+}
+
+// StorageSize returns the size of the segment and tombstone files. Deleted events take up space until their segments are merged.
+func (repo *segmentEventRepository) StorageSize() (int64, error) {
+	snap := repo.snapshot(nil)
+	defer releaseAll(snap)
+	var ret int64
+	for _, segs := range snap {
+		for _, s := range segs {
+			ret += s.storageSize()
+		}
+	}
+	return ret, nil
+}
+
+// Compact rewrites the segments containing deleted events so that the space used by the deleted events is freed.
+func (repo *segmentEventRepository) Compact() error {
+	snap := repo.snapshot(nil)
+	defer releaseAll(snap)
+	for _, segs := range snap {
+		withDeleted := []*segment{}
+		for _, s := range segs {
+			if s.liveDocs() < s.numDocs() {
+				withDeleted = append(withDeleted, s)
+			}
+		}
+		if len(withDeleted) == 0 {
+			continue
+		}
+		err := repo.mergeSegments(withDeleted)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dedupKey is the key used to detect duplicate events, which is the same as the unique key of the Events table used by
+// @logsuck/sqlite_events.
+type dedupKey struct {
+	host      string
+	source    string
+	timestamp int64
+	offset    int64
+}
+
+func keyOf(doc segmentDoc) dedupKey {
+	return dedupKey{host: doc.host, source: doc.source, timestamp: doc.timestamp, offset: doc.offset}
+}
+
+// dedupCache contains the dedup keys of the events in the most recently used buckets.
+type dedupCache struct {
+	// buckets is sorted from the least recently used to the most recently used bucket
+	buckets []int64
+	keys    map[int64]map[dedupKey]struct{}
+}
+
+func (c *dedupCache) get(bucket int64) (map[dedupKey]struct{}, bool) {
+	keys, ok := c.keys[bucket]
+	return keys, ok
+}
+
+func (c *dedupCache) remove(bucket int64) {
+	delete(c.keys, bucket)
+	for i, b := range c.buckets {
+		if b == bucket {
+			c.buckets = append(c.buckets[:i], c.buckets[i+1:]...)
+			break
+		}
+	}
+}
+
+// dedupKeys returns the dedup keys of the events in the bucket, reading them from the segments if they are not cached.
+func (repo *segmentEventRepository) dedupKeys(bucket int64) map[dedupKey]struct{} {
+	c := &repo.dedup
+	if keys, ok := c.keys[bucket]; ok {
+		if c.buckets[len(c.buckets)-1] != bucket {
+			c.remove(bucket)
+			c.buckets = append(c.buckets, bucket)
+			c.keys[bucket] = keys
+		}
+		return keys
+	}
+	if c.keys == nil {
+		c.keys = map[int64]map[dedupKey]struct{}{}
+	}
+	keys := map[dedupKey]struct{}{}
+	repo.mu.RLock()
+	for _, s := range repo.buckets[bucket] {
+		deleted := s.copyDeleted()
+		for d := range s.ids {
+			if !deleted[d] {
+				keys[keyOf(s.doc(uint32(d), ""))] = struct{}{}
+			}
+		}
+	}
+	repo.mu.RUnlock()
+	if len(c.buckets) >= dedupCacheBuckets {
+		c.remove(c.buckets[0])
+	}
+	c.buckets = append(c.buckets, bucket)
+	c.keys[bucket] = keys
+	return keys
+}
@@ -0,0 +1,406 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package segment_events
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/search"
+)
+
+func TestAddBatchAndGetByIds(t *testing.T) {
+	repo := createRepo(t, t.TempDir())
+	err := repo.AddBatch([]events.Event{
+		newEvent("first event", 0, 0),
+		newEvent("second event", 1, 10),
+		newEvent("third event", 2, 20),
+	})
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	evts, err := repo.GetByIds([]int64{3, 1}, events.SortModePreserveArgOrder)
+	if err != nil {
+		t.Fatalf("got error when getting events: %v", err)
+	}
+	assertRaws(t, evts, "third event", "first event")
+	if evts[1].Host != "localhost" || evts[1].Source != "log.txt" || evts[1].SourceId != "source-1" || evts[1].Index != events.DefaultIndex {
+		t.Fatalf("got unexpected event=%+v", evts[1])
+	}
+	if !evts[1].Timestamp.Equal(testTime(0)) {
+		t.Fatalf("got unexpected timestamp=%v, expected %v", evts[1].Timestamp, testTime(0))
+	}
+
+	evts, err = repo.GetByIds([]int64{1, 2, 3, 4}, events.SortModeTimestampDesc)
+	if err != nil {
+		t.Fatalf("got error when getting events: %v", err)
+	}
+	assertRaws(t, evts, "third event", "second event", "first event")
+	evts, err = repo.GetByIds([]int64{3, 2, 1}, events.SortModeTimestampAsc)
+	if err != nil {
+		t.Fatalf("got error when getting events: %v", err)
+	}
+	assertRaws(t, evts, "first event", "second event", "third event")
+}
+
+func TestAddBatchSkipsDuplicates(t *testing.T) {
+	repo := createRepo(t, t.TempDir())
+	repo.AddBatch([]events.Event{newEvent("an event", 0, 0), newEvent("an event", 0, 0)})
+	repo.AddBatch([]events.Event{newEvent("an event", 0, 0), newEvent("another event", 1, 10)})
+
+	evts := filter(t, repo, &search.Search{}, events.SortModeTimestampAsc)
+	assertRaws(t, evts, "an event", "another event")
+
+	repo.DeleteBatch([]int64{evts[0].Id})
+	repo.AddBatch([]events.Event{newEvent("an event", 0, 0)})
+	evts = filter(t, repo, &search.Search{}, events.SortModeTimestampAsc)
+	assertRaws(t, evts, "an event", "another event")
+}
+
+func TestFilterStream(t *testing.T) {
+	repo := createRepo(t, t.TempDir())
+	evts := []events.Event{
+		newEvent("NullPointerException in handler", 0, 0),
+		newEvent("user logged in", 1, 10),
+		newEvent("user logged out", 2, 20),
+		newEvent("otherwise fine", 3, 30),
+		newEvent("error: disk full", 4, 40),
+	}
+	evts[3].Host = "otherhost"
+	evts[4].Source = "errors.log"
+	evts[4].Index = "security"
+	err := repo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		srch     search.Search
+		expected []string
+	}{
+		{"all", search.Search{}, []string{"NullPointerException in handler", "user logged in", "user logged out", "otherwise fine", "error: disk full"}},
+		{"word", search.Search{Fragments: set("user")}, []string{"user logged in", "user logged out"}},
+		{"whole word only", search.Search{Fragments: set("wise")}, []string{}},
+		{"case insensitive", search.Search{Fragments: set("USER", "In")}, []string{"user logged in"}},
+		{"prefix", search.Search{Fragments: set("null*")}, []string{"NullPointerException in handler"}},
+		{"suffix", search.Search{Fragments: set("*exception")}, []string{"NullPointerException in handler"}},
+		{"infix", search.Search{Fragments: set("*wise*")}, []string{"otherwise fine"}},
+		{"punctuation", search.Search{Fragments: set("error:")}, []string{"error: disk full"}},
+		{"missing term", search.Search{Fragments: set("user", "missing")}, []string{}},
+		{"not fragment", search.Search{Fragments: set("user"), NotFragments: set("out")}, []string{"user logged in"}},
+		{"not wildcard fragment", search.Search{NotFragments: set("*o*")}, []string{}},
+		{"host", search.Search{Hosts: set("otherhost")}, []string{"otherwise fine"}},
+		{"not host", search.Search{Fragments: set("*i*"), NotHosts: set("otherhost")}, []string{"NullPointerException in handler", "user logged in", "error: disk full"}},
+		{"source", search.Search{Sources: set("errors*")}, []string{"error: disk full"}},
+		{"not source", search.Search{NotSources: set("log.txt")}, []string{"error: disk full"}},
+		{"index", search.Search{Indexes: set("security")}, []string{"error: disk full"}},
+		{"index wildcard", search.Search{Indexes: set("sec*")}, []string{"error: disk full"}},
+		{"not index", search.Search{NotIndexes: set("main")}, []string{"error: disk full"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertRaws(t, filter(t, repo, &tt.srch, events.SortModeTimestampAsc), tt.expected...)
+		})
+	}
+
+	startTime, endTime := testTime(1), testTime(3)
+	res := collect(repo.FilterStream(&search.Search{}, &startTime, &endTime, events.SortModeTimestampDesc))
+	assertRaws(t, res, "otherwise fine", "user logged out", "user logged in")
+}
+
+func TestFilterStreamAcrossBuckets(t *testing.T) {
+	repo := createRepo(t, t.TempDir())
+	numEvents := 2500
+	evts := make([]events.Event, numEvents)
+	for i := range evts {
+		// Spread the events over several days so that they are stored in different buckets
+		evts[i] = newEvent(fmt.Sprintf("event %v", i), time.Duration(i)*time.Minute, int64(i))
+	}
+	err := repo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	if len(repo.buckets) < 2 {
+		t.Fatalf("expected events to be stored in several buckets but got numBuckets=%v", len(repo.buckets))
+	}
+
+	pages := 0
+	var res []events.EventWithId
+	for page := range repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampDesc) {
+		pages++
+		res = append(res, page...)
+	}
+	if pages != 3 || len(res) != numEvents {
+		t.Fatalf("expected numEvents=%v in 3 pages but got numEvents=%v in numPages=%v", numEvents, len(res), pages)
+	}
+	for i, evt := range res {
+		if expected := fmt.Sprintf("event %v", numEvents-1-i); evt.Raw != expected {
+			t.Fatalf("got unexpected event at i=%v, expected %v but got %v", i, expected, evt.Raw)
+		}
+	}
+}
+
+func TestDeleteBatch(t *testing.T) {
+	repo := createRepo(t, t.TempDir())
+	repo.AddBatch([]events.Event{newEvent("first event", 0, 0), newEvent("second event", 1, 10)})
+	repo.AddBatch([]events.Event{newEvent("third event", 2, 20)})
+
+	err := repo.DeleteBatch([]int64{1, 3})
+	if err != nil {
+		t.Fatalf("got error when deleting events: %v", err)
+	}
+	assertRaws(t, filter(t, repo, &search.Search{Fragments: set("event")}, events.SortModeTimestampAsc), "second event")
+	evts, err := repo.GetByIds([]int64{1, 2, 3}, events.SortModeTimestampAsc)
+	if err != nil {
+		t.Fatalf("got error when getting events: %v", err)
+	}
+	assertRaws(t, evts, "second event")
+	if numSegments := countSegments(repo); numSegments != 1 {
+		t.Fatalf("expected the segment without events to be removed, but got numSegments=%v", numSegments)
+	}
+}
+
+func TestGetSurroundingEvents(t *testing.T) {
+	repo := createRepo(t, t.TempDir())
+	evts := []events.Event{}
+	for i := 0; i < 10; i++ {
+		evts = append(evts, newEvent(fmt.Sprintf("line %v", i), time.Duration(i), int64(i*10)))
+	}
+	other := newEvent("other file", 5, 50)
+	other.Source = "other.txt"
+	other.SourceId = "source-2"
+	evts = append(evts, other)
+	// The events are split into two segments to check that events are found in all segments
+	repo.AddBatch(evts[:4])
+	repo.AddBatch(evts[4:])
+
+	res, err := repo.GetSurroundingEvents(5, 4)
+	if err != nil {
+		t.Fatalf("got error when getting surrounding events: %v", err)
+	}
+	assertRaws(t, res, "line 6", "line 5", "line 4", "line 3")
+
+	_, err = repo.GetSurroundingEvents(100, 4)
+	if err == nil {
+		t.Fatalf("expected error when getting surrounding events of an event which does not exist")
+	}
+}
+
+func TestMergeSegments(t *testing.T) {
+	dir := t.TempDir()
+	repo := createRepo(t, dir)
+	for i := 0; i < mergeFactor; i++ {
+		err := repo.AddBatch([]events.Event{
+			newEvent(fmt.Sprintf("batch %v first", i), time.Duration(i*2), int64(i*2)),
+			newEvent(fmt.Sprintf("batch %v second", i), time.Duration(i*2+1), int64(i*2+1)),
+		})
+		if err != nil {
+			t.Fatalf("got error when adding events: %v", err)
+		}
+	}
+	before := filter(t, repo, &search.Search{}, events.SortModeTimestampDesc)
+	repo.DeleteBatch([]int64{1})
+
+	repo.mergeAll(testTime(0))
+	if numSegments := countSegments(repo); numSegments != 1 {
+		t.Fatalf("expected segments to be merged into one segment but got numSegments=%v", numSegments)
+	}
+	after := filter(t, repo, &search.Search{}, events.SortModeTimestampDesc)
+	if !reflect.DeepEqual(before[:len(before)-1], after) {
+		t.Fatalf("got different events after merging, before=%v, after=%v", before, after)
+	}
+	assertRaws(t, filter(t, repo, &search.Search{Fragments: set("second")}, events.SortModeTimestampAsc),
+		"batch 0 second", "batch 1 second", "batch 2 second", "batch 3 second", "batch 4 second", "batch 5 second", "batch 6 second", "batch 7 second")
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 1 {
+		t.Fatalf("expected only the merged segment file to be left but got files=%v", files)
+	}
+
+	// The merged segment must be used after reopening the repository
+	repo.close()
+	repo = createRepo(t, dir)
+	reopened := filter(t, repo, &search.Search{}, events.SortModeTimestampDesc)
+	if !reflect.DeepEqual(after, reopened) {
+		t.Fatalf("got different events after reopening, expected=%v, got=%v", after, reopened)
+	}
+	repo.AddBatch([]events.Event{newEvent("new event", 100, 100)})
+	evts, _ := repo.GetByIds([]int64{int64(2*mergeFactor + 1)}, events.SortModeNone)
+	assertRaws(t, evts, "new event")
+}
+
+func TestMergeOldBucket(t *testing.T) {
+	repo := createRepo(t, t.TempDir())
+	repo.AddBatch([]events.Event{newEvent("first event", 0, 0)})
+	repo.AddBatch([]events.Event{newEvent("second event", 1, 10)})
+
+	repo.mergeAll(testTime(0))
+	if numSegments := countSegments(repo); numSegments != 2 {
+		t.Fatalf("expected segments in the current bucket to be kept but got numSegments=%v", numSegments)
+	}
+	repo.mergeAll(testTime(72 * time.Hour))
+	if numSegments := countSegments(repo); numSegments != 1 {
+		t.Fatalf("expected segments in an old bucket to be merged but got numSegments=%v", numSegments)
+	}
+}
+
+func TestOpenRemovesReplacedSegments(t *testing.T) {
+	dir := t.TempDir()
+	repo := createRepo(t, dir)
+	repo.AddBatch([]events.Event{newEvent("first event", 0, 0)})
+	repo.AddBatch([]events.Event{newEvent("second event", 1, 10)})
+	segs := repo.buckets[repo.bucketOf(testTime(0).UnixNano())]
+	// Simulate a crash after the merged segment has been written but before the replaced segments were removed
+	names := []string{}
+	docs := []segmentDoc{}
+	for _, s := range segs {
+		names = append(names, s.name)
+		docs = append(docs, s.doc(0, "merged "+s.strs[s.sourceIds[0]]))
+	}
+	repo.writeMu.Lock()
+	_, err := repo.writeSegment(segs[0].bucket, docs, names)
+	repo.writeMu.Unlock()
+	if err != nil {
+		t.Fatalf("got error when writing segment: %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, "leftover"+tmpExt), []byte("garbage"), 0600)
+	repo.close()
+
+	repo = createRepo(t, dir)
+	assertRaws(t, filter(t, repo, &search.Search{}, events.SortModeTimestampAsc), "merged source-1", "merged source-1")
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 1 {
+		t.Fatalf("expected only the merged segment file to be left but got files=%v", files)
+	}
+}
+
+func TestDeletePartitionsBefore(t *testing.T) {
+	repo := createRepo(t, t.TempDir())
+	repo.AddBatch([]events.Event{
+		newEvent("old event", 0, 0),
+		newEvent("new event", 25*time.Hour, 10),
+	})
+
+	n, err := repo.DeletePartitionsBefore(testTime(24 * time.Hour))
+	if err != nil {
+		t.Fatalf("got error when deleting partitions: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 deleted partition but got %v", n)
+	}
+	assertRaws(t, filter(t, repo, &search.Search{}, events.SortModeTimestampAsc), "new event")
+}
+
+func TestCompact(t *testing.T) {
+	repo := createRepo(t, t.TempDir())
+	evts := make([]events.Event, 100)
+	for i := range evts {
+		evts[i] = newEvent(strings.Repeat(fmt.Sprintf("event %v ", i), 20), time.Duration(i), int64(i))
+	}
+	repo.AddBatch(evts)
+	sizeBefore, _ := repo.StorageSize()
+	ids := make([]int64, 90)
+	for i := range ids {
+		ids[i] = int64(i + 1)
+	}
+	repo.DeleteBatch(ids)
+
+	err := repo.Compact()
+	if err != nil {
+		t.Fatalf("got error when compacting: %v", err)
+	}
+	sizeAfter, _ := repo.StorageSize()
+	if sizeAfter >= sizeBefore {
+		t.Fatalf("expected storage size to decrease after compacting, before=%v, after=%v", sizeBefore, sizeAfter)
+	}
+	if res := filter(t, repo, &search.Search{}, events.SortModeTimestampAsc); len(res) != 10 {
+		t.Fatalf("expected 10 events after compacting but got %v", len(res))
+	}
+}
+
+// createRepo creates a repository which does not merge segments in the background, so that tests can merge segments by calling mergeAll.
+func createRepo(t *testing.T, dir string) *segmentEventRepository {
+	repo, err := newSegmentEventRepository(&Config{Directory: dir, BucketHours: 24}, slog.Default())
+	if err != nil {
+		t.Fatalf("got error when creating repository: %v", err)
+	}
+	t.Cleanup(repo.close)
+	return repo
+}
+
+func testTime(d time.Duration) time.Time {
+	return time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC).Add(d)
+}
+
+func newEvent(raw string, d time.Duration, offset int64) events.Event {
+	return events.Event{
+		Raw:       raw,
+		Timestamp: testTime(d),
+		Host:      "localhost",
+		Source:    "log.txt",
+		SourceId:  "source-1",
+		Offset:    offset,
+	}
+}
+
+func countSegments(repo *segmentEventRepository) int {
+	ret := 0
+	for _, segs := range repo.buckets {
+		ret += len(segs)
+	}
+	return ret
+}
+
+func filter(t *testing.T, repo *segmentEventRepository, srch *search.Search, sortMode events.SortMode) []events.EventWithId {
+	return collect(repo.FilterStream(srch, nil, nil, sortMode))
+}
+
+func collect(c <-chan []events.EventWithId) []events.EventWithId {
+	ret := []events.EventWithId{}
+	for page := range c {
+		ret = append(ret, page...)
+	}
+	return ret
+}
+
+func set(values ...string) map[string]struct{} {
+	ret := map[string]struct{}{}
+	for _, v := range values {
+		ret[v] = struct{}{}
+	}
+	return ret
+}
+
+func assertRaws(t *testing.T, evts []events.EventWithId, expected ...string) {
+	t.Helper()
+	raws := make([]string, len(evts))
+	for i, evt := range evts {
+		raws[i] = evt.Raw
+	}
+	if len(expected) == 0 {
+		expected = []string{}
+	}
+	if !reflect.DeepEqual(raws, expected) {
+		t.Fatalf("got unexpected events, expected %v but got %v", expected, raws)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package segment_events
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/jackbister/logsuck/pkg/logsuck"
+	"github.com/jackbister/logsuck/pkg/logsuck/config"
+
+	"go.uber.org/dig"
+)
+
+const pluginName = "@logsuck/segment_events"
+
+//go:embed segment_events.schema.json
+var schemaString string
+
+type Config struct {
+	// Directory is the directory containing the segment files.
+	Directory string
+
+	// BucketHours is the length of the time period covered by each bucket of segments.
+	BucketHours int
+}
+
+// IsConfigured returns true if the configuration contains a configuration for this plugin, which means the plugin should be used to
+// store events instead of @logsuck/sqlite_events.
+func IsConfigured(cfg *config.Config) bool {
+	_, ok := cfg.Plugins[pluginName]
+	return ok
+}
+
+var Plugin = logsuck.Plugin{
+	Name: pluginName,
+	Provide: func(c *dig.Container, logger *slog.Logger) error {
+		err := c.Provide(NewSegmentEventRepository)
+		if err != nil {
+			return err
+		}
+		err = c.Provide(func(cfg *config.Config) *Config {
+			ret := Config{
+				Directory:   "segments",
+				BucketHours: 24,
+			}
+			cfgMap, ok := cfg.Plugins[pluginName].(map[string]any)
+			if !ok {
+				return &ret
+			}
+			if dir, ok := cfgMap["directory"].(string); ok && dir != "" {
+				ret.Directory = dir
+			}
+			// Numbers in the configuration are unmarshaled as float64
+			if bh, ok := cfgMap["bucketHours"].(float64); ok {
+				ret.BucketHours = int(bh)
+			}
+			return &ret
+		})
+		if err != nil {
+			return err
+		}
+		return nil
+	},
+	JsonSchema: func() (map[string]any, error) {
+		ret := map[string]any{}
+		err := json.Unmarshal([]byte(schemaString), &ret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal segment_events JSON schema: %w", err)
+		}
+		return ret, nil
+	},
+}
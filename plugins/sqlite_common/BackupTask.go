@@ -0,0 +1,258 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_common
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/tasks"
+)
+
+const (
+	backupPrefix         = "logsuck-"
+	backupSuffix         = ".db"
+	compressedSuffix     = ".gz"
+	backupTimeLayout     = "20060102T150405Z"
+	defaultBackupsToKeep = 7
+)
+
+// BackupTask writes a snapshot of the database to a directory using VACUUM INTO, which creates a consistent copy of the database while
+// Logsuck keeps adding events. Only the newest snapshots are kept.
+type BackupTask struct {
+	Db *sql.DB
+
+	Logger *slog.Logger
+}
+
+func NewBackupTask(db *sql.DB, logger *slog.Logger) tasks.Task {
+	return &BackupTask{
+		Db:     db,
+		Logger: logger,
+	}
+}
+
+func (t *BackupTask) Name() string {
+	return "@logsuck/BackupTask"
+}
+
+type backupConfig struct {
+	directory string
+	keep      int
+	compress  bool
+}
+
+func (t *BackupTask) Run(cfg map[string]any, ctx context.Context) {
+	c, err := parseBackupConfig(cfg)
+	if err != nil {
+		t.Logger.Error("Failed to parse config. Will not do anything.",
+			slog.Any("error", err))
+		return
+	}
+	startTime := time.Now()
+	fileName, err := backup(ctx, t.Db, c.directory, c.compress, startTime)
+	if err != nil {
+		t.Logger.Error("Failed to back up database",
+			slog.String("directory", c.directory),
+			slog.Any("error", err))
+		return
+	}
+	size := int64(-1)
+	if fi, err := os.Stat(fileName); err == nil {
+		size = fi.Size()
+	}
+	t.Logger.Info("Backed up database",
+		slog.String("fileName", fileName),
+		slog.Int64("sizeBytes", size),
+		slog.Duration("duration", time.Since(startTime)))
+	deleted, err := pruneBackups(c.directory, c.keep)
+	if err != nil {
+		t.Logger.Error("Failed to delete old backups",
+			slog.String("directory", c.directory),
+			slog.Any("error", err))
+		return
+	}
+	for _, d := range deleted {
+		t.Logger.Info("Deleted old backup",
+			slog.String("fileName", d))
+	}
+}
+
+func (t *BackupTask) ConfigSchema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"directory": map[string]any{
+				"description": "The directory where the backups are written. It is created if it does not exist.",
+				"type":        "string",
+			},
+			"keep": map[string]any{
+				"description": "The number of backups to keep. The oldest backups in the directory are deleted after a new backup has been written. Default 7.",
+				"type":        "integer",
+			},
+			"compress": map[string]any{
+				"description": "Whether the backups are compressed using gzip. Default false.",
+				"type":        "boolean",
+			},
+		},
+	}
+}
+
+// parseBackupConfig parses the task configuration. Values may be strings since the configuration GUI stores all values as strings.
+func parseBackupConfig(cfg map[string]any) (*backupConfig, error) {
+	ret := backupConfig{keep: defaultBackupsToKeep}
+	dir, ok := cfg["directory"].(string)
+	if !ok || dir == "" {
+		return nil, errors.New("directory must be set")
+	}
+	ret.directory = dir
+	switch keep := cfg["keep"].(type) {
+	case nil:
+	case float64:
+		ret.keep = int(keep)
+	case string:
+		n, err := strconv.Atoi(keep)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse keep: %w", err)
+		}
+		ret.keep = n
+	default:
+		return nil, errors.New("keep must be an integer")
+	}
+	if ret.keep < 1 {
+		return nil, fmt.Errorf("keep must be at least 1, got keep=%v", ret.keep)
+	}
+	switch compress := cfg["compress"].(type) {
+	case nil:
+	case bool:
+		ret.compress = compress
+	case string:
+		b, err := strconv.ParseBool(compress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse compress: %w", err)
+		}
+		ret.compress = b
+	default:
+		return nil, errors.New("compress must be a boolean")
+	}
+	return &ret, nil
+}
+
+// backup writes a snapshot of the database to a file in dir named after the time now and returns the name of the file. The snapshot is
+// written to a temporary file which is renamed once it is complete, so the directory never contains partial backups with the final name.
+func backup(ctx context.Context, db *sql.DB, dir string, compress bool, now time.Time) (string, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	fileName := filepath.Join(dir, backupPrefix+now.UTC().Format(backupTimeLayout)+backupSuffix)
+	tmpFileName := filepath.Join(dir, "."+filepath.Base(fileName)+".tmp")
+	// VACUUM INTO fails if the file already exists, which it only does if a previous backup was interrupted
+	err = os.Remove(tmpFileName)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("failed to remove leftover temporary file: %w", err)
+	}
+	defer os.Remove(tmpFileName)
+	_, err = db.ExecContext(ctx, "VACUUM INTO ?;", tmpFileName)
+	if err != nil {
+		return "", fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	// The backup contains the same data as the database, so it should not be readable by other users
+	err = os.Chmod(tmpFileName, 0o600)
+	if err != nil {
+		return "", fmt.Errorf("failed to set permissions of snapshot: %w", err)
+	}
+	if compress {
+		gzFileName := tmpFileName + compressedSuffix
+		defer os.Remove(gzFileName)
+		err = gzipFile(tmpFileName, gzFileName)
+		if err != nil {
+			return "", err
+		}
+		tmpFileName = gzFileName
+		fileName += compressedSuffix
+	}
+	err = os.Rename(tmpFileName, fileName)
+	if err != nil {
+		return "", fmt.Errorf("failed to rename snapshot: %w", err)
+	}
+	return fileName, nil
+}
+
+func gzipFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create compressed snapshot: %w", err)
+	}
+	defer out.Close()
+	w := gzip.NewWriter(out)
+	_, err = io.Copy(w, in)
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to compress snapshot: %w", err)
+	}
+	return nil
+}
+
+// pruneBackups deletes the oldest backups in dir so that at most keep backups remain, and returns the names of the deleted files.
+// Only files named like the backups written by backup are considered.
+func pruneBackups(dir string, keep int) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backup directory: %w", err)
+	}
+	backups := []string{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.Type().IsRegular() && strings.HasPrefix(name, backupPrefix) &&
+			(strings.HasSuffix(name, backupSuffix) || strings.HasSuffix(name, backupSuffix+compressedSuffix)) {
+			backups = append(backups, name)
+		}
+	}
+	// The timestamps in the names sort in chronological order
+	sort.Strings(backups)
+	deleted := []string{}
+	for len(backups) > keep {
+		fileName := filepath.Join(dir, backups[0])
+		err = os.Remove(fileName)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete backup with fileName=%v: %w", fileName, err)
+		}
+		deleted = append(deleted, fileName)
+		backups = backups[1:]
+	}
+	return deleted, nil
+}
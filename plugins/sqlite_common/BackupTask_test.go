@@ -0,0 +1,164 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_common
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		dir := t.TempDir()
+		dbFile := filepath.Join(dir, "logsuck.db")
+		db := openFileDb(t, dbFile)
+		_, err := db.Exec("INSERT INTO A (x) VALUES (1);")
+		if err != nil {
+			t.Fatalf("got error when inserting row: %v", err)
+		}
+		backupFile, err := backup(context.Background(), db, filepath.Join(dir, "backups"), compress, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+		if err != nil {
+			t.Fatalf("got error when backing up database with compress=%v: %v", compress, err)
+		}
+		expectedName := "logsuck-20240102T030405Z.db"
+		if compress {
+			expectedName += ".gz"
+		}
+		if filepath.Base(backupFile) != expectedName {
+			t.Fatalf("expected backup to be named %v, got %v", expectedName, backupFile)
+		}
+		_, err = db.Exec("INSERT INTO A (x) VALUES (2);")
+		if err != nil {
+			t.Fatalf("got error when inserting row: %v", err)
+		}
+
+		err = Restore(backupFile, dbFile, slog.Default())
+		if err == nil || !strings.Contains(err.Error(), "in use") {
+			t.Fatalf("expected error when restoring while the database is in use, got err=%v", err)
+		}
+		db.Close()
+		err = Restore(backupFile, dbFile, slog.Default())
+		if err != nil {
+			t.Fatalf("got error when restoring backup with compress=%v: %v", compress, err)
+		}
+		db = openFileDb(t, dbFile)
+		var count int
+		err = db.QueryRow("SELECT COUNT(*) FROM A;").Scan(&count)
+		if err != nil || count != 1 {
+			t.Fatalf("expected restored database to contain 1 row, got count=%v, err=%v", count, err)
+		}
+		previous, _ := filepath.Glob(dbFile + ".before-restore-*")
+		if len(previous) != 1 {
+			t.Fatalf("expected the previous database to be kept, got files=%v", previous)
+		}
+	}
+}
+
+func TestRestoreRejectsCorruptBackup(t *testing.T) {
+	dir := t.TempDir()
+	dbFile := filepath.Join(dir, "logsuck.db")
+	openFileDb(t, dbFile).Close()
+	before, err := os.ReadFile(dbFile)
+	if err != nil {
+		t.Fatalf("got error when reading database: %v", err)
+	}
+	corrupt := filepath.Join(dir, "corrupt.db")
+	err = os.WriteFile(corrupt, []byte("this is not a database"), 0o600)
+	if err != nil {
+		t.Fatalf("got error when writing corrupt backup: %v", err)
+	}
+	err = Restore(corrupt, dbFile, slog.Default())
+	if err == nil {
+		t.Fatalf("expected error when restoring corrupt backup")
+	}
+	after, err := os.ReadFile(dbFile)
+	if err != nil || !reflect.DeepEqual(before, after) {
+		t.Fatalf("expected database to be unchanged after failed restore, err=%v", err)
+	}
+	if _, err := os.Stat(dbFile + ".restore"); !os.IsNotExist(err) {
+		t.Fatalf("expected the copy of the backup to be removed after failed restore, got err=%v", err)
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{
+		"logsuck-20240101T000000Z.db",
+		"logsuck-20240102T000000Z.db.gz",
+		"logsuck-20240103T000000Z.db",
+		"other.db",
+		".logsuck-20240104T000000Z.db.tmp",
+	}
+	for _, n := range names {
+		err := os.WriteFile(filepath.Join(dir, n), nil, 0o600)
+		if err != nil {
+			t.Fatalf("got error when creating file: %v", err)
+		}
+	}
+	deleted, err := pruneBackups(dir, 2)
+	if err != nil {
+		t.Fatalf("got error when pruning backups: %v", err)
+	}
+	if !reflect.DeepEqual(deleted, []string{filepath.Join(dir, "logsuck-20240101T000000Z.db")}) {
+		t.Fatalf("expected only the oldest backup to be deleted, got deleted=%v", deleted)
+	}
+}
+
+func TestParseBackupConfig(t *testing.T) {
+	var tests = []struct {
+		cfg         map[string]any
+		expected    *backupConfig
+		expectedErr bool
+	}{
+		{map[string]any{"directory": "b"}, &backupConfig{directory: "b", keep: 7}, false},
+		{map[string]any{"directory": "b", "keep": 3.0, "compress": true}, &backupConfig{directory: "b", keep: 3, compress: true}, false},
+		{map[string]any{"directory": "b", "keep": "3", "compress": "true"}, &backupConfig{directory: "b", keep: 3, compress: true}, false},
+		{map[string]any{}, nil, true},
+		{map[string]any{"directory": "b", "keep": 0.0}, nil, true},
+		{map[string]any{"directory": "b", "compress": "maybe"}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseBackupConfig(tt.cfg)
+		if (err != nil) != tt.expectedErr || !reflect.DeepEqual(got, tt.expected) {
+			t.Fatalf("got unexpected result for cfg=%v, expected=%+v, expectedErr=%v, got=%+v, err=%v", tt.cfg, tt.expected, tt.expectedErr, got, err)
+		}
+	}
+}
+
+// openFileDb opens a database file in WAL mode like the one used by Logsuck, and creates a table A in it using a migration.
+func openFileDb(t *testing.T, fileName string) *sql.DB {
+	db, err := sql.Open("sqlite3", "file:"+fileName+"?_journal_mode=WAL")
+	if err != nil {
+		t.Fatalf("got error when opening database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = Migrate(db, slog.Default(), PluginMigrations{
+		PluginName: "test",
+		Migrations: []Migration{
+			{Version: 1, Description: "Create A", Apply: ExecStatements("CREATE TABLE A (x INTEGER);")},
+		},
+	})
+	if err != nil {
+		t.Fatalf("got error when migrating database: %v", err)
+	}
+	return db
+}
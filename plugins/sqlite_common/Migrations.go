@@ -0,0 +1,204 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_common
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// Migration is a change to the tables owned by a plugin.
+type Migration struct {
+	// Version is the schema version of the plugin after the migration has been applied.
+	Version int
+	// Description is shown in the log when the migration is applied and when running with -migrate-dry-run.
+	Description string
+	// Apply performs the migration. The migration is rolled back if Apply returns an error.
+	Apply func(tx *sql.Tx) error
+}
+
+// PluginMigrations contains all migrations for the tables owned by a plugin, in the order they should be applied.
+// The versions must start at 1 and increase by one for each migration. Migrations must never be changed or removed once they have been
+// released, since databases which have already applied them will not apply them again.
+//
+// Plugins register their migrations by providing a PluginMigrations in the "sqliteMigrations" group. All registered migrations are
+// applied before the *sql.DB provided by this plugin is returned.
+type PluginMigrations struct {
+	PluginName string
+	Migrations []Migration
+}
+
+// PendingMigration is a migration which has not been applied to the database yet.
+type PendingMigration struct {
+	PluginName string
+	Migration  Migration
+}
+
+// Migrator keeps track of which migrations have been applied using the SchemaVersions table, which contains the current schema version
+// of each plugin.
+type Migrator struct {
+	db         *sql.DB
+	migrations []PluginMigrations
+
+	logger *slog.Logger
+}
+
+func NewMigrator(db *sql.DB, migrations []PluginMigrations, logger *slog.Logger) (*Migrator, error) {
+	sorted := make([]PluginMigrations, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].PluginName < sorted[j].PluginName
+	})
+	for i, pm := range sorted {
+		if i > 0 && sorted[i-1].PluginName == pm.PluginName {
+			return nil, fmt.Errorf("got multiple sets of migrations for pluginName=%v", pm.PluginName)
+		}
+		for j, m := range pm.Migrations {
+			if m.Version != j+1 {
+				return nil, fmt.Errorf("migration with description=%q for pluginName=%v has version=%v, expected version=%v", m.Description, pm.PluginName, m.Version, j+1)
+			}
+		}
+	}
+	return &Migrator{
+		db:         db,
+		migrations: sorted,
+		logger:     logger,
+	}, nil
+}
+
+// Migrate applies all pending migrations in the given sets of migrations to the database. It is mostly useful for creating the tables of
+// a repository in tests, when the *sql.DB is not provided by this plugin.
+func Migrate(db *sql.DB, logger *slog.Logger, migrations ...PluginMigrations) error {
+	m, err := NewMigrator(db, migrations, logger)
+	if err != nil {
+		return err
+	}
+	return m.Migrate()
+}
+
+// Plan returns the migrations which would be applied by Migrate, without changing the database.
+// Returns an error if the database has a newer schema version than the latest migration for any plugin, since that means the database
+// was used by a newer version of Logsuck and its schema may not be compatible with this version.
+func (m *Migrator) Plan() ([]PendingMigration, error) {
+	versions, err := m.getVersions()
+	if err != nil {
+		return nil, err
+	}
+	ret := []PendingMigration{}
+	for _, pm := range m.migrations {
+		current := versions[pm.PluginName]
+		if current > len(pm.Migrations) {
+			return nil, fmt.Errorf("the database has schema version=%v for pluginName=%v, but this version of Logsuck only knows about versions up to %v. "+
+				"Refusing to start since the database was created by a newer version of Logsuck", current, pm.PluginName, len(pm.Migrations))
+		}
+		for _, migration := range pm.Migrations[current:] {
+			ret = append(ret, PendingMigration{PluginName: pm.PluginName, Migration: migration})
+		}
+	}
+	return ret, nil
+}
+
+// Migrate applies all pending migrations. Each migration is applied in its own transaction together with the update of its plugin's
+// schema version, so a failed migration leaves the database at the version of the last successful migration.
+func (m *Migrator) Migrate() error {
+	_, err := m.db.Exec("CREATE TABLE IF NOT EXISTS SchemaVersions (plugin_name TEXT NOT NULL PRIMARY KEY, version INTEGER NOT NULL, applied DATETIME NOT NULL);")
+	if err != nil {
+		return fmt.Errorf("error creating SchemaVersions table: %w", err)
+	}
+	pending, err := m.Plan()
+	if err != nil {
+		return err
+	}
+	for _, p := range pending {
+		err = m.apply(p)
+		if err != nil {
+			return fmt.Errorf("failed to apply migration to version=%v for pluginName=%v: %w", p.Migration.Version, p.PluginName, err)
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) apply(p PendingMigration) error {
+	startTime := time.Now()
+	tx, err := m.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	err = p.Migration.Apply(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO SchemaVersions (plugin_name, version, applied) VALUES (?, ?, ?) ON CONFLICT(plugin_name) DO UPDATE SET version = excluded.version, applied = excluded.applied;",
+		p.PluginName, p.Migration.Version, time.Now())
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to update schema version: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	m.logger.Info("applied migration",
+		slog.String("pluginName", p.PluginName),
+		slog.Int("version", p.Migration.Version),
+		slog.String("description", p.Migration.Description),
+		slog.Duration("duration", time.Since(startTime)))
+	return nil
+}
+
+// getVersions returns the current schema version of each plugin. Plugins which have not applied any migrations are not included.
+func (m *Migrator) getVersions() (map[string]int, error) {
+	var count int
+	err := m.db.QueryRow("SELECT COUNT(1) FROM sqlite_master WHERE type = 'table' AND name = 'SchemaVersions';").Scan(&count)
+	if err != nil {
+		return nil, fmt.Errorf("error checking if SchemaVersions table exists: %w", err)
+	}
+	ret := map[string]int{}
+	if count == 0 {
+		return ret, nil
+	}
+	rows, err := m.db.Query("SELECT plugin_name, version FROM SchemaVersions;")
+	if err != nil {
+		return nil, fmt.Errorf("error getting schema versions: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pluginName string
+		var version int
+		err = rows.Scan(&pluginName, &version)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning schema version: %w", err)
+		}
+		ret[pluginName] = version
+	}
+	return ret, rows.Err()
+}
+
+// ExecStatements returns an Apply function for a migration which executes the statements in order.
+func ExecStatements(statements ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, stmt := range statements {
+			_, err := tx.Exec(stmt)
+			if err != nil {
+				return fmt.Errorf("error executing statement=%q: %w", stmt, err)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_common
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"testing"
+)
+
+func TestMigrateAppliesPendingMigrations(t *testing.T) {
+	db := openDb(t)
+	migrations := PluginMigrations{
+		PluginName: "test",
+		Migrations: []Migration{
+			{Version: 1, Description: "Create A", Apply: ExecStatements("CREATE TABLE A (x INTEGER);")},
+		},
+	}
+	err := Migrate(db, slog.Default(), migrations)
+	if err != nil {
+		t.Fatalf("got error when applying first migration: %v", err)
+	}
+	migrations.Migrations = append(migrations.Migrations, Migration{Version: 2, Description: "Add y to A", Apply: ExecStatements("ALTER TABLE A ADD COLUMN y TEXT;")})
+	m, err := NewMigrator(db, []PluginMigrations{migrations}, slog.Default())
+	if err != nil {
+		t.Fatalf("got error when creating migrator: %v", err)
+	}
+	pending, err := m.Plan()
+	if err != nil {
+		t.Fatalf("got error when planning migrations: %v", err)
+	}
+	if len(pending) != 1 || pending[0].Migration.Version != 2 {
+		t.Fatalf("expected only version 2 to be pending, got %+v", pending)
+	}
+	err = m.Migrate()
+	if err != nil {
+		t.Fatalf("got error when applying second migration: %v", err)
+	}
+	err = m.Migrate()
+	if err != nil {
+		t.Fatalf("got error when migrating an up to date database: %v", err)
+	}
+	_, err = db.Exec("INSERT INTO A (x, y) VALUES (1, 'a');")
+	if err != nil {
+		t.Fatalf("got error when using migrated table: %v", err)
+	}
+	assertVersion(t, db, "test", 2)
+}
+
+func TestMigrateRollsBackFailedMigration(t *testing.T) {
+	db := openDb(t)
+	err := Migrate(db, slog.Default(), PluginMigrations{
+		PluginName: "test",
+		Migrations: []Migration{
+			{Version: 1, Description: "Create A", Apply: ExecStatements("CREATE TABLE A (x INTEGER);")},
+			{Version: 2, Description: "Create B and fail", Apply: func(tx *sql.Tx) error {
+				_, err := tx.Exec("CREATE TABLE B (x INTEGER);")
+				if err != nil {
+					return err
+				}
+				return errors.New("failed")
+			}},
+		},
+	})
+	if err == nil {
+		t.Fatalf("expected error when a migration fails")
+	}
+	assertVersion(t, db, "test", 1)
+	var count int
+	err = db.QueryRow("SELECT COUNT(1) FROM sqlite_master WHERE name = 'B';").Scan(&count)
+	if err != nil || count != 0 {
+		t.Fatalf("expected table B to be rolled back, got count=%v, err=%v", count, err)
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	db := openDb(t)
+	migrations := PluginMigrations{
+		PluginName: "test",
+		Migrations: []Migration{
+			{Version: 1, Description: "Create A", Apply: ExecStatements("CREATE TABLE A (x INTEGER);")},
+			{Version: 2, Description: "Create B", Apply: ExecStatements("CREATE TABLE B (x INTEGER);")},
+		},
+	}
+	err := Migrate(db, slog.Default(), migrations)
+	if err != nil {
+		t.Fatalf("got error when migrating: %v", err)
+	}
+	migrations.Migrations = migrations.Migrations[:1]
+	err = Migrate(db, slog.Default(), migrations)
+	if err == nil {
+		t.Fatalf("expected error when the database has a newer schema version than the migrations")
+	}
+}
+
+func TestNewMigratorValidatesVersions(t *testing.T) {
+	_, err := NewMigrator(openDb(t), []PluginMigrations{
+		{
+			PluginName: "test",
+			Migrations: []Migration{
+				{Version: 1, Apply: ExecStatements()},
+				{Version: 3, Apply: ExecStatements()},
+			},
+		},
+	}, slog.Default())
+	if err == nil {
+		t.Fatalf("expected error when migration versions are not consecutive")
+	}
+}
+
+func openDb(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	// Every connection to :memory: gets its own database, so only one connection can be used
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func assertVersion(t *testing.T, db *sql.DB, pluginName string, expected int) {
+	var version int
+	err := db.QueryRow("SELECT version FROM SchemaVersions WHERE plugin_name = ?;", pluginName).Scan(&version)
+	if err != nil {
+		t.Fatalf("got error when getting schema version for pluginName=%v: %v", pluginName, err)
+	}
+	if version != expected {
+		t.Fatalf("got unexpected schema version for pluginName=%v, expected=%v, got=%v", pluginName, expected, version)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_common
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// Restore replaces the database in dbFile with the backup in backupFile, which may be compressed using gzip. The backup is copied and
+// checked using PRAGMA integrity_check before the current database is touched. The current database is kept next to dbFile with a
+// .before-restore-<timestamp> suffix, and Restore fails if the database is in use, so Logsuck must be stopped before restoring.
+func Restore(backupFile string, dbFile string, logger *slog.Logger) error {
+	if dbFile == ":memory:" {
+		return errors.New("can not restore an in-memory database")
+	}
+	candidate := dbFile + ".restore"
+	err := copyBackup(backupFile, candidate)
+	if err != nil {
+		os.Remove(candidate)
+		return err
+	}
+	err = checkBackup(candidate)
+	if err != nil {
+		os.Remove(candidate)
+		return fmt.Errorf("backup with fileName=%v failed the integrity check: %w", backupFile, err)
+	}
+	logger.Info("backup passed the integrity check", slog.String("fileName", backupFile))
+
+	previous := ""
+	if _, err := os.Stat(dbFile); err == nil {
+		previous = dbFile + ".before-restore-" + time.Now().UTC().Format(backupTimeLayout)
+		err = checkpoint(dbFile)
+		if err != nil {
+			os.Remove(candidate)
+			return err
+		}
+		err = os.Rename(dbFile, previous)
+		if err != nil {
+			os.Remove(candidate)
+			return fmt.Errorf("failed to move current database: %w", err)
+		}
+	}
+	// The WAL and shared memory files belong to the previous database and would corrupt the restored one if they were left in place. They
+	// are empty after the checkpoint.
+	for _, suffix := range []string{"-wal", "-shm"} {
+		err = os.Remove(dbFile + suffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove %v file of current database: %w", suffix, err)
+		}
+	}
+	err = os.Rename(candidate, dbFile)
+	if err != nil {
+		return fmt.Errorf("failed to move restored database into place: %w", err)
+	}
+	logger.Info("restored database",
+		slog.String("fileName", backupFile),
+		slog.String("dbFile", dbFile),
+		slog.String("previousDbFile", previous))
+	return nil
+}
+
+// copyBackup copies the backup to dst, decompressing it if its name ends with .gz.
+func copyBackup(backupFile string, dst string) error {
+	in, err := os.Open(backupFile)
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer in.Close()
+	var r io.Reader = in
+	if strings.HasSuffix(backupFile, compressedSuffix) {
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return fmt.Errorf("failed to decompress backup: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create copy of backup: %w", err)
+	}
+	defer out.Close()
+	_, err = io.Copy(out, r)
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to copy backup: %w", err)
+	}
+	return nil
+}
+
+// checkBackup returns an error if the file is not an intact SQLite database created by Logsuck.
+func checkBackup(fileName string) error {
+	db, err := sql.Open("sqlite3", "file:"+fileName+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+	rows, err := db.Query("PRAGMA integrity_check;")
+	if err != nil {
+		return fmt.Errorf("failed to run integrity_check: %w", err)
+	}
+	problems := []string{}
+	for rows.Next() {
+		var result string
+		err = rows.Scan(&result)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan integrity_check result: %w", err)
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to run integrity_check: %w", err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity_check found problems=%q", problems)
+	}
+	var count int
+	err = db.QueryRow("SELECT COUNT(1) FROM sqlite_master WHERE type = 'table' AND name = 'SchemaVersions';").Scan(&count)
+	if err != nil {
+		return fmt.Errorf("failed to check for SchemaVersions table: %w", err)
+	}
+	if count == 0 {
+		return errors.New("the database does not contain a SchemaVersions table, so it does not appear to be a Logsuck database")
+	}
+	return nil
+}
+
+// checkpoint moves everything in the WAL file of the database into the database file, so that the database file is complete on its own.
+// Returns an error if the database is in use by another connection, since exclusive locking mode can then not lock the database.
+func checkpoint(dbFile string) error {
+	db, err := sql.Open("sqlite3", "file:"+dbFile+"?_locking_mode=EXCLUSIVE&_busy_timeout=0")
+	if err != nil {
+		return fmt.Errorf("failed to open current database: %w", err)
+	}
+	defer db.Close()
+	// The lock is held by the connection, so the same connection must be used for the checkpoint
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec("BEGIN EXCLUSIVE; COMMIT;")
+	if err != nil {
+		return fmt.Errorf("the current database is in use, stop Logsuck before restoring: %w", err)
+	}
+	var busy, logFrames, checkpointedFrames int
+	err = db.QueryRow("PRAGMA wal_checkpoint(TRUNCATE);").Scan(&busy, &logFrames, &checkpointedFrames)
+	if err != nil {
+		return fmt.Errorf("failed to checkpoint current database: %w", err)
+	}
+	if busy != 0 {
+		return errors.New("the current database is in use, stop Logsuck before restoring")
+	}
+	return nil
+}
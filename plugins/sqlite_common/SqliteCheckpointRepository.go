@@ -0,0 +1,107 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_common
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/checkpoints"
+)
+
+// Migrations creates and updates the tables owned by this plugin.
+var Migrations = PluginMigrations{
+	PluginName: pluginName,
+	Migrations: []Migration{
+		{
+			Version:     1,
+			Description: "Create FileCheckpoints table",
+			Apply: ExecStatements(
+				"CREATE TABLE IF NOT EXISTS FileCheckpoints (host TEXT NOT NULL, path TEXT NOT NULL, device INTEGER NOT NULL, inode INTEGER NOT NULL, fingerprint BLOB, fingerprint_size INTEGER NOT NULL, offset INTEGER NOT NULL, source_id TEXT NOT NULL, updated DATETIME NOT NULL, PRIMARY KEY(host, path));",
+			),
+		},
+		{
+			Version:     2,
+			Description: "Add complete column to FileCheckpoints",
+			Apply: ExecStatements(
+				"ALTER TABLE FileCheckpoints ADD COLUMN complete INTEGER NOT NULL DEFAULT 0;",
+			),
+		},
+	},
+}
+
+type SqliteCheckpointRepository struct {
+	db *sql.DB
+}
+
+// NewSqliteCheckpointRepository creates a repository using the table created by Migrations, which must have been applied to the database.
+func NewSqliteCheckpointRepository(db *sql.DB) checkpoints.Repository {
+	return &SqliteCheckpointRepository{db: db}
+}
+
+func (r *SqliteCheckpointRepository) Get(host, path string) (*checkpoints.Checkpoint, error) {
+	row := r.db.QueryRow("SELECT device, inode, fingerprint, fingerprint_size, offset, complete, source_id, updated FROM FileCheckpoints WHERE host = ? AND path = ?;", host, path)
+	ret := checkpoints.Checkpoint{Host: host, Path: path}
+	// device and inode are stored as signed integers since database/sql does not support uint64 values with the high bit set
+	var device, inode int64
+	err := row.Scan(&device, &inode, &ret.Fingerprint, &ret.FingerprintSize, &ret.Offset, &ret.Complete, &ret.SourceId, &ret.Updated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting checkpoint for host=%v, path=%v: %w", host, path, err)
+	}
+	ret.Device = uint64(device)
+	ret.Inode = uint64(inode)
+	return &ret, nil
+}
+
+func (r *SqliteCheckpointRepository) List(host string) ([]checkpoints.Checkpoint, error) {
+	rows, err := r.db.Query("SELECT path, device, inode, fingerprint, fingerprint_size, offset, complete, source_id, updated FROM FileCheckpoints WHERE host = ? ORDER BY path;", host)
+	if err != nil {
+		return nil, fmt.Errorf("error listing checkpoints for host=%v: %w", host, err)
+	}
+	defer rows.Close()
+	ret := []checkpoints.Checkpoint{}
+	for rows.Next() {
+		cp := checkpoints.Checkpoint{Host: host}
+		var device, inode int64
+		err = rows.Scan(&cp.Path, &device, &inode, &cp.Fingerprint, &cp.FingerprintSize, &cp.Offset, &cp.Complete, &cp.SourceId, &cp.Updated)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning checkpoint for host=%v: %w", host, err)
+		}
+		cp.Device = uint64(device)
+		cp.Inode = uint64(inode)
+		ret = append(ret, cp)
+	}
+	return ret, rows.Err()
+}
+
+func (r *SqliteCheckpointRepository) Put(c checkpoints.Checkpoint) error {
+	updated := c.Updated
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	_, err := r.db.Exec("INSERT INTO FileCheckpoints (host, path, device, inode, fingerprint, fingerprint_size, offset, complete, source_id, updated) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) "+
+		"ON CONFLICT(host, path) DO UPDATE SET device = excluded.device, inode = excluded.inode, fingerprint = excluded.fingerprint, fingerprint_size = excluded.fingerprint_size, "+
+		"offset = excluded.offset, complete = excluded.complete, source_id = excluded.source_id, updated = excluded.updated;",
+		c.Host, c.Path, int64(c.Device), int64(c.Inode), c.Fingerprint, c.FingerprintSize, c.Offset, c.Complete, c.SourceId, updated)
+	if err != nil {
+		return fmt.Errorf("error putting checkpoint for host=%v, path=%v: %w", c.Host, c.Path, err)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_common
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/checkpoints"
+)
+
+func TestSqliteCheckpointRepository(t *testing.T) {
+	db := openDb(t)
+	err := Migrate(db, slog.Default(), Migrations)
+	if err != nil {
+		t.Fatalf("got error when migrating: %v", err)
+	}
+	repo := NewSqliteCheckpointRepository(db)
+
+	cp, err := repo.Get("host", "/var/log/a.log")
+	if err != nil {
+		t.Fatalf("got error when getting missing checkpoint: %v", err)
+	}
+	if cp != nil {
+		t.Fatalf("expected nil checkpoint for file without checkpoint, got %+v", cp)
+	}
+
+	expected := checkpoints.Checkpoint{
+		Host:            "host",
+		Path:            "/var/log/a.log",
+		Device:          1<<63 + 1,
+		Inode:           42,
+		Fingerprint:     []byte{1, 2, 3},
+		FingerprintSize: 3,
+		Offset:          10,
+		SourceId:        "first",
+	}
+	for _, offset := range []int64{10, 20} {
+		expected.Offset = offset
+		expected.Complete = offset == 20
+		err = repo.Put(expected)
+		if err != nil {
+			t.Fatalf("got error when putting checkpoint with offset=%v: %v", offset, err)
+		}
+	}
+	cp, err = repo.Get("host", "/var/log/a.log")
+	if err != nil {
+		t.Fatalf("got error when getting checkpoint: %v", err)
+	}
+	if cp == nil || cp.Device != expected.Device || cp.Inode != expected.Inode || !bytes.Equal(cp.Fingerprint, expected.Fingerprint) ||
+		cp.FingerprintSize != expected.FingerprintSize || cp.Offset != 20 || !cp.Complete || cp.SourceId != expected.SourceId || cp.Updated.IsZero() {
+		t.Fatalf("got unexpected checkpoint, expected=%+v, got=%+v", expected, cp)
+	}
+
+	list, err := repo.List("host")
+	if err != nil {
+		t.Fatalf("got error when listing checkpoints: %v", err)
+	}
+	if len(list) != 1 || list[0].Path != expected.Path || list[0].Inode != expected.Inode || list[0].Offset != 20 || !list[0].Complete {
+		t.Fatalf("got unexpected checkpoints from List, expected one checkpoint with offset=20, got=%+v", list)
+	}
+
+	cp, err = repo.Get("otherhost", "/var/log/a.log")
+	if err != nil {
+		t.Fatalf("got error when getting checkpoint for other host: %v", err)
+	}
+	if cp != nil {
+		t.Fatalf("expected checkpoints to be per host, got %+v", cp)
+	}
+}
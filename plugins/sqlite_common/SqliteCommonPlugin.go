@@ -63,7 +63,9 @@ var Plugin = logsuck.Plugin{
 			return err
 		}
 		err = c.Provide(func(cfg *Config) string {
-			additionalSqliteParameters := "?_journal_mode=WAL"
+			// auto_vacuum only takes effect for new databases, existing databases must be vacuumed once before the space freed by deleting
+			// events can be returned to the operating system.
+			additionalSqliteParameters := "?_journal_mode=WAL&_auto_vacuum=incremental"
 			if cfg.FileName == ":memory:" {
 				// cache=shared breaks DeleteOldEventsTask. But not having it breaks everything in :memory: mode.
 				// So we set cache=shared for :memory: mode and assume people will not need to delete old tasks in that mode.
@@ -77,18 +79,44 @@ var Plugin = logsuck.Plugin{
 		err = c.Provide(func(p struct {
 			dig.In
 
-			DriverName     string `name:"sqlDriver"`
-			DataSourceName string `name:"sqlDataSourceName"`
-		}) (*sql.DB, error) {
+			DriverName     string             `name:"sqlDriver"`
+			DataSourceName string             `name:"sqlDataSourceName"`
+			Migrations     []PluginMigrations `group:"sqliteMigrations"`
+			Logger         *slog.Logger
+		}) (*Migrator, error) {
 			db, err := sql.Open(p.DriverName, p.DataSourceName)
 			if err != nil {
 				return nil, err
 			}
-			return db, nil
+			return NewMigrator(db, p.Migrations, p.Logger)
 		})
 		if err != nil {
 			return err
 		}
+		err = c.Provide(func(m *Migrator) (*sql.DB, error) {
+			err := m.Migrate()
+			if err != nil {
+				return nil, fmt.Errorf("failed to migrate database: %w", err)
+			}
+			return m.db, nil
+		})
+		if err != nil {
+			return err
+		}
+		err = c.Provide(func() PluginMigrations {
+			return Migrations
+		}, dig.Group("sqliteMigrations"))
+		if err != nil {
+			return err
+		}
+		err = c.Provide(NewSqliteCheckpointRepository)
+		if err != nil {
+			return err
+		}
+		err = c.Provide(NewBackupTask, dig.Group("tasks"))
+		if err != nil {
+			return err
+		}
 		return nil
 	},
 	JsonSchema: func() (map[string]any, error) {
@@ -0,0 +1,32 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_config
+
+import "github.com/jackbister/logsuck/plugins/sqlite_common"
+
+// Migrations creates and updates the tables used by the config repository.
+var Migrations = sqlite_common.PluginMigrations{
+	PluginName: pluginName,
+	Migrations: []sqlite_common.Migration{
+		{
+			Version:     1,
+			Description: "Create Config table",
+			// IF NOT EXISTS is used since databases created before migrations were introduced already have the table
+			Apply: sqlite_common.ExecStatements(
+				"CREATE TABLE IF NOT EXISTS Config (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, config_json TEXT, modified DATETIME);",
+			),
+		},
+	},
+}
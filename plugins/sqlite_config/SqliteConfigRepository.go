@@ -42,11 +42,8 @@ type SqliteConfigRepositoryParams struct {
 	Logger            *slog.Logger
 }
 
+// NewSqliteConfigRepository creates a repository using the table created by Migrations, which must have been applied to the database.
 func NewSqliteConfigRepository(p SqliteConfigRepositoryParams) (config.Repository, error) {
-	_, err := p.Db.Exec("CREATE TABLE IF NOT EXISTS Config (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, config_json TEXT, modified DATETIME)")
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize SqliteConfigRepository: %w", err)
-	}
 	r, err := p.Db.Query("SELECT COUNT(1) FROM Config")
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize SqliteConfigRepository: failed to query for COUNT from Config: %w", err)
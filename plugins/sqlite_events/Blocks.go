@@ -0,0 +1,507 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_events
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+)
+
+// When the raw events are stored in blocks, the raw events from the same source in a batch are concatenated and compressed together,
+// which compresses much better than compressing each event on its own since log lines from the same file tend to be similar.
+// Each event refers to its block using the block_id and block_index columns in the Events table.
+//
+// The EventRaws table is then an external content table using the normally empty EventRawsContent table as its content table, so it
+// contains the full-text index but not the raw events. FTS4 and FTS5 read the content table to find the terms to remove from the index
+// when a row is deleted, so deleteBlockRaws fills the content table with the decompressed raw events right before deleting them.
+
+// blockCodecFlate is the first byte of blocks compressed using DEFLATE. The codec is stored in each block so that blocks using different
+// codecs can be read from the same table.
+const blockCodecFlate byte = 1
+
+// maxBlockSize is the number of uncompressed bytes after which a new block is started. Reading a single event requires decompressing its
+// whole block, so larger blocks compress better but make GetByIds and GetSurroundingEvents slower.
+const maxBlockSize = 128 * 1024
+
+// encodeBlock concatenates the raw events, each prefixed by its length, and compresses the result. The block is encrypted using key if it
+// is not nil, see Encryption.go.
+func encodeBlock(raws []string, key *dataKey) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(blockCodecFlate)
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create flate writer: %w", err)
+	}
+	var lenBuf [binary.MaxVarintLen64]byte
+	for _, raw := range raws {
+		n := binary.PutUvarint(lenBuf[:], uint64(len(raw)))
+		_, err = w.Write(lenBuf[:n])
+		if err == nil {
+			_, err = io.WriteString(w, raw)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress event: %w", err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress block: %w", err)
+	}
+	if key != nil {
+		return key.seal(buf.Bytes()[1:])
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeBlock returns the raw events in a block created by encodeBlock. keys is only used for encrypted blocks and may be nil if
+// encryption is disabled.
+func decodeBlock(data []byte, keys *keyring) ([]string, error) {
+	if len(data) == 0 {
+		return nil, errors.New("block is empty")
+	}
+	var compressed []byte
+	switch data[0] {
+	case blockCodecFlate:
+		compressed = data[1:]
+	case blockCodecFlateAesGcm:
+		var err error
+		compressed, err = keys.open(data)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("block has unknown codec=%v", data[0])
+	}
+	r := bufio.NewReader(flate.NewReader(bytes.NewReader(compressed)))
+	ret := []string{}
+	for {
+		l, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read length of event at index=%v: %w", len(ret), err)
+		}
+		raw := make([]byte, l)
+		_, err = io.ReadFull(r, raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read event at index=%v: %w", len(ret), err)
+		}
+		ret = append(ret, string(raw))
+	}
+}
+
+// compressionStats counts the bytes before and after compression, so that the compression ratio can be logged.
+type compressionStats struct {
+	rawBytes        int64
+	compressedBytes int64
+}
+
+func (s *compressionStats) add(raws []string, data []byte) {
+	for _, raw := range raws {
+		s.rawBytes += int64(len(raw))
+	}
+	s.compressedBytes += int64(len(data))
+}
+
+func (s *compressionStats) ratio() float64 {
+	if s.compressedBytes == 0 {
+		return 0
+	}
+	return float64(s.rawBytes) / float64(s.compressedBytes)
+}
+
+// blockRef is the position of an event in a block. The fields are NULL if the raw event is stored in the EventRaws table.
+type blockRef struct {
+	id    sql.NullInt64
+	index sql.NullInt64
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// selectEventsFrom returns the start of a statement selecting events in the format expected by scanEvent. The events table has the alias e.
+func (repo *sqliteEventRepository) selectEventsFrom() string {
+	if repo.layout.blocks {
+		// Joining with the EventRaws table would not find any rows since it is an external content table with an empty content table
+		return "SELECT e.id, e.host, e.source, e.source_id, e.index_name, e.timestamp, e.offset, NULL, e.block_id, e.block_index FROM " + repo.tables.events + " e"
+	}
+	return "SELECT e.id, e.host, e.source, e.source_id, e.index_name, e.timestamp, e.offset, r.raw, e.block_id, e.block_index FROM " + repo.tables.events + " e INNER JOIN " + repo.tables.raws + " r ON r.rowid = e.id"
+}
+
+// scanEvent scans a row selected using selectEventsFrom. The raw event is empty if it is stored in a block, in which case loadRaws must be
+// used to read it.
+func scanEvent(rows *sql.Rows, evt *events.EventWithId, ref *blockRef) error {
+	var raw sql.NullString
+	err := rows.Scan(&evt.Id, &evt.Host, &evt.Source, &evt.SourceId, &evt.Index, &evt.Timestamp, &evt.Offset, &raw, &ref.id, &ref.index)
+	evt.Raw = raw.String
+	return err
+}
+
+// scanEvents scans all rows selected using selectEventsFrom and closes rows.
+func scanEvents(rows *sql.Rows) ([]events.EventWithId, []blockRef, error) {
+	defer rows.Close()
+	evts := []events.EventWithId{}
+	refs := []blockRef{}
+	for rows.Next() {
+		var evt events.EventWithId
+		var ref blockRef
+		err := scanEvent(rows, &evt, &ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		evts = append(evts, evt)
+		refs = append(refs, ref)
+	}
+	return evts, refs, rows.Err()
+}
+
+// loadRaws sets the raw events of the events which are stored in blocks. Each block is only decompressed once.
+func loadRaws(q queryer, blocksTable string, keys *keyring, evts []events.EventWithId, refs []blockRef) error {
+	ids := []any{}
+	seen := map[int64]struct{}{}
+	for _, ref := range refs {
+		if !ref.id.Valid {
+			continue
+		}
+		if _, ok := seen[ref.id.Int64]; !ok {
+			seen[ref.id.Int64] = struct{}{}
+			ids = append(ids, ref.id.Int64)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	rows, err := q.Query("SELECT id, data FROM "+blocksTable+" WHERE id IN ("+placeholders(len(ids))+");", ids...)
+	if err != nil {
+		return fmt.Errorf("failed to get blocks: %w", err)
+	}
+	defer rows.Close()
+	blocks := make(map[int64][]string, len(ids))
+	for rows.Next() {
+		var id int64
+		var data []byte
+		err = rows.Scan(&id, &data)
+		if err != nil {
+			return fmt.Errorf("failed to scan block: %w", err)
+		}
+		blocks[id], err = decodeBlock(data, keys)
+		if err != nil {
+			return fmt.Errorf("failed to decode block with id=%v: %w", id, err)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to get blocks: %w", err)
+	}
+	for i, ref := range refs {
+		if !ref.id.Valid {
+			continue
+		}
+		raws := blocks[ref.id.Int64]
+		if ref.index.Int64 < 0 || ref.index.Int64 >= int64(len(raws)) {
+			return fmt.Errorf("eventId=%v refers to missing index=%v in block with id=%v", evts[i].Id, ref.index.Int64, ref.id.Int64)
+		}
+		evts[i].Raw = raws[ref.index.Int64]
+	}
+	return nil
+}
+
+// groupBySource splits the events into groups of events from the same source, where each group is small enough to be stored in one block.
+func groupBySource(evts []events.Event) [][]events.Event {
+	ret := [][]events.Event{}
+	current := map[string]int{}
+	sizes := map[string]int{}
+	for _, evt := range evts {
+		i, ok := current[evt.Source]
+		if !ok || sizes[evt.Source] >= maxBlockSize {
+			i = len(ret)
+			current[evt.Source] = i
+			sizes[evt.Source] = 0
+			ret = append(ret, nil)
+		}
+		ret[i] = append(ret[i], evt)
+		sizes[evt.Source] += len(evt.Raw)
+	}
+	return ret
+}
+
+// addBatchBlocks adds the events when the raw events are stored in blocks. Events which are duplicates of existing events are skipped.
+func (repo *sqliteEventRepository) addBatchBlocks(evts []events.Event) error {
+	startTime := time.Now()
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction for adding event batch: %w", err)
+	}
+	defer tx.Rollback()
+	insertEvent, err := tx.Prepare("INSERT OR IGNORE INTO " + repo.tables.events + " (host, source, source_id, timestamp, offset, index_name, block_id, block_index, content_hash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);")
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer insertEvent.Close()
+	insertRaw, err := tx.Prepare("INSERT INTO " + repo.tables.raws + " (rowid, raw, source, host) VALUES (?, ?, ?, ?);")
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer insertRaw.Close()
+
+	var stats compressionStats
+	numberOfDuplicates := map[string]int64{}
+	duplicates := []events.Event{}
+	for _, group := range groupBySource(evts) {
+		// The block is created before the events since the events refer to it, and its data is set once it is known which events were
+		// not duplicates
+		res, err := tx.Exec("INSERT INTO " + repo.tables.blocks + " (data) VALUES (x'');")
+		if err != nil {
+			return fmt.Errorf("error adding block: %w", err)
+		}
+		blockId, err := res.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("error getting block id after insert: %w", err)
+		}
+		raws := make([]string, 0, len(group))
+		for _, evt := range group {
+			res, err := insertEvent.Exec(evt.Host, evt.Source, evt.SourceId, evt.Timestamp, evt.Offset, indexName(evt), blockId, len(raws), repo.contentHashOf(evt))
+			if err != nil {
+				return fmt.Errorf("error executing add statement: %w", err)
+			}
+			if n, err := res.RowsAffected(); err == nil && n == 0 {
+				numberOfDuplicates[evt.Source]++
+				duplicates = append(duplicates, evt)
+				continue
+			}
+			id, err := res.LastInsertId()
+			if err != nil {
+				return fmt.Errorf("error getting event id after insert: %w", err)
+			}
+			_, err = insertRaw.Exec(id, repo.indexedRaw(evt.Raw), evt.Source, evt.Host)
+			if err != nil {
+				return fmt.Errorf("error adding event to full-text index: %w", err)
+			}
+			for k, v := range evt.IndexedFields {
+				_, err = tx.Exec("INSERT INTO "+repo.tables.fields+" (event_id, key, value, version) VALUES (?, ?, ?, ?);", id, k, v, fieldsVersion(evt))
+				if err != nil {
+					return fmt.Errorf("error executing add field statement: %w", err)
+				}
+			}
+			raws = append(raws, evt.Raw)
+		}
+		if len(raws) == 0 {
+			_, err = tx.Exec("DELETE FROM "+repo.tables.blocks+" WHERE id = ?;", blockId)
+			if err != nil {
+				return fmt.Errorf("error deleting empty block: %w", err)
+			}
+			continue
+		}
+		key := repo.keys.currentKey()
+		data, err := encodeBlock(raws, key)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE "+repo.tables.blocks+" SET data = ?, key_id = ? WHERE id = ?;", data, keyIdOf(key), blockId)
+		if err != nil {
+			return fmt.Errorf("error setting block data: %w", err)
+		}
+		stats.add(raws, data)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("error committing event batch: %w", err)
+	}
+	repo.metrics.RecordBatch(evts, duplicates)
+	for k, v := range numberOfDuplicates {
+		repo.logger.Info("Skipped adding events because they appear to be duplicates ("+repo.duplicateReason()+")",
+			slog.Int64("numEvents", v), slog.String("source", k))
+	}
+	repo.logger.Info("added events",
+		slog.Int("numEvents", len(evts)),
+		slog.Int64("rawBytes", stats.rawBytes),
+		slog.Int64("compressedBytes", stats.compressedBytes),
+		slog.Float64("compressionRatio", stats.ratio()),
+		slog.Duration("duration", time.Since(startTime)))
+	return nil
+}
+
+// deleteBlockRaws removes the events with the given IDs from the full-text index and returns the IDs of the blocks they are stored in.
+// The events must still exist in the Events table.
+func (repo *sqliteEventRepository) deleteBlockRaws(tx *sql.Tx, args []any) ([]any, error) {
+	rows, err := tx.Query(repo.selectEventsFrom()+" WHERE e.id IN ("+placeholders(len(args))+");", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get events: %w", err)
+	}
+	evts, refs, err := scanEvents(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan events: %w", err)
+	}
+	err = loadRaws(tx, repo.tables.blocks, repo.keys, evts, refs)
+	if err != nil {
+		return nil, err
+	}
+	blockIds := []any{}
+	seen := map[int64]struct{}{}
+	content := repo.tables.rawsContent
+	for i, evt := range evts {
+		_, err = tx.Exec("INSERT INTO "+content+" (rowid, raw, source, host) VALUES (?, ?, ?, ?);", evt.Id, repo.indexedRaw(evt.Raw), evt.Source, evt.Host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add event to content table: %w", err)
+		}
+		if _, ok := seen[refs[i].id.Int64]; refs[i].id.Valid && !ok {
+			seen[refs[i].id.Int64] = struct{}{}
+			blockIds = append(blockIds, refs[i].id.Int64)
+		}
+	}
+	_, err = tx.Exec("DELETE FROM "+repo.tables.raws+" WHERE rowid IN ("+placeholders(len(args))+");", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete events from full-text index: %w", err)
+	}
+	_, err = tx.Exec("DELETE FROM " + content + ";")
+	if err != nil {
+		return nil, fmt.Errorf("failed to clear content table: %w", err)
+	}
+	return blockIds, nil
+}
+
+// deleteUnusedBlocks deletes the blocks with the given IDs which no event refers to anymore. Blocks where only some of the events have
+// been deleted are kept as they are.
+func (repo *sqliteEventRepository) deleteUnusedBlocks(tx *sql.Tx, blockIds []any) error {
+	if len(blockIds) == 0 {
+		return nil
+	}
+	_, err := tx.Exec("DELETE FROM "+repo.tables.blocks+" WHERE id IN ("+placeholders(len(blockIds))+") AND NOT EXISTS (SELECT 1 FROM "+repo.tables.events+" e WHERE e.block_id = "+repo.tables.blocks+".id);", blockIds...)
+	if err != nil {
+		return fmt.Errorf("failed to delete unused blocks: %w", err)
+	}
+	return nil
+}
+
+// migrationPageSize is the number of events copied at a time by copyRaws.
+const migrationPageSize = 1000
+
+// copyRaws copies the raw events to a new EventRaws table when migrating between layouts where at least one stores the raw events in
+// blocks or is encrypted. If the events are not already stored in blocks, or are stored in blocks which must be encrypted or decrypted,
+// they are written to new blocks and true is returned so that the old blocks can be deleted.
+func copyRaws(tx *sql.Tx, tables eventTables, keys *keyring, from, to rawsLayout, migratedTable string) (int64, compressionStats, bool, error) {
+	var stats compressionStats
+	src := &sqliteEventRepository{tables: tables, layout: from, keys: keys}
+	dst := &sqliteEventRepository{tables: tables, layout: to, keys: keys}
+	rewriteBlocks := to.blocks && (!from.blocks || from.encrypted() != to.encrypted())
+	insertRaw, err := tx.Prepare("INSERT INTO " + migratedTable + " (rowid, raw, source, host) VALUES (?, ?, ?, ?);")
+	if err != nil {
+		return 0, stats, false, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer insertRaw.Close()
+	var numEvents int64
+	var lastId int64
+	for {
+		rows, err := tx.Query(src.selectEventsFrom()+" WHERE e.id > ? ORDER BY e.id LIMIT ?;", lastId, migrationPageSize)
+		if err != nil {
+			return 0, stats, false, fmt.Errorf("failed to get events: %w", err)
+		}
+		evts, refs, err := scanEvents(rows)
+		if err != nil {
+			return 0, stats, false, fmt.Errorf("failed to scan events: %w", err)
+		}
+		if len(evts) == 0 {
+			return numEvents, stats, rewriteBlocks, nil
+		}
+		err = loadRaws(tx, tables.blocks, keys, evts, refs)
+		if err != nil {
+			return 0, stats, false, err
+		}
+		if rewriteBlocks {
+			var key *dataKey
+			if to.encrypted() {
+				key = keys.currentKey()
+			}
+			err = writeBlocks(tx, tables, key, evts, &stats)
+			if err != nil {
+				return 0, stats, false, err
+			}
+		}
+		for _, evt := range evts {
+			_, err = insertRaw.Exec(evt.Id, dst.indexedRaw(evt.Raw), evt.Source, evt.Host)
+			if err != nil {
+				return 0, stats, false, fmt.Errorf("failed to add eventId=%v to new table: %w", evt.Id, err)
+			}
+		}
+		numEvents += int64(len(evts))
+		lastId = evts[len(evts)-1].Id
+	}
+}
+
+// writeBlocks stores the raw events of existing events in new blocks, which are encrypted using key unless it is nil.
+func writeBlocks(tx *sql.Tx, tables eventTables, key *dataKey, evts []events.EventWithId, stats *compressionStats) error {
+	bySource := map[string][]events.EventWithId{}
+	sources := []string{}
+	for _, evt := range evts {
+		if _, ok := bySource[evt.Source]; !ok {
+			sources = append(sources, evt.Source)
+		}
+		bySource[evt.Source] = append(bySource[evt.Source], evt)
+	}
+	for _, source := range sources {
+		group := bySource[source]
+		start, size := 0, 0
+		for i, evt := range group {
+			size += len(evt.Raw)
+			if size >= maxBlockSize || i == len(group)-1 {
+				err := writeBlock(tx, tables, key, group[start:i+1], stats)
+				if err != nil {
+					return err
+				}
+				start, size = i+1, 0
+			}
+		}
+	}
+	return nil
+}
+
+func writeBlock(tx *sql.Tx, tables eventTables, key *dataKey, evts []events.EventWithId, stats *compressionStats) error {
+	raws := make([]string, len(evts))
+	for i, evt := range evts {
+		raws[i] = evt.Raw
+	}
+	data, err := encodeBlock(raws, key)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("INSERT INTO "+tables.blocks+" (data, key_id) VALUES (?, ?);", data, keyIdOf(key))
+	if err != nil {
+		return fmt.Errorf("failed to add block: %w", err)
+	}
+	blockId, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get block id after insert: %w", err)
+	}
+	for i, evt := range evts {
+		_, err = tx.Exec("UPDATE "+tables.events+" SET block_id = ?, block_index = ? WHERE id = ?;", blockId, i, evt.Id)
+		if err != nil {
+			return fmt.Errorf("failed to set block of eventId=%v: %w", evt.Id, err)
+		}
+	}
+	stats.add(raws, data)
+	return nil
+}
@@ -0,0 +1,287 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_events
+
+import (
+	"database/sql"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/brianvoe/gofakeit"
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/parser"
+	"github.com/jackbister/logsuck/pkg/logsuck/search"
+	"github.com/jackbister/logsuck/plugins/sqlite_common"
+)
+
+func TestEncodeDecodeBlock(t *testing.T) {
+	raws := []string{"hello world", "", "räksmörgås", string(make([]byte, 1000))}
+	data, err := encodeBlock(raws, nil)
+	if err != nil {
+		t.Fatalf("got error when encoding block: %v", err)
+	}
+	decoded, err := decodeBlock(data, nil)
+	if err != nil {
+		t.Fatalf("got error when decoding block: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, raws) {
+		t.Fatalf("got unexpected events after decoding block, expected=%v, got=%v", raws, decoded)
+	}
+	_, err = decodeBlock([]byte{42, 1, 2, 3}, nil)
+	if err == nil {
+		t.Fatalf("expected error when decoding block with unknown codec")
+	}
+}
+
+func TestGroupBySource(t *testing.T) {
+	big := string(make([]byte, maxBlockSize))
+	evts := []events.Event{
+		{Raw: "a1", Source: "a.log"},
+		{Raw: "b1", Source: "b.log"},
+		{Raw: big, Source: "a.log"},
+		{Raw: "a2", Source: "a.log"},
+		{Raw: "b2", Source: "b.log"},
+	}
+	groups := groupBySource(evts)
+	got := make([][]string, len(groups))
+	for i, g := range groups {
+		for _, evt := range g {
+			got[i] = append(got[i], evt.Raw)
+		}
+	}
+	expected := [][]string{{"a1", big}, {"b1", "b2"}, {"a2"}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got unexpected groups, expected %v groups, got %v", len(expected), len(got))
+	}
+}
+
+func TestCompressedFilterStream(t *testing.T) {
+	repo := createRepoWithCfg(t, &Config{TrueBatch: true, Compression: CompressionFlate})
+	raws := []string{"java.lang.NullPointerException: oops", "IllegalStateException", "hello world", "othello"}
+	evts := eventsWithRaws(raws)
+	evts[3].Source = "other.txt"
+	evts[3].SourceId = "other"
+	err := repo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	// Duplicates must be skipped without breaking the blocks of the other events
+	err = repo.AddBatch(append(eventsWithRaws(raws[:1]), events.Event{Raw: "new", Timestamp: time.Now(), Host: "localhost", Source: "new.txt", SourceId: "new", Offset: 0}))
+	if err != nil {
+		t.Fatalf("got error when adding duplicate events: %v", err)
+	}
+	assertSearchResults(t, repo, "", append(raws, "new"))
+	assertSearchResults(t, repo, "hello", []string{"hello world"})
+	assertSearchResults(t, repo, "NOT hello", []string{"java.lang.NullPointerException: oops", "IllegalStateException", "othello", "new"})
+	assertSearchResults(t, repo, "source=other.txt", []string{"othello"})
+
+	got, err := repo.GetByIds([]int64{4, 2}, events.SortModePreserveArgOrder)
+	if err != nil {
+		t.Fatalf("got error when getting events by id: %v", err)
+	}
+	if len(got) != 2 || got[0].Raw != "othello" || got[1].Raw != "IllegalStateException" {
+		t.Fatalf("got unexpected events from GetByIds: %v", got)
+	}
+	surrounding, err := repo.GetSurroundingEvents(2, 4)
+	if err != nil {
+		t.Fatalf("got error when getting surrounding events: %v", err)
+	}
+	surroundingRaws := []string{}
+	for _, evt := range surrounding {
+		surroundingRaws = append(surroundingRaws, evt.Raw)
+	}
+	expected := []string{"hello world", "IllegalStateException", "java.lang.NullPointerException: oops"}
+	if !reflect.DeepEqual(surroundingRaws, expected) {
+		t.Fatalf("got unexpected surrounding events, expected=%v, got=%v", expected, surroundingRaws)
+	}
+}
+
+func TestCompressedFts5(t *testing.T) {
+	repo := createFts5RepoWithCfg(t, ":memory:", &Config{TrueBatch: true, FullTextSearch: FullTextSearchFts5, Compression: CompressionFlate})
+	raws := []string{"java.lang.NullPointerException: oops", "IllegalStateException", "hello world", "othello"}
+	err := repo.AddBatch(eventsWithRaws(raws))
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	for _, tt := range fts5SearchTests {
+		assertSearchResults(t, repo, tt.search, tt.expected)
+	}
+	err = repo.DeleteBatch([]int64{1})
+	if err != nil {
+		t.Fatalf("got error when deleting events: %v", err)
+	}
+	assertSearchResults(t, repo, "*Exception", []string{"IllegalStateException"})
+}
+
+func TestCompressedDeleteBatch(t *testing.T) {
+	repo := createRepoWithCfg(t, &Config{TrueBatch: true, Compression: CompressionFlate})
+	evts := eventsWithRaws([]string{"hello world", "hello there", "goodbye"})
+	evts[2].Source = "other.txt"
+	err := repo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	err = repo.DeleteBatch([]int64{1, 3})
+	if err != nil {
+		t.Fatalf("got error when deleting events: %v", err)
+	}
+	assertSearchResults(t, repo, "hello", []string{"hello there"})
+	assertSearchResults(t, repo, "goodbye", []string{})
+
+	db := repo.(*sqliteEventRepository).db
+	var numBlocks, numContent int
+	err = db.QueryRow("SELECT (SELECT COUNT(*) FROM EventBlocks), (SELECT COUNT(*) FROM EventRawsContent);").Scan(&numBlocks, &numContent)
+	if err != nil {
+		t.Fatalf("got error when counting blocks: %v", err)
+	}
+	// The block of other.txt is unused and should be deleted, while the block of log.txt still has an event
+	if numBlocks != 1 || numContent != 0 {
+		t.Fatalf("expected 1 block and an empty content table after deleting, got numBlocks=%v, numContent=%v", numBlocks, numContent)
+	}
+}
+
+func TestCompressedPartitions(t *testing.T) {
+	repo := createRepoWithCfg(t, &Config{TrueBatch: true, Compression: CompressionFlate, PartitionHours: 24})
+	err := repo.AddBatch(eventsOverDays(3, 2))
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	evts := collectEvents(repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampDesc))
+	assertTimestampOrder(t, evts, 6, events.SortModeTimestampDesc)
+	for _, evt := range evts {
+		if evt.Raw != "event" {
+			t.Fatalf("got unexpected raw=%q for eventId=%v", evt.Raw, evt.Id)
+		}
+	}
+	numDeleted, err := repo.(events.PartitionDeleter).DeletePartitionsBefore(time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC))
+	if err != nil || numDeleted != 2 {
+		t.Fatalf("expected 2 partitions to be deleted, got numDeleted=%v, err=%v", numDeleted, err)
+	}
+}
+
+func TestMigrateCompression(t *testing.T) {
+	db := openMigratedDb(t, "file:"+filepath.Join(t.TempDir(), "logsuck.db"))
+	raws := []string{"java.lang.NullPointerException: oops", "hello world", "hello there"}
+	evts := eventsWithRaws(raws)
+	evts[2].Source = "other.txt"
+	// True batch mode is not used since it assumes that the rowids of the EventRaws table follow the IDs of the Events table, which is not
+	// the case after the newest event has been deleted
+	err := createRepoWithDb(t, db, &Config{}).AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	for _, compression := range []string{CompressionFlate, CompressionNone, CompressionFlate} {
+		repo := createRepoWithDb(t, db, &Config{Compression: compression})
+		assertSearchResults(t, repo, "", raws)
+		assertSearchResults(t, repo, "hello", []string{"hello world", "hello there"})
+		err = repo.DeleteBatch([]int64{idOf(t, repo, "hello there")})
+		if err != nil {
+			t.Fatalf("got error when deleting event with compression=%v: %v", compression, err)
+		}
+		assertSearchResults(t, repo, "hello", []string{"hello world"})
+		err = repo.AddBatch(evts[2:])
+		if err != nil {
+			t.Fatalf("got error when adding event with compression=%v: %v", compression, err)
+		}
+	}
+	layout, _, err := getEventRawsLayout(db, defaultEventTables.raws)
+	if err != nil || !layout.blocks {
+		t.Fatalf("expected eventraws table to use blocks after migrating, got layout=%v, err=%v", layout, err)
+	}
+}
+
+var logdunkRows = []string{
+	"Reticulated numSplines=### for userId=#### in timeInMs=###",
+	"Setting password=??#?#?#? for userId=####, userName={person.first}",
+	"{hacker.verb} {hacker.noun}, {hacker.noun}=###",
+	"{company.buzzwords}=### {company.buzzwords}=??? {company.buzzwords}=###",
+}
+
+// logdunkEvents returns events like the ones written by cmd/logdunk.
+func logdunkEvents(n int) []events.Event {
+	gofakeit.Seed(42)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ret := make([]events.Event, n)
+	for i := range ret {
+		ts := start.Add(time.Duration(i) * 100 * time.Millisecond)
+		ret[i] = events.Event{
+			Raw:       ts.Format("2006/01/02 15:04:05.000000") + " /home/logsuck/cmd/logdunk/main.go:53: " + gofakeit.Generate(gofakeit.RandString(logdunkRows)),
+			Timestamp: ts,
+			Host:      "localhost",
+			Source:    "log-" + strconv.Itoa(i%4) + ".txt",
+			Offset:    int64(i),
+		}
+	}
+	return ret
+}
+
+// BenchmarkCompression compares the size of the database and the latency of a search with and without compression. Run it with
+// go test -bench Compression -run ^$ ./plugins/sqlite_events/
+func BenchmarkCompression(b *testing.B) {
+	evts := logdunkEvents(20000)
+	srch, err := parser.Parse("Reticulated")
+	if err != nil {
+		b.Fatalf("got error when parsing search: %v", err)
+	}
+	for _, compression := range []string{CompressionNone, CompressionFlate} {
+		b.Run(compression, func(b *testing.B) {
+			db := openMigratedDb(b, "file:"+filepath.Join(b.TempDir(), "logsuck.db"))
+			repo := createRepoWithDb(b, db, &Config{TrueBatch: true, Compression: compression})
+			for i := 0; i < len(evts); i += 1000 {
+				err := repo.AddBatch(evts[i : i+1000])
+				if err != nil {
+					b.Fatalf("got error when adding events: %v", err)
+				}
+			}
+			size, err := storageSize(db)
+			if err != nil {
+				b.Fatalf("got error when getting storage size: %v", err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				collectEvents(repo.FilterStream(srch, nil, nil, events.SortModeTimestampDesc))
+			}
+			b.ReportMetric(float64(size), "dbBytes")
+		})
+	}
+}
+
+func openMigratedDb(t testing.TB, dataSourceName string) *sql.DB {
+	db, err := sql.Open("sqlite3", dataSourceName)
+	if err != nil {
+		t.Fatalf("got error when opening database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = sqlite_common.Migrate(db, slog.Default(), Migrations)
+	if err != nil {
+		t.Fatalf("got error when migrating database: %v", err)
+	}
+	return db
+}
+
+func idOf(t *testing.T, repo events.Repository, raw string) int64 {
+	for _, evt := range collectEvents(repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampDesc)) {
+		if evt.Raw == raw {
+			return evt.Id
+		}
+	}
+	t.Fatalf("found no event with raw=%v", raw)
+	return 0
+}
@@ -0,0 +1,131 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_events
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+)
+
+// contentHashLength is the number of bytes of the SHA-256 hash stored in the content_hash column
+const contentHashLength = 16
+
+// duplicateReason describes which events are considered duplicates, for use in log messages.
+func (repo *sqliteEventRepository) duplicateReason() string {
+	if repo.cfg.Dedup == DedupContentHash {
+		return "same host, file fingerprint, offset and contents or same source, offset and timestamp as an existing event"
+	}
+	return "same source, offset and timestamp as an existing event"
+}
+
+// contentHashOf returns the value of the content_hash column for the event, which is nil unless DedupContentHash is used and the event
+// has a fingerprint.
+func (repo *sqliteEventRepository) contentHashOf(evt events.Event) any {
+	if repo.cfg.Dedup != DedupContentHash || len(evt.Fingerprint) == 0 {
+		return nil
+	}
+	return contentHash(evt, repo.keys)
+}
+
+// contentHash hashes the host, file fingerprint, offset and raw event. The fingerprint identifies the file by its first bytes, so the same
+// file gets the same hash when it is read again under another name after being rotated or compressed, while another file at the same path,
+// such as the next generation of a rotated file, gets a different hash even if it starts with the same lines. The timestamp is not included
+// since events without a parsed timestamp get the time they were read as their timestamp, and the source ID is not included since it
+// changes when Logsuck is restarted.
+// If the raw events are encrypted, the hash is keyed using the index key so that it can not be used to guess the contents of events.
+func contentHash(evt events.Event, keys *keyring) []byte {
+	h := sha256.New()
+	if keys != nil {
+		h = hmac.New(sha256.New, keys.indexKey)
+	}
+	var buf [binary.MaxVarintLen64]byte
+	for _, s := range []string{evt.Host, string(evt.Fingerprint), evt.Raw} {
+		// The length is written before each string so that different combinations of strings can not result in the same input
+		h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(s)))])
+		h.Write([]byte(s))
+	}
+	h.Write(buf[:binary.PutVarint(buf[:], evt.Offset)])
+	return h.Sum(nil)[:contentHashLength]
+}
+
+// maxContentHashParameters is the maximum number of hashes looked up in one statement, which is well below the default maximum number
+// of parameters in SQLite
+const maxContentHashParameters = 500
+
+// removeContentHashDuplicates removes the events whose content hash exists in any partition, and the events which are duplicates of an
+// earlier event in the batch. The unique index on content_hash only applies within a partition, but the events of a file which is read
+// again without parsed timestamps get new timestamps and would often be added to a different partition. Events without a fingerprint are
+// never removed. The removed events are returned as the second return value.
+func (repo *partitionedEventRepository) removeContentHashDuplicates(evts []events.Event) ([]events.Event, []events.Event, error) {
+	if repo.cfg.Dedup != DedupContentHash || len(evts) == 0 {
+		return evts, nil, nil
+	}
+	hashes := make([]string, len(evts))
+	lookup := make([]string, 0, len(evts))
+	for i, evt := range evts {
+		if len(evt.Fingerprint) > 0 {
+			hashes[i] = string(contentHash(evt, repo.keys))
+			lookup = append(lookup, hashes[i])
+		}
+	}
+	existing := map[string]struct{}{}
+	for _, p := range repo.allPartitions() {
+		for start := 0; start < len(lookup); start += maxContentHashParameters {
+			chunk := lookup[start:min(start+maxContentHashParameters, len(lookup))]
+			args := make([]any, len(chunk))
+			for i, h := range chunk {
+				args[i] = []byte(h)
+			}
+			rows, err := repo.db.Query("SELECT content_hash FROM "+p.repo.tables.events+" WHERE content_hash IN (?"+strings.Repeat(", ?", len(chunk)-1)+");", args...)
+			if err != nil {
+				return nil, nil, fmt.Errorf("error checking for duplicates in table=%v: %w", p.repo.tables.events, err)
+			}
+			for rows.Next() {
+				var h []byte
+				err = rows.Scan(&h)
+				if err != nil {
+					rows.Close()
+					return nil, nil, fmt.Errorf("error scanning content hash in table=%v: %w", p.repo.tables.events, err)
+				}
+				existing[string(h)] = struct{}{}
+			}
+			err = rows.Err()
+			rows.Close()
+			if err != nil {
+				return nil, nil, fmt.Errorf("error checking for duplicates in table=%v: %w", p.repo.tables.events, err)
+			}
+		}
+	}
+	ret := make([]events.Event, 0, len(evts))
+	duplicates := []events.Event{}
+	for i, evt := range evts {
+		if hashes[i] == "" {
+			ret = append(ret, evt)
+			continue
+		}
+		if _, ok := existing[hashes[i]]; ok {
+			duplicates = append(duplicates, evt)
+			continue
+		}
+		existing[hashes[i]] = struct{}{}
+		ret = append(ret, evt)
+	}
+	return ret, duplicates, nil
+}
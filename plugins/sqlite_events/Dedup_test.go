@@ -0,0 +1,184 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_events
+
+import (
+	"database/sql"
+	"log/slog"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/search"
+	"github.com/jackbister/logsuck/plugins/sqlite_common"
+)
+
+func TestContentHashDedup(t *testing.T) {
+	configs := map[string]*Config{
+		"trueBatch":   {TrueBatch: true, Dedup: DedupContentHash},
+		"oneByOne":    {TrueBatch: false, Dedup: DedupContentHash},
+		"compression": {Compression: CompressionFlate, Dedup: DedupContentHash},
+		"partitioned": {TrueBatch: true, PartitionHours: 1, Dedup: DedupContentHash},
+	}
+	for name, cfg := range configs {
+		t.Run(name, func(t *testing.T) {
+			metrics := events.NewIngestionMetrics()
+			repo := createRepoWithMetrics(t, cfg, metrics)
+			first := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+			err := repo.AddBatch(dedupEvents(first, "/var/log/app.log", "gen1", "first", "second"))
+			if err != nil {
+				t.Fatalf("got error when adding events: %v", err)
+			}
+
+			// The events are read again without parsed timestamps, so they get a new timestamp, and then read again after being rotated
+			err = repo.AddBatch(dedupEvents(first.Add(3*time.Hour), "/var/log/app.log", "gen1", "first", "second"))
+			if err != nil {
+				t.Fatalf("got error when adding events: %v", err)
+			}
+			err = repo.AddBatch(dedupEvents(first.Add(6*time.Hour), "/var/log/app.log.1", "gen1", "first", "second", "third"))
+			if err != nil {
+				t.Fatalf("got error when adding events: %v", err)
+			}
+			// The next generation of the file starts with the same lines, but has another fingerprint
+			err = repo.AddBatch(dedupEvents(first.Add(9*time.Hour), "/var/log/app.log", "gen2", "first", "second"))
+			if err != nil {
+				t.Fatalf("got error when adding events: %v", err)
+			}
+			// Events read before the file was long enough to be fingerprinted are never considered duplicates
+			err = repo.AddBatch(dedupEvents(first.Add(12*time.Hour), "/var/log/other.log", "", "first"))
+			if err == nil {
+				err = repo.AddBatch(dedupEvents(first.Add(15*time.Hour), "/var/log/other.log", "", "first"))
+			}
+			if err != nil {
+				t.Fatalf("got error when adding events: %v", err)
+			}
+
+			evts := collectEvents(repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampAsc))
+			raws := make([]string, len(evts))
+			for i, evt := range evts {
+				raws[i] = evt.Raw
+			}
+			if !reflect.DeepEqual(raws, []string{"first", "second", "third", "first", "second", "first", "first"}) {
+				t.Fatalf("got unexpected events=%v", raws)
+			}
+			expected := []events.SourceMetrics{
+				{Host: "localhost", Source: "/var/log/app.log", AddedEvents: 4, SkippedDuplicates: 2},
+				{Host: "localhost", Source: "/var/log/app.log.1", AddedEvents: 1, SkippedDuplicates: 2},
+				{Host: "localhost", Source: "/var/log/other.log", AddedEvents: 2},
+			}
+			if actual := metrics.Snapshot(); !reflect.DeepEqual(actual, expected) {
+				t.Fatalf("got unexpected metrics=%+v, expected %+v", actual, expected)
+			}
+		})
+	}
+}
+
+func TestKeyDedupKeepsEventsWithNewTimestamps(t *testing.T) {
+	metrics := events.NewIngestionMetrics()
+	repo := createRepoWithMetrics(t, &Config{TrueBatch: true, Dedup: DedupKey}, metrics)
+	first := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	repo.AddBatch(dedupEvents(first, "/var/log/app.log", "gen1", "first"))
+	repo.AddBatch(dedupEvents(first, "/var/log/app.log", "gen1", "first"))
+	repo.AddBatch(dedupEvents(first.Add(time.Hour), "/var/log/app.log", "gen1", "first"))
+
+	evts := collectEvents(repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampAsc))
+	if len(evts) != 2 {
+		t.Fatalf("expected 2 events but got %v", len(evts))
+	}
+	expected := []events.SourceMetrics{{Host: "localhost", Source: "/var/log/app.log", AddedEvents: 2, SkippedDuplicates: 1}}
+	if actual := metrics.Snapshot(); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("got unexpected metrics=%+v, expected %+v", actual, expected)
+	}
+}
+
+func TestFailedCommitIsNotRecorded(t *testing.T) {
+	for _, trueBatch := range []bool{true, false} {
+		t.Run("TrueBatch="+strconv.FormatBool(trueBatch), func(t *testing.T) {
+			metrics := events.NewIngestionMetrics()
+			repo := createRepoWithMetrics(t, &Config{TrueBatch: trueBatch, Dedup: DedupContentHash}, metrics)
+			// A deferred foreign key is only checked when committing, so every insert succeeds and the commit fails
+			_, err := repo.(*sqliteEventRepository).db.Exec(`PRAGMA foreign_keys = ON;
+				CREATE TABLE CommitCheck (id INTEGER PRIMARY KEY);
+				CREATE TABLE CommitBlocker (id INTEGER REFERENCES CommitCheck(id) DEFERRABLE INITIALLY DEFERRED);
+				CREATE TRIGGER BlockCommit AFTER INSERT ON Events BEGIN INSERT INTO CommitBlocker VALUES (NEW.id); END;`)
+			if err != nil {
+				t.Fatalf("got error when creating tables: %v", err)
+			}
+			first := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+			err = repo.AddBatch(dedupEvents(first, "/var/log/app.log", "gen1", "first", "second"))
+			if err == nil {
+				t.Fatalf("expected error when the commit fails")
+			}
+			if actual := metrics.Snapshot(); len(actual) != 0 {
+				t.Fatalf("expected no metrics to be recorded for a batch which was not committed, got=%+v", actual)
+			}
+			if evts := collectEvents(repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampAsc)); len(evts) != 0 {
+				t.Fatalf("expected no events to be added, got=%v", evts)
+			}
+		})
+	}
+}
+
+func TestUnknownDedup(t *testing.T) {
+	_, err := createRepoOrError(&Config{Dedup: "raw"})
+	if err == nil {
+		t.Fatalf("expected error when creating repository with unknown dedup")
+	}
+}
+
+func createRepoWithMetrics(t *testing.T, cfg *Config, metrics *events.IngestionMetrics) events.Repository {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	// Each connection to :memory: would get its own database
+	db.SetMaxOpenConns(1)
+	err = sqlite_common.Migrate(db, slog.Default(), Migrations)
+	if err != nil {
+		t.Fatalf("got error when migrating database: %v", err)
+	}
+	repo, err := NewSqliteEventRepository(SqliteEventRepositoryParams{
+		Db:      db,
+		Cfg:     cfg,
+		Metrics: metrics,
+		Logger:  slog.Default(),
+	})
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+	return repo
+}
+
+// dedupEvents returns events from the given source with the given raws, one second apart starting at timestamp. The events have the
+// given fingerprint, or no fingerprint if it is empty.
+func dedupEvents(timestamp time.Time, source string, fingerprint string, raws ...string) []events.Event {
+	ret := make([]events.Event, len(raws))
+	for i, raw := range raws {
+		ret[i] = events.Event{
+			Raw:       raw,
+			Timestamp: timestamp.Add(time.Duration(i) * time.Second),
+			Host:      "localhost",
+			Source:    source,
+			SourceId:  "source-" + timestamp.String(),
+			Offset:    int64(i * 10),
+		}
+		if fingerprint != "" {
+			ret[i].Fingerprint = []byte(fingerprint)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,512 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_events
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+)
+
+// The raw events can be encrypted at rest using AES-256-GCM. Encryption builds on the compressed blocks described in Blocks.go: each
+// block is compressed and then encrypted using the current data key. The ID of the key is stored in the block as well as in the key_id
+// column of the EventBlocks table, so that blocks encrypted using a previous key can still be read and can be found by Reencrypt.
+//
+// The full-text index must not contain the words of the raw events, so when encryption is enabled the EventRaws table indexes blind
+// tokens instead. A blind token is an HMAC-SHA256 of a token keyed by the index key, so a search for a whole word or a phrase is converted
+// to a search for the blind tokens of its words. Prefixes and other wildcards can not be converted to blind tokens, so those parts of a
+// search are only checked after the events have been decrypted.
+//
+// The index key is separate from the data keys since rotating it would require rebuilding the whole full-text index.
+
+// blockCodecFlateAesGcm is the first byte of blocks which are compressed using DEFLATE and then encrypted. It is followed by the ID of the
+// key, the nonce and the encrypted DEFLATE stream.
+const blockCodecFlateAesGcm byte = 2
+
+// keyIdLength is the number of bytes of the HMAC of a key which are used as its ID.
+const keyIdLength = 8
+
+// blindTokenLength is the number of bytes of the HMAC of a token which are used as its blind token.
+const blindTokenLength = 10
+
+// keyLength is the length of the keys in bytes. AES-256 is used for the data keys.
+const keyLength = 32
+
+// EncryptionConfig is the configuration of the keys used to encrypt the raw events. Each key is read from a file if the file is set and
+// from an environment variable otherwise, and must be 32 bytes encoded as hex.
+type EncryptionConfig struct {
+	// KeyFile and KeyEnv give the key used to encrypt new events.
+	KeyFile string
+	KeyEnv  string
+
+	// PreviousKeyFiles and PreviousKeyEnvs give keys which are only used to decrypt events that were encrypted before the key was
+	// rotated. They can be removed once @logsuck/ReencryptEventsTask has re-encrypted all events.
+	PreviousKeyFiles []string
+	PreviousKeyEnvs  []string
+
+	// IndexKeyFile and IndexKeyEnv give the key used to create the blind tokens in the full-text index. It can not be changed once events
+	// have been added.
+	IndexKeyFile string
+	IndexKeyEnv  string
+}
+
+// dataKey is a key used to encrypt and decrypt blocks.
+type dataKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// keyring contains the keys configured by an EncryptionConfig.
+type keyring struct {
+	// current is the key used to encrypt new blocks
+	current *dataKey
+	// keys contains the current key and the previous keys by ID
+	keys map[string]*dataKey
+
+	indexKey   []byte
+	indexKeyId string
+}
+
+// loadKeyring reads the keys in the configuration. Returns nil if cfg is nil, meaning encryption is disabled.
+func loadKeyring(cfg *EncryptionConfig) (*keyring, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	key, err := readKey("key", cfg.KeyFile, cfg.KeyEnv)
+	if err != nil {
+		return nil, err
+	}
+	current, err := newDataKey(key)
+	if err != nil {
+		return nil, err
+	}
+	ret := &keyring{current: current, keys: map[string]*dataKey{current.id: current}}
+	previous := make([][]byte, 0, len(cfg.PreviousKeyFiles)+len(cfg.PreviousKeyEnvs))
+	for _, f := range cfg.PreviousKeyFiles {
+		key, err = readKey("previous key", f, "")
+		if err != nil {
+			return nil, err
+		}
+		previous = append(previous, key)
+	}
+	for _, e := range cfg.PreviousKeyEnvs {
+		key, err = readKey("previous key", "", e)
+		if err != nil {
+			return nil, err
+		}
+		previous = append(previous, key)
+	}
+	for _, key := range previous {
+		k, err := newDataKey(key)
+		if err != nil {
+			return nil, err
+		}
+		ret.keys[k.id] = k
+	}
+	ret.indexKey, err = readKey("index key", cfg.IndexKeyFile, cfg.IndexKeyEnv)
+	if err != nil {
+		return nil, err
+	}
+	ret.indexKeyId = keyId(ret.indexKey)
+	if _, ok := ret.keys[ret.indexKeyId]; ok {
+		return nil, errors.New("the index key must be different from the encryption keys")
+	}
+	return ret, nil
+}
+
+// readKey reads a hex encoded key from the file, or from the environment variable if file is empty.
+func readKey(name string, file string, env string) ([]byte, error) {
+	var encoded string
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %v from file=%v: %w", name, file, err)
+		}
+		encoded = string(b)
+	} else if env != "" {
+		var ok bool
+		encoded, ok = os.LookupEnv(env)
+		if !ok {
+			return nil, fmt.Errorf("failed to read %v: environment variable=%v is not set", name, env)
+		}
+	} else {
+		return nil, fmt.Errorf("no file or environment variable is configured for the %v", name)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %v, expected %v bytes encoded as hex: %w", name, keyLength, err)
+	}
+	if len(key) != keyLength {
+		return nil, fmt.Errorf("%v has length=%v bytes, expected %v bytes encoded as hex", name, len(key), keyLength)
+	}
+	return key, nil
+}
+
+// keyId returns an ID identifying the key, which can be stored without revealing the key.
+func keyId(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("logsuck key id"))
+	return hex.EncodeToString(mac.Sum(nil)[:keyIdLength])
+}
+
+func newDataKey(key []byte) (*dataKey, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return &dataKey{id: keyId(key), aead: aead}, nil
+}
+
+// seal encrypts a compressed block, returning a block using blockCodecFlateAesGcm.
+func (k *dataKey) seal(compressed []byte) ([]byte, error) {
+	id, err := hex.DecodeString(k.id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode key id: %w", err)
+	}
+	header := make([]byte, 0, 1+keyIdLength+k.aead.NonceSize())
+	header = append(header, blockCodecFlateAesGcm)
+	header = append(header, id...)
+	nonce := make([]byte, k.aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	header = append(header, nonce...)
+	// The header is authenticated as well so that the key ID can not be changed
+	return k.aead.Seal(header, nonce, compressed, header[:1+keyIdLength]), nil
+}
+
+// open decrypts a block using blockCodecFlateAesGcm, returning the compressed block without the codec byte.
+func (kr *keyring) open(data []byte) ([]byte, error) {
+	if kr == nil {
+		return nil, errors.New("block is encrypted but encryption is not configured")
+	}
+	if len(data) < 1+keyIdLength {
+		return nil, errors.New("encrypted block is too short")
+	}
+	id := hex.EncodeToString(data[1 : 1+keyIdLength])
+	k, ok := kr.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("block is encrypted using keyId=%v which is not configured", id)
+	}
+	nonceEnd := 1 + keyIdLength + k.aead.NonceSize()
+	if len(data) < nonceEnd {
+		return nil, errors.New("encrypted block is too short")
+	}
+	ret, err := k.aead.Open(nil, data[1+keyIdLength:nonceEnd], data[nonceEnd:], data[:1+keyIdLength])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt block using keyId=%v: %w", id, err)
+	}
+	return ret, nil
+}
+
+// currentKey returns the key used to encrypt new blocks, or nil if encryption is disabled.
+func (kr *keyring) currentKey() *dataKey {
+	if kr == nil {
+		return nil
+	}
+	return kr.current
+}
+
+// blindDocument converts the raw event to the text stored in the full-text index, which is the blind tokens of its tokens separated by
+// spaces.
+func (kr *keyring) blindDocument(raw string) string {
+	tokens := ftsTokens(raw)
+	mac := hmac.New(sha256.New, kr.indexKey)
+	var sb strings.Builder
+	sb.Grow(len(tokens) * (blindTokenLength*2 + 1))
+	for i, t := range tokens {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(blindToken(mac, t.text))
+	}
+	return sb.String()
+}
+
+func (kr *keyring) blindToken(token string) string {
+	return blindToken(hmac.New(sha256.New, kr.indexKey), token)
+}
+
+func blindToken(mac hash.Hash, token string) string {
+	mac.Reset()
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil)[:blindTokenLength])
+}
+
+// ftsToken is a token as the simple tokenizer sees it. partial is true if the token is directly preceded or followed by a wildcard.
+type ftsToken struct {
+	text    string
+	partial bool
+}
+
+// ftsTokens splits the value into tokens in the same way as the simple tokenizer does it.
+func ftsTokens(value string) []ftsToken {
+	ret := []ftsToken{}
+	var sb strings.Builder
+	wildcardBefore := false
+	for _, r := range value {
+		if isFtsTokenRune(r) {
+			if r >= 'A' && r <= 'Z' {
+				r += 'a' - 'A'
+			}
+			sb.WriteRune(r)
+			continue
+		}
+		if sb.Len() > 0 {
+			ret = append(ret, ftsToken{text: sb.String(), partial: wildcardBefore || r == '*'})
+			sb.Reset()
+		}
+		wildcardBefore = r == '*'
+	}
+	if sb.Len() > 0 {
+		ret = append(ret, ftsToken{text: sb.String(), partial: wildcardBefore})
+	}
+	return ret
+}
+
+// blindDialect creates terms for an FTS4 table where the raw column contains blind tokens, see blindDocument. The host and source columns
+// are not encrypted, so they are queried in the same way as with fts4Dialect.
+type blindDialect struct {
+	keys *keyring
+}
+
+// includeTerm converts values without wildcards to a phrase of blind tokens. Values with wildcards are converted to the blind tokens of
+// the tokens which are not next to a wildcard, for example "user* logged in*" becomes (raw:<logged> AND raw:<in>) where <x> is the blind
+// token of x.
+func (d blindDialect) includeTerm(column, value string) (string, bool) {
+	if column != "raw" {
+		return ftsTerm(column, value)
+	}
+	if !strings.Contains(value, "*") {
+		return d.phrase(ftsTokens(value))
+	}
+	terms := []string{}
+	for _, t := range ftsTokens(value) {
+		if !t.partial {
+			terms = append(terms, "raw:"+d.keys.blindToken(t.text))
+		}
+	}
+	if len(terms) == 0 {
+		return "", false
+	}
+	if len(terms) == 1 {
+		return terms[0], true
+	}
+	return "(" + strings.Join(terms, " AND ") + ")", true
+}
+
+// excludeTerm only creates terms for values without wildcards, since an event containing some of the tokens of a value with wildcards
+// does not necessarily match the value.
+func (d blindDialect) excludeTerm(column, value string) (string, bool) {
+	if column != "raw" {
+		return ftsTerm(column, value)
+	}
+	if strings.Contains(value, "*") {
+		return "", false
+	}
+	return d.phrase(ftsTokens(value))
+}
+
+func (blindDialect) exact() bool {
+	return false
+}
+
+// phrase returns a phrase matching the blind tokens of the tokens in order.
+func (d blindDialect) phrase(tokens []ftsToken) (string, bool) {
+	if len(tokens) == 0 {
+		return "", false
+	}
+	blind := make([]string, len(tokens))
+	for i, t := range tokens {
+		blind[i] = d.keys.blindToken(t.text)
+	}
+	return "raw:" + strings.Join(blind, "-"), true
+}
+
+// checkBlockKeys returns an error if the blocks table contains blocks encrypted using a key which is not configured. This makes startup
+// fail when the wrong key is configured, instead of failing when the events are read.
+func checkBlockKeys(db *sql.DB, blocksTable string, keys *keyring) error {
+	rows, err := db.Query("SELECT DISTINCT key_id FROM " + blocksTable + " WHERE key_id IS NOT NULL;")
+	if err != nil {
+		return fmt.Errorf("failed to get encryption keys used by table=%v: %w", blocksTable, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return fmt.Errorf("failed to scan encryption key used by table=%v: %w", blocksTable, err)
+		}
+		if keys == nil {
+			return fmt.Errorf("table=%v contains events encrypted using keyId=%v, but encryption is not configured. Encryption can not be disabled once events have been encrypted", blocksTable, id)
+		}
+		if _, ok := keys.keys[id]; !ok {
+			return fmt.Errorf("table=%v contains events encrypted using keyId=%v, which is neither the configured key (keyId=%v) nor one of the previous keys. Check that the right keys are configured",
+				blocksTable, id, keys.current.id)
+		}
+	}
+	return rows.Err()
+}
+
+func (repo *sqliteEventRepository) Encrypted() bool {
+	return repo.layout.encrypted()
+}
+
+func (repo *partitionedEventRepository) Encrypted() bool {
+	return repo.layout.encrypted()
+}
+
+// reencryptPageSize is the number of blocks re-encrypted in each transaction by reencryptPage.
+const reencryptPageSize = 100
+
+// Reencrypt encrypts the blocks which were encrypted using a previous key with the current key, so that the previous key can be removed
+// from the configuration.
+func (repo *sqliteEventRepository) Reencrypt(ctx context.Context) (int, error) {
+	numEvents := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return numEvents, err
+		}
+		numBlocks, n, err := repo.reencryptPage()
+		numEvents += n
+		if err != nil || numBlocks == 0 {
+			return numEvents, err
+		}
+	}
+}
+
+// reencryptPage re-encrypts up to reencryptPageSize blocks which are not encrypted using the current key, and returns the number of blocks
+// and events which were re-encrypted.
+func (repo *sqliteEventRepository) reencryptPage() (int, int, error) {
+	if repo.keys == nil {
+		return 0, 0, errors.New("encryption is not configured")
+	}
+	current := repo.keys.current
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT id, data FROM "+repo.tables.blocks+" WHERE key_id IS NOT ? LIMIT ?;", current.id, reencryptPageSize)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get blocks to re-encrypt in table=%v: %w", repo.tables.blocks, err)
+	}
+	ids := []int64{}
+	blocks := [][]byte{}
+	for rows.Next() {
+		var id int64
+		var data []byte
+		err = rows.Scan(&id, &data)
+		if err != nil {
+			rows.Close()
+			return 0, 0, fmt.Errorf("failed to scan block: %w", err)
+		}
+		ids = append(ids, id)
+		blocks = append(blocks, data)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, 0, fmt.Errorf("failed to get blocks to re-encrypt in table=%v: %w", repo.tables.blocks, err)
+	}
+	numEvents := 0
+	for i, id := range ids {
+		raws, err := decodeBlock(blocks[i], repo.keys)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to decode block with id=%v: %w", id, err)
+		}
+		data, err := encodeBlock(raws, current)
+		if err != nil {
+			return 0, 0, err
+		}
+		_, err = tx.Exec("UPDATE "+repo.tables.blocks+" SET data = ?, key_id = ? WHERE id = ?;", data, current.id, id)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to update block with id=%v: %w", id, err)
+		}
+		numEvents += len(raws)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to commit re-encrypted blocks: %w", err)
+	}
+	return len(ids), numEvents, nil
+}
+
+// keyIdOf returns the value of the key_id column for blocks encrypted using key, which is NULL if the block is not encrypted.
+func keyIdOf(key *dataKey) any {
+	if key == nil {
+		return nil
+	}
+	return key.id
+}
+
+// indexedRaw returns the text stored in the raw column of the full-text index for the raw event.
+func (repo *sqliteEventRepository) indexedRaw(raw string) string {
+	if repo.layout.encrypted() {
+		return repo.keys.blindDocument(raw)
+	}
+	return raw
+}
+
+func (repo *partitionedEventRepository) Reencrypt(ctx context.Context) (int, error) {
+	numEvents := 0
+	for _, p := range repo.allPartitions() {
+		for {
+			if err := ctx.Err(); err != nil {
+				return numEvents, err
+			}
+			numBlocks, n, err := repo.reencryptPage(p)
+			numEvents += n
+			if err != nil {
+				return numEvents, fmt.Errorf("error re-encrypting partition with tables=%v: %w", p.repo.tables.events, err)
+			}
+			if numBlocks == 0 {
+				break
+			}
+		}
+	}
+	return numEvents, nil
+}
+
+// reencryptPage re-encrypts a page of blocks in the partition. writeMu is held so that the partition is not dropped while it is being
+// re-encrypted, but only for one page at a time so that adding events is not blocked for long.
+func (repo *partitionedEventRepository) reencryptPage(p *eventPartition) (int, int, error) {
+	repo.writeMu.Lock()
+	defer repo.writeMu.Unlock()
+	repo.mu.RLock()
+	exists := p == repo.legacy
+	for _, existing := range repo.partitions {
+		exists = exists || existing == p
+	}
+	repo.mu.RUnlock()
+	if !exists {
+		return 0, 0, nil
+	}
+	return p.repo.reencryptPage()
+}
@@ -0,0 +1,263 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_events
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/search"
+)
+
+const (
+	testKeyA     = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testKeyB     = "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f"
+	testIndexKey = "404142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f"
+)
+
+func TestEncryptDecryptBlock(t *testing.T) {
+	keysA := testKeyring(t, testKeyA)
+	raws := []string{"hello world", "räksmörgås"}
+	data, err := encodeBlock(raws, keysA.current)
+	if err != nil {
+		t.Fatalf("got error when encoding block: %v", err)
+	}
+	if data[0] != blockCodecFlateAesGcm {
+		t.Fatalf("expected encrypted block to have codec=%v, got codec=%v", blockCodecFlateAesGcm, data[0])
+	}
+	decoded, err := decodeBlock(data, keysA)
+	if err != nil {
+		t.Fatalf("got error when decoding block: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, raws) {
+		t.Fatalf("got unexpected events after decoding block, expected=%v, got=%v", raws, decoded)
+	}
+	_, err = decodeBlock(data, testKeyring(t, testKeyB))
+	if err == nil {
+		t.Fatalf("expected error when decoding block using the wrong key")
+	}
+	_, err = decodeBlock(data, nil)
+	if err == nil {
+		t.Fatalf("expected error when decoding encrypted block without keys")
+	}
+	data[len(data)-1] ^= 1
+	_, err = decodeBlock(data, keysA)
+	if err == nil {
+		t.Fatalf("expected error when decoding block which has been tampered with")
+	}
+}
+
+func TestBlindDialect(t *testing.T) {
+	d := blindDialect{keys: testKeyring(t, testKeyA)}
+	token := d.keys.blindToken
+	var tests = []struct {
+		value            string
+		expectedInclude  string
+		expectedExclude  string
+		expectedIncluded bool
+		expectedExcluded bool
+	}{
+		{"Hello", "raw:" + token("hello"), "raw:" + token("hello"), true, true},
+		{"hello world", "raw:" + token("hello") + "-" + token("world"), "raw:" + token("hello") + "-" + token("world"), true, true},
+		{"hel*", "", "", false, false},
+		{"*user* logged in*", "raw:" + token("logged"), "", true, false},
+		{"user* logged in", "(raw:" + token("logged") + " AND raw:" + token("in") + ")", "", true, false},
+		{"!!", "", "", false, false},
+	}
+	for _, tt := range tests {
+		got, ok := d.includeTerm("raw", tt.value)
+		if got != tt.expectedInclude || ok != tt.expectedIncluded {
+			t.Fatalf("got unexpected include term for value=%q, expected=%q, %v, got=%q, %v", tt.value, tt.expectedInclude, tt.expectedIncluded, got, ok)
+		}
+		got, ok = d.excludeTerm("raw", tt.value)
+		if got != tt.expectedExclude || ok != tt.expectedExcluded {
+			t.Fatalf("got unexpected exclude term for value=%q, expected=%q, %v, got=%q, %v", tt.value, tt.expectedExclude, tt.expectedExcluded, got, ok)
+		}
+	}
+	if got, _ := d.includeTerm("source", "access*"); got != "source:access*" {
+		t.Fatalf("expected source to be queried without blind tokens, got=%q", got)
+	}
+}
+
+func TestEncryptedFilterStream(t *testing.T) {
+	db := openMigratedDb(t, "file:"+filepath.Join(t.TempDir(), "logsuck.db"))
+	repo := createRepoWithDb(t, db, encryptedConfig(t, testKeyA))
+	raws := []string{"user=alice logged in", "user=bob logged out", "hello world", "world hello", "othello"}
+	err := repo.AddBatch(eventsWithRaws(raws))
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	assertSearchResults(t, repo, "", raws)
+	assertSearchResults(t, repo, "hello", []string{"hello world", "world hello"})
+	assertSearchResults(t, repo, "\"hello world\"", []string{"hello world"})
+	assertSearchResults(t, repo, "*ello", []string{"hello world", "world hello", "othello"})
+	assertSearchResults(t, repo, "logged NOT out", []string{"user=alice logged in"})
+	assertSearchResults(t, repo, "alice", []string{"user=alice logged in"})
+	assertSearchResults(t, repo, "NOT hello", []string{"user=alice logged in", "user=bob logged out", "othello"})
+
+	// Neither the full-text index nor the blocks may contain the words of the events
+	var n int
+	err = db.QueryRow("SELECT COUNT(*) FROM EventRaws WHERE EventRaws MATCH 'raw:hello';").Scan(&n)
+	if err != nil || n != 0 {
+		t.Fatalf("expected plaintext words to not be indexed, got n=%v, err=%v", n, err)
+	}
+	err = db.QueryRow("SELECT COUNT(*) FROM EventBlocks WHERE key_id IS NULL OR instr(data, 'alice') > 0;").Scan(&n)
+	if err != nil || n != 0 {
+		t.Fatalf("expected all blocks to be encrypted, got n=%v, err=%v", n, err)
+	}
+
+	err = repo.DeleteBatch([]int64{idOf(t, repo, "hello world")})
+	if err != nil {
+		t.Fatalf("got error when deleting event: %v", err)
+	}
+	assertSearchResults(t, repo, "hello", []string{"world hello"})
+}
+
+func TestEncryptionWrongKeys(t *testing.T) {
+	db := openMigratedDb(t, "file:"+filepath.Join(t.TempDir(), "logsuck.db"))
+	err := createRepoWithDb(t, db, encryptedConfig(t, testKeyA)).AddBatch(eventsWithRaws([]string{"hello"}))
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	_, err = createRepoOrErrorWithDb(db, encryptedConfig(t, testKeyB))
+	if err == nil || !strings.Contains(err.Error(), "keyId") {
+		t.Fatalf("expected error mentioning keyId when starting with the wrong key, got err=%v", err)
+	}
+	wrongIndexKey := encryptedConfig(t, testKeyA)
+	wrongIndexKey.Encryption.IndexKeyFile = writeKeyFile(t, testKeyB)
+	_, err = createRepoOrErrorWithDb(db, wrongIndexKey)
+	if err == nil || !strings.Contains(err.Error(), "index key") {
+		t.Fatalf("expected error mentioning the index key when starting with the wrong index key, got err=%v", err)
+	}
+	_, err = createRepoOrErrorWithDb(db, &Config{Compression: CompressionFlate})
+	if err == nil || !strings.Contains(err.Error(), "encryption is not configured") {
+		t.Fatalf("expected error when starting without encryption, got err=%v", err)
+	}
+	_, err = createRepoOrErrorWithDb(db, &Config{Encryption: &EncryptionConfig{KeyEnv: "LOGSUCK_TEST_MISSING_KEY"}})
+	if err == nil || !strings.Contains(err.Error(), "LOGSUCK_TEST_MISSING_KEY") {
+		t.Fatalf("expected error when the key environment variable is not set, got err=%v", err)
+	}
+	// The events must still be readable using the right key
+	assertSearchResults(t, createRepoWithDb(t, db, encryptedConfig(t, testKeyA)), "hello", []string{"hello"})
+}
+
+func TestReencrypt(t *testing.T) {
+	for _, partitionHours := range []int{0, 24} {
+		db := openMigratedDb(t, "file:"+filepath.Join(t.TempDir(), "logsuck.db"))
+		cfg := encryptedConfig(t, testKeyA)
+		cfg.PartitionHours = partitionHours
+		err := createRepoWithDb(t, db, cfg).AddBatch(eventsOverDays(3, 2))
+		if err != nil {
+			t.Fatalf("got error when adding events with partitionHours=%v: %v", partitionHours, err)
+		}
+
+		cfg = encryptedConfig(t, testKeyB)
+		cfg.PartitionHours = partitionHours
+		t.Setenv("LOGSUCK_TEST_PREVIOUS_KEY", testKeyA)
+		cfg.Encryption.PreviousKeyEnvs = []string{"LOGSUCK_TEST_PREVIOUS_KEY"}
+		repo := createRepoWithDb(t, db, cfg)
+		n, err := repo.(events.Reencrypter).Reencrypt(context.Background())
+		if err != nil || n != 6 {
+			t.Fatalf("expected 6 events to be re-encrypted with partitionHours=%v, got n=%v, err=%v", partitionHours, n, err)
+		}
+		n, err = repo.(events.Reencrypter).Reencrypt(context.Background())
+		if err != nil || n != 0 {
+			t.Fatalf("expected no events to be re-encrypted the second time with partitionHours=%v, got n=%v, err=%v", partitionHours, n, err)
+		}
+
+		cfg.Encryption.PreviousKeyEnvs = nil
+		repo = createRepoWithDb(t, db, cfg)
+		evts := collectEvents(repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampDesc))
+		assertTimestampOrder(t, evts, 6, events.SortModeTimestampDesc)
+		for _, evt := range evts {
+			if evt.Raw != "event" {
+				t.Fatalf("got unexpected raw=%q for eventId=%v with partitionHours=%v", evt.Raw, evt.Id, partitionHours)
+			}
+		}
+		if pd, ok := repo.(events.PartitionDeleter); ok {
+			_, err = pd.DeletePartitionsBefore(time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC))
+			if err != nil {
+				t.Fatalf("got error when deleting partitions: %v", err)
+			}
+		}
+	}
+}
+
+func TestMigrateToEncryption(t *testing.T) {
+	db := openMigratedDb(t, "file:"+filepath.Join(t.TempDir(), "logsuck.db"))
+	raws := []string{"java.lang.NullPointerException: oops", "hello world", "hello there"}
+	evts := eventsWithRaws(raws)
+	evts[2].Source = "other.txt"
+	err := createRepoWithDb(t, db, &Config{Compression: CompressionFlate}).AddBatch(evts[:2])
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	repo := createRepoWithDb(t, db, encryptedConfig(t, testKeyA))
+	err = repo.AddBatch(evts[2:])
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	assertSearchResults(t, repo, "", raws)
+	assertSearchResults(t, repo, "hello", []string{"hello world", "hello there"})
+	assertSearchResults(t, repo, "NullPointerException", []string{"java.lang.NullPointerException: oops"})
+	var n int
+	err = db.QueryRow("SELECT COUNT(*) FROM EventBlocks WHERE key_id IS NULL;").Scan(&n)
+	if err != nil || n != 0 {
+		t.Fatalf("expected all blocks to be encrypted after migrating, got n=%v, err=%v", n, err)
+	}
+	layout, _, err := getEventRawsLayout(db, defaultEventTables.raws)
+	if err != nil || !layout.encrypted() {
+		t.Fatalf("expected eventraws table to be encrypted after migrating, got layout=%v, err=%v", layout, err)
+	}
+}
+
+// encryptedConfig returns a configuration which encrypts the events using key and testIndexKey. The keys are written to files in a
+// temporary directory.
+func encryptedConfig(t *testing.T, key string) *Config {
+	return &Config{
+		Encryption: &EncryptionConfig{
+			KeyFile:      writeKeyFile(t, key),
+			IndexKeyFile: writeKeyFile(t, testIndexKey),
+		},
+	}
+}
+
+func writeKeyFile(t *testing.T, key string) string {
+	f, err := os.CreateTemp(t.TempDir(), "key")
+	if err != nil {
+		t.Fatalf("got error when creating key file: %v", err)
+	}
+	defer f.Close()
+	_, err = f.WriteString(key + "\n")
+	if err != nil {
+		t.Fatalf("got error when writing key file: %v", err)
+	}
+	return f.Name()
+}
+
+func testKeyring(t *testing.T, key string) *keyring {
+	keys, err := loadKeyring(encryptedConfig(t, key).Encryption)
+	if err != nil {
+		t.Fatalf("got error when loading keys: %v", err)
+	}
+	return keys
+}
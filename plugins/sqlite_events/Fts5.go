@@ -0,0 +1,91 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_events
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/search"
+)
+
+// trigramMinLength is the shortest substring the trigram tokenizer can find. Shorter strings do not match any rows.
+const trigramMinLength = 3
+
+// fts5TrigramDialect creates terms using the FTS5 query syntax for a table using the trigram tokenizer.
+// The trigram tokenizer matches substrings, so "hello" also matches "othello". Since a fragment in a search must match a whole word unless
+// it has wildcards, the terms only narrow down the candidates and the results are checked by a search.Matcher.
+type fts5TrigramDialect struct{}
+
+// includeTerm splits the value on wildcards and requires the column to contain each part which is long enough for the trigram
+// tokenizer, for example "*Null*Exception" becomes (raw : "Null" AND raw : "Exception").
+func (fts5TrigramDialect) includeTerm(column, value string) (string, bool) {
+	parts := trigramParts(value)
+	if len(parts) == 0 {
+		return "", false
+	}
+	terms := make([]string, len(parts))
+	for i, p := range parts {
+		terms[i] = fts5String(column, p)
+	}
+	if len(terms) == 1 {
+		return terms[0], true
+	}
+	return "(" + strings.Join(terms, " AND ") + ")", true
+}
+
+// excludeTerm only creates a term for values like "*access*", since those are the only values where containing the substring means the
+// value matches.
+func (fts5TrigramDialect) excludeTerm(column, value string) (string, bool) {
+	parts := trigramParts(value)
+	if len(parts) != 1 || "*"+parts[0]+"*" != value {
+		return "", false
+	}
+	return fts5String(column, parts[0]), true
+}
+
+func (fts5TrigramDialect) exact() bool {
+	return false
+}
+
+// trigramParts returns the parts of the value between wildcards which are long enough to be found by the trigram tokenizer.
+// Invalid UTF-8 is left out since it is not certain that the tokenizer counts the characters the same way.
+func trigramParts(value string) []string {
+	ret := []string{}
+	for _, p := range strings.FieldsFunc(value, func(r rune) bool { return r == '*' || r == 0 }) {
+		if utf8.ValidString(p) && utf8.RuneCountInString(p) >= trigramMinLength {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// fts5String creates a term where the value is an FTS5 string, meaning that it is never interpreted as query syntax.
+func fts5String(column, value string) string {
+	return column + " : \"" + strings.ReplaceAll(value, "\"", "\"\"") + "\""
+}
+
+// filterMatching removes the events which do not match from evts, reusing its backing array. It is used by FilterStream when the full-text
+// query only narrows down the candidates.
+func filterMatching(m *search.Matcher, evts []events.EventWithId) []events.EventWithId {
+	ret := evts[:0]
+	for _, evt := range evts {
+		if m.Matches(evt.Raw, evt.Host, evt.Source, evt.Index) {
+			ret = append(ret, evt)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,192 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_events
+
+import (
+	"database/sql"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/parser"
+	"github.com/jackbister/logsuck/plugins/sqlite_common"
+)
+
+var fts5TermTests = []struct {
+	value           string
+	expectedInclude string
+	expectedExclude string
+}{
+	{"hello", "raw : \"hello\"", ""},
+	{"*Exception", "raw : \"Exception\"", ""},
+	{"*access*", "raw : \"access\"", "raw : \"access\""},
+	{"*Null*Exception", "(raw : \"Null\" AND raw : \"Exception\")", ""},
+	{"ab*cde", "raw : \"cde\"", ""},
+	{"*ab*", "", ""},
+	{"say \"hi\"", "raw : \"say \"\"hi\"\"\"", ""},
+	{"*OR NOT*", "raw : \"OR NOT\"", "raw : \"OR NOT\""},
+	{"a\x00bcd", "raw : \"bcd\"", ""},
+}
+
+func TestFts5TrigramTerms(t *testing.T) {
+	d := fts5TrigramDialect{}
+	for _, tt := range fts5TermTests {
+		include, ok := d.includeTerm("raw", tt.value)
+		if ok != (tt.expectedInclude != "") || include != tt.expectedInclude {
+			t.Fatalf("got unexpected include term for value=%q, expected=%v, got=%v (ok=%v)", tt.value, tt.expectedInclude, include, ok)
+		}
+		exclude, ok := d.excludeTerm("raw", tt.value)
+		if ok != (tt.expectedExclude != "") || exclude != tt.expectedExclude {
+			t.Fatalf("got unexpected exclude term for value=%q, expected=%v, got=%v (ok=%v)", tt.value, tt.expectedExclude, exclude, ok)
+		}
+	}
+}
+
+var fts5SearchTests = []struct {
+	search   string
+	expected []string
+}{
+	{"*Exception", []string{"java.lang.NullPointerException: oops", "IllegalStateException"}},
+	{"hello", []string{"hello world"}},
+	{"*ello", []string{"hello world", "othello"}},
+	{"NOT *exception*", []string{"hello world", "othello"}},
+	{"NOT hello", []string{"java.lang.NullPointerException: oops", "IllegalStateException", "othello"}},
+	{"*ll*", []string{"java.lang.NullPointerException: oops", "IllegalStateException", "hello world", "othello"}},
+	{"\"pointer\"", []string{}},
+	{"source=*.txt hello", []string{"hello world"}},
+}
+
+func TestFilterStreamFts5(t *testing.T) {
+	repo := createFts5Repo(t, ":memory:")
+	raws := []string{"java.lang.NullPointerException: oops", "IllegalStateException", "hello world", "othello"}
+	err := repo.AddBatch(eventsWithRaws(raws))
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	for _, tt := range fts5SearchTests {
+		assertSearchResults(t, repo, tt.search, tt.expected)
+	}
+}
+
+func TestMigrateEventRaws(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "logsuck.db")
+	db, err := sql.Open("sqlite3", "file:"+fileName)
+	if err != nil {
+		t.Fatalf("got error when opening database: %v", err)
+	}
+	defer db.Close()
+	err = sqlite_common.Migrate(db, slog.Default(), Migrations)
+	if err != nil {
+		t.Fatalf("got error when migrating database: %v", err)
+	}
+	fts4Repo, err := NewSqliteEventRepository(SqliteEventRepositoryParams{
+		Db:     db,
+		Cfg:    &Config{TrueBatch: true, FullTextSearch: FullTextSearchFts4},
+		Logger: slog.Default(),
+	})
+	if err != nil {
+		t.Fatalf("got error when creating fts4 repo: %v", err)
+	}
+	raws := []string{"java.lang.NullPointerException: oops", "hello world"}
+	err = fts4Repo.AddBatch(eventsWithRaws(raws))
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	fts5Repo := createFts5Repo(t, "file:"+fileName)
+	assertSearchResults(t, fts5Repo, "*Exception", []string{"java.lang.NullPointerException: oops"})
+	assertSearchResults(t, fts5Repo, "hello", []string{"hello world"})
+
+	fts4Repo, err = NewSqliteEventRepository(SqliteEventRepositoryParams{
+		Db:     db,
+		Cfg:    &Config{TrueBatch: true, FullTextSearch: FullTextSearchFts4},
+		Logger: slog.Default(),
+	})
+	if err != nil {
+		t.Fatalf("got error when migrating back to fts4: %v", err)
+	}
+	module, err := getEventRawsModule(db, defaultEventTables.raws)
+	if err != nil || module != FullTextSearchFts4 {
+		t.Fatalf("expected EventRaws to use fts4 after migrating back, got module=%v, err=%v", module, err)
+	}
+	assertSearchResults(t, fts4Repo, "hello", []string{"hello world"})
+}
+
+// createFts5Repo creates a repository using FTS5, or skips the test if Logsuck was built without FTS5 support.
+func createFts5Repo(t *testing.T, dataSourceName string) events.Repository {
+	return createFts5RepoWithCfg(t, dataSourceName, &Config{TrueBatch: true, FullTextSearch: FullTextSearchFts5})
+}
+
+func createFts5RepoWithCfg(t *testing.T, dataSourceName string, cfg *Config) events.Repository {
+	db, err := sql.Open("sqlite3", dataSourceName)
+	if err != nil {
+		t.Fatalf("got error when opening database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = sqlite_common.Migrate(db, slog.Default(), Migrations)
+	if err != nil {
+		t.Fatalf("got error when migrating database: %v", err)
+	}
+	repo, err := NewSqliteEventRepository(SqliteEventRepositoryParams{
+		Db:     db,
+		Cfg:    cfg,
+		Logger: slog.Default(),
+	})
+	if err != nil && strings.Contains(err.Error(), "sqlite_fts5 build tag") {
+		t.Skip("skipping since FTS5 is not available, run the tests with -tags sqlite_fts5 to include it")
+	}
+	if err != nil {
+		t.Fatalf("got error when creating fts5 repo: %v", err)
+	}
+	return repo
+}
+
+func eventsWithRaws(raws []string) []events.Event {
+	evts := make([]events.Event, len(raws))
+	for i, raw := range raws {
+		evts[i] = events.Event{
+			Raw:       raw,
+			Timestamp: time.Date(2021, 2, 1, 0, 0, i, 0, time.UTC),
+			Host:      "localhost",
+			Source:    "log.txt",
+			Offset:    int64(i),
+		}
+	}
+	return evts
+}
+
+func assertSearchResults(t *testing.T, repo events.Repository, searchString string, expectedRaws []string) {
+	srch, err := parser.Parse(searchString)
+	if err != nil {
+		t.Fatalf("got error when parsing search=%v: %v", searchString, err)
+	}
+	got := map[string]struct{}{}
+	for page := range repo.FilterStream(srch, nil, nil, events.SortModeTimestampDesc) {
+		for _, evt := range page {
+			got[evt.Raw] = struct{}{}
+		}
+	}
+	expected := map[string]struct{}{}
+	for _, raw := range expectedRaws {
+		expected[raw] = struct{}{}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got unexpected events for search=%v, expected=%v, got=%v", searchString, expected, got)
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_events
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/tasks"
+)
+
+const (
+	defaultMaintenanceTimeBudget = 1 * time.Minute
+	// mergePages is the number of pages written by each incremental merge of a full-text index. Each merge holds the write lock, so it
+	// must be small enough to not make the writes of new events time out.
+	mergePages = 200
+	// vacuumPages is the number of pages removed from the database file by each incremental vacuum.
+	vacuumPages = 1000
+	// analysisLimit is the approximate number of rows in each index which ANALYZE looks at, see
+	// https://www.sqlite.org/pragma.html#pragma_analysis_limit
+	analysisLimit = 1000
+	// integrityCheckMaxErrors is the maximum number of errors reported by the integrity check.
+	integrityCheckMaxErrors = 10
+)
+
+const (
+	maintenanceStatusOk          = "ok"
+	maintenanceStatusFailed      = "failed"
+	maintenanceStatusInterrupted = "interrupted"
+	maintenanceStatusSkipped     = "skipped"
+)
+
+// MaintenanceTask keeps the database in shape by merging the segments of the full-text indexes, returning free pages to the operating
+// system, updating the statistics used by the query planner and checking the integrity of the database. The work is done in small steps
+// which only hold the write lock briefly, and the whole run is stopped when the configured time budget has been used.
+type MaintenanceTask struct {
+	Db *sql.DB
+
+	Logger *slog.Logger
+
+	mu         sync.Mutex
+	lastResult []maintenanceStepResult
+}
+
+type maintenanceStepResult struct {
+	Step     string `json:"step"`
+	Status   string `json:"status"`
+	Duration string `json:"duration"`
+	Message  string `json:"message,omitempty"`
+}
+
+type maintenanceStep struct {
+	name string
+	run  func(ctx context.Context, conn *sql.Conn) (string, error)
+}
+
+func NewMaintenanceTask(db *sql.DB, logger *slog.Logger) tasks.Task {
+	return &MaintenanceTask{
+		Db:     db,
+		Logger: logger,
+	}
+}
+
+func (t *MaintenanceTask) Name() string {
+	return "@logsuck/MaintenanceTask"
+}
+
+func (t *MaintenanceTask) Run(cfg map[string]any, ctx context.Context) {
+	timeBudget, err := parseTimeBudget(cfg)
+	if err != nil {
+		t.Logger.Error("Failed to parse config. Will not do anything.",
+			slog.Any("error", err))
+		return
+	}
+	results := runMaintenance(ctx, t.Db, timeBudget)
+	for _, r := range results {
+		level := slog.LevelInfo
+		if r.Status == maintenanceStatusFailed {
+			level = slog.LevelError
+		}
+		t.Logger.Log(ctx, level, "Maintenance step finished",
+			slog.String("step", r.Step),
+			slog.String("status", r.Status),
+			slog.String("duration", r.Duration),
+			slog.String("message", r.Message))
+	}
+	t.mu.Lock()
+	t.lastResult = results
+	t.mu.Unlock()
+}
+
+func (t *MaintenanceTask) LastResult() any {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastResult
+}
+
+func (t *MaintenanceTask) ConfigSchema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"timeBudget": map[string]any{
+				"description": "The maximum time spent on each run, for example \"30s\" or \"5m\". Steps which have not finished when the time budget is used are interrupted, and the remaining steps are skipped until the next run. Default \"1m\".",
+				"type":        "string",
+			},
+		},
+	}
+}
+
+func parseTimeBudget(cfg map[string]any) (time.Duration, error) {
+	tb, ok := cfg["timeBudget"]
+	if !ok || tb == "" {
+		return defaultMaintenanceTimeBudget, nil
+	}
+	tbs, ok := tb.(string)
+	if !ok {
+		return 0, errors.New("timeBudget must be a string")
+	}
+	d, err := time.ParseDuration(tbs)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse timeBudget: %w", err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("timeBudget must be positive, got timeBudget=%v", tbs)
+	}
+	return d, nil
+}
+
+// runMaintenance runs the maintenance steps in order until they are done or the time budget is used. The integrity check runs last since
+// it reads the whole database and is the step most likely to be interrupted.
+func runMaintenance(ctx context.Context, db *sql.DB, timeBudget time.Duration) []maintenanceStepResult {
+	steps := []maintenanceStep{
+		{name: "ftsMerge", run: mergeFullTextIndexes},
+		{name: "incrementalVacuum", run: incrementalVacuum},
+		{name: "analyze", run: analyze},
+		{name: "integrityCheck", run: integrityCheck},
+	}
+	results := make([]maintenanceStepResult, 0, len(steps))
+	// All steps use the same connection since analysis_limit is set per connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return append(results, maintenanceStepResult{Step: "connect", Status: maintenanceStatusFailed, Message: err.Error()})
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(ctx, timeBudget)
+	defer cancel()
+	for _, s := range steps {
+		if ctx.Err() != nil {
+			results = append(results, maintenanceStepResult{Step: s.name, Status: maintenanceStatusSkipped, Message: "time budget used"})
+			continue
+		}
+		startTime := time.Now()
+		msg, err := s.run(ctx, conn)
+		r := maintenanceStepResult{Step: s.name, Status: maintenanceStatusOk, Message: msg}
+		if err != nil && ctx.Err() != nil {
+			r.Status = maintenanceStatusInterrupted
+			r.Message = "time budget used"
+		} else if err != nil {
+			r.Status = maintenanceStatusFailed
+			r.Message = err.Error()
+		}
+		r.Duration = time.Since(startTime).Round(time.Millisecond).String()
+		results = append(results, r)
+	}
+	return results
+}
+
+// mergeFullTextIndexes merges the segments of every EventRaws table, including the partitions. This has the same effect as the 'optimize'
+// command, but 'optimize' rewrites the whole index in one transaction which would stop new events from being written until it is done.
+func mergeFullTextIndexes(ctx context.Context, conn *sql.Conn) (string, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT name, sql FROM sqlite_master
+		WHERE type = 'table' AND sql LIKE 'CREATE VIRTUAL TABLE%' AND (name = 'EventRaws' OR name LIKE 'EventRaws\_%' ESCAPE '\');`)
+	if err != nil {
+		return "", fmt.Errorf("failed to get full-text tables: %w", err)
+	}
+	var tables, sqls []string
+	for rows.Next() {
+		var name, ddl string
+		err = rows.Scan(&name, &ddl)
+		if err != nil {
+			rows.Close()
+			return "", fmt.Errorf("failed to scan full-text table: %w", err)
+		}
+		tables = append(tables, name)
+		sqls = append(sqls, ddl)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to get full-text tables: %w", err)
+	}
+	merges := 0
+	for i, table := range tables {
+		mergeStatement := "INSERT INTO " + table + "(" + table + ") VALUES ('merge=" + fmt.Sprint(mergePages) + ",2');"
+		if strings.Contains(strings.ToLower(sqls[i]), "using fts5") {
+			// A negative number of pages makes FTS5 merge all segments, like 'optimize' does
+			mergeStatement = "INSERT INTO " + table + "(" + table + ", rank) VALUES ('merge', " + fmt.Sprint(-mergePages) + ");"
+		}
+		for {
+			var before, after int64
+			err = conn.QueryRowContext(ctx, "SELECT total_changes();").Scan(&before)
+			if err != nil {
+				return "", fmt.Errorf("failed to get total_changes: %w", err)
+			}
+			_, err = conn.ExecContext(ctx, mergeStatement)
+			if err != nil {
+				return "", fmt.Errorf("failed to merge segments of table %v: %w", table, err)
+			}
+			err = conn.QueryRowContext(ctx, "SELECT total_changes();").Scan(&after)
+			if err != nil {
+				return "", fmt.Errorf("failed to get total_changes: %w", err)
+			}
+			// The merge did not do anything if it changed less than two rows, see https://www.sqlite.org/fts3.html#*fts4mergecmd
+			if after-before < 2 {
+				break
+			}
+			merges++
+		}
+	}
+	return fmt.Sprintf("ran %v merges on %v tables", merges, len(tables)), nil
+}
+
+// incrementalVacuum removes the pages on the freelist from the database file, a few at a time instead of all at once like Compact.
+func incrementalVacuum(ctx context.Context, conn *sql.Conn) (string, error) {
+	freed, err := compact(ctx, conn, vacuumPages)
+	if errors.Is(err, errIncrementalVacuumDisabled) {
+		return err.Error(), nil
+	} else if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("freed %v pages", freed), nil
+}
+
+func analyze(ctx context.Context, conn *sql.Conn) (string, error) {
+	_, err := conn.ExecContext(ctx, "PRAGMA analysis_limit="+fmt.Sprint(analysisLimit)+";")
+	if err != nil {
+		return "", fmt.Errorf("failed to set analysis_limit: %w", err)
+	}
+	_, err = conn.ExecContext(ctx, "ANALYZE;")
+	if err != nil {
+		return "", fmt.Errorf("failed to run ANALYZE: %w", err)
+	}
+	return "", nil
+}
+
+func integrityCheck(ctx context.Context, conn *sql.Conn) (string, error) {
+	rows, err := conn.QueryContext(ctx, "PRAGMA integrity_check("+fmt.Sprint(integrityCheckMaxErrors)+");")
+	if err != nil {
+		return "", fmt.Errorf("failed to run integrity_check: %w", err)
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var s string
+		err = rows.Scan(&s)
+		if err != nil {
+			return "", fmt.Errorf("failed to scan integrity_check result: %w", err)
+		}
+		if s != "ok" {
+			problems = append(problems, s)
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return "", fmt.Errorf("failed to run integrity_check: %w", err)
+	}
+	if len(problems) > 0 {
+		return "", fmt.Errorf("database is corrupt: %v", strings.Join(problems, "; "))
+	}
+	return "ok", nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_events
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/search"
+)
+
+func TestRunMaintenance(t *testing.T) {
+	for _, fts := range []string{FullTextSearchFts4, FullTextSearchFts5} {
+		t.Run(fts, func(t *testing.T) {
+			testRunMaintenance(t, fts)
+		})
+	}
+}
+
+func testRunMaintenance(t *testing.T, fullTextSearch string) {
+	db := openMigratedDb(t, "file:"+filepath.Join(t.TempDir(), "logsuck.db")+"?_auto_vacuum=incremental")
+	repo, err := createRepoOrErrorWithDb(db, &Config{TrueBatch: true, FullTextSearch: fullTextSearch, PartitionHours: 24})
+	if err != nil && strings.Contains(err.Error(), "sqlite_fts5 build tag") {
+		t.Skip("skipping since FTS5 is not available, run the tests with -tags sqlite_fts5 to include it")
+	}
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+	// Every batch creates a new segment in the full-text index of the partition
+	for i := 0; i < 20; i++ {
+		evts := eventsOverDays(3, 5)
+		for j := range evts {
+			evts[j].Offset += int64(i * len(evts))
+		}
+		err = repo.AddBatch(evts)
+		if err != nil {
+			t.Fatalf("got error when adding events: %v", err)
+		}
+	}
+	numDeleted, err := repo.(events.PartitionDeleter).DeletePartitionsBefore(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC))
+	if err != nil || numDeleted != 1 {
+		t.Fatalf("expected 1 partition to be deleted, got numDeleted=%v, err=%v", numDeleted, err)
+	}
+
+	results := runMaintenance(context.Background(), db, time.Minute)
+	expectedSteps := []string{"ftsMerge", "incrementalVacuum", "analyze", "integrityCheck"}
+	if len(results) != len(expectedSteps) {
+		t.Fatalf("expected %v results, got %v", len(expectedSteps), results)
+	}
+	for i, r := range results {
+		if r.Step != expectedSteps[i] || r.Status != maintenanceStatusOk {
+			t.Fatalf("expected step %v to be %v with status ok, got %+v", i, expectedSteps[i], r)
+		}
+	}
+	// The tables are the unpartitioned EventRaws table and the two remaining partitions
+	if results[0].Message == "ran 0 merges on 3 tables" || !strings.HasSuffix(results[0].Message, "on 3 tables") {
+		t.Fatalf("expected segments to be merged, got message=%q", results[0].Message)
+	}
+	var numStats int
+	err = db.QueryRow("SELECT COUNT(1) FROM sqlite_stat1;").Scan(&numStats)
+	if err != nil || numStats == 0 {
+		t.Fatalf("expected ANALYZE to write statistics, got numStats=%v, err=%v", numStats, err)
+	}
+	evts := collectEvents(repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampDesc))
+	assertTimestampOrder(t, evts, 200, events.SortModeTimestampDesc)
+
+	// Running again should find nothing to merge
+	results = runMaintenance(context.Background(), db, time.Minute)
+	if results[0].Message != "ran 0 merges on 3 tables" {
+		t.Fatalf("expected no merges on the second run, got message=%q", results[0].Message)
+	}
+}
+
+func TestRunMaintenanceTimeBudget(t *testing.T) {
+	db := openMigratedDb(t, "file:"+filepath.Join(t.TempDir(), "logsuck.db"))
+	results := runMaintenance(context.Background(), db, time.Nanosecond)
+	for _, r := range results {
+		if r.Status != maintenanceStatusSkipped {
+			t.Fatalf("expected all steps to be skipped when the time budget is used, got %+v", r)
+		}
+	}
+}
+
+func TestParseTimeBudget(t *testing.T) {
+	tests := []struct {
+		cfg      map[string]any
+		expected time.Duration
+		wantErr  bool
+	}{
+		{cfg: map[string]any{}, expected: defaultMaintenanceTimeBudget},
+		{cfg: map[string]any{"timeBudget": "30s"}, expected: 30 * time.Second},
+		{cfg: map[string]any{"timeBudget": "-1s"}, wantErr: true},
+		{cfg: map[string]any{"timeBudget": 30.0}, wantErr: true},
+		{cfg: map[string]any{"timeBudget": "soon"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		d, err := parseTimeBudget(tt.cfg)
+		if (err != nil) != tt.wantErr || d != tt.expected {
+			t.Fatalf("got d=%v, err=%v for cfg=%v, expected d=%v, wantErr=%v", d, err, tt.cfg, tt.expected, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_events
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jackbister/logsuck/plugins/sqlite_common"
+)
+
+// Migrations creates and updates the tables used by the events repository.
+// The EventRaws table is not part of the migrations since the full-text search module it uses is configurable, see createEventRawsTable.
+// The tables of each partition are created when the partition is created, see partitionTableStatements, so any change to the Events or
+// EventFields tables must be made to the partition tables as well.
+var Migrations = sqlite_common.PluginMigrations{
+	PluginName: pluginName,
+	Migrations: []sqlite_common.Migration{
+		{
+			Version:     1,
+			Description: "Create Events and EventFields tables",
+			// IF NOT EXISTS is used since databases created before migrations were introduced already have the tables
+			Apply: sqlite_common.ExecStatements(
+				"CREATE TABLE IF NOT EXISTS Events (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, host TEXT NOT NULL, source TEXT NOT NULL, source_id TEXT NOT NULL, timestamp DATETIME NOT NULL, offset BIGINT NOT NULL, UNIQUE(host, source, timestamp, offset));",
+				"CREATE INDEX IF NOT EXISTS IX_Events_Timestamp ON Events(timestamp);",
+				"CREATE TABLE IF NOT EXISTS EventFields (event_id INTEGER NOT NULL, key TEXT NOT NULL, value TEXT NOT NULL, PRIMARY KEY(event_id, key)) WITHOUT ROWID;",
+				"CREATE INDEX IF NOT EXISTS IX_EventFields_Key_Value ON EventFields(key, value);",
+			),
+		},
+		{
+			Version:     2,
+			Description: "Create EventPartitions table",
+			Apply: sqlite_common.ExecStatements(
+				"CREATE TABLE EventPartitions (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, start_time INTEGER NOT NULL, end_time INTEGER NOT NULL, suffix TEXT NOT NULL UNIQUE);",
+			),
+		},
+		{
+			Version:     3,
+			Description: "Add index_name column to Events tables",
+			Apply:       addIndexNameColumn,
+		},
+		{
+			Version:     4,
+			Description: "Add EventBlocks tables for compressed raw events",
+			Apply:       addEventBlocks,
+		},
+		{
+			Version:     5,
+			Description: "Add encryption key IDs to EventBlocks tables and create EventBlindIndexes table",
+			Apply:       addEncryptionKeyIds,
+		},
+		{
+			Version:     6,
+			Description: "Add content_hash column to Events tables",
+			Apply:       addContentHashColumn,
+		},
+		{
+			Version:     7,
+			Description: "Add version column to EventFields tables",
+			Apply:       addFieldsVersionColumn,
+		},
+	},
+}
+
+// addIndexNameColumn adds the index_name column to the Events table and the Events table of every existing partition. Existing events are
+// placed in the default index.
+func addIndexNameColumn(tx *sql.Tx) error {
+	suffixes, err := tableSuffixes(tx)
+	if err != nil {
+		return err
+	}
+	for _, suffix := range suffixes {
+		table := "Events" + suffix
+		_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN index_name TEXT NOT NULL DEFAULT 'main';")
+		if err != nil {
+			return fmt.Errorf("error adding index_name column to table=%v: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// addEventBlocks adds the EventBlocks table and the columns referring to it to the unpartitioned tables and the tables of every existing
+// partition. The columns are NULL for events which are not stored in a block.
+func addEventBlocks(tx *sql.Tx) error {
+	suffixes, err := tableSuffixes(tx)
+	if err != nil {
+		return err
+	}
+	for _, suffix := range suffixes {
+		err = sqlite_common.ExecStatements(
+			"CREATE TABLE EventBlocks"+suffix+" (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, data BLOB NOT NULL);",
+			"ALTER TABLE Events"+suffix+" ADD COLUMN block_id INTEGER;",
+			"ALTER TABLE Events"+suffix+" ADD COLUMN block_index INTEGER;",
+			"CREATE INDEX IX_Events"+suffix+"_BlockId ON Events"+suffix+"(block_id);",
+		)(tx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableSuffixes returns the suffixes of the table names of the unpartitioned tables, which is an empty string, and of every partition.
+func tableSuffixes(tx *sql.Tx) ([]string, error) {
+	ret := []string{""}
+	rows, err := tx.Query("SELECT suffix FROM EventPartitions;")
+	if err != nil {
+		return nil, fmt.Errorf("error getting partitions: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var suffix string
+		err = rows.Scan(&suffix)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning partition: %w", err)
+		}
+		ret = append(ret, "_"+suffix)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error getting partitions: %w", err)
+	}
+	return ret, nil
+}
+
+// addEncryptionKeyIds adds the key_id column to the EventBlocks table of the unpartitioned tables and of every existing partition, and
+// creates the EventBlindIndexes table which records which EventRaws tables contain blind tokens. The existing blocks are not encrypted, so
+// their key_id is NULL.
+func addEncryptionKeyIds(tx *sql.Tx) error {
+	suffixes, err := tableSuffixes(tx)
+	if err != nil {
+		return err
+	}
+	for _, suffix := range suffixes {
+		err = sqlite_common.ExecStatements(
+			"ALTER TABLE EventBlocks"+suffix+" ADD COLUMN key_id TEXT;",
+			"CREATE INDEX IX_EventBlocks"+suffix+"_KeyId ON EventBlocks"+suffix+"(key_id);",
+		)(tx)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("CREATE TABLE EventBlindIndexes (table_name TEXT NOT NULL PRIMARY KEY, key_id TEXT NOT NULL);")
+	if err != nil {
+		return fmt.Errorf("error creating EventBlindIndexes table: %w", err)
+	}
+	return nil
+}
+
+// addContentHashColumn adds the content_hash column used by DedupContentHash to the Events table of the unpartitioned tables and of every
+// existing partition. The column is NULL for existing events and when DedupKey is used, so the unique index only covers the rows which have
+// a hash.
+func addContentHashColumn(tx *sql.Tx) error {
+	suffixes, err := tableSuffixes(tx)
+	if err != nil {
+		return err
+	}
+	for _, suffix := range suffixes {
+		err = sqlite_common.ExecStatements(
+			"ALTER TABLE Events"+suffix+" ADD COLUMN content_hash BLOB;",
+			contentHashIndexStatement("Events"+suffix),
+		)(tx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addFieldsVersionColumn adds the version column, which records the version of the field extraction used for each indexed field, to the
+// EventFields table of the unpartitioned tables and of every existing partition. The version of the existing fields is unknown, so it is
+// NULL and the fields are not used by searches.
+func addFieldsVersionColumn(tx *sql.Tx) error {
+	suffixes, err := tableSuffixes(tx)
+	if err != nil {
+		return err
+	}
+	for _, suffix := range suffixes {
+		table := "EventFields" + suffix
+		_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN version TEXT;")
+		if err != nil {
+			return fmt.Errorf("error adding version column to table=%v: %w", table, err)
+		}
+	}
+	return nil
+}
+
+func contentHashIndexStatement(eventsTable string) string {
+	return "CREATE UNIQUE INDEX UX_" + eventsTable + "_ContentHash ON " + eventsTable + "(content_hash) WHERE content_hash IS NOT NULL;"
+}
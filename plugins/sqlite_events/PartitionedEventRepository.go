@@ -0,0 +1,770 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_events
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/search"
+)
+
+// partitionIdBits is the number of bits of an event ID which are used for the ID of the event within its partition. The remaining bits
+// contain the ID of the partition, so that the partition of an event can be found using only its ID.
+const partitionIdBits = 32
+
+// eventPartition is a set of tables containing the events with timestamps in [start, end).
+type eventPartition struct {
+	// id is the ID of the partition in the EventPartitions table. The legacy partition, which contains the events that were added before
+	// partitioning was enabled, has ID 0.
+	id    int64
+	start time.Time
+	end   time.Time
+	repo  *sqliteEventRepository
+}
+
+func (p *eventPartition) idBase() int64 {
+	return p.id << partitionIdBits
+}
+
+func (p *eventPartition) overlaps(start, end *time.Time) bool {
+	return (start == nil || p.end.After(*start)) && (end == nil || !p.start.After(*end))
+}
+
+// toGlobalIds converts the IDs of the events from IDs within the partition to the IDs returned by the repository.
+func (p *eventPartition) toGlobalIds(evts []events.EventWithId) []events.EventWithId {
+	base := p.idBase()
+	for i := range evts {
+		evts[i].Id += base
+	}
+	return evts
+}
+
+// partitionedEventRepository stores events in separate tables for each time period of partitionHours hours, so that old events can be
+// deleted by dropping whole partitions and searches only need to look at the partitions overlapping their time range.
+//
+// Event IDs are globally unique since the ID of the partition is stored in the upper bits of each event ID. Events which were added
+// before partitioning was enabled are kept in the Events, EventRaws and EventFields tables, which are treated as a partition with ID 0
+// covering the time range of those events.
+type partitionedEventRepository struct {
+	db      *sql.DB
+	cfg     *Config
+	dialect ftsDialect
+	layout  rawsLayout
+	keys    *keyring
+	metrics *events.IngestionMetrics
+	logger  *slog.Logger
+
+	// writeMu is held while adding events and dropping partitions so that events are never added to a partition which is being dropped
+	writeMu sync.Mutex
+	// mu protects partitions and legacy
+	mu sync.RWMutex
+	// partitions contains the partitions sorted by start time. The partitions never overlap.
+	partitions []*eventPartition
+	// legacy is the partition containing the events added before partitioning was enabled, or nil if there are no such events
+	legacy *eventPartition
+}
+
+func newPartitionedEventRepository(legacyRepo *sqliteEventRepository) (events.Repository, error) {
+	repo := &partitionedEventRepository{
+		db:      legacyRepo.db,
+		cfg:     legacyRepo.cfg,
+		dialect: legacyRepo.dialect,
+		layout:  legacyRepo.layout,
+		keys:    legacyRepo.keys,
+		metrics: legacyRepo.metrics,
+		logger:  legacyRepo.logger,
+	}
+	legacy, err := getLegacyPartition(legacyRepo)
+	if err != nil {
+		return nil, err
+	}
+	repo.legacy = legacy
+
+	rows, err := repo.db.Query("SELECT id, start_time, end_time, suffix FROM EventPartitions ORDER BY start_time;")
+	if err != nil {
+		return nil, fmt.Errorf("error getting event partitions: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, start, end int64
+		var suffix string
+		err = rows.Scan(&id, &start, &end, &suffix)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning event partition: %w", err)
+		}
+		repo.partitions = append(repo.partitions, repo.newPartition(id, time.Unix(start, 0).UTC(), time.Unix(end, 0).UTC(), suffix))
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("error getting event partitions: %w", err)
+	}
+	rows.Close()
+	for _, p := range repo.partitions {
+		// This also migrates the partition if the full-text search module or compression has been changed
+		err = createEventRawsTable(repo.db, p.repo.tables, repo.layout, repo.keys, repo.logger)
+		if err != nil {
+			return nil, err
+		}
+		err = checkBlockKeys(repo.db, p.repo.tables.blocks, repo.keys)
+		if err != nil {
+			return nil, err
+		}
+	}
+	repo.logger.Info("using partitioned event storage",
+		slog.Int("partitionHours", repo.cfg.PartitionHours),
+		slog.Int("numPartitions", len(repo.partitions)),
+		slog.Bool("hasLegacyEvents", legacy != nil))
+	return repo, nil
+}
+
+// getLegacyPartition returns a partition for the events in the unpartitioned tables, or nil if there are no events in them.
+func getLegacyPartition(legacyRepo *sqliteEventRepository) (*eventPartition, error) {
+	// MIN and MAX would not return the timestamps as time.Time, since the driver uses the declared type of the column for the conversion
+	var start, end time.Time
+	err := legacyRepo.db.QueryRow("SELECT timestamp FROM " + legacyRepo.tables.events + " ORDER BY timestamp ASC LIMIT 1;").Scan(&start)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting oldest unpartitioned event: %w", err)
+	}
+	err = legacyRepo.db.QueryRow("SELECT timestamp FROM " + legacyRepo.tables.events + " ORDER BY timestamp DESC LIMIT 1;").Scan(&end)
+	if err != nil {
+		return nil, fmt.Errorf("error getting newest unpartitioned event: %w", err)
+	}
+	return &eventPartition{
+		id:    0,
+		start: start,
+		// end is exclusive
+		end:  end.Add(time.Nanosecond),
+		repo: legacyRepo,
+	}, nil
+}
+
+func (repo *partitionedEventRepository) newPartition(id int64, start, end time.Time, suffix string) *eventPartition {
+	return &eventPartition{
+		id:    id,
+		start: start,
+		end:   end,
+		repo: &sqliteEventRepository{
+			db:      repo.db,
+			cfg:     repo.cfg,
+			dialect: repo.dialect,
+			layout:  repo.layout,
+			keys:    repo.keys,
+			metrics: repo.metrics,
+			tables: eventTables{
+				events:      "Events_" + suffix,
+				raws:        "EventRaws_" + suffix,
+				fields:      "EventFields_" + suffix,
+				blocks:      "EventBlocks_" + suffix,
+				rawsContent: "EventRawsContent_" + suffix,
+			},
+			logger: repo.logger,
+		},
+	}
+}
+
+// partitionTableStatements returns the statements creating the tables of a partition except for the EventRaws table.
+// The tables must match the latest version of the tables created by Migrations.
+func partitionTableStatements(tables eventTables) []string {
+	return []string{
+		"CREATE TABLE " + tables.events + " (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, host TEXT NOT NULL, source TEXT NOT NULL, source_id TEXT NOT NULL, timestamp DATETIME NOT NULL, offset BIGINT NOT NULL, index_name TEXT NOT NULL DEFAULT 'main', block_id INTEGER, block_index INTEGER, content_hash BLOB, UNIQUE(host, source, timestamp, offset));",
+		"CREATE INDEX IX_" + tables.events + "_Timestamp ON " + tables.events + "(timestamp);",
+		"CREATE INDEX IX_" + tables.events + "_BlockId ON " + tables.events + "(block_id);",
+		contentHashIndexStatement(tables.events),
+		"CREATE TABLE " + tables.blocks + " (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, data BLOB NOT NULL, key_id TEXT);",
+		"CREATE INDEX IX_" + tables.blocks + "_KeyId ON " + tables.blocks + "(key_id);",
+		"CREATE TABLE " + tables.fields + " (event_id INTEGER NOT NULL, key TEXT NOT NULL, value TEXT NOT NULL, version TEXT, PRIMARY KEY(event_id, key)) WITHOUT ROWID;",
+		"CREATE INDEX IX_" + tables.fields + "_Key_Value ON " + tables.fields + "(key, value);",
+	}
+}
+
+// findPartition returns the partition containing the timestamp, or nil if there is no such partition. mu must be held by the caller.
+func (repo *partitionedEventRepository) findPartition(timestamp time.Time) *eventPartition {
+	i := sort.Search(len(repo.partitions), func(i int) bool {
+		return repo.partitions[i].end.After(timestamp)
+	})
+	if i < len(repo.partitions) && !repo.partitions[i].start.After(timestamp) {
+		return repo.partitions[i]
+	}
+	return nil
+}
+
+// createPartition creates the partition which the timestamp belongs to. Partitions start at a multiple of partitionHours hours since the
+// Unix epoch, but are shortened if they would overlap an existing partition, which can happen if partitionHours has been changed.
+// mu must be held by the caller.
+func (repo *partitionedEventRepository) createPartition(timestamp time.Time) (*eventPartition, error) {
+	length := int64(repo.cfg.PartitionHours) * 3600
+	startUnix := timestamp.Unix() / length * length
+	if timestamp.Unix() < 0 && timestamp.Unix()%length != 0 {
+		// Division rounds towards zero, but the start of the partition must be before the timestamp
+		startUnix -= length
+	}
+	start := time.Unix(startUnix, 0).UTC()
+	end := start.Add(time.Duration(length) * time.Second)
+	i := sort.Search(len(repo.partitions), func(i int) bool {
+		return repo.partitions[i].start.After(timestamp)
+	})
+	if i > 0 && repo.partitions[i-1].end.After(start) {
+		start = repo.partitions[i-1].end
+	}
+	if i < len(repo.partitions) && repo.partitions[i].start.Before(end) {
+		end = repo.partitions[i].start
+	}
+	suffix := "p" + start.Format("2006010215")
+
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	res, err := tx.Exec("INSERT INTO EventPartitions (start_time, end_time, suffix) VALUES (?, ?, ?);", start.Unix(), end.Unix(), suffix)
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to add partition with suffix=%v: %w", suffix, err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to get ID of partition with suffix=%v: %w", suffix, err)
+	}
+	p := repo.newPartition(id, start, end, suffix)
+	tables := p.repo.tables
+	stmts := append(partitionTableStatements(tables), createEventRawsStatements(repo.layout, tables.raws, tables.rawsContent)...)
+	for _, stmt := range append(stmts, blindIndexStatements(repo.layout, tables.raws)...) {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			tx.Rollback()
+			return nil, wrapFtsError(fmt.Errorf("failed to create tables for partition with suffix=%v: %w", suffix, err))
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit creation of partition with suffix=%v: %w", suffix, err)
+	}
+	repo.partitions = append(repo.partitions, nil)
+	copy(repo.partitions[i+1:], repo.partitions[i:])
+	repo.partitions[i] = p
+	repo.logger.Info("created event partition",
+		slog.String("suffix", suffix),
+		slog.Time("start", start),
+		slog.Time("end", end))
+	return p, nil
+}
+
+// getPartitionById returns the partition containing the event with the given ID and the ID of the event within the partition, or nil if
+// the partition does not exist. mu must be held by the caller.
+func (repo *partitionedEventRepository) getPartitionById(id int64) (*eventPartition, int64) {
+	partitionId := id >> partitionIdBits
+	if partitionId == 0 {
+		return repo.legacy, id
+	}
+	i := sort.Search(len(repo.partitions), func(i int) bool {
+		return repo.partitions[i].id >= partitionId
+	})
+	// The partitions are sorted by start time rather than ID, so fall back to looking through all of them
+	if i >= len(repo.partitions) || repo.partitions[i].id != partitionId {
+		i = -1
+		for j, p := range repo.partitions {
+			if p.id == partitionId {
+				i = j
+				break
+			}
+		}
+	}
+	if i == -1 {
+		return nil, 0
+	}
+	p := repo.partitions[i]
+	return p, id - p.idBase()
+}
+
+// allPartitions returns the partitions sorted by start time, with the legacy partition first if it exists.
+func (repo *partitionedEventRepository) allPartitions() []*eventPartition {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	ret := make([]*eventPartition, 0, len(repo.partitions)+1)
+	if repo.legacy != nil {
+		ret = append(ret, repo.legacy)
+	}
+	return append(ret, repo.partitions...)
+}
+
+func (repo *partitionedEventRepository) AddBatch(evts []events.Event) error {
+	repo.writeMu.Lock()
+	defer repo.writeMu.Unlock()
+	byPartition := map[*eventPartition][]events.Event{}
+	order := []*eventPartition{}
+	evts, err := repo.removeLegacyDuplicates(evts)
+	if err != nil {
+		return err
+	}
+	evts, duplicates, err := repo.removeContentHashDuplicates(evts)
+	if err != nil {
+		return err
+	}
+	if len(duplicates) > 0 {
+		for _, evt := range duplicates {
+			repo.metrics.Record(evt.Host, evt.Source, 0, 1)
+		}
+		repo.logger.Info("Skipped adding events because they appear to be duplicates (same host, source, offset and contents as an existing event)",
+			slog.Int("numEvents", len(duplicates)))
+	}
+	repo.mu.Lock()
+	for _, evt := range evts {
+		p := repo.findPartition(evt.Timestamp)
+		if p == nil {
+			p, err = repo.createPartition(evt.Timestamp)
+			if err != nil {
+				repo.mu.Unlock()
+				return fmt.Errorf("error creating partition for timestamp=%v: %w", evt.Timestamp, err)
+			}
+		}
+		if _, ok := byPartition[p]; !ok {
+			order = append(order, p)
+		}
+		byPartition[p] = append(byPartition[p], evt)
+	}
+	repo.mu.Unlock()
+	for _, p := range order {
+		err := p.repo.AddBatch(byPartition[p])
+		if err != nil {
+			return fmt.Errorf("error adding events to partition with tables=%v: %w", p.repo.tables.events, err)
+		}
+	}
+	return nil
+}
+
+// removeLegacyDuplicates removes the events which already exist in the legacy partition. The unique constraint which normally prevents
+// duplicates only applies within a partition, so without this a file which is read again would add its old events to the partitions.
+func (repo *partitionedEventRepository) removeLegacyDuplicates(evts []events.Event) ([]events.Event, error) {
+	repo.mu.RLock()
+	legacy := repo.legacy
+	repo.mu.RUnlock()
+	if legacy == nil {
+		return evts, nil
+	}
+	ret := make([]events.Event, 0, len(evts))
+	for _, evt := range evts {
+		if evt.Timestamp.Before(legacy.start) || !evt.Timestamp.Before(legacy.end) {
+			ret = append(ret, evt)
+			continue
+		}
+		var count int
+		err := repo.db.QueryRow("SELECT COUNT(1) FROM "+legacy.repo.tables.events+" WHERE host = ? AND source = ? AND timestamp = ? AND offset = ?;",
+			evt.Host, evt.Source, evt.Timestamp, evt.Offset).Scan(&count)
+		if err != nil {
+			return nil, fmt.Errorf("error checking for duplicates of unpartitioned events: %w", err)
+		}
+		if count == 0 {
+			ret = append(ret, evt)
+		} else {
+			repo.metrics.Record(evt.Host, evt.Source, 0, 1)
+		}
+	}
+	if len(ret) < len(evts) {
+		repo.logger.Info("Skipped adding events because they appear to be duplicates (same source, offset and timestamp as an existing event)",
+			slog.Int("numEvents", len(evts)-len(ret)))
+	}
+	return ret, nil
+}
+
+func (repo *partitionedEventRepository) DeleteBatch(ids []int64) error {
+	byPartition := map[*eventPartition][]int64{}
+	repo.mu.RLock()
+	for _, id := range ids {
+		p, localId := repo.getPartitionById(id)
+		if p != nil {
+			byPartition[p] = append(byPartition[p], localId)
+		}
+	}
+	repo.mu.RUnlock()
+	for p, localIds := range byPartition {
+		err := p.repo.DeleteBatch(localIds)
+		if err != nil {
+			return fmt.Errorf("error deleting events from partition with tables=%v: %w", p.repo.tables.events, err)
+		}
+	}
+	return nil
+}
+
+// DeletePartitionsBefore drops the partitions which only contain events older than endTime.
+func (repo *partitionedEventRepository) DeletePartitionsBefore(endTime time.Time) (int, error) {
+	repo.writeMu.Lock()
+	defer repo.writeMu.Unlock()
+	repo.mu.RLock()
+	toDrop := []*eventPartition{}
+	for _, p := range repo.partitions {
+		if p.end.After(endTime) {
+			break
+		}
+		toDrop = append(toDrop, p)
+	}
+	repo.mu.RUnlock()
+
+	dropped := 0
+	for _, p := range toDrop {
+		err := repo.dropPartition(p)
+		if err != nil {
+			return dropped, err
+		}
+		dropped++
+	}
+	return dropped, nil
+}
+
+func (repo *partitionedEventRepository) dropPartition(p *eventPartition) error {
+	startTime := time.Now()
+	tables := p.repo.tables
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	dropStatements := []string{
+		"DROP TABLE " + tables.events + ";",
+		"DROP TABLE " + tables.raws + ";",
+		"DROP TABLE IF EXISTS " + tables.rawsContent + ";",
+		"DROP TABLE " + tables.fields + ";",
+		"DROP TABLE " + tables.blocks + ";",
+	}
+	for _, stmt := range dropStatements {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to drop tables of partition with tables=%v: %w", tables.events, err)
+		}
+	}
+	_, err = tx.Exec("DELETE FROM EventBlindIndexes WHERE table_name = ?;", tables.raws)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete blind index of partition with tables=%v: %w", tables.events, err)
+	}
+	_, err = tx.Exec("DELETE FROM EventPartitions WHERE id = ?;", p.id)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete partition with tables=%v: %w", tables.events, err)
+	}
+	_, err = tx.Exec("DELETE FROM sqlite_sequence WHERE name IN (?, ?);", tables.events, tables.blocks)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete sequence of partition with tables=%v: %w", tables.events, err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit drop of partition with tables=%v: %w", tables.events, err)
+	}
+
+	repo.mu.Lock()
+	for i, existing := range repo.partitions {
+		if existing == p {
+			repo.partitions = append(repo.partitions[:i], repo.partitions[i+1:]...)
+			break
+		}
+	}
+	repo.mu.Unlock()
+	repo.logger.Info("dropped event partition",
+		slog.String("table", tables.events),
+		slog.Time("start", p.start),
+		slog.Time("end", p.end),
+		slog.Duration("duration", time.Since(startTime)))
+	return nil
+}
+
+// overlappingPartitions returns the partitions which overlap the time range, sorted in the order they should be searched in, and the
+// legacy partition if it overlaps the time range.
+func (repo *partitionedEventRepository) overlappingPartitions(searchStartTime, searchEndTime *time.Time, sortMode events.SortMode) ([]*eventPartition, *eventPartition) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	ret := []*eventPartition{}
+	for _, p := range repo.partitions {
+		if p.overlaps(searchStartTime, searchEndTime) {
+			ret = append(ret, p)
+		}
+	}
+	if sortMode != events.SortModeTimestampAsc {
+		for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+			ret[i], ret[j] = ret[j], ret[i]
+		}
+	}
+	var legacy *eventPartition
+	if repo.legacy != nil && repo.legacy.overlaps(searchStartTime, searchEndTime) {
+		legacy = repo.legacy
+	}
+	return ret, legacy
+}
+
+func (repo *partitionedEventRepository) FilterStream(srch *search.Search, searchStartTime, searchEndTime *time.Time, sortMode events.SortMode) <-chan []events.EventWithId {
+	partitions, legacy := repo.overlappingPartitions(searchStartTime, searchEndTime, sortMode)
+	ret := make(chan []events.EventWithId)
+	go func() {
+		defer close(ret)
+		// The partitions do not overlap, so the events are sorted if the partitions are searched one at a time
+		for _, p := range partitions {
+			for evts := range p.repo.FilterStream(srch, searchStartTime, searchEndTime, sortMode) {
+				ret <- p.toGlobalIds(evts)
+			}
+		}
+	}()
+	if legacy == nil {
+		return ret
+	}
+	// The legacy events can have any timestamp within their time range, so they are merged with the events from the partitions
+	legacyEvts := make(chan []events.EventWithId)
+	go func() {
+		defer close(legacyEvts)
+		for evts := range legacy.repo.FilterStream(srch, searchStartTime, searchEndTime, sortMode) {
+			legacyEvts <- legacy.toGlobalIds(evts)
+		}
+	}()
+	return mergeEventStreams(ret, legacyEvts, sortMode)
+}
+
+// mergeEventStreams merges two streams of events which are sorted in the order used by FilterStream into one sorted stream.
+func mergeEventStreams(a, b <-chan []events.EventWithId, sortMode events.SortMode) <-chan []events.EventWithId {
+	ret := make(chan []events.EventWithId)
+	go func() {
+		defer close(ret)
+		var bufA, bufB []events.EventWithId
+		for {
+			for len(bufA) == 0 && a != nil {
+				page, ok := <-a
+				if !ok {
+					a = nil
+				}
+				bufA = page
+			}
+			for len(bufB) == 0 && b != nil {
+				page, ok := <-b
+				if !ok {
+					b = nil
+				}
+				bufB = page
+			}
+			if len(bufA) == 0 && len(bufB) == 0 {
+				return
+			}
+			// Events can only be sent until one of the buffers is empty, since the next page of that stream may contain earlier events
+			merged := make([]events.EventWithId, 0, len(bufA)+len(bufB))
+			for len(bufA) > 0 && len(bufB) > 0 {
+				if comesBefore(bufA[0], bufB[0], sortMode) {
+					merged = append(merged, bufA[0])
+					bufA = bufA[1:]
+				} else {
+					merged = append(merged, bufB[0])
+					bufB = bufB[1:]
+				}
+			}
+			if a == nil {
+				merged = append(merged, bufB...)
+				bufB = nil
+			}
+			if b == nil {
+				merged = append(merged, bufA...)
+				bufA = nil
+			}
+			ret <- merged
+		}
+	}()
+	return ret
+}
+
+// comesBefore returns true if a comes before b in the order used by FilterStream.
+func comesBefore(a, b events.EventWithId, sortMode events.SortMode) bool {
+	if sortMode == events.SortModeTimestampAsc {
+		return a.Timestamp.Before(b.Timestamp) || a.Timestamp.Equal(b.Timestamp) && a.Id < b.Id
+	}
+	return a.Timestamp.After(b.Timestamp) || a.Timestamp.Equal(b.Timestamp) && a.Id > b.Id
+}
+
+func (repo *partitionedEventRepository) ExplainFilter(srch *search.Search, searchStartTime, searchEndTime *time.Time, sortMode events.SortMode) (*events.FilterExplanation, error) {
+	partitions, legacy := repo.overlappingPartitions(searchStartTime, searchEndTime, sortMode)
+	if legacy != nil {
+		partitions = append(partitions, legacy)
+	}
+	if len(partitions) == 0 {
+		return &events.FilterExplanation{
+			Statement:         "",
+			Parameters:        []any{},
+			PushedDownFilters: []string{"partitions=() (no partitions overlap the time range)"},
+		}, nil
+	}
+	// The statement is the same for all partitions except for the table names, so only the first partition's statement is shown
+	ret, err := partitions[0].repo.ExplainFilter(srch, searchStartTime, searchEndTime, sortMode)
+	if err != nil {
+		return nil, err
+	}
+	tables := make([]string, len(partitions))
+	for i, p := range partitions {
+		tables[i] = p.repo.tables.events
+	}
+	ret.PushedDownFilters = append([]string{"partitions=(" + strings.Join(tables, ", ") + ")"}, ret.PushedDownFilters...)
+	return ret, nil
+}
+
+func (repo *partitionedEventRepository) GetByIds(ids []int64, sortMode events.SortMode) ([]events.EventWithId, error) {
+	byPartition := map[*eventPartition][]int64{}
+	repo.mu.RLock()
+	for _, id := range ids {
+		p, localId := repo.getPartitionById(id)
+		if p != nil {
+			byPartition[p] = append(byPartition[p], localId)
+		}
+	}
+	repo.mu.RUnlock()
+	ret := make([]events.EventWithId, 0, len(ids))
+	for p, localIds := range byPartition {
+		evts, err := p.repo.GetByIds(localIds, events.SortModeNone)
+		if err != nil {
+			return nil, fmt.Errorf("error getting events from partition with tables=%v: %w", p.repo.tables.events, err)
+		}
+		ret = append(ret, p.toGlobalIds(evts)...)
+	}
+	switch sortMode {
+	case events.SortModeTimestampDesc, events.SortModeTimestampAsc:
+		sort.Slice(ret, func(i, j int) bool {
+			return comesBefore(ret[i], ret[j], sortMode)
+		})
+	case events.SortModePreserveArgOrder:
+		m := make(map[int64]int, len(ids))
+		for i, id := range ids {
+			m[id] = i
+		}
+		sort.Slice(ret, func(i, j int) bool {
+			return m[ret[i].Id] < m[ret[j].Id]
+		})
+	}
+	return ret, nil
+}
+
+// GetSurroundingEvents returns the events surrounding the event in the same source. Since the events of a source can be spread over many
+// partitions, the partition of the event is searched first and then the partitions before and after it until enough events are found.
+func (repo *partitionedEventRepository) GetSurroundingEvents(id int64, count int) ([]events.EventWithId, error) {
+	repo.mu.RLock()
+	p, localId := repo.getPartitionById(id)
+	repo.mu.RUnlock()
+	if p == nil {
+		return nil, fmt.Errorf("got error when getting source_id and offset for eventId=%v: %w", id, sql.ErrNoRows)
+	}
+	sourceId, baseOffset, err := p.repo.getSourceIdAndOffset(localId)
+	if err != nil {
+		return nil, err
+	}
+	partitions := repo.allPartitions()
+	idx := 0
+	for i, other := range partitions {
+		if other == p {
+			idx = i
+			break
+		}
+	}
+
+	// Earlier partitions contain events with lower offsets, so the events up to and including the event are found by searching backwards
+	upRows := make([]events.EventWithId, 0, count/2)
+	for i := idx; i >= 0 && len(upRows) < count/2; i-- {
+		evts, err := partitions[i].repo.getEventsUpToOffset(sourceId, baseOffset, count/2-len(upRows))
+		if err != nil {
+			return nil, fmt.Errorf("got error when querying for surrounding rows for eventId=%v: %w", id, err)
+		}
+		upRows = append(upRows, partitions[i].toGlobalIds(evts)...)
+	}
+	// Each partition returns its events sorted by descending offset, so the partitions found later are placed first
+	downRows := make([]events.EventWithId, 0, count/2)
+	found := 0
+	for i := idx; i < len(partitions) && found < count/2; i++ {
+		evts, err := partitions[i].repo.getEventsAfterOffset(sourceId, baseOffset, count/2-found)
+		if err != nil {
+			return nil, fmt.Errorf("got error when querying for surrounding rows for eventId=%v: %w", id, err)
+		}
+		found += len(evts)
+		downRows = append(partitions[i].toGlobalIds(evts), downRows...)
+	}
+	return append(downRows, upRows...), nil
+}
+
+func (repo *partitionedEventRepository) GetIndexedFields(ids []int64) (map[int64]events.StoredFields, error) {
+	byPartition := map[*eventPartition][]int64{}
+	repo.mu.RLock()
+	for _, id := range ids {
+		p, localId := repo.getPartitionById(id)
+		if p != nil {
+			byPartition[p] = append(byPartition[p], localId)
+		}
+	}
+	repo.mu.RUnlock()
+	ret := make(map[int64]events.StoredFields, len(ids))
+	for p, localIds := range byPartition {
+		fields, err := p.repo.GetIndexedFields(localIds)
+		if err != nil {
+			return nil, fmt.Errorf("error getting indexed fields from partition with tables=%v: %w", p.repo.tables.events, err)
+		}
+		base := p.idBase()
+		for id, f := range fields {
+			ret[id+base] = f
+		}
+	}
+	return ret, nil
+}
+
+func (repo *partitionedEventRepository) GetIndexedFieldValueCounts(fieldName string, limit int) (map[string]int, error) {
+	counts := map[string]int{}
+	for _, p := range repo.allPartitions() {
+		// SQLite treats a negative limit as no limit. All values are needed since the most common values may differ between partitions.
+		partitionCounts, err := p.repo.GetIndexedFieldValueCounts(fieldName, -1)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range partitionCounts {
+			counts[k] += v
+		}
+	}
+	values := make([]string, 0, len(counts))
+	for k := range counts {
+		values = append(values, k)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if counts[values[i]] != counts[values[j]] {
+			return counts[values[i]] > counts[values[j]]
+		}
+		return values[i] < values[j]
+	})
+	ret := make(map[string]int, limit)
+	for i := 0; i < len(values) && i < limit; i++ {
+		ret[values[i]] = counts[values[i]]
+	}
+	return ret, nil
+}
+
+// checkNotPartitioned returns an error if the database contains partitions. The events in them can not be moved to the unpartitioned
+// tables without changing their IDs, so partitioning can not be disabled once it has been used.
+func checkNotPartitioned(db *sql.DB) error {
+	var count int
+	err := db.QueryRow("SELECT COUNT(1) FROM EventPartitions;").Scan(&count)
+	if err != nil {
+		return fmt.Errorf("error getting number of event partitions: %w", err)
+	}
+	if count > 0 {
+		return fmt.Errorf("the database contains numPartitions=%v event partitions, which are only used when partitionHours is set. "+
+			"Set partitionHours to keep using them", count)
+	}
+	return nil
+}
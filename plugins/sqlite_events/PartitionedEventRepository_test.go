@@ -0,0 +1,278 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_events
+
+import (
+	"database/sql"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/search"
+	"github.com/jackbister/logsuck/plugins/sqlite_common"
+)
+
+func TestPartitionedFilterStream(t *testing.T) {
+	repo := createRepoWithCfg(t, &Config{TrueBatch: true, PartitionHours: 24})
+	err := repo.AddBatch(eventsOverDays(3, 2))
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	numPartitions := len(repo.(*partitionedEventRepository).partitions)
+	if numPartitions != 3 {
+		t.Fatalf("expected 3 partitions, got %v", numPartitions)
+	}
+
+	desc := collectEvents(repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampDesc))
+	assertTimestampOrder(t, desc, 6, events.SortModeTimestampDesc)
+	asc := collectEvents(repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampAsc))
+	assertTimestampOrder(t, asc, 6, events.SortModeTimestampAsc)
+
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2024, 1, 2, 23, 0, 0, 0, time.UTC)
+	inRange := collectEvents(repo.FilterStream(&search.Search{}, &start, &end, events.SortModeTimestampDesc))
+	assertTimestampOrder(t, inRange, 2, events.SortModeTimestampDesc)
+
+	explanation, err := repo.(events.FilterExplainer).ExplainFilter(&search.Search{}, &start, &end, events.SortModeTimestampDesc)
+	if err != nil {
+		t.Fatalf("got error when explaining filter: %v", err)
+	}
+	if explanation.PushedDownFilters[0] != "partitions=(Events_p2024010200)" {
+		t.Fatalf("expected only the partition for 2024-01-02 to be searched, got pushedDownFilters=%v", explanation.PushedDownFilters)
+	}
+}
+
+func TestPartitionedGetByIds(t *testing.T) {
+	repo := createRepoWithCfg(t, &Config{TrueBatch: true, PartitionHours: 24})
+	err := repo.AddBatch(eventsOverDays(3, 1))
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	all := collectEvents(repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampDesc))
+	ids := []int64{all[1].Id, all[2].Id, all[0].Id}
+	evts, err := repo.GetByIds(ids, events.SortModePreserveArgOrder)
+	if err != nil {
+		t.Fatalf("got error when getting events by ID: %v", err)
+	}
+	if len(evts) != 3 || evts[0].Id != ids[0] || evts[1].Id != ids[1] || evts[2].Id != ids[2] {
+		t.Fatalf("expected events with ids=%v, got %v", ids, evts)
+	}
+	evts, err = repo.GetByIds(ids, events.SortModeTimestampDesc)
+	if err != nil {
+		t.Fatalf("got error when getting events by ID: %v", err)
+	}
+	assertTimestampOrder(t, evts, 3, events.SortModeTimestampDesc)
+
+	err = repo.DeleteBatch([]int64{all[1].Id})
+	if err != nil {
+		t.Fatalf("got error when deleting event: %v", err)
+	}
+	evts, err = repo.GetByIds(ids, events.SortModeNone)
+	if err != nil {
+		t.Fatalf("got error when getting events by ID: %v", err)
+	}
+	if len(evts) != 2 {
+		t.Fatalf("expected 2 events after deleting one, got %v", len(evts))
+	}
+}
+
+func TestDeletePartitionsBefore(t *testing.T) {
+	repo := createRepoWithCfg(t, &Config{TrueBatch: true, PartitionHours: 24})
+	err := repo.AddBatch(eventsOverDays(3, 2))
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	// The partition for 2024-01-02 also contains events after the end time, so only the first partition is dropped
+	numDeleted, err := repo.(events.PartitionDeleter).DeletePartitionsBefore(time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("got error when deleting partitions: %v", err)
+	}
+	if numDeleted != 1 {
+		t.Fatalf("expected 1 partition to be deleted, got %v", numDeleted)
+	}
+	remaining := collectEvents(repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampDesc))
+	assertTimestampOrder(t, remaining, 4, events.SortModeTimestampDesc)
+
+	// Adding events to a dropped time range creates the partition again
+	err = repo.AddBatch(eventsOverDays(1, 1))
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	remaining = collectEvents(repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampDesc))
+	assertTimestampOrder(t, remaining, 5, events.SortModeTimestampDesc)
+}
+
+func TestPartitionedSurroundingEvents(t *testing.T) {
+	repo := createRepoWithCfg(t, &Config{TrueBatch: true, PartitionHours: 24})
+	err := repo.AddBatch(eventsOverDays(3, 2))
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	asc := collectEvents(repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampAsc))
+	evts, err := repo.GetSurroundingEvents(asc[2].Id, 4)
+	if err != nil {
+		t.Fatalf("got error when getting surrounding events: %v", err)
+	}
+	// The surrounding events are sorted by descending offset, and the events are spread over all three partitions
+	expected := []int64{asc[4].Id, asc[3].Id, asc[2].Id, asc[1].Id}
+	if len(evts) != len(expected) {
+		t.Fatalf("expected %v surrounding events, got %v", len(expected), evts)
+	}
+	for i, evt := range evts {
+		if evt.Id != expected[i] {
+			t.Fatalf("expected surrounding events with ids=%v, got %v", expected, evts)
+		}
+	}
+}
+
+func TestPartitioningKeepsUnpartitionedEvents(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "logsuck.db")
+	db, err := sql.Open("sqlite3", "file:"+fileName)
+	if err != nil {
+		t.Fatalf("got error when opening database: %v", err)
+	}
+	defer db.Close()
+	err = sqlite_common.Migrate(db, slog.Default(), Migrations)
+	if err != nil {
+		t.Fatalf("got error when migrating database: %v", err)
+	}
+	unpartitioned := createRepoWithDb(t, db, &Config{TrueBatch: true})
+	// Every other hour on 2024-01-01 is added before partitioning is enabled
+	legacyEvts := eventsOverDays(1, 12)
+	for i := range legacyEvts {
+		legacyEvts[i].Timestamp = legacyEvts[i].Timestamp.Add(time.Duration(i) * time.Hour)
+	}
+	err = unpartitioned.AddBatch(legacyEvts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	repo := createRepoWithDb(t, db, &Config{TrueBatch: true, PartitionHours: 1})
+	// The events which were added before partitioning was enabled are not added again
+	err = repo.AddBatch(legacyEvts[:2])
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	newEvts := eventsOverDays(1, 12)
+	for i := range newEvts {
+		newEvts[i].Timestamp = newEvts[i].Timestamp.Add(time.Duration(i)*time.Hour + 30*time.Minute)
+		newEvts[i].Source = "new.txt"
+	}
+	err = repo.AddBatch(newEvts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	desc := collectEvents(repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampDesc))
+	assertTimestampOrder(t, desc, 24, events.SortModeTimestampDesc)
+	asc := collectEvents(repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampAsc))
+	assertTimestampOrder(t, asc, 24, events.SortModeTimestampAsc)
+
+	evts, err := repo.GetByIds([]int64{asc[0].Id}, events.SortModeNone)
+	if err != nil || len(evts) != 1 || evts[0].Source != "log.txt" {
+		t.Fatalf("expected to get the oldest unpartitioned event by ID, got evts=%v, err=%v", evts, err)
+	}
+
+	_, err = createRepoOrErrorWithDb(db, &Config{TrueBatch: true})
+	if err == nil {
+		t.Fatalf("expected an error when disabling partitioning for a database with partitions")
+	}
+}
+
+// eventsOverDays creates eventsPerDay events on each of the first days of January 2024, with increasing offsets.
+func TestPartitionedGetIndexedFields(t *testing.T) {
+	repo := createRepoWithCfg(t, &Config{TrueBatch: true, PartitionHours: 24})
+	evts := eventsOverDays(3, 1)
+	for i := range evts {
+		evts[i].IndexedFields = map[string]string{"day": strconv.Itoa(i)}
+		evts[i].IndexedFieldsVersion = "v1"
+	}
+	err := repo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	all := collectEvents(repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampAsc))
+	ids := []int64{all[0].Id, all[2].Id}
+	stored, err := repo.(events.IndexedFieldReader).GetIndexedFields(ids)
+	if err != nil {
+		t.Fatalf("got error when getting indexed fields: %v", err)
+	}
+	expected := map[int64]events.StoredFields{
+		ids[0]: {Version: "v1", Fields: map[string]string{"day": "0"}},
+		ids[1]: {Version: "v1", Fields: map[string]string{"day": "2"}},
+	}
+	if !reflect.DeepEqual(stored, expected) {
+		t.Fatalf("got unexpected indexed fields, expected=%v, got=%v", expected, stored)
+	}
+}
+
+func eventsOverDays(days int, eventsPerDay int) []events.Event {
+	ret := make([]events.Event, 0, days*eventsPerDay)
+	for d := 0; d < days; d++ {
+		for i := 0; i < eventsPerDay; i++ {
+			ret = append(ret, events.Event{
+				Raw:       "event",
+				Timestamp: time.Date(2024, 1, 1+d, 0, i, 0, 0, time.UTC),
+				Host:      "localhost",
+				Source:    "log.txt",
+				Offset:    int64(len(ret)),
+			})
+		}
+	}
+	return ret
+}
+
+func collectEvents(c <-chan []events.EventWithId) []events.EventWithId {
+	ret := []events.EventWithId{}
+	for evts := range c {
+		ret = append(ret, evts...)
+	}
+	return ret
+}
+
+func assertTimestampOrder(t *testing.T, evts []events.EventWithId, expectedLen int, sortMode events.SortMode) {
+	if len(evts) != expectedLen {
+		t.Fatalf("expected %v events, got %v", expectedLen, len(evts))
+	}
+	seen := map[int64]struct{}{}
+	for i, evt := range evts {
+		if _, ok := seen[evt.Id]; ok {
+			t.Fatalf("got duplicate event with id=%v", evt.Id)
+		}
+		seen[evt.Id] = struct{}{}
+		if i > 0 && !comesBefore(evts[i-1], evt, sortMode) {
+			t.Fatalf("expected events to be sorted with sortMode=%v, but event %v with timestamp=%v came after timestamp=%v", sortMode, i, evt.Timestamp, evts[i-1].Timestamp)
+		}
+	}
+}
+
+func createRepoWithDb(t testing.TB, db *sql.DB, cfg *Config) events.Repository {
+	repo, err := createRepoOrErrorWithDb(db, cfg)
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+	return repo
+}
+
+func createRepoOrErrorWithDb(db *sql.DB, cfg *Config) (events.Repository, error) {
+	return NewSqliteEventRepository(SqliteEventRepositoryParams{
+		Db:     db,
+		Cfg:    cfg,
+		Logger: slog.Default(),
+	})
+}
@@ -0,0 +1,166 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_events
+
+import (
+	"strings"
+)
+
+// queryBuilder builds an SQL statement where all values are passed as bound parameters instead of being part of the statement.
+type queryBuilder struct {
+	conditions []string
+	args       []any
+}
+
+// where adds a condition to the statement. The condition must use ? placeholders for all values, and args must contain one value per
+// placeholder.
+func (qb *queryBuilder) where(condition string, args ...any) {
+	qb.conditions = append(qb.conditions, condition)
+	qb.args = append(qb.args, args...)
+}
+
+// build returns the statement and its parameters. The conditions are combined using AND and placed between selectFrom and suffix.
+func (qb *queryBuilder) build(selectFrom string, suffix string) (string, []any) {
+	stmt := selectFrom
+	if len(qb.conditions) > 0 {
+		stmt += " WHERE " + strings.Join(qb.conditions, " AND ")
+	}
+	return stmt + suffix, qb.args
+}
+
+// ftsDialect converts values from searches to terms in the query syntax of the full-text search module used by the EventRaws table.
+// The terms must never cause events which match the search to be excluded. If the terms can match events which do not match the search,
+// exact must return false so that FilterStream checks the results before returning them.
+type ftsDialect interface {
+	// includeTerm returns a term which all events where the column matches value will match, or false if no such term can be created.
+	includeTerm(column, value string) (string, bool)
+	// excludeTerm returns a term which only events where the column matches value will match, or false if no such term can be created.
+	excludeTerm(column, value string) (string, bool)
+	// exact returns true if the terms created by includeTerm match exactly the events where the column matches the value.
+	exact() bool
+}
+
+// fts4Dialect creates terms using the FTS4 enhanced query syntax for a table using the simple tokenizer.
+type fts4Dialect struct{}
+
+func (fts4Dialect) includeTerm(column, value string) (string, bool) {
+	return ftsTerm(column, value)
+}
+
+func (fts4Dialect) excludeTerm(column, value string) (string, bool) {
+	return ftsTerm(column, value)
+}
+
+func (fts4Dialect) exact() bool {
+	return true
+}
+
+// ftsQuery builds a query for the EventRaws table.
+// Values are converted to terms using the dialect, so quotes and operators like OR, NOT and NEAR in the values are never interpreted as
+// query syntax.
+type ftsQuery struct {
+	dialect ftsDialect
+	// table is the name of the EventRaws table which is queried
+	table string
+	// external is true if the EventRaws table is not joined with the events, which is the case when the raw events are stored in blocks
+	external bool
+	includes []string
+	nots     []string
+	// ignored is true if a value could not be converted to a term
+	ignored bool
+}
+
+// include adds a term which the column must match. Values which can not be converted to a term are ignored.
+func (q *ftsQuery) include(column, value string) {
+	if term, ok := q.dialect.includeTerm(column, value); ok {
+		q.includes = append(q.includes, term)
+	} else {
+		q.ignored = true
+	}
+}
+
+// exclude adds a term which the column must not match. Values which can not be converted to a term are ignored.
+func (q *ftsQuery) exclude(column, value string) {
+	if term, ok := q.dialect.excludeTerm(column, value); ok {
+		q.nots = append(q.nots, term)
+	} else {
+		q.ignored = true
+	}
+}
+
+// exact returns true if the query matches exactly the events matching the values added to it, which means that the results do not need
+// to be checked before they are returned.
+func (q *ftsQuery) exact() bool {
+	return q.dialect.exact() && !q.ignored
+}
+
+func (q *ftsQuery) addTo(qb *queryBuilder) {
+	if len(q.includes) > 0 {
+		// FTS5 only allows implicit AND between phrases, so AND is written out since terms can be parenthesized expressions
+		match := strings.Join(q.includes, " AND ")
+		for _, n := range q.nots {
+			match += " NOT " + n
+		}
+		if q.external {
+			qb.where("e.id IN (SELECT rowid FROM "+q.table+" WHERE "+q.table+" MATCH ?)", match)
+		} else {
+			qb.where(q.table+" MATCH ?", match)
+		}
+	} else if len(q.nots) > 0 {
+		// The NOT operator requires a left hand side, so a subquery is used when there is nothing to include
+		qb.where("e.id NOT IN (SELECT rowid FROM "+q.table+" WHERE "+q.table+" MATCH ?)", strings.Join(q.nots, " OR "))
+	}
+}
+
+// ftsTerm converts a value from a search to a term matching the value in the given column, for example "Hello, world*" becomes
+// raw:hello-world*. The value is split into tokens in the same way as the simple tokenizer does it, and the tokens are joined with
+// hyphens which makes them a phrase. A * at the end of the value makes the last token a prefix token, any other characters are dropped.
+// Returns false if the value does not contain any tokens, or if it contains a * anywhere but at the end. A * at the start of a token
+// would need a suffix query, and a * within a phrase would need to match any number of tokens, which the full-text index cannot do.
+func ftsTerm(column, value string) (string, bool) {
+	if i := strings.IndexByte(value, '*'); i != -1 && i != len(value)-1 {
+		return "", false
+	}
+	var sb strings.Builder
+	sb.WriteString(column)
+	sb.WriteByte(':')
+	hasTokens := false
+	inToken := false
+	for _, r := range value {
+		if isFtsTokenRune(r) {
+			if !inToken && hasTokens {
+				sb.WriteByte('-')
+			}
+			if r >= 'A' && r <= 'Z' {
+				// Lowercasing here is not only for consistency with the tokenizer, it also makes sure operators like OR are treated as text
+				r += 'a' - 'A'
+			}
+			sb.WriteRune(r)
+			hasTokens = true
+			inToken = true
+			continue
+		}
+		if r == '*' && inToken {
+			sb.WriteByte('*')
+		}
+		inToken = false
+	}
+	return sb.String(), hasTokens
+}
+
+// isFtsTokenRune returns true if the simple tokenizer considers r to be part of a token.
+func isFtsTokenRune(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r >= 0x80
+}
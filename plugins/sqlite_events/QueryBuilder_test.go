@@ -0,0 +1,113 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_events
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/parser"
+)
+
+var ftsTermTests = []struct {
+	value    string
+	expected string
+	ok       bool
+}{
+	{"hello", "raw:hello", true},
+	{"Hello, World*", "raw:hello-world*", true},
+	{"\"quoted\"", "raw:quoted", true},
+	{"it's", "raw:it-s", true},
+	{"OR", "raw:or", true},
+	{"NEAR/2", "raw:near-2", true},
+	{"-excluded", "raw:excluded", true},
+	{"*access*", "", false},
+	{"a*b", "", false},
+	{"*Exception", "", false},
+	{"foo*bar", "", false},
+	{"*Pointer*", "", false},
+	{"héllo", "raw:héllo", true},
+	{"***", "", false},
+	{"' OR 1=1 --", "raw:or-1-1", true},
+}
+
+func TestFtsTerm(t *testing.T) {
+	for _, tt := range ftsTermTests {
+		term, ok := ftsTerm("raw", tt.value)
+		if ok != tt.ok {
+			t.Fatalf("got unexpected ok for value=%v, expected=%v, got=%v", tt.value, tt.ok, ok)
+		}
+		if ok && term != tt.expected {
+			t.Fatalf("got unexpected term for value=%v, expected=%v, got=%v", tt.value, tt.expected, term)
+		}
+	}
+}
+
+func FuzzFilterStreamStatement(f *testing.F) {
+	for _, s := range []string{
+		"hello",
+		"don't",
+		"\"it's ok\"",
+		"NOT bye",
+		"a OR b NEAR/3 c",
+		"x=y'z",
+		"source=*'* host=\"a\\\"b\"",
+		"userid IN (1, *2, '3')",
+		"NOT \"a -b\" x!=\"%_\\\\\"",
+		"*",
+	} {
+		f.Add(s)
+	}
+	repos := []*sqliteEventRepository{createRepo(f).(*sqliteEventRepository)}
+	if fts5Repo, err := createRepoOrError(&Config{TrueBatch: true, FullTextSearch: FullTextSearchFts5}); err == nil {
+		repos = append(repos, fts5Repo.(*sqliteEventRepository))
+	}
+	for _, repo := range repos {
+		err := repo.AddBatch([]events.Event{
+			{
+				Raw:       "2021-02-01 00:00:00 hello don't x=y'z",
+				Timestamp: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC),
+				Host:      "localhost",
+				Source:    "log.txt",
+				Offset:    0,
+			},
+		})
+		if err != nil {
+			f.Fatalf("got error when adding events: %v", err)
+		}
+	}
+	f.Fuzz(func(t *testing.T, searchString string) {
+		srch, err := parser.Parse(searchString)
+		if err != nil {
+			return
+		}
+		startTime := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+		for _, repo := range repos {
+			stmt, args := repo.buildFilterStreamStatement(srch, &startTime, nil, 1, events.SortModeTimestampDesc, &filterStreamCursor{timestamp: startTime, id: 1})
+			res, err := repo.db.Query(stmt, args...)
+			if err != nil {
+				t.Fatalf("got error when executing statement for searchString=%q, stmt=%v, args=%v: %v", searchString, stmt, args, err)
+			}
+			for res.Next() {
+			}
+			err = res.Err()
+			res.Close()
+			if err != nil {
+				t.Fatalf("got error when reading results for searchString=%q, stmt=%v, args=%v: %v", searchString, stmt, args, err)
+			}
+		}
+	})
+}
@@ -17,6 +17,7 @@ package sqlite_events
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog"
 	"sort"
@@ -32,7 +33,8 @@ import (
 
 // It might be more correct to use source_id + offset for deduplication, but this works poorly in single mode / while developing since
 // a new source ID is generated for all existing files on each restart.
-const expectedConstraintViolationForDuplicates = "UNIQUE constraint failed: Events.host, Events.source, Events.timestamp, Events.offset"
+const expectedConstraintViolationForDuplicates = "UNIQUE constraint failed: %[1]v.host, %[1]v.source, %[1]v.timestamp, %[1]v.offset"
+const expectedConstraintViolationForContentHashDuplicates = "UNIQUE constraint failed: %v.content_hash"
 const expectedErrorWhenDatabaseIsEmpty = "sql: Scan error on column index 0, name \"MAX(id)\": converting NULL to int is unsupported"
 const filterStreamPageSize = 1000
 
@@ -41,66 +43,414 @@ type sqliteEventRepository struct {
 
 	cfg *Config
 
-	logger *slog.Logger
+	dialect ftsDialect
+	layout  rawsLayout
+	tables  eventTables
+	// keys are the keys used to encrypt the raw events, or nil if encryption is disabled
+	keys *keyring
+
+	metrics *events.IngestionMetrics
+	logger  *slog.Logger
 }
 
 type SqliteEventRepositoryParams struct {
 	dig.In
 
-	Db     *sql.DB
-	Cfg    *Config
-	Logger *slog.Logger
+	Db      *sql.DB
+	Cfg     *Config
+	Metrics *events.IngestionMetrics `optional:"true"`
+	Logger  *slog.Logger
 }
 
+// NewSqliteEventRepository creates a repository using the tables created by Migrations, which must have been applied to the database.
 func NewSqliteEventRepository(p SqliteEventRepositoryParams) (events.Repository, error) {
-	_, err := p.Db.Exec("CREATE TABLE IF NOT EXISTS Events (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, host TEXT NOT NULL, source TEXT NOT NULL, source_id TEXT NOT NULL, timestamp DATETIME NOT NULL, offset BIGINT NOT NULL, UNIQUE(host, source, timestamp, offset));")
+	switch p.Cfg.Dedup {
+	case DedupKey, "", DedupContentHash:
+	default:
+		return nil, fmt.Errorf("unknown dedup=%v, expected %v or %v", p.Cfg.Dedup, DedupKey, DedupContentHash)
+	}
+	keys, err := loadKeyring(p.Cfg.Encryption)
+	if err != nil {
+		return nil, fmt.Errorf("error loading encryption keys: %w", err)
+	}
+	layout, dialect, err := configuredRawsLayout(p.Cfg, keys)
 	if err != nil {
-		return nil, fmt.Errorf("error creating events table: %w", err)
+		return nil, err
+	}
+	err = createEventRawsTable(p.Db, defaultEventTables, layout, keys, p.Logger)
+	if err != nil {
+		return nil, err
+	}
+	err = checkBlockKeys(p.Db, defaultEventTables.blocks, keys)
+	if err != nil {
+		return nil, err
 	}
-	_, err = p.Db.Exec("CREATE INDEX IF NOT EXISTS IX_Events_Timestamp ON Events(timestamp);")
+	repo := &sqliteEventRepository{
+		db:      p.Db,
+		cfg:     p.Cfg,
+		dialect: dialect,
+		layout:  layout,
+		tables:  defaultEventTables,
+		keys:    keys,
+		metrics: p.Metrics,
+		logger:  p.Logger,
+	}
+	if p.Cfg.PartitionHours > 0 {
+		return newPartitionedEventRepository(repo)
+	}
+	err = checkNotPartitioned(p.Db)
 	if err != nil {
-		return nil, fmt.Errorf("error creating events timestamp index: %w", err)
+		return nil, err
+	}
+	return repo, nil
+}
+
+// eventTables are the names of the tables containing a set of events. Unpartitioned repositories use Events, EventRaws, EventFields,
+// EventBlocks and EventRawsContent, while each partition of a partitioned repository has its own tables.
+type eventTables struct {
+	events string
+	raws   string
+	fields string
+	blocks string
+	// rawsContent is the content table of the EventRaws table when the raw events are stored in blocks, see deleteBlockRaws. It can not
+	// be named EventRaws_content since that is the name of the table where FTS4 and FTS5 store the content of tables which are not
+	// external content tables.
+	rawsContent string
+}
+
+var defaultEventTables = eventTables{
+	events:      "Events",
+	raws:        "EventRaws",
+	fields:      "EventFields",
+	blocks:      "EventBlocks",
+	rawsContent: "EventRawsContent",
+}
+
+// rawsLayout describes how the raw events are stored.
+type rawsLayout struct {
+	// fullTextSearch is the full-text search module used for the EventRaws table
+	fullTextSearch string
+	// blocks is true if the raw events are stored in compressed blocks in the EventBlocks table, in which case the EventRaws table is an
+	// external content table which only contains the full-text index
+	blocks bool
+	// blindIndexKeyId is the ID of the index key used to create the blind tokens in the full-text index if the raw events are encrypted,
+	// see Encryption.go. It is empty if the raw events are not encrypted.
+	blindIndexKeyId string
+}
+
+func (l rawsLayout) encrypted() bool {
+	return l.blindIndexKeyId != ""
+}
+
+func (l rawsLayout) String() string {
+	if l.encrypted() {
+		return l.fullTextSearch + " with encrypted blocks"
+	}
+	if l.blocks {
+		return l.fullTextSearch + " with compressed blocks"
+	}
+	return l.fullTextSearch
+}
+
+// configuredRawsLayout returns the layout of the raw events described by the configuration and the dialect used to query the full-text
+// index. keys are the encryption keys loaded from the configuration, or nil if encryption is disabled.
+func configuredRawsLayout(cfg *Config, keys *keyring) (rawsLayout, ftsDialect, error) {
+	var ret rawsLayout
+	var dialect ftsDialect
+	switch cfg.FullTextSearch {
+	case FullTextSearchFts4, "":
+		ret.fullTextSearch = FullTextSearchFts4
+		dialect = fts4Dialect{}
+	case FullTextSearchFts5:
+		ret.fullTextSearch = FullTextSearchFts5
+		dialect = fts5TrigramDialect{}
+	default:
+		return ret, nil, fmt.Errorf("unknown fullTextSearch=%v, expected %v or %v", cfg.FullTextSearch, FullTextSearchFts4, FullTextSearchFts5)
+	}
+	switch cfg.Compression {
+	case CompressionNone, "":
+	case CompressionFlate:
+		ret.blocks = true
+	default:
+		return ret, nil, fmt.Errorf("unknown compression=%v, expected %v or %v", cfg.Compression, CompressionNone, CompressionFlate)
+	}
+	if keys != nil {
+		if ret.fullTextSearch != FullTextSearchFts4 {
+			// The blind tokens are whole words, so the trigram tokenizer would not add anything except a larger index
+			return ret, nil, fmt.Errorf("encryption requires fullTextSearch=%v, but fullTextSearch=%v is configured", FullTextSearchFts4, ret.fullTextSearch)
+		}
+		// Encrypted events are always stored in blocks, which are compressed before they are encrypted
+		ret.blocks = true
+		ret.blindIndexKeyId = keys.indexKeyId
+		dialect = blindDialect{keys: keys}
+	}
+	return ret, dialect, nil
+}
+
+// createEventRawsTable creates the EventRaws table using the given layout. If the table already exists but uses a different layout, the
+// events are migrated to a new table using the given layout.
+func createEventRawsTable(db *sql.DB, tables eventTables, layout rawsLayout, keys *keyring, logger *slog.Logger) error {
+	existing, exists, err := getEventRawsLayout(db, tables.raws)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		for _, stmt := range append(createEventRawsStatements(layout, tables.raws, tables.rawsContent), blindIndexStatements(layout, tables.raws)...) {
+			_, err = db.Exec(stmt)
+			if err != nil {
+				return wrapFtsError(fmt.Errorf("error creating eventraws table: %w", err))
+			}
+		}
+		return nil
+	}
+	if existing.encrypted() && !layout.encrypted() {
+		return fmt.Errorf("the events in table=%v are encrypted, but encryption is not configured. Encryption can not be disabled once events have been encrypted", tables.raws)
+	}
+	if existing.encrypted() && existing.blindIndexKeyId != layout.blindIndexKeyId {
+		return fmt.Errorf("the full-text index of table=%v was created using the index key with keyId=%v, but the configured index key has keyId=%v. The index key can not be changed",
+			tables.raws, existing.blindIndexKeyId, layout.blindIndexKeyId)
+	}
+	if existing != layout {
+		err = migrateEventRaws(db, tables, keys, existing, layout, logger)
+		if err != nil {
+			return wrapFtsError(fmt.Errorf("error migrating eventraws table from %v to %v: %w", existing, layout, err))
+		}
+	}
+	return nil
+}
+
+// createEventRawsStatements returns the statements creating an EventRaws table with the given layout. contentTable is the name of the
+// content table used when the raw events are stored in blocks. It is given separately since tables are renamed after being migrated.
+func createEventRawsStatements(layout rawsLayout, tableName string, contentTable string) []string {
+	if !layout.blocks {
+		return []string{createEventRawsStatement(layout.fullTextSearch, tableName, "")}
+	}
+	return []string{
+		"CREATE TABLE IF NOT EXISTS " + contentTable + " (raw TEXT, source TEXT, host TEXT);",
+		createEventRawsStatement(layout.fullTextSearch, tableName, ", content='"+contentTable+"'"),
+	}
+}
+
+// blindIndexStatements returns the statements recording whether the EventRaws table with the given name contains blind tokens, see
+// getEventRawsLayout.
+func blindIndexStatements(layout rawsLayout, tableName string) []string {
+	ret := []string{"DELETE FROM EventBlindIndexes WHERE table_name = '" + tableName + "';"}
+	if layout.encrypted() {
+		ret = append(ret, "INSERT INTO EventBlindIndexes (table_name, key_id) VALUES ('"+tableName+"', '"+layout.blindIndexKeyId+"');")
+	}
+	return ret
+}
+
+func createEventRawsStatement(fullTextSearch string, tableName string, options string) string {
+	if fullTextSearch == FullTextSearchFts5 {
+		// FTS5 has no equivalent to order=DESC, but FilterStream orders by Events.timestamp which is indexed, so the order of the
+		// full-text index does not matter as much as it does for FTS4.
+		return "CREATE VIRTUAL TABLE IF NOT EXISTS " + tableName + " USING fts5 (raw, source, host, tokenize='trigram'" + options + ");"
 	}
 	// It seems we have to use FTS4 instead of FTS5? - I could not find an option equivalent to order=DESC for FTS5 and order=DESC makes queries 8-9x faster...
-	_, err = p.Db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS EventRaws USING fts4 (raw TEXT, source TEXT, host TEXT, order=DESC);")
+	return "CREATE VIRTUAL TABLE IF NOT EXISTS " + tableName + " USING fts4 (raw TEXT, source TEXT, host TEXT, order=DESC" + options + ");"
+}
+
+// getEventRawsModule returns the full-text search module used by an existing EventRaws table, or an empty string if the table does not
+// exist.
+func getEventRawsModule(db *sql.DB, table string) (string, error) {
+	layout, _, err := getEventRawsLayout(db, table)
+	return layout.fullTextSearch, err
+}
+
+// getEventRawsLayout returns the layout of an existing EventRaws table, or false if the table does not exist.
+func getEventRawsLayout(db *sql.DB, table string) (rawsLayout, bool, error) {
+	var stmt string
+	err := db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?;", table).Scan(&stmt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return rawsLayout{}, false, nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("error creating eventraws table: %w", err)
+		return rawsLayout{}, false, fmt.Errorf("error getting eventraws table definition: %w", err)
 	}
-	return &sqliteEventRepository{
-		db:     p.Db,
-		cfg:    p.Cfg,
-		logger: p.Logger,
-	}, nil
+	lower := strings.ToLower(stmt)
+	ret := rawsLayout{blocks: strings.Contains(lower, "content=")}
+	if strings.Contains(lower, "using fts5") {
+		ret.fullTextSearch = FullTextSearchFts5
+	} else if strings.Contains(lower, "using fts4") {
+		ret.fullTextSearch = FullTextSearchFts4
+	} else {
+		return rawsLayout{}, false, fmt.Errorf("eventraws table has unexpected definition=%v", stmt)
+	}
+	// Whether the table contains blind tokens can not be seen from its definition, so it is recorded in a separate table
+	err = db.QueryRow("SELECT key_id FROM EventBlindIndexes WHERE table_name = ?;", table).Scan(&ret.blindIndexKeyId)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return rawsLayout{}, false, fmt.Errorf("error getting blind index of eventraws table: %w", err)
+	}
+	return ret, true, nil
+}
+
+// migrateEventRaws copies the contents of an EventRaws table to a new table using a different layout, keeping the rowids so that they
+// still match the IDs in the Events table. This rebuilds the full-text index and may take a while for large databases.
+func migrateEventRaws(db *sql.DB, tables eventTables, keys *keyring, from, to rawsLayout, logger *slog.Logger) error {
+	startTime := time.Now()
+	logger.Info("migrating eventraws table, this may take a while",
+		slog.String("table", tables.raws),
+		slog.String("from", from.String()),
+		slog.String("to", to.String()))
+	migratedTable := tables.raws + "_migrated"
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	for _, stmt := range createEventRawsStatements(to, migratedTable, tables.rawsContent) {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to create new table: %w", err)
+		}
+	}
+	var numEvents int64
+	var stats compressionStats
+	var rewroteBlocks bool
+	if !from.blocks && !to.blocks {
+		var res sql.Result
+		res, err = tx.Exec("INSERT INTO " + migratedTable + " (rowid, raw, source, host) SELECT rowid, raw, source, host FROM " + tables.raws + ";")
+		if err == nil {
+			numEvents, _ = res.RowsAffected()
+		}
+	} else {
+		numEvents, stats, rewroteBlocks, err = copyRaws(tx, tables, keys, from, to, migratedTable)
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to copy events to new table: %w", err)
+	}
+	cleanup := []string{
+		"DROP TABLE " + tables.raws + ";",
+		"ALTER TABLE " + migratedTable + " RENAME TO " + tables.raws + ";",
+	}
+	if from.blocks && !to.blocks {
+		cleanup = append(cleanup,
+			"UPDATE "+tables.events+" SET block_id = NULL, block_index = NULL;",
+			"DELETE FROM "+tables.blocks+";",
+			"DROP TABLE "+tables.rawsContent+";")
+	} else if from.blocks && rewroteBlocks {
+		cleanup = append(cleanup,
+			"DELETE FROM "+tables.blocks+" WHERE id NOT IN (SELECT block_id FROM "+tables.events+" WHERE block_id IS NOT NULL);")
+	}
+	cleanup = append(cleanup, blindIndexStatements(to, tables.raws)...)
+	for _, stmt := range cleanup {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to execute statement=%q: %w", stmt, err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	attrs := []any{
+		slog.String("table", tables.raws),
+		slog.String("from", from.String()),
+		slog.String("to", to.String()),
+		slog.Int64("numEvents", numEvents),
+		slog.Duration("duration", time.Since(startTime)),
+	}
+	if stats.compressedBytes > 0 {
+		attrs = append(attrs, slog.Float64("compressionRatio", stats.ratio()))
+	}
+	logger.Info("migrated eventraws table", attrs...)
+	return nil
+}
+
+// wrapFtsError adds a hint about the build tag if the error was caused by FTS5 not being compiled in.
+func wrapFtsError(err error) error {
+	if strings.Contains(err.Error(), "no such module: fts5") {
+		return fmt.Errorf("fullTextSearch=fts5 requires Logsuck to be built with the sqlite_fts5 build tag: %w", err)
+	}
+	return err
 }
 
 func (repo *sqliteEventRepository) AddBatch(events []events.Event) error {
-	if repo.cfg.TrueBatch {
+	if repo.layout.blocks {
+		return repo.addBatchBlocks(events)
+	} else if repo.cfg.TrueBatch {
 		return repo.addBatchTrueBatch(events)
 	} else {
 		return repo.addBatchOneByOne(events)
 	}
 }
 
-const esbBase = "INSERT OR IGNORE INTO Events (host, source, source_id, timestamp, offset) VALUES "
+// fieldsVersion returns the value of the version column for the indexed fields of the event, which is NULL if the version is unknown.
+func fieldsVersion(evt events.Event) any {
+	if evt.IndexedFieldsVersion == "" {
+		return nil
+	}
+	return evt.IndexedFieldsVersion
+}
+
+// addIndexedFieldsByKey adds the IndexedFields of the events to the EventFields table.
+// The IDs of the events are not known in true batch mode, so the events are looked up using their unique key instead.
+func addIndexedFieldsByKey(tx *sql.Tx, tables eventTables, evts []events.Event) error {
+	var stmt *sql.Stmt
+	for _, evt := range evts {
+		for k, v := range evt.IndexedFields {
+			if stmt == nil {
+				var err error
+				stmt, err = tx.Prepare("INSERT OR IGNORE INTO " + tables.fields + " (event_id, key, value, version) SELECT id, ?, ?, ? FROM " + tables.events + " WHERE host = ? AND source = ? AND timestamp = ? AND offset = ?;")
+				if err != nil {
+					return fmt.Errorf("failed to prepare statement: %w", err)
+				}
+				defer stmt.Close()
+			}
+			_, err := stmt.Exec(k, v, fieldsVersion(evt), evt.Host, evt.Source, evt.Timestamp, evt.Offset)
+			if err != nil {
+				return fmt.Errorf("failed to add field with key=%v: %w", k, err)
+			}
+		}
+	}
+	return nil
+}
+
+const esbBase = "INSERT OR IGNORE INTO %v (host, source, source_id, timestamp, offset, index_name, content_hash) VALUES "
 const esbBaseLen = len(esbBase)
-const esbPerEvt = "(?, ?, ?, ?, ?)"
+const esbPerEvt = "(?, ?, ?, ?, ?, ?, ?)"
 const esbPerEvtLen = len(esbPerEvt)
-const rsbBase = "INSERT INTO EventRaws (raw, source, host) VALUES "
+const rsbBase = "INSERT INTO %v (rowid, raw, source, host) VALUES "
 const rsbBaseLen = len(rsbBase)
-const rsbPerEvt = "(?, ?, ?)"
+const rsbPerEvt = "(?, ?, ?, ?)"
 const rsbPerEvtLen = len(rsbPerEvt)
 
+// indexName returns the name of the index the event should be stored in.
+func indexName(evt events.Event) string {
+	if evt.Index == "" {
+		return events.DefaultIndex
+	}
+	return evt.Index
+}
+
 func (repo *sqliteEventRepository) addBatchTrueBatch(events []events.Event) error {
 	startTime := time.Now()
 	var eventSb strings.Builder
 	var rawSb strings.Builder
 	eventSb.Grow(esbBaseLen + esbPerEvtLen*len(events) + len(events))
 	rawSb.Grow(rsbBaseLen + rsbPerEvtLen*len(events) + len(events))
-	eventSb.WriteString(esbBase)
-	rawSb.WriteString(rsbBase)
+	eventSb.WriteString(fmt.Sprintf(esbBase, repo.tables.events))
+	rawSb.WriteString(fmt.Sprintf(rsbBase, repo.tables.raws))
 
-	esbArgs := make([]interface{}, 0, 4*len(events))
-	rsbArgs := make([]interface{}, 0, 3*len(events))
+	tx, err := repo.db.BeginTx(context.TODO(), nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction for adding event batch: %w", err)
+	}
+	// Every row in the INSERT OR IGNORE statement uses up an ID from the AUTOINCREMENT sequence of the Events table, even if it is ignored
+	// since it is a duplicate. So the IDs of the events are known in advance, and the raw events are inserted using the same IDs. The raw
+	// events of the duplicates are removed afterwards.
+	var prevMaxID int64
+	err = tx.QueryRow("SELECT seq FROM sqlite_sequence WHERE name = ?;", repo.tables.events).Scan(&prevMaxID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		tx.Rollback()
+		return fmt.Errorf("error adding event batch: failed to get sequence of %v: %w", repo.tables.events, err)
+	}
+
+	esbArgs := make([]interface{}, 0, 7*len(events))
+	rsbArgs := make([]interface{}, 0, 4*len(events))
 	for i, evt := range events {
 		eventSb.WriteString(esbPerEvt)
 		rawSb.WriteString(rsbPerEvt)
@@ -108,23 +458,10 @@ func (repo *sqliteEventRepository) addBatchTrueBatch(events []events.Event) erro
 			eventSb.WriteRune(',')
 			rawSb.WriteRune(',')
 		}
-		esbArgs = append(esbArgs, evt.Host, evt.Source, evt.SourceId, evt.Timestamp, evt.Offset)
-		rsbArgs = append(rsbArgs, evt.Raw, evt.Source, evt.Host)
+		esbArgs = append(esbArgs, evt.Host, evt.Source, evt.SourceId, evt.Timestamp, evt.Offset, indexName(evt), repo.contentHashOf(evt))
+		rsbArgs = append(rsbArgs, prevMaxID+int64(i)+1, evt.Raw, evt.Source, evt.Host)
 	}
 
-	tx, err := repo.db.BeginTx(context.TODO(), nil)
-	if err != nil {
-		return fmt.Errorf("error starting transaction for adding event batch: %w", err)
-	}
-	rows, err := tx.Query("SELECT MAX(rowid) FROM EventRaws;")
-	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("error adding event batch: failed to get MAX(rowid): %w", err)
-	}
-	prevMaxID := 0
-	if rows.Next() {
-		rows.Scan(&prevMaxID)
-	}
 	eventQ := eventSb.String()
 	_, err = tx.Exec(eventQ, esbArgs...)
 	if err != nil {
@@ -132,46 +469,107 @@ func (repo *sqliteEventRepository) addBatchTrueBatch(events []events.Event) erro
 		return fmt.Errorf("error adding event batch to Events table: %w", err)
 	}
 	rawQ := rawSb.String()
-	res, err := tx.Exec(rawQ, rsbArgs...)
+	_, err = tx.Exec(rawQ, rsbArgs...)
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("error adding event batch to EventRaws table: %w", err)
 	}
-	newMaxID, err := res.LastInsertId()
+	newMaxID := prevMaxID + int64(len(events))
+	orphanedRaws := " FROM " + repo.tables.raws + " AS er WHERE NOT EXISTS (SELECT 1 FROM " + repo.tables.events + " e WHERE e.ID = er.rowid) AND er.rowid > ? AND er.rowid <= ?"
+	duplicates, err := countBySource(tx, "SELECT host, source, COUNT(1)"+orphanedRaws+" GROUP BY host, source", prevMaxID, newMaxID)
 	if err != nil {
-		repo.logger.Error("got error when getting new max ID to clean up EventRaws", slog.Any("error", err))
-	} else {
-		res, err = tx.Exec("DELETE FROM EventRaws AS er WHERE NOT EXISTS (SELECT 1 FROM Events e WHERE e.ID = er.rowid) AND er.rowid > ? AND er.rowid <= ? AND er.rowid != (SELECT MAX(ID) FROM Events)", prevMaxID, newMaxID)
-		if err != nil {
-			repo.logger.Error("got error when cleaning up EventRaws", slog.Any("error", err))
-		} else if deleted, err := res.RowsAffected(); err == nil && deleted > 0 {
-			repo.logger.Info("Skipped adding events as they appear to be duplicates (same source, offset and timestamp as an existing event)",
-				slog.Int64("numEvents", deleted))
-		}
+		repo.logger.Error("got error when counting duplicates", slog.Any("error", err))
+	}
+	var deleted int64
+	res, err := tx.Exec("DELETE"+orphanedRaws, prevMaxID, newMaxID)
+	if err != nil {
+		repo.logger.Error("got error when cleaning up EventRaws", slog.Any("error", err))
+	} else if n, err := res.RowsAffected(); err == nil {
+		deleted = n
+	}
+	err = addIndexedFieldsByKey(tx, repo.tables, events)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error adding event batch to EventFields table: %w", err)
 	}
 	err = tx.Commit()
 	if err != nil {
-		// TODO: Hmm?
+		return fmt.Errorf("error committing event batch: %w", err)
+	}
+	// The duplicates are only known to have been skipped once the batch has been committed
+	if deleted > 0 {
+		repo.logger.Info("Skipped adding events as they appear to be duplicates ("+repo.duplicateReason()+")",
+			slog.Int64("numEvents", deleted))
 	}
+	repo.recordCounts(events, duplicates)
 	repo.logger.Info("added events",
 		slog.Int("numEvents", len(events)),
 		slog.Duration("duration", time.Since(startTime)))
 	return nil
 }
 
-func (repo *sqliteEventRepository) addBatchOneByOne(events []events.Event) error {
+// sourceCount is the number of events from a source.
+type sourceCount struct {
+	host   string
+	source string
+	count  int64
+}
+
+// countBySource runs a query returning the host, source and number of events, such as the events skipped in a batch.
+func countBySource(tx *sql.Tx, query string, args ...any) ([]sourceCount, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []sourceCount{}
+	for rows.Next() {
+		var sc sourceCount
+		err = rows.Scan(&sc.host, &sc.source, &sc.count)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, sc)
+	}
+	return ret, rows.Err()
+}
+
+// recordCounts records a batch of events in the ingestion metrics when only the number of duplicates from each source is known.
+func (repo *sqliteEventRepository) recordCounts(evts []events.Event, duplicates []sourceCount) {
+	if repo.metrics == nil {
+		return
+	}
+	added := map[[2]string]int64{}
+	for _, evt := range evts {
+		added[[2]string{evt.Host, evt.Source}]++
+	}
+	for _, d := range duplicates {
+		k := [2]string{d.host, d.source}
+		repo.metrics.Record(d.host, d.source, added[k]-d.count, d.count)
+		delete(added, k)
+	}
+	for k, n := range added {
+		repo.metrics.Record(k[0], k[1], n, 0)
+	}
+}
+
+func (repo *sqliteEventRepository) addBatchOneByOne(evts []events.Event) error {
 	startTime := time.Now()
-	ret := make([]int64, len(events))
+	ret := make([]int64, len(evts))
 	tx, err := repo.db.BeginTx(context.TODO(), nil)
 	if err != nil {
 		return fmt.Errorf("error starting transaction for adding event: %w", err)
 	}
 	numberOfDuplicates := map[string]int64{}
-	for i, evt := range events {
-		res, err := tx.Exec("INSERT INTO Events(host, source, source_id, timestamp, offset) VALUES(?, ?, ?, ?, ?);", evt.Host, evt.Source, evt.SourceId, evt.Timestamp, evt.Offset)
+	duplicates := []events.Event{}
+	expectedErrorForDuplicates := fmt.Sprintf(expectedConstraintViolationForDuplicates, repo.tables.events)
+	expectedErrorForContentHashDuplicates := fmt.Sprintf(expectedConstraintViolationForContentHashDuplicates, repo.tables.events)
+	for i, evt := range evts {
+		res, err := tx.Exec("INSERT INTO "+repo.tables.events+"(host, source, source_id, timestamp, offset, index_name, content_hash) VALUES(?, ?, ?, ?, ?, ?, ?);", evt.Host, evt.Source, evt.SourceId, evt.Timestamp, evt.Offset, indexName(evt), repo.contentHashOf(evt))
 		// Surely this can't be the right way to check for this error...
-		if err != nil && err.Error() == expectedConstraintViolationForDuplicates {
+		if err != nil && (err.Error() == expectedErrorForDuplicates || err.Error() == expectedErrorForContentHashDuplicates) {
 			numberOfDuplicates[evt.Source]++
+			duplicates = append(duplicates, evt)
 			continue
 		}
 		if err != nil {
@@ -183,32 +581,41 @@ func (repo *sqliteEventRepository) addBatchOneByOne(events []events.Event) error
 			tx.Rollback()
 			return fmt.Errorf("error getting event id after insert: %w", err)
 		}
-		_, err = tx.Exec("INSERT INTO EventRaws (rowid, raw, source, host) SELECT LAST_INSERT_ROWID(), ?, ?, ?;", evt.Raw, evt.Source, evt.Host)
+		_, err = tx.Exec("INSERT INTO "+repo.tables.raws+" (rowid, raw, source, host) SELECT LAST_INSERT_ROWID(), ?, ?, ?;", evt.Raw, evt.Source, evt.Host)
 		if err != nil {
 			tx.Rollback()
 			return fmt.Errorf("error executing add raw statement: %w", err)
 		}
+		for k, v := range evt.IndexedFields {
+			_, err = tx.Exec("INSERT INTO "+repo.tables.fields+" (event_id, key, value, version) VALUES (?, ?, ?, ?);", id, k, v, fieldsVersion(evt))
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("error executing add field statement: %w", err)
+			}
+		}
 		ret[i] = id
 	}
 	err = tx.Commit()
 	if err != nil {
-		// TODO: Hmm?
+		return fmt.Errorf("error committing event batch: %w", err)
 	}
+	repo.metrics.RecordBatch(evts, duplicates)
 	for k, v := range numberOfDuplicates {
-		repo.logger.Info("Skipped adding events because they appear to be duplicates (same source, offset and timestamp as an existing event)",
+		repo.logger.Info("Skipped adding events because they appear to be duplicates ("+repo.duplicateReason()+")",
 			slog.Int64("numEvents", v), slog.String("source", k))
 	}
 	repo.logger.Info("added events",
-		slog.Int("numEvents", len(events)),
+		slog.Int("numEvents", len(evts)),
 		slog.Duration("duration", time.Since(startTime)))
 	return nil
 }
 
-var delSbBase = "DELETE FROM Events WHERE ID IN ("
+var delSbBase = "DELETE FROM %v WHERE ID IN ("
 var delSbBaseLen = len(delSbBase)
-var delRawSbBase = "DELETE FROM EventRaws WHERE rowid IN ("
+var delRawSbBase = "DELETE FROM %v WHERE rowid IN ("
 var delRawSbBaseLen = len(delRawSbBase)
 var delSbPerEvtLen = 3 // "?, " except for the last one which is just ?. So the buffer ends up being two bytes too large.
+var delFieldsSbBase = "DELETE FROM %v WHERE event_id IN ("
 var delSbSuffix = ")"
 var delSbSuffixLen = len(delSbSuffix)
 
@@ -218,23 +625,29 @@ func (repo *sqliteEventRepository) DeleteBatch(ids []int64) error {
 	}
 	var sb strings.Builder
 	var rsb strings.Builder
+	var fsb strings.Builder
 	sb.Grow(delSbBaseLen + len(ids)*delSbPerEvtLen + delSbSuffixLen)
 	rsb.Grow(delRawSbBaseLen + len(ids)*delSbPerEvtLen + delSbSuffixLen)
-	sb.WriteString(delSbBase)
-	rsb.WriteString(delRawSbBase)
+	sb.WriteString(fmt.Sprintf(delSbBase, repo.tables.events))
+	rsb.WriteString(fmt.Sprintf(delRawSbBase, repo.tables.raws))
+	fsb.WriteString(fmt.Sprintf(delFieldsSbBase, repo.tables.fields))
 	for i := range ids {
 		if i != len(ids)-1 {
 			sb.WriteString("?, ")
 			rsb.WriteString("?, ")
+			fsb.WriteString("?, ")
 		} else {
 			sb.WriteString("?")
 			rsb.WriteString("?")
+			fsb.WriteString("?")
 		}
 	}
 	sb.WriteString(delSbSuffix)
 	rsb.WriteString(delSbSuffix)
+	fsb.WriteString(delSbSuffix)
 	deleteQuery := sb.String()
 	deleteRawQuery := rsb.String()
+	deleteFieldsQuery := fsb.String()
 
 	// yuck
 	args := make([]interface{}, len(ids))
@@ -247,15 +660,37 @@ func (repo *sqliteEventRepository) DeleteBatch(ids []int64) error {
 		return fmt.Errorf("failed to start transaction when deleting numIds=%v: %w", len(ids), err)
 	}
 
+	var blockIds []any
+	if repo.layout.blocks {
+		// The raw events are read from the blocks to remove them from the full-text index, so this must be done before the events are
+		// deleted
+		blockIds, err = repo.deleteBlockRaws(tx, args)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to delete numIds=%v from EventRaws table: %w", len(ids), err)
+		}
+	}
 	_, err = tx.Exec(deleteQuery, args...)
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("failed to delete numIds=%v from Events table: %w", len(ids), err)
 	}
-	_, err = tx.Exec(deleteRawQuery, args...)
+	if !repo.layout.blocks {
+		_, err = tx.Exec(deleteRawQuery, args...)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to delete numIds=%v from EventRaws table: %w", len(ids), err)
+		}
+	}
+	_, err = tx.Exec(deleteFieldsQuery, args...)
 	if err != nil {
 		tx.Rollback()
-		return fmt.Errorf("failed to delete numIds=%v from EventRaws table: %w", len(ids), err)
+		return fmt.Errorf("failed to delete numIds=%v from EventFields table: %w", len(ids), err)
+	}
+	err = repo.deleteUnusedBlocks(tx, blockIds)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete blocks of numIds=%v: %w", len(ids), err)
 	}
 	err = tx.Commit()
 	if err != nil {
@@ -265,12 +700,12 @@ func (repo *sqliteEventRepository) DeleteBatch(ids []int64) error {
 	return nil
 }
 
-func (repo *sqliteEventRepository) FilterStream(srch *search.Search, searchStartTime, searchEndTime *time.Time) <-chan []events.EventWithId {
+func (repo *sqliteEventRepository) FilterStream(srch *search.Search, searchStartTime, searchEndTime *time.Time, sortMode events.SortMode) <-chan []events.EventWithId {
 	startTime := time.Now()
 	ret := make(chan []events.EventWithId)
 	go func() {
 		defer close(ret)
-		res, err := repo.db.Query("SELECT MAX(id) FROM Events;")
+		res, err := repo.db.Query("SELECT MAX(id) FROM " + repo.tables.events + ";")
 		if err != nil {
 			repo.logger.Error("error when getting max(id) from Events table in FilterStream", slog.Any("error", err))
 			return
@@ -290,87 +725,44 @@ func (repo *sqliteEventRepository) FilterStream(srch *search.Search, searchStart
 			repo.logger.Error("error when scanning max(id) in FilterStream", slog.Any("error", err))
 			return
 		}
-		var lastTimestamp string
+		var matcher *search.Matcher
+		if fq := repo.ftsQuery(srch); !fq.exact() {
+			matcher = search.NewMatcher(srch)
+		}
+		var cursor *filterStreamCursor
 		for {
-			stmt := "SELECT e.id, e.host, e.source, e.source_id, e.timestamp, r.raw FROM Events e INNER JOIN EventRaws r ON r.rowid = e.id WHERE e.id <= " + strconv.Itoa(maxID)
-			if searchStartTime != nil {
-				stmt += " AND e.timestamp >= '" + searchStartTime.String() + "'"
-			}
-			if searchEndTime != nil {
-				stmt += " AND e.timestamp <= '" + searchEndTime.String() + "'"
-			}
-			if lastTimestamp != "" {
-				stmt += " AND e.timestamp < '" + lastTimestamp + "'"
-			}
-			includes := map[string][]string{}
-			nots := map[string][]string{}
-			hostIncludes := make([]string, 0, len(srch.Hosts))
-			for h := range srch.Hosts {
-				hostIncludes = append(hostIncludes, h)
-			}
-			includes["host"] = hostIncludes
-			hostNots := make([]string, 0, len(srch.NotHosts))
-			for h := range srch.NotHosts {
-				hostNots = append(hostNots, h)
-			}
-			nots["host"] = hostNots
-			sourceIncludes := make([]string, 0, len(srch.Sources))
-			for s := range srch.Sources {
-				sourceIncludes = append(sourceIncludes, s)
-			}
-			includes["source"] = sourceIncludes
-			sourceNots := make([]string, 0, len(srch.NotSources))
-			for s := range srch.NotSources {
-				sourceNots = append(sourceNots, s)
-			}
-			nots["source"] = sourceNots
-			rawIncludes := make([]string, 0, len(srch.Fragments))
-			for f := range srch.Fragments {
-				rawIncludes = append(rawIncludes, f)
-			}
-			includes["raw"] = rawIncludes
-			rawNots := make([]string, 0, len(srch.NotFragments))
-			for f := range srch.NotFragments {
-				rawNots = append(rawNots, f)
-			}
-			nots["raw"] = rawNots
-
-			matchString := ""
-			for k, v := range includes {
-				for _, s := range v {
-					matchString += k + ":" + s + " "
-				}
-			}
-			for k, v := range nots {
-				for _, s := range v {
-					matchString += "NOT " + k + ":" + s + " "
-				}
-			}
-
-			if len(matchString) > 0 {
-				stmt += " AND EventRaws MATCH '" + matchString + "'"
-			}
-			stmt += " ORDER BY e.timestamp DESC LIMIT " + strconv.Itoa(filterStreamPageSize)
-			repo.logger.Info("executing SQL statement", slog.String("stmt", stmt))
-			res, err = repo.db.Query(stmt)
+			stmt, args := repo.buildFilterStreamStatement(srch, searchStartTime, searchEndTime, maxID, sortMode, cursor)
+			repo.logger.Info("executing SQL statement", slog.String("stmt", stmt), slog.Any("args", args))
+			res, err = repo.db.Query(stmt, args...)
 			if err != nil {
 				repo.logger.Error("error when getting filtered events in FilterStream", slog.Any("error", err))
 				return
 			}
 			evts := make([]events.EventWithId, 0, filterStreamPageSize)
+			refs := make([]blockRef, 0, filterStreamPageSize)
 			eventsInPage := 0
 			for res.Next() {
 				var evt events.EventWithId
-				err := res.Scan(&evt.Id, &evt.Host, &evt.Source, &evt.SourceId, &evt.Timestamp, &evt.Raw)
+				var ref blockRef
+				err := scanEvent(res, &evt, &ref)
 				if err != nil {
 					repo.logger.Warn("error when scanning result in FilterStream", slog.Any("error", err))
 				} else {
 					evts = append(evts, evt)
+					refs = append(refs, ref)
 				}
 				eventsInPage++
-				lastTimestamp = evt.Timestamp.String()
+				cursor = &filterStreamCursor{timestamp: evt.Timestamp, id: evt.Id}
 			}
 			res.Close()
+			err = loadRaws(repo.db, repo.tables.blocks, repo.keys, evts, refs)
+			if err != nil {
+				repo.logger.Error("error when reading compressed events in FilterStream", slog.Any("error", err))
+				return
+			}
+			if matcher != nil {
+				evts = filterMatching(matcher, evts)
+			}
 			ret <- evts
 			if eventsInPage < filterStreamPageSize {
 				endTime := time.Now()
@@ -383,11 +775,328 @@ func (repo *sqliteEventRepository) FilterStream(srch *search.Search, searchStart
 	return ret
 }
 
-func (repo *sqliteEventRepository) GetByIds(ids []int64, sortMode events.SortMode) ([]events.EventWithId, error) {
-	ret := make([]events.EventWithId, 0, len(ids))
+func (repo *sqliteEventRepository) ExplainFilter(srch *search.Search, searchStartTime, searchEndTime *time.Time, sortMode events.SortMode) (*events.FilterExplanation, error) {
+	var maxID sql.NullInt64
+	err := repo.db.QueryRow("SELECT MAX(id) FROM " + repo.tables.events + ";").Scan(&maxID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get max(id) from Events table: %w", err)
+	}
+	pushedDown := []string{}
+	if searchStartTime != nil {
+		pushedDown = append(pushedDown, "_time>="+searchStartTime.Format(time.RFC3339Nano))
+	}
+	if searchEndTime != nil {
+		pushedDown = append(pushedDown, "_time<="+searchEndTime.Format(time.RFC3339Nano))
+	}
+	if fq := repo.ftsQuery(srch); fq.exact() {
+		pushedDown = append(pushedDown, srch.DescribeFragments()...)
+		pushedDown = append(pushedDown, srch.DescribeSourcesAndHosts()...)
+	} else {
+		// The full-text search only finds candidates which are checked by FilterStream before they are returned
+		for _, f := range append(srch.DescribeFragments(), srch.DescribeSourcesAndHosts()...) {
+			pushedDown = append(pushedDown, f+" (candidates)")
+		}
+	}
+	pushedDown = append(pushedDown, srch.DescribeIndexes()...)
+	if len(srch.IndexedFieldsVersions) > 0 {
+		for _, k := range sortedFieldKeys(srch.Fields) {
+			if !isColumnField(k) {
+				pushedDown = append(pushedDown, describeIndexedField(k, srch.Fields[k], false))
+			}
+		}
+		for _, k := range sortedFieldKeys(srch.NotFields) {
+			if values := literalValues(srch.NotFields[k]); !isColumnField(k) && len(values) > 0 {
+				pushedDown = append(pushedDown, describeIndexedField(k, values, true))
+			}
+		}
+	}
+	stmt, args := repo.buildFilterStreamStatement(srch, searchStartTime, searchEndTime, int(maxID.Int64), sortMode, nil)
+	return &events.FilterExplanation{
+		Statement:         stmt,
+		Parameters:        args,
+		PushedDownFilters: pushedDown,
+	}, nil
+}
+
+// filterStreamCursor is the position of the last event in the previous page of FilterStream.
+// Since many events can have the same timestamp, the ID is used to decide where the next page starts among events with the same timestamp.
+type filterStreamCursor struct {
+	timestamp time.Time
+	id        int64
+}
+
+// buildFilterStreamStatement creates the statement and parameters used by FilterStream to retrieve a page of events.
+// cursor is the position of the last event in the previous page, or nil if this is the first page.
+func (repo *sqliteEventRepository) buildFilterStreamStatement(srch *search.Search, searchStartTime, searchEndTime *time.Time, maxID int, sortMode events.SortMode, cursor *filterStreamCursor) (string, []any) {
+	var qb queryBuilder
+	qb.where("e.id <= ?", maxID)
+	if searchStartTime != nil {
+		qb.where("e.timestamp >= ?", *searchStartTime)
+	}
+	if searchEndTime != nil {
+		qb.where("e.timestamp <= ?", *searchEndTime)
+	}
+	order := "DESC"
+	if sortMode == events.SortModeTimestampAsc {
+		order = "ASC"
+	}
+	if cursor != nil {
+		if order == "ASC" {
+			qb.where("(e.timestamp, e.id) > (?, ?)", cursor.timestamp, cursor.id)
+		} else {
+			qb.where("(e.timestamp, e.id) < (?, ?)", cursor.timestamp, cursor.id)
+		}
+	}
+
+	fq := repo.ftsQuery(srch)
+	fq.addTo(&qb)
+
+	addIndexConditions(&qb, srch)
+	addIndexedFieldConditions(&qb, repo.tables.fields, srch)
+	return qb.build(repo.selectEventsFrom(),
+		" ORDER BY e.timestamp "+order+", e.id "+order+" LIMIT "+strconv.Itoa(filterStreamPageSize))
+}
+
+// ftsQuery returns the full-text query for the fragments, hosts and sources of the search.
+func (repo *sqliteEventRepository) ftsQuery(srch *search.Search) ftsQuery {
+	fq := ftsQuery{dialect: repo.dialect, table: repo.tables.raws, external: repo.layout.blocks}
+	for _, h := range sortedSetKeys(srch.Hosts) {
+		fq.include("host", h)
+	}
+	for _, s := range sortedSetKeys(srch.Sources) {
+		fq.include("source", s)
+	}
+	for _, f := range sortedSetKeys(srch.Fragments) {
+		fq.include("raw", f)
+	}
+	for _, h := range sortedSetKeys(srch.NotHosts) {
+		fq.exclude("host", h)
+	}
+	for _, s := range sortedSetKeys(srch.NotSources) {
+		fq.exclude("source", s)
+	}
+	for _, f := range sortedSetKeys(srch.NotFragments) {
+		fq.exclude("raw", f)
+	}
+	return fq
+}
+
+// addIndexConditions adds conditions which only include events from the Indexes of the search and exclude events from its NotIndexes.
+func addIndexConditions(qb *queryBuilder, srch *search.Search) {
+	if len(srch.Indexes) > 0 {
+		conditions, args := indexConditions(sortedSetKeys(srch.Indexes))
+		qb.where("("+strings.Join(conditions, " OR ")+")", args...)
+	}
+	if len(srch.NotIndexes) > 0 {
+		conditions, args := indexConditions(sortedSetKeys(srch.NotIndexes))
+		qb.where("NOT ("+strings.Join(conditions, " OR ")+")", args...)
+	}
+}
+
+// indexConditions returns conditions matching events in any of the given indexes. Names without wildcards are matched using IN, while
+// names with wildcards are converted to LIKE patterns.
+func indexConditions(names []string) ([]string, []any) {
+	conditions := []string{}
+	args := []any{}
+	literals := literalValues(names)
+	if len(literals) > 0 {
+		conditions = append(conditions, "e.index_name IN ("+placeholders(len(literals))+")")
+		for _, l := range literals {
+			args = append(args, l)
+		}
+	}
+	for _, n := range names {
+		if strings.Contains(n, "*") {
+			escaped := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(strings.ToLower(n))
+			conditions = append(conditions, "e.index_name LIKE ? ESCAPE '\\'")
+			args = append(args, strings.ReplaceAll(escaped, "*", "%"))
+		}
+	}
+	return conditions, args
+}
+
+// isColumnField returns true if the field is stored in its own column of the Events or EventRaws table instead of being extracted from
+// the raw event.
+func isColumnField(key string) bool {
+	return key == "host" || key == "source" || key == "index"
+}
+
+// addIndexedFieldConditions adds conditions which exclude events based on their indexed fields.
+// Events which do not have a field indexed, either because it was not configured as an indexed field when the event was indexed or because
+// the field was not found in the event, are not excluded by the conditions. The conditions only narrow down the candidates and the exact
+// field values are still checked after the fields have been extracted.
+// Field values are never used to narrow down the candidates using the full-text index, since an extracted value is not necessarily a
+// token in the raw event. For example the extractor (\w+)=(\d+) extracts duration=42 from "duration=42ms", where the token is 42ms.
+// Only fields which were extracted with one of the IndexedFieldsVersions of the search are used, since the values of fields extracted with
+// another version may be stale.
+func addIndexedFieldConditions(qb *queryBuilder, fieldsTable string, srch *search.Search) {
+	if len(srch.IndexedFieldsVersions) == 0 {
+		return
+	}
+	versions := sortedSetKeys(srch.IndexedFieldsVersions)
+	for _, k := range sortedFieldKeys(srch.Fields) {
+		if isColumnField(k) {
+			continue
+		}
+		// The field values are matched as words within the extracted value, so LIKE is used to find values which might match.
+		patterns := make([]string, len(srch.Fields[k]))
+		args := make([]any, 0, len(srch.Fields[k])+len(versions)+1)
+		args = append(args, k)
+		args = appendStrings(args, versions)
+		for i, v := range srch.Fields[k] {
+			patterns[i] = "f.value LIKE ? ESCAPE '\\'"
+			args = append(args, fieldValueToLikePattern(v))
+		}
+		qb.where("NOT EXISTS (SELECT 1 FROM "+fieldsTable+" f WHERE f.event_id = e.id AND f.key = ? AND f.version IN ("+placeholders(len(versions))+") AND NOT ("+strings.Join(patterns, " OR ")+"))", args...)
+	}
+	for _, k := range sortedFieldKeys(srch.NotFields) {
+		if isColumnField(k) {
+			continue
+		}
+		// Only values without wildcards are used for NotFields since an event must definitely match the value to be excluded.
+		values := literalValues(srch.NotFields[k])
+		if len(values) == 0 {
+			continue
+		}
+		args := make([]any, 0, len(values)+len(versions)+1)
+		args = append(args, k)
+		args = appendStrings(args, versions)
+		args = appendStrings(args, values)
+		qb.where("NOT EXISTS (SELECT 1 FROM "+fieldsTable+" f WHERE f.event_id = e.id AND f.key = ? AND f.version IN ("+placeholders(len(versions))+") AND f.value IN ("+placeholders(len(values))+"))", args...)
+	}
+}
+
+// fieldValueToLikePattern converts a field value from a search to a LIKE pattern which matches all values containing it.
+func fieldValueToLikePattern(value string) string {
+	escaped := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(strings.ToLower(value))
+	return "%" + strings.ReplaceAll(escaped, "*", "%") + "%"
+}
+
+func describeIndexedField(key string, values []string, not bool) string {
+	op := "="
+	if not {
+		op = "!="
+	}
+	if len(values) == 1 {
+		return key + op + values[0] + " (indexed field)"
+	}
+	op = " IN "
+	if not {
+		op = " NOT IN "
+	}
+	return key + op + "(" + strings.Join(values, ", ") + ") (indexed field)"
+}
+
+// literalValues returns the lowercased values which do not contain wildcards.
+func literalValues(values []string) []string {
+	ret := make([]string, 0, len(values))
+	for _, v := range values {
+		if !strings.Contains(v, "*") {
+			ret = append(ret, strings.ToLower(v))
+		}
+	}
+	return ret
+}
+
+func appendStrings(args []any, values []string) []any {
+	for _, v := range values {
+		args = append(args, v)
+	}
+	return args
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func sortedFieldKeys(m map[string][]string) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// maxIdsPerStatement is the maximum number of event IDs looked up in one statement, which is well below the default maximum number of
+// parameters in SQLite
+const maxIdsPerStatement = 500
+
+func (repo *sqliteEventRepository) GetIndexedFields(ids []int64) (map[int64]events.StoredFields, error) {
+	ret := make(map[int64]events.StoredFields, len(ids))
+	for start := 0; start < len(ids); start += maxIdsPerStatement {
+		chunk := ids[start:min(start+maxIdsPerStatement, len(ids))]
+		args := make([]any, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+		rows, err := repo.db.Query("SELECT event_id, key, value, version FROM "+repo.tables.fields+" WHERE event_id IN ("+placeholders(len(chunk))+");", args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get indexed fields for numIds=%v: %w", len(chunk), err)
+		}
+		err = scanStoredFields(rows, ret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get indexed fields for numIds=%v: %w", len(chunk), err)
+		}
+	}
+	return ret, nil
+}
+
+// scanStoredFields adds the fields in the rows, which contain the event ID, key, value and version of each field, to m and closes the rows.
+func scanStoredFields(rows *sql.Rows, m map[int64]events.StoredFields) error {
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var key, value string
+		var version sql.NullString
+		err := rows.Scan(&id, &key, &value, &version)
+		if err != nil {
+			return err
+		}
+		sf, ok := m[id]
+		if !ok {
+			sf = events.StoredFields{Version: version.String, Fields: map[string]string{}}
+		} else if sf.Version != version.String {
+			// The fields of an event are always saved together, so this should not happen
+			sf.Version = ""
+		}
+		sf.Fields[key] = value
+		m[id] = sf
+	}
+	return rows.Err()
+}
+
+func (repo *sqliteEventRepository) GetIndexedFieldValueCounts(fieldName string, limit int) (map[string]int, error) {
+	rows, err := repo.db.Query("SELECT value, COUNT(*) FROM "+repo.tables.fields+" WHERE key = ? GROUP BY value ORDER BY COUNT(*) DESC LIMIT ?;", fieldName, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get value counts for indexed field with fieldName=%v: %w", fieldName, err)
+	}
+	defer rows.Close()
+	ret := map[string]int{}
+	for rows.Next() {
+		var value string
+		var count int
+		err = rows.Scan(&value, &count)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan value count for indexed field with fieldName=%v: %w", fieldName, err)
+		}
+		ret[value] = count
+	}
+	return ret, nil
+}
 
+func sortedSetKeys(m map[string]struct{}) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (repo *sqliteEventRepository) GetByIds(ids []int64, sortMode events.SortMode) ([]events.EventWithId, error) {
 	// TODO: I'm PRETTY sure this code is garbage
-	stmt := "SELECT e.id, e.host, e.source, e.source_id, e.timestamp, r.raw FROM Events e INNER JOIN EventRaws r ON r.rowid = e.id WHERE e.id IN ("
+	stmt := repo.selectEventsFrom() + " WHERE e.id IN ("
 	for i, id := range ids {
 		if i == len(ids)-1 {
 			stmt += strconv.FormatInt(id, 10)
@@ -398,7 +1107,9 @@ func (repo *sqliteEventRepository) GetByIds(ids []int64, sortMode events.SortMod
 	stmt += ")"
 
 	if sortMode == events.SortModeTimestampDesc {
-		stmt += " ORDER BY e.timestamp DESC;"
+		stmt += " ORDER BY e.timestamp DESC, e.id DESC;"
+	} else if sortMode == events.SortModeTimestampAsc {
+		stmt += " ORDER BY e.timestamp ASC, e.id ASC;"
 	} else {
 		stmt += ";"
 	}
@@ -407,16 +1118,13 @@ func (repo *sqliteEventRepository) GetByIds(ids []int64, sortMode events.SortMod
 	if err != nil {
 		return nil, fmt.Errorf("error executing GetByIds query: %w", err)
 	}
-	defer res.Close()
-
-	idx := 0
-	for res.Next() {
-		ret = append(ret, events.EventWithId{})
-		err = res.Scan(&ret[idx].Id, &ret[idx].Host, &ret[idx].Source, &ret[idx].SourceId, &ret[idx].Timestamp, &ret[idx].Raw)
-		if err != nil {
-			return nil, fmt.Errorf("error when scanning row in GetByIds: %w", err)
-		}
-		idx++
+	ret, refs, err := scanEvents(res)
+	if err != nil {
+		return nil, fmt.Errorf("error when scanning row in GetByIds: %w", err)
+	}
+	err = loadRaws(repo.db, repo.tables.blocks, repo.keys, ret, refs)
+	if err != nil {
+		return nil, fmt.Errorf("error when reading compressed events in GetByIds: %w", err)
 	}
 
 	if sortMode == events.SortModePreserveArgOrder {
@@ -432,48 +1140,66 @@ func (repo *sqliteEventRepository) GetByIds(ids []int64, sortMode events.SortMod
 	return ret, nil
 }
 
-const surroundingBaseSQL = "SELECT source_id, offset FROM Events WHERE id=?"
-const surroundingUpSQL = "SELECT e.id, e.host, e.source, e.source_id, e.timestamp, r.raw FROM Events e INNER JOIN EventRaws r ON r.rowid = e.id WHERE e.source_id=? AND e.offset<=? ORDER BY e.offset DESC LIMIT ?"
-const surroundingDownSQL = "SELECT id, host, source, source_id, timestamp, raw FROM (SELECT e.id, e.host, e.source, e.source_id, e.timestamp, e.offset, r.raw FROM Events e INNER JOIN EventRaws r ON r.rowid = e.id WHERE e.source_id=? AND e.offset>? ORDER BY e.offset ASC LIMIT ?) ORDER BY offset DESC"
+const surroundingBaseSQL = "SELECT source_id, offset FROM %v WHERE id=?"
+const surroundingUpSQL = " WHERE e.source_id=? AND e.offset<=? ORDER BY e.offset DESC LIMIT ?"
+const surroundingDownSQL = " WHERE e.id IN (SELECT id FROM %v WHERE source_id=? AND offset>? ORDER BY offset ASC LIMIT ?) ORDER BY e.offset DESC"
 
 func (repo *sqliteEventRepository) GetSurroundingEvents(id int64, count int) ([]events.EventWithId, error) {
-	row := repo.db.QueryRow(surroundingBaseSQL, id)
-	if row == nil {
-		return []events.EventWithId{}, nil
+	sourceId, baseOffset, err := repo.getSourceIdAndOffset(id)
+	if err != nil {
+		return nil, err
+	}
+	upRows, err := repo.getEventsUpToOffset(sourceId, baseOffset, count/2)
+	if err != nil {
+		return nil, fmt.Errorf("got error when querying for surrounding rows for eventId=%v: %w", id, err)
+	}
+	downRows, err := repo.getEventsAfterOffset(sourceId, baseOffset, count/2)
+	if err != nil {
+		return nil, fmt.Errorf("got error when querying for surrounding rows for eventId=%v: %w", id, err)
 	}
+
+	return append(downRows, upRows...), nil
+}
+
+// getSourceIdAndOffset returns the source ID and offset of the event with the given ID. The returned error wraps sql.ErrNoRows if the
+// event does not exist.
+func (repo *sqliteEventRepository) getSourceIdAndOffset(id int64) (string, int, error) {
+	row := repo.db.QueryRow(fmt.Sprintf(surroundingBaseSQL, repo.tables.events), id)
 	if row.Err() != nil {
-		return nil, fmt.Errorf("got error when getting source_id and offset for eventId=%v: %w", id, row.Err())
+		return "", 0, fmt.Errorf("got error when getting source_id and offset for eventId=%v: %w", id, row.Err())
 	}
 
 	var sourceId string
 	var baseOffset int
 	err := row.Scan(&sourceId, &baseOffset)
 	if err != nil {
-		return nil, fmt.Errorf("got error when scanning source_id and offset for eventId=%v: %w", id, err)
+		return "", 0, fmt.Errorf("got error when scanning source_id and offset for eventId=%v: %w", id, err)
 	}
+	return sourceId, baseOffset, nil
+}
 
-	upRows, err := queryAndScan(repo.db, surroundingUpSQL, sourceId, baseOffset, count/2)
-	if err != nil {
-		return nil, fmt.Errorf("got error when querying for surrounding rows for eventId=%v: %w", id, err)
-	}
-	downRows, err := queryAndScan(repo.db, surroundingDownSQL, sourceId, baseOffset, count/2)
+// getEventsUpToOffset returns up to count events from the source with offsets less than or equal to baseOffset, sorted by descending offset.
+func (repo *sqliteEventRepository) getEventsUpToOffset(sourceId string, baseOffset int, count int) ([]events.EventWithId, error) {
+	return repo.queryAndScan(repo.selectEventsFrom()+surroundingUpSQL, sourceId, baseOffset, count)
+}
 
-	return append(downRows, upRows...), nil
+// getEventsAfterOffset returns up to count events from the source with offsets greater than baseOffset, sorted by descending offset.
+func (repo *sqliteEventRepository) getEventsAfterOffset(sourceId string, baseOffset int, count int) ([]events.EventWithId, error) {
+	return repo.queryAndScan(repo.selectEventsFrom()+fmt.Sprintf(surroundingDownSQL, repo.tables.events), sourceId, baseOffset, count)
 }
 
-func queryAndScan(db *sql.DB, query string, sourceId string, baseOffset int, count int) ([]events.EventWithId, error) {
-	ret := make([]events.EventWithId, 0, count)
-	rows, err := db.Query(query, sourceId, baseOffset, count)
+func (repo *sqliteEventRepository) queryAndScan(query string, sourceId string, baseOffset int, count int) ([]events.EventWithId, error) {
+	rows, err := repo.db.Query(query, sourceId, baseOffset, count)
 	if err != nil {
 		return nil, err
 	}
-	for rows.Next() {
-		var evt events.EventWithId
-		err := rows.Scan(&evt.Id, &evt.Host, &evt.Source, &evt.SourceId, &evt.Timestamp, &evt.Raw)
-		if err != nil {
-			return nil, err
-		}
-		ret = append(ret, evt)
+	ret, refs, err := scanEvents(rows)
+	if err != nil {
+		return nil, err
+	}
+	err = loadRaws(repo.db, repo.tables.blocks, repo.keys, ret, refs)
+	if err != nil {
+		return nil, err
 	}
 	return ret, nil
 }
@@ -16,11 +16,18 @@ package sqlite_events
 
 import (
 	"database/sql"
+	"fmt"
 	"log/slog"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/parser"
+	"github.com/jackbister/logsuck/pkg/logsuck/search"
+	"github.com/jackbister/logsuck/plugins/sqlite_common"
 )
 
 func TestAddBatchTrueBatch(t *testing.T) {
@@ -129,24 +136,487 @@ func TestDeleteOneEvent(t *testing.T) {
 	}
 }
 
-func createRepo(t *testing.T) events.Repository {
+func TestExplainFilter(t *testing.T) {
+	repo := createRepo(t)
+	srch, err := parser.Parse("hello NOT bye source=access* userid=123")
+	if err != nil {
+		t.Fatalf("got error when parsing search: %v", err)
+	}
+	explanation, err := repo.(events.FilterExplainer).ExplainFilter(srch, nil, nil, events.SortModeTimestampDesc)
+	if err != nil {
+		t.Fatalf("got error when explaining filter: %v", err)
+	}
+	// Indexed fields are only used if the current versions of the field extraction are known
+	expected := []string{"hello", "NOT bye", "source=access*"}
+	if !reflect.DeepEqual(explanation.PushedDownFilters, expected) {
+		t.Fatalf("got unexpected pushed down filters, expected=%v, got=%v", expected, explanation.PushedDownFilters)
+	}
+	srch.IndexedFieldsVersions = map[string]struct{}{"v1": {}}
+	explanation, err = repo.(events.FilterExplainer).ExplainFilter(srch, nil, nil, events.SortModeTimestampDesc)
+	if err != nil {
+		t.Fatalf("got error when explaining filter: %v", err)
+	}
+	expected = []string{"hello", "NOT bye", "source=access*", "userid=123 (indexed field)"}
+	if !reflect.DeepEqual(explanation.PushedDownFilters, expected) {
+		t.Fatalf("got unexpected pushed down filters, expected=%v, got=%v", expected, explanation.PushedDownFilters)
+	}
+	if !strings.Contains(explanation.Statement, "MATCH") {
+		t.Fatalf("expected statement to contain a MATCH clause, got=%v", explanation.Statement)
+	}
+
+	// A wildcard at the start of a fragment can not be pushed down, so the events are checked after they have been retrieved
+	srch, err = parser.Parse("hello *Exception")
+	if err != nil {
+		t.Fatalf("got error when parsing search: %v", err)
+	}
+	explanation, err = repo.(events.FilterExplainer).ExplainFilter(srch, nil, nil, events.SortModeTimestampDesc)
+	if err != nil {
+		t.Fatalf("got error when explaining filter: %v", err)
+	}
+	expected = []string{"*Exception (candidates)", "hello (candidates)"}
+	if !reflect.DeepEqual(explanation.PushedDownFilters, expected) {
+		t.Fatalf("got unexpected pushed down filters, expected=%v, got=%v", expected, explanation.PushedDownFilters)
+	}
+}
+
+// Field values are only used to narrow down the candidates if the field is stored with the current version of the field extraction,
+// since the value extracted from the raw event is not necessarily a token in the raw event.
+var fieldPushdownTests = []struct {
+	search             string
+	expectedCandidates int
+}{
+	{"", 100},
+	{"userid=42", 1},
+	{"USERID=42", 1},
+	{"userid IN (1, 2, 3)", 51},
+	{"userid=4*", 19},
+	{"userid=*2", 19},
+	{"userid=4-2", 0},
+	{"userid!=42", 99},
+	// NotFields with wildcards can not be used since the event must definitely match the value to be excluded
+	{"userid!=4*", 100},
+	// Fields which are not stored can not narrow down the candidates
+	{"level=info", 100},
+}
+
+func TestFilterStreamFieldPushdown(t *testing.T) {
+	repo := createRepo(t)
+	evts := make([]events.Event, 100)
+	for i := range evts {
+		evts[i] = events.Event{
+			Raw:                  "2021-02-01 00:00:00 userid=" + strconv.Itoa(i) + " level=info",
+			Timestamp:            time.Date(2021, 2, 1, 0, 0, i, 0, time.UTC),
+			Host:                 "localhost",
+			Source:               "log.txt",
+			Offset:               int64(i),
+			IndexedFields:        map[string]string{"userid": strconv.Itoa(i)},
+			IndexedFieldsVersion: "v1",
+		}
+	}
+	err := repo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	countCandidates := func(srch *search.Search) int {
+		candidates := 0
+		for page := range repo.FilterStream(srch, nil, nil, events.SortModeTimestampDesc) {
+			candidates += len(page)
+		}
+		return candidates
+	}
+	for _, tt := range fieldPushdownTests {
+		t.Run(tt.search, func(t *testing.T) {
+			srch, err := parser.Parse(tt.search)
+			if err != nil {
+				t.Fatalf("got error when parsing search: %v", err)
+			}
+			// Without the current version the stored fields may be stale, so nothing is pushed down
+			if candidates := countCandidates(srch); candidates != 100 {
+				t.Fatalf("got unexpected number of candidates without versions for search=%v, expected=100, got=%v", tt.search, candidates)
+			}
+			srch.IndexedFieldsVersions = map[string]struct{}{"v2": {}}
+			if candidates := countCandidates(srch); candidates != 100 {
+				t.Fatalf("got unexpected number of candidates with a stale version for search=%v, expected=100, got=%v", tt.search, candidates)
+			}
+			srch.IndexedFieldsVersions = map[string]struct{}{"v1": {}}
+			if candidates := countCandidates(srch); candidates != tt.expectedCandidates {
+				t.Fatalf("got unexpected number of candidates for search=%v, expected=%v, got=%v", tt.search, tt.expectedCandidates, candidates)
+			}
+		})
+	}
+}
+
+var indexTests = []struct {
+	search   string
+	expected []string
+}{
+	{"", []string{"main event", "security event", "other event"}},
+	{"index=main", []string{"main event"}},
+	{"index=SECURITY", []string{"security event"}},
+	{"index IN (main, other)", []string{"main event", "other event"}},
+	{"index=*e*", []string{"other event", "security event"}},
+	{"index!=main", []string{"security event", "other event"}},
+	{"index!=s*", []string{"main event", "other event"}},
+	{"index=missing", []string{}},
+}
+
+func TestFilterStreamIndexes(t *testing.T) {
+	repo := createRepo(t)
+	evts := eventsWithRaws([]string{"main event", "security event", "other event"})
+	evts[1].Index = "security"
+	evts[2].Index = "other"
+	err := repo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	for _, tt := range indexTests {
+		assertSearchResults(t, repo, tt.search, tt.expected)
+	}
+
+	got, err := repo.GetByIds([]int64{1, 2}, events.SortModeNone)
+	if err != nil {
+		t.Fatalf("got error when getting events by id: %v", err)
+	}
+	if len(got) != 2 || got[0].Index != events.DefaultIndex || got[1].Index != "security" {
+		t.Fatalf("expected events to have index=%v and index=security, got %v", events.DefaultIndex, got)
+	}
+}
+
+var indexedFieldTests = []struct {
+	search             string
+	expectedCandidates int
+}{
+	// Only the even events have indexed fields, so the odd events are always candidates
+	{"", 100},
+	{"status=s-42", 51},
+	{"status=s-4*", 56},
+	{"status IN (s-1, s-2)", 61},
+	{"status=\"o'brien\"", 50},
+	{"status!=s-42", 99},
+	// NotFields with wildcards are not used to narrow down candidates
+	{"status!=s-4*", 100},
+}
+
+func TestFilterStreamIndexedFields(t *testing.T) {
+	for _, trueBatch := range []bool{true, false} {
+		t.Run("TrueBatch="+strconv.FormatBool(trueBatch), func(t *testing.T) {
+			repo := createRepoWithCfg(t, &Config{
+				TrueBatch: trueBatch,
+			})
+			evts := make([]events.Event, 100)
+			for i := range evts {
+				level := "info"
+				if i%10 == 0 {
+					level = "error"
+				}
+				evts[i] = events.Event{
+					Raw:       "2021-02-01 00:00:00 status=s-" + strconv.Itoa(i) + " level=" + level,
+					Timestamp: time.Date(2021, 2, 1, 0, 0, i, 0, time.UTC),
+					Host:      "localhost",
+					Source:    "log.txt",
+					Offset:    int64(i),
+				}
+				if i%2 == 0 {
+					evts[i].IndexedFields = map[string]string{"status": "s-" + strconv.Itoa(i), "level": level}
+					evts[i].IndexedFieldsVersion = "v2"
+				}
+			}
+			err := repo.AddBatch(evts)
+			if err != nil {
+				t.Fatalf("got error when adding events: %v", err)
+			}
+
+			for _, tt := range indexedFieldTests {
+				srch, err := parser.Parse(tt.search)
+				if err != nil {
+					t.Fatalf("got error when parsing search=%v: %v", tt.search, err)
+				}
+				srch.IndexedFieldsVersions = map[string]struct{}{"v2": {}}
+				candidates := 0
+				for page := range repo.FilterStream(srch, nil, nil, events.SortModeTimestampDesc) {
+					candidates += len(page)
+				}
+				if candidates != tt.expectedCandidates {
+					t.Fatalf("got unexpected number of candidates for search=%v, expected=%v, got=%v", tt.search, tt.expectedCandidates, candidates)
+				}
+
+				// Fields extracted with another version of the field extraction may be stale, so they must not exclude any events
+				srch.IndexedFieldsVersions = map[string]struct{}{"v3": {}}
+				candidates = 0
+				for page := range repo.FilterStream(srch, nil, nil, events.SortModeTimestampDesc) {
+					candidates += len(page)
+				}
+				if candidates != 100 {
+					t.Fatalf("got unexpected number of candidates for search=%v with stale fields, expected=100, got=%v", tt.search, candidates)
+				}
+			}
+
+			byRaw := map[string]int64{}
+			for page := range repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampDesc) {
+				for _, evt := range page {
+					byRaw[evt.Raw] = evt.Id
+				}
+			}
+			withFields, withoutFields := byRaw[evts[10].Raw], byRaw[evts[11].Raw]
+			stored, err := repo.(events.IndexedFieldReader).GetIndexedFields([]int64{withFields, withoutFields})
+			if err != nil {
+				t.Fatalf("got error when getting indexed fields: %v", err)
+			}
+			expectedStored := map[int64]events.StoredFields{
+				withFields: {Version: "v2", Fields: map[string]string{"status": "s-10", "level": "error"}},
+			}
+			if !reflect.DeepEqual(stored, expectedStored) {
+				t.Fatalf("got unexpected indexed fields, expected=%v, got=%v", expectedStored, stored)
+			}
+
+			counts, err := repo.(events.IndexedFieldStatsProvider).GetIndexedFieldValueCounts("level", 10)
+			if err != nil {
+				t.Fatalf("got error when getting indexed field value counts: %v", err)
+			}
+			if !reflect.DeepEqual(counts, map[string]int{"error": 10, "info": 40}) {
+				t.Fatalf("got unexpected indexed field value counts: %v", counts)
+			}
+
+			ids := []int64{}
+			for page := range repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampDesc) {
+				for _, evt := range page {
+					ids = append(ids, evt.Id)
+				}
+			}
+			err = repo.DeleteBatch(ids)
+			if err != nil {
+				t.Fatalf("got error when deleting events: %v", err)
+			}
+			var remaining int
+			err = repo.(*sqliteEventRepository).db.QueryRow("SELECT COUNT(*) FROM EventFields").Scan(&remaining)
+			if err != nil {
+				t.Fatalf("got error when counting remaining fields: %v", err)
+			}
+			if remaining != 0 {
+				t.Fatalf("expected all fields to be deleted along with the events but got remaining=%v", remaining)
+			}
+		})
+	}
+}
+
+func TestFilterStreamPagination(t *testing.T) {
+	repo := createRepo(t)
+	// More events than fit in one page share the same timestamp, which must not cause events to be skipped at page boundaries
+	evts := make([]events.Event, 2500)
+	for i := range evts {
+		ts := time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)
+		if i >= 1500 {
+			ts = ts.Add(time.Duration(i) * time.Second)
+		}
+		evts[i] = events.Event{
+			Raw:       "2021-02-01 00:00:00 event " + strconv.Itoa(i),
+			Timestamp: ts,
+			Host:      "localhost",
+			Source:    "log.txt",
+			Offset:    int64(i),
+		}
+	}
+	err := repo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	for _, sortMode := range []events.SortMode{events.SortModeTimestampDesc, events.SortModeTimestampAsc} {
+		seen := map[int64]struct{}{}
+		var last *events.EventWithId
+		for page := range repo.FilterStream(&search.Search{}, nil, nil, sortMode) {
+			for i := range page {
+				evt := page[i]
+				if _, ok := seen[evt.Id]; ok {
+					t.Fatalf("got duplicate event with sortMode=%v, id=%v", sortMode, evt.Id)
+				}
+				seen[evt.Id] = struct{}{}
+				if last != nil {
+					inOrder := evt.Timestamp.Before(last.Timestamp) || evt.Timestamp.Equal(last.Timestamp) && evt.Id < last.Id
+					if sortMode == events.SortModeTimestampAsc {
+						inOrder = evt.Timestamp.After(last.Timestamp) || evt.Timestamp.Equal(last.Timestamp) && evt.Id > last.Id
+					}
+					if !inOrder {
+						t.Fatalf("got events out of order with sortMode=%v, id=%v came after id=%v", sortMode, evt.Id, last.Id)
+					}
+				}
+				last = &evt
+			}
+		}
+		if len(seen) != len(evts) {
+			t.Fatalf("got unexpected number of events with sortMode=%v, expected=%v, got=%v", sortMode, len(evts), len(seen))
+		}
+	}
+}
+
+func TestGetByIdsSortModes(t *testing.T) {
+	repo := createRepo(t)
+	evts := make([]events.Event, 3)
+	for i := range evts {
+		evts[i] = events.Event{
+			Raw:       "2021-02-01 00:00:00 event " + strconv.Itoa(i),
+			Timestamp: time.Date(2021, 2, 1, 0, 0, i, 0, time.UTC),
+			Host:      "localhost",
+			Source:    "log.txt",
+			Offset:    int64(i),
+		}
+	}
+	err := repo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	tests := []struct {
+		sortMode events.SortMode
+		expected []int64
+	}{
+		{events.SortModeTimestampDesc, []int64{3, 2, 1}},
+		{events.SortModeTimestampAsc, []int64{1, 2, 3}},
+		{events.SortModePreserveArgOrder, []int64{2, 3, 1}},
+	}
+	for _, tt := range tests {
+		res, err := repo.GetByIds([]int64{2, 3, 1}, tt.sortMode)
+		if err != nil {
+			t.Fatalf("got error when getting events with sortMode=%v: %v", tt.sortMode, err)
+		}
+		ids := make([]int64, len(res))
+		for i, evt := range res {
+			ids[i] = evt.Id
+		}
+		if !reflect.DeepEqual(ids, tt.expected) {
+			t.Fatalf("got unexpected order with sortMode=%v, expected=%v, got=%v", tt.sortMode, tt.expected, ids)
+		}
+	}
+}
+
+var specialCharacterTests = []struct {
+	search   string
+	expected []string
+}{
+	{"don't", []string{"i don't know"}},
+	{"\"it's\"", []string{"it's fine"}},
+	{"OR", []string{"this or that", "near or far"}},
+	{"NEAR", []string{"near or far"}},
+	{"NOT or", []string{"i don't know", "it's fine"}},
+	// The fragment ' does not contain any tokens, so the candidates found using the fragment OR are checked before they are returned
+	{"' OR 1=1 --", []string{}},
+}
+
+var wildcardTests = []struct {
+	search   string
+	expected []string
+}{
+	{"*Exception", []string{"java.lang.NullPointerException thrown"}},
+	{"foo*bar", []string{"foo and bar"}},
+	{"*Pointer*", []string{"java.lang.NullPointerException thrown", "NullPointer warning"}},
+	{"Null*", []string{"java.lang.NullPointerException thrown", "NullPointer warning"}},
+}
+
+func TestFilterStreamWildcards(t *testing.T) {
+	repo := createRepo(t)
+	raws := []string{"java.lang.NullPointerException thrown", "foo and bar", "NullPointer warning", "nothing here"}
+	evts := make([]events.Event, len(raws))
+	for i, raw := range raws {
+		evts[i] = events.Event{
+			Raw:       raw,
+			Timestamp: time.Date(2021, 2, 1, 0, 0, i, 0, time.UTC),
+			Host:      "localhost",
+			Source:    "log.txt",
+			Offset:    int64(i),
+		}
+	}
+	err := repo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	for _, tt := range wildcardTests {
+		srch, err := parser.Parse(tt.search)
+		if err != nil {
+			t.Fatalf("got error when parsing search=%v: %v", tt.search, err)
+		}
+		got := map[string]struct{}{}
+		for page := range repo.FilterStream(srch, nil, nil, events.SortModeTimestampDesc) {
+			for _, evt := range page {
+				got[evt.Raw] = struct{}{}
+			}
+		}
+		expected := map[string]struct{}{}
+		for _, raw := range tt.expected {
+			expected[raw] = struct{}{}
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("got unexpected events for search=%v, expected=%v, got=%v", tt.search, expected, got)
+		}
+	}
+}
+
+func TestFilterStreamSpecialCharacters(t *testing.T) {
+	repo := createRepo(t)
+	raws := []string{"i don't know", "it's fine", "this or that", "near or far"}
+	evts := make([]events.Event, len(raws))
+	for i, raw := range raws {
+		evts[i] = events.Event{
+			Raw:       raw,
+			Timestamp: time.Date(2021, 2, 1, 0, 0, i, 0, time.UTC),
+			Host:      "localhost",
+			Source:    "log.txt",
+			Offset:    int64(i),
+		}
+	}
+	err := repo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	for _, tt := range specialCharacterTests {
+		srch, err := parser.Parse(tt.search)
+		if err != nil {
+			t.Fatalf("got error when parsing search=%v: %v", tt.search, err)
+		}
+		got := map[string]struct{}{}
+		for page := range repo.FilterStream(srch, nil, nil, events.SortModeTimestampDesc) {
+			for _, evt := range page {
+				got[evt.Raw] = struct{}{}
+			}
+		}
+		expected := map[string]struct{}{}
+		for _, raw := range tt.expected {
+			expected[raw] = struct{}{}
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("got unexpected events for search=%v, expected=%v, got=%v", tt.search, expected, got)
+		}
+	}
+}
+
+func createRepo(t testing.TB) events.Repository {
 	return createRepoWithCfg(t, &Config{
 		TrueBatch: true,
 	})
 }
 
-func createRepoWithCfg(t *testing.T, cfg *Config) events.Repository {
+func createRepoWithCfg(t testing.TB, cfg *Config) events.Repository {
+	repo, err := createRepoOrError(cfg)
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+	return repo
+}
+
+func createRepoOrError(cfg *Config) (events.Repository, error) {
 	db, err := sql.Open("sqlite3", ":memory:")
 	if err != nil {
-		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+		return nil, fmt.Errorf("got error when creating in-memory SQLite database: %w", err)
 	}
-	repo, err := NewSqliteEventRepository(SqliteEventRepositoryParams{
+	err = sqlite_common.Migrate(db, slog.Default(), Migrations)
+	if err != nil {
+		return nil, fmt.Errorf("got error when migrating database: %w", err)
+	}
+	return NewSqliteEventRepository(SqliteEventRepositoryParams{
 		Db:     db,
 		Cfg:    cfg,
 		Logger: slog.Default(),
 	})
-	if err != nil {
-		t.Fatalf("got error when creating events repo: %v", err)
-	}
-	return repo
 }
@@ -22,6 +22,7 @@ import (
 
 	"github.com/jackbister/logsuck/pkg/logsuck"
 	"github.com/jackbister/logsuck/pkg/logsuck/config"
+	"github.com/jackbister/logsuck/plugins/sqlite_common"
 
 	_ "github.com/mattn/go-sqlite3"
 	"go.uber.org/dig"
@@ -32,8 +33,48 @@ const pluginName = "@logsuck/sqlite_events"
 //go:embed sqlite_events.schema.json
 var schemaString string
 
+const (
+	// FullTextSearchFts4 stores events in an FTS4 table using the simple tokenizer, which matches whole words and prefixes.
+	FullTextSearchFts4 = "fts4"
+	// FullTextSearchFts5 stores events in an FTS5 table using the trigram tokenizer, which matches arbitrary substrings.
+	// It requires Logsuck to be built with the sqlite_fts5 build tag.
+	FullTextSearchFts5 = "fts5"
+)
+
+const (
+	// CompressionNone stores the raw events in the EventRaws table.
+	CompressionNone = "none"
+	// CompressionFlate stores the raw events in blocks compressed using DEFLATE, and only stores the full-text index in the EventRaws table.
+	CompressionFlate = "flate"
+)
+
+const (
+	// DedupKey skips events which have the same host, source, timestamp and offset as an existing event.
+	DedupKey = "key"
+	// DedupContentHash also skips events which have the same host, file fingerprint, offset and raw event as an existing event, see
+	// contentHash. This catches events which are read again without a parsed timestamp, and files which are read again after being
+	// rotated.
+	DedupContentHash = "contentHash"
+)
+
 type Config struct {
 	TrueBatch bool
+
+	// FullTextSearch is the full-text search module used for the EventRaws table, FullTextSearchFts4 or FullTextSearchFts5.
+	FullTextSearch string
+
+	// PartitionHours is the length of the time period covered by each partition when events are stored in partitions, see
+	// partitionedEventRepository. Events are not partitioned if PartitionHours is 0.
+	PartitionHours int
+
+	// Compression is the compression used for the raw events, CompressionNone or CompressionFlate.
+	Compression string
+
+	// Encryption configures the keys used to encrypt the raw events. The raw events are not encrypted if Encryption is nil.
+	Encryption *EncryptionConfig
+
+	// Dedup is how duplicate events are detected, DedupKey or DedupContentHash.
+	Dedup string
 }
 
 var Plugin = logsuck.Plugin{
@@ -43,9 +84,22 @@ var Plugin = logsuck.Plugin{
 		if err != nil {
 			return err
 		}
+		err = c.Provide(NewMaintenanceTask, dig.Group("tasks"))
+		if err != nil {
+			return err
+		}
+		err = c.Provide(func() sqlite_common.PluginMigrations {
+			return Migrations
+		}, dig.Group("sqliteMigrations"))
+		if err != nil {
+			return err
+		}
 		err = c.Provide(func(cfg *config.Config) *Config {
 			ret := Config{
-				TrueBatch: true,
+				TrueBatch:      true,
+				FullTextSearch: FullTextSearchFts4,
+				Compression:    CompressionNone,
+				Dedup:          DedupKey,
 			}
 			cfgMap, ok := cfg.Plugins[pluginName].(map[string]any)
 			if !ok {
@@ -54,6 +108,22 @@ var Plugin = logsuck.Plugin{
 			if fns, ok := cfgMap["trueBatch"].(bool); ok {
 				ret.TrueBatch = fns
 			}
+			if fts, ok := cfgMap["fullTextSearch"].(string); ok {
+				ret.FullTextSearch = fts
+			}
+			if c, ok := cfgMap["compression"].(string); ok {
+				ret.Compression = c
+			}
+			if d, ok := cfgMap["dedup"].(string); ok {
+				ret.Dedup = d
+			}
+			// Numbers in the configuration are unmarshaled as float64
+			if ph, ok := cfgMap["partitionHours"].(float64); ok {
+				ret.PartitionHours = int(ph)
+			}
+			if enc, ok := cfgMap["encryption"].(map[string]any); ok {
+				ret.Encryption = parseEncryptionConfig(enc)
+			}
 			return &ret
 		})
 		if err != nil {
@@ -70,3 +140,27 @@ var Plugin = logsuck.Plugin{
 		return ret, nil
 	},
 }
+
+func parseEncryptionConfig(cfgMap map[string]any) *EncryptionConfig {
+	ret := EncryptionConfig{}
+	ret.KeyFile, _ = cfgMap["keyFile"].(string)
+	ret.KeyEnv, _ = cfgMap["keyEnv"].(string)
+	ret.PreviousKeyFiles = stringSlice(cfgMap["previousKeyFiles"])
+	ret.PreviousKeyEnvs = stringSlice(cfgMap["previousKeyEnvs"])
+	ret.IndexKeyFile, _ = cfgMap["indexKeyFile"].(string)
+	ret.IndexKeyEnv, _ = cfgMap["indexKeyEnv"].(string)
+	return &ret
+}
+
+// stringSlice converts an array from the configuration, which is unmarshaled as []any, to a []string. Elements which are not strings are
+// ignored.
+func stringSlice(v any) []string {
+	arr, _ := v.([]any)
+	ret := make([]string, 0, len(arr))
+	for _, e := range arr {
+		if s, ok := e.(string); ok {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,137 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_events
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// autoVacuumIncremental is the value of PRAGMA auto_vacuum when incremental vacuum is enabled.
+const autoVacuumIncremental = 2
+
+// storageSize returns the number of bytes used by the database, not counting pages on the freelist. Since the database file is shared
+// with the other SQLite plugins this includes the jobs and configuration as well as the events.
+func storageSize(db *sql.DB) (int64, error) {
+	var pageCount, freelistCount, pageSize int64
+	err := db.QueryRow("PRAGMA page_count;").Scan(&pageCount)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get page_count: %w", err)
+	}
+	err = db.QueryRow("PRAGMA freelist_count;").Scan(&freelistCount)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get freelist_count: %w", err)
+	}
+	err = db.QueryRow("PRAGMA page_size;").Scan(&pageSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get page_size: %w", err)
+	}
+	return (pageCount - freelistCount) * pageSize, nil
+}
+
+// errIncrementalVacuumDisabled is returned by compact if incremental vacuum is not enabled for the database.
+var errIncrementalVacuumDisabled = errors.New("incremental vacuum is not enabled")
+
+// contextQueryer is the part of *sql.DB and *sql.Conn which is used by compact.
+type contextQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// compact runs an incremental vacuum, which removes the pages on the freelist from the database file. Incremental vacuum is only possible
+// if auto_vacuum was set to incremental when the database was created or the database has been vacuumed since it was set.
+// If pageLimit is above zero each incremental_vacuum statement removes at most pageLimit pages, so the write lock is released in between,
+// otherwise all pages are removed by one statement. It returns the number of pages removed.
+func compact(ctx context.Context, db contextQueryer, pageLimit int64) (int64, error) {
+	var autoVacuum int
+	err := db.QueryRowContext(ctx, "PRAGMA auto_vacuum;").Scan(&autoVacuum)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get auto_vacuum: %w", err)
+	}
+	if autoVacuum != autoVacuumIncremental {
+		return 0, errIncrementalVacuumDisabled
+	}
+	statement := "PRAGMA incremental_vacuum;"
+	if pageLimit > 0 {
+		statement = "PRAGMA incremental_vacuum(" + fmt.Sprint(pageLimit) + ");"
+	}
+	var freed int64
+	for {
+		var freelistCount int64
+		err = db.QueryRowContext(ctx, "PRAGMA freelist_count;").Scan(&freelistCount)
+		if err != nil {
+			return freed, fmt.Errorf("failed to get freelist_count: %w", err)
+		}
+		if freelistCount == 0 {
+			return freed, nil
+		}
+		// incremental_vacuum frees one page each time a row is stepped, so the rows must be read for it to free all pages
+		rows, err := db.QueryContext(ctx, statement)
+		if err != nil {
+			return freed, fmt.Errorf("failed to run incremental_vacuum: %w", err)
+		}
+		for rows.Next() {
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return freed, fmt.Errorf("failed to run incremental_vacuum: %w", err)
+		}
+		if pageLimit > 0 {
+			freed += min(freelistCount, pageLimit)
+		} else {
+			freed += freelistCount
+		}
+	}
+}
+
+// compactRepository runs compact for the Compact method of the repositories, logging the result.
+func compactRepository(db *sql.DB, logger *slog.Logger) error {
+	startTime := time.Now()
+	numPages, err := compact(context.Background(), db, 0)
+	if errors.Is(err, errIncrementalVacuumDisabled) {
+		logger.Warn("not compacting database since incremental vacuum is not enabled. The space freed by deleting events will be reused but the database file will not shrink. " +
+			"Run 'PRAGMA auto_vacuum = INCREMENTAL; VACUUM;' on the database once while Logsuck is stopped to enable incremental vacuum")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if numPages > 0 {
+		logger.Info("compacted database",
+			slog.Int64("numPages", numPages),
+			slog.Duration("duration", time.Since(startTime)))
+	}
+	return nil
+}
+
+func (repo *sqliteEventRepository) StorageSize() (int64, error) {
+	return storageSize(repo.db)
+}
+
+func (repo *sqliteEventRepository) Compact() error {
+	return compactRepository(repo.db, repo.logger)
+}
+
+func (repo *partitionedEventRepository) StorageSize() (int64, error) {
+	return storageSize(repo.db)
+}
+
+func (repo *partitionedEventRepository) Compact() error {
+	return compactRepository(repo.db, repo.logger)
+}
@@ -0,0 +1,35 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite_jobs
+
+import "github.com/jackbister/logsuck/plugins/sqlite_common"
+
+// Migrations creates and updates the tables used by the jobs repository.
+var Migrations = sqlite_common.PluginMigrations{
+	PluginName: pluginName,
+	Migrations: []sqlite_common.Migration{
+		{
+			Version:     1,
+			Description: "Create Jobs, JobResults, JobTableResults and JobFieldValues tables",
+			// IF NOT EXISTS is used since databases created before migrations were introduced already have the tables
+			Apply: sqlite_common.ExecStatements(
+				"CREATE TABLE IF NOT EXISTS Jobs (id INTEGER NOT NULL PRIMARY KEY, state INTEGER NOT NULL, query TEXT NOT NULL, start_time DATETIME, end_time DATETIME, sort_mode INTEGER NOT NULL, output_type INTEGER NOT NULL, column_order_json TEXT NOT NULL);",
+				"CREATE TABLE IF NOT EXISTS JobResults (job_id INTEGER NOT NULL, event_id INTEGER NOT NULL, timestamp DATETIME NOT NULL, FOREIGN KEY(job_id) REFERENCES Jobs(id), FOREIGN KEY(event_id) REFERENCES Events(id));",
+				"CREATE TABLE IF NOT EXISTS JobTableResults (job_id INTEGER NOT NULL, row_number INTEGER NOT NULL, row_json TEXT NOT NULL, FOREIGN KEY(job_id) REFERENCES Jobs(id));",
+				"CREATE TABLE IF NOT EXISTS JobFieldValues (job_id INTEGER NOT NULL, key TEXT NOT NULL, value TEXT NOT NULL, occurrences INTEGER NOT NULL, UNIQUE(job_id, key, value), FOREIGN KEY(job_id) REFERENCES Jobs(id));",
+			),
+		},
+	},
+}
@@ -30,23 +30,8 @@ type sqliteJobRepository struct {
 	db *sql.DB
 }
 
+// NewSqliteJobRepository creates a repository using the tables created by Migrations, which must have been applied to the database.
 func NewSqliteJobRepository(db *sql.DB) (jobs.Repository, error) {
-	_, err := db.Exec("CREATE TABLE IF NOT EXISTS Jobs (id INTEGER NOT NULL PRIMARY KEY, state INTEGER NOT NULL, query TEXT NOT NULL, start_time DATETIME, end_time DATETIME, sort_mode INTEGER NOT NULL, output_type INTEGER NOT NULL, column_order_json TEXT NOT NULL);")
-	if err != nil {
-		return nil, fmt.Errorf("error when creating Jobs table: %w", err)
-	}
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS JobResults (job_id INTEGER NOT NULL, event_id INTEGER NOT NULL, timestamp DATETIME NOT NULL, FOREIGN KEY(job_id) REFERENCES Jobs(id), FOREIGN KEY(event_id) REFERENCES Events(id));")
-	if err != nil {
-		return nil, fmt.Errorf("error when creating JobResults table: %w", err)
-	}
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS JobTableResults (job_id INTEGER NOT NULL, row_number INTEGER NOT NULL, row_json TEXT NOT NULL, FOREIGN KEY(job_id) REFERENCES Jobs(id));")
-	if err != nil {
-		return nil, fmt.Errorf("error when creating JobTableResults table: %w", err)
-	}
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS JobFieldValues (job_id INTEGER NOT NULL, key TEXT NOT NULL, value TEXT NOT NULL, occurrences INTEGER NOT NULL, UNIQUE(job_id, key, value), FOREIGN KEY(job_id) REFERENCES Jobs(id));")
-	if err != nil {
-		return nil, fmt.Errorf("error when creating JobFieldValues table: %w", err)
-	}
 	return &sqliteJobRepository{
 		db: db,
 	}, nil
@@ -140,8 +125,12 @@ func (repo *sqliteJobRepository) Get(id int64) (*jobs.Job, error) {
 	return &job, nil
 }
 
-func (repo *sqliteJobRepository) GetResults(jobId int64, skip int, take int) ([]int64, error) {
-	res, err := repo.db.Query("SELECT event_id FROM JobResults WHERE job_id=? ORDER BY timestamp DESC LIMIT ? OFFSET ?;", jobId, take, skip)
+func (repo *sqliteJobRepository) GetResults(jobId int64, sortMode events.SortMode, skip int, take int) ([]int64, error) {
+	order := "DESC"
+	if sortMode == events.SortModeTimestampAsc {
+		order = "ASC"
+	}
+	res, err := repo.db.Query("SELECT event_id FROM JobResults WHERE job_id=? ORDER BY timestamp "+order+", event_id "+order+" LIMIT ? OFFSET ?;", jobId, take, skip)
 	if err != nil {
 		return nil, fmt.Errorf("error when getting results for jobId=%v, skip=%v, take=%v: %w", jobId, skip, take, err)
 	}
@@ -248,6 +237,44 @@ func (repo *sqliteJobRepository) GetNumMatchedEvents(id int64) (int64, error) {
 	return count, nil
 }
 
+func (repo *sqliteJobRepository) GetRecentFieldOccurences(numJobs int) (map[string]int, error) {
+	res, err := repo.db.Query("SELECT key, SUM(occurrences) FROM JobFieldValues WHERE job_id IN (SELECT id FROM Jobs ORDER BY id DESC LIMIT ?) GROUP BY key;", numJobs)
+	if err != nil {
+		return nil, fmt.Errorf("error when getting field occurrences for numJobs=%v: %w", numJobs, err)
+	}
+	defer res.Close()
+	m := map[string]int{}
+	for res.Next() {
+		var key string
+		var count int
+		err = res.Scan(&key, &count)
+		if err != nil {
+			return nil, fmt.Errorf("error reading field occurences for numJobs=%v: %w", numJobs, err)
+		}
+		m[key] = count
+	}
+	return m, nil
+}
+
+func (repo *sqliteJobRepository) GetRecentFieldValues(numJobs int, fieldName string) (map[string]int, error) {
+	res, err := repo.db.Query("SELECT value, SUM(occurrences) FROM JobFieldValues WHERE job_id IN (SELECT id FROM Jobs ORDER BY id DESC LIMIT ?) AND key=? GROUP BY value;", numJobs, fieldName)
+	if err != nil {
+		return nil, fmt.Errorf("error when getting field values for numJobs=%v and fieldName=%v: %w", numJobs, fieldName, err)
+	}
+	defer res.Close()
+	m := map[string]int{}
+	for res.Next() {
+		var value string
+		var count int
+		err = res.Scan(&value, &count)
+		if err != nil {
+			return nil, fmt.Errorf("error reading field values for numJobs=%v and fieldName=%v: %w", numJobs, fieldName, err)
+		}
+		m[value] = count
+	}
+	return m, nil
+}
+
 func (repo *sqliteJobRepository) Insert(query string, startTime, endTime *time.Time, sortMode events.SortMode, outputType pipeline.PipeType, columnOrder []string) (*int64, error) {
 	columnOrderJson, err := json.Marshal(columnOrder)
 	if err != nil {
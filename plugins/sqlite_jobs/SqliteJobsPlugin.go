@@ -18,17 +18,26 @@ import (
 	"log/slog"
 
 	"github.com/jackbister/logsuck/pkg/logsuck"
+	"github.com/jackbister/logsuck/plugins/sqlite_common"
 
 	"go.uber.org/dig"
 )
 
+const pluginName = "@logsuck/sqlite_jobs"
+
 var Plugin = logsuck.Plugin{
-	Name: "@logsuck/sqlite_jobs",
+	Name: pluginName,
 	Provide: func(c *dig.Container, logger *slog.Logger) error {
 		err := c.Provide(NewSqliteJobRepository)
 		if err != nil {
 			return err
 		}
+		err = c.Provide(func() sqlite_common.PluginMigrations {
+			return Migrations
+		}, dig.Group("sqliteMigrations"))
+		if err != nil {
+			return err
+		}
 		return nil
 	},
 }
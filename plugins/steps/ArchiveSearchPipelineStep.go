@@ -0,0 +1,225 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package steps
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/archive"
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/indexedfiles"
+	"github.com/jackbister/logsuck/pkg/logsuck/parser"
+	"github.com/jackbister/logsuck/pkg/logsuck/pipeline"
+	"github.com/jackbister/logsuck/pkg/logsuck/search"
+)
+
+// archiveSearchBatchSize is the number of archived events which are checked against the search at a time.
+const archiveSearchBatchSize = 1000
+
+// ArchiveSearchPipelineStep is like SearchPipelineStep, but reads the events from the files written by ArchiveTask instead of from the
+// repository. The days are searched newest first, and the index of each day is used to skip the days which cannot contain matching events.
+type ArchiveSearchPipelineStep struct {
+	Search             *search.Search
+	StartTime, EndTime *time.Time
+}
+
+func (s *ArchiveSearchPipelineStep) Execute(ctx context.Context, pipe pipeline.Pipe, params pipeline.Parameters) {
+	defer close(pipe.Output)
+
+	cfg, err := params.ConfigSource.Get()
+	if err != nil {
+		params.Logger.Error("got error when executing archivesearch pipeline step: failed to get config",
+			slog.Any("error", err))
+		return
+	}
+	dir, err := archive.Directory(&cfg.Cfg)
+	if err != nil {
+		params.Logger.Error("got error when executing archivesearch pipeline step: failed to get archive directory",
+			slog.Any("error", err))
+		return
+	}
+	days, err := archive.Days(dir)
+	if err != nil {
+		params.Logger.Error("got error when executing archivesearch pipeline step",
+			slog.Any("error", err))
+		return
+	}
+	indexedFiles, err := indexedfiles.ReadFileConfig(&cfg.Cfg, params.Logger)
+	if err != nil {
+		// TODO: signal error to rest of pipe??
+		return
+	}
+	cs := compileSearch(s.Search, params.Logger)
+	indexes := withDefaultIndexes(s.Search, cfg.Cfg.DefaultIndexes).Indexes
+
+	batch := make([]events.EventWithId, 0, archiveSearchBatchSize)
+	send := func() error {
+		res := cs.filterEvents(batch, indexedFiles, nil, params.Logger)
+		batch = batch[:0]
+		if len(res) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case pipe.Output <- pipeline.StepResult{Events: res}:
+			return nil
+		}
+	}
+	for i := len(days) - 1; i >= 0; i-- {
+		day := days[i]
+		idx, err := archive.ReadIndex(dir, day)
+		if err != nil {
+			params.Logger.Warn("failed to read archive index, the day will not be searched",
+				slog.String("day", day),
+				slog.Any("error", err))
+			continue
+		}
+		if !s.mayMatch(idx, cs) {
+			continue
+		}
+		err = archive.Read(dir, day, func(line int, evt archive.Event) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if (s.StartTime != nil && evt.Timestamp.Before(*s.StartTime)) || (s.EndTime != nil && evt.Timestamp.After(*s.EndTime)) {
+				return nil
+			}
+			if _, ok := indexes[indexOf(evt)]; len(indexes) > 0 && !ok {
+				return nil
+			}
+			// The fragments are normally matched by the repository, so they are not checked by filterEvents
+			if !cs.matchesFragments(evt.Raw) {
+				return nil
+			}
+			id, err := archive.EventId(day, line)
+			if err != nil {
+				return err
+			}
+			batch = append(batch, evt.WithId(id))
+			if len(batch) < archiveSearchBatchSize {
+				return nil
+			}
+			return send()
+		})
+		if err == nil {
+			err = send()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			params.Logger.Error("got error when reading archived events",
+				slog.String("day", day),
+				slog.Any("error", err))
+		}
+	}
+}
+
+// mayMatch returns false if the index shows that none of the events of the day can match the search.
+func (s *ArchiveSearchPipelineStep) mayMatch(idx *archive.Index, cs *compiledSearch) bool {
+	if (s.StartTime != nil && idx.EndTime.Before(*s.StartTime)) || (s.EndTime != nil && idx.StartTime.After(*s.EndTime)) {
+		return false
+	}
+	for key, values := range map[string][]string{"host": idx.Hosts, "source": idx.Sources, "index": idx.Indexes} {
+		if res, ok := cs.fields[key]; ok && !anyMatch(res, values) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cs *compiledSearch) matchesFragments(raw string) bool {
+	for _, re := range cs.frags {
+		if !re.MatchString(raw) {
+			return false
+		}
+	}
+	for _, re := range cs.notFrags {
+		if re.MatchString(raw) {
+			return false
+		}
+	}
+	return true
+}
+
+func anyMatch(res []*regexp.Regexp, values []string) bool {
+	for _, v := range values {
+		for _, re := range res {
+			if re.MatchString(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func indexOf(evt archive.Event) string {
+	if evt.Index == "" {
+		return events.DefaultIndex
+	}
+	return evt.Index
+}
+
+func (s *ArchiveSearchPipelineStep) Name() string {
+	return "archivesearch"
+}
+
+func (s *ArchiveSearchPipelineStep) InputType() pipeline.PipeType {
+	return pipeline.PipeTypeNone
+}
+
+func (s *ArchiveSearchPipelineStep) OutputType() pipeline.PipeType {
+	return pipeline.PipeTypeEvents
+}
+
+var archiveSearchStepDefinition = pipeline.StepDefinition{
+	StepName: "archivesearch",
+	Compiler: compileArchiveSearchStep,
+
+	Summary: "Retrieves archived events matching the given search from the files written by @logsuck/ArchiveTask.",
+	Value:   "<search>",
+	Options: []pipeline.StepOption{
+		{Name: "startTime", Description: "Only include events after this time.", Type: pipeline.StepOptionTypeTime},
+		{Name: "endTime", Description: "Only include events before this time.", Type: pipeline.StepOptionTypeTime},
+	},
+	Examples:   []string{`| archivesearch "source=*access* userId=123"`},
+	InputType:  pipeline.PipeTypeNone,
+	OutputType: pipeline.PipeTypeEvents,
+}
+
+func compileArchiveSearchStep(input string, options map[string]string) (pipeline.Step, error) {
+	startTime, err := parseTimeOption(options, "startTime")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create archivesearch: %w", err)
+	}
+	endTime, err := parseTimeOption(options, "endTime")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create archivesearch: %w", err)
+	}
+	srch, err := parser.Parse(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create archivesearch: %w", err)
+	}
+	return &ArchiveSearchPipelineStep{
+		Search:    srch,
+		StartTime: startTime,
+		EndTime:   endTime,
+	}, nil
+}
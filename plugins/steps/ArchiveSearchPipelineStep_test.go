@@ -0,0 +1,92 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package steps
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/archive"
+	"github.com/jackbister/logsuck/pkg/logsuck/config"
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/pipeline"
+)
+
+func TestArchiveSearchPipelineStep(t *testing.T) {
+	dir := t.TempDir()
+	for d := 1; d <= 3; d++ {
+		host := "otherhost"
+		if d == 2 {
+			host = "MYHOST"
+		}
+		err := archive.Append(dir, archive.Day(time.Date(2021, 1, d, 0, 0, 0, 0, time.UTC)), []events.EventWithId{
+			{Raw: "2021-01-0x userid=42", Timestamp: time.Date(2021, 1, d, 10, 0, 0, 0, time.UTC), Host: host, Source: "my-log.txt", Index: "main"},
+			{Raw: "2021-01-0x userid=43", Timestamp: time.Date(2021, 1, d, 11, 0, 0, 0, time.UTC), Host: host, Source: "my-log.txt", Index: "main"},
+		})
+		if err != nil {
+			t.Fatalf("got error when archiving events: %v", err)
+		}
+	}
+	cfgSource := newConfigSource().(*TestConfigSource)
+	cfgSource.config.Tasks = map[string]config.TaskConfig{
+		archive.TaskName: {Name: archive.TaskName, Config: map[string]any{"directory": dir}},
+	}
+	params := pipeline.Parameters{
+		ConfigSource: cfgSource,
+		EventsRepo:   newInMemRepo(t),
+
+		Logger: slog.Default(),
+	}
+
+	tests := []struct {
+		search         string
+		options        map[string]string
+		expectedEvents int
+	}{
+		{search: "userid=42", options: map[string]string{}, expectedEvents: 3},
+		{search: "userid=42 host=MYHOST", options: map[string]string{}, expectedEvents: 1},
+		{search: "", options: map[string]string{"startTime": "2021-01-02T10:30:00Z", "endTime": "2021-01-03T10:30:00Z"}, expectedEvents: 2},
+		{search: "index=other", options: map[string]string{}, expectedEvents: 0},
+		{search: "userid", options: map[string]string{}, expectedEvents: 6},
+		{search: "userid NOT 42", options: map[string]string{}, expectedEvents: 3},
+		{search: "user", options: map[string]string{}, expectedEvents: 0},
+	}
+	for _, tt := range tests {
+		step, err := archiveSearchStepDefinition.Compile(tt.search, tt.options)
+		if err != nil {
+			t.Fatalf("got error when compiling archivesearch with search=%v: %v", tt.search, err)
+		}
+		pipe, input, output := newPipe()
+		close(input)
+		go step.Execute(context.Background(), pipe, params)
+		evts := []events.EventWithExtractedFields{}
+		for res := range output {
+			evts = append(evts, res.Events...)
+		}
+		if len(evts) != tt.expectedEvents {
+			t.Fatalf("expected %v events for search=%v, got %v", tt.expectedEvents, tt.search, evts)
+		}
+		for i, evt := range evts {
+			if _, _, ok := archive.ParseEventId(evt.Id); !ok {
+				t.Fatalf("expected archived event to have the ID of an archived event, got id=%v", evt.Id)
+			}
+			if i > 0 && evt.Timestamp.After(evts[i-1].Timestamp) && archive.Day(evt.Timestamp) != archive.Day(evts[i-1].Timestamp) {
+				t.Fatalf("expected newest days to be searched first, got %v after %v", evt.Timestamp, evts[i-1].Timestamp)
+			}
+		}
+	}
+}
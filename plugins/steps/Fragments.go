@@ -15,12 +15,12 @@
 package steps
 
 import (
-	"fmt"
 	"log/slog"
 	"regexp"
 	"strings"
 
 	"github.com/jackbister/logsuck/pkg/logsuck/parser"
+	"github.com/jackbister/logsuck/pkg/logsuck/search"
 
 	"github.com/jackbister/logsuck/pkg/logsuck/events"
 )
@@ -28,7 +28,7 @@ import (
 func compileMultipleFrags(frags []string, logger *slog.Logger) []*regexp.Regexp {
 	ret := make([]*regexp.Regexp, 0, len(frags))
 	for _, frag := range frags {
-		compiled, err := compileFrag(frag)
+		compiled, err := search.CompileFragment(frag)
 		if err != nil {
 			logger.Warn("failed to compile fragment, fragment will not be included",
 				slog.String("fragment", frag),
@@ -57,7 +57,7 @@ func compileFieldValues(m map[string][]string, logger *slog.Logger) map[string][
 	for key, values := range m {
 		compiledValues := make([]*regexp.Regexp, len(values))
 		for i, value := range values {
-			compiled, err := compileFrag(value)
+			compiled, err := search.CompileFragment(value)
 			if err != nil {
 				logger.Warn("failed to compile fieldValue, fieldValue will not be included",
 					slog.String("fieldValue", value),
@@ -71,23 +71,6 @@ func compileFieldValues(m map[string][]string, logger *slog.Logger) map[string][
 	return ret
 }
 
-func compileFrag(frag string) (*regexp.Regexp, error) {
-	pre := "(?i)(^|\\W)"
-	if strings.HasPrefix(frag, "*") {
-		pre = ""
-	}
-	post := "($|\\W)"
-	if strings.HasSuffix(frag, "*") {
-		post = ""
-	}
-	rexString := pre + strings.Replace(frag, "*", ".*", -1) + post
-	rex, err := regexp.Compile(rexString)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to compile rexString="+rexString+": %w", err)
-	}
-	return rex, nil
-}
-
 func shouldIncludeEvent(evt events.EventWithId,
 	internalParser parser.FileParser,
 	compiledFrags []*regexp.Regexp, compiledNotFrags []*regexp.Regexp,
@@ -96,6 +79,7 @@ func shouldIncludeEvent(evt events.EventWithId,
 	// TODO: This could produce unexpected results
 	evtFields["host"] = evt.Host
 	evtFields["source"] = evt.Source
+	evtFields["index"] = evt.Index
 
 	include := true
 	for key, values := range compiledFields {
@@ -104,13 +88,7 @@ func shouldIncludeEvent(evt events.EventWithId,
 			include = false
 			break
 		}
-		anyMatch := false
-		for _, value := range values {
-			if value.MatchString(evtValue) {
-				anyMatch = true
-			}
-		}
-		if !anyMatch {
+		if !anyMatches(values, evtValue) {
 			include = false
 			break
 		}
@@ -118,18 +96,26 @@ func shouldIncludeEvent(evt events.EventWithId,
 	for key, values := range compiledNotFields {
 		evtValue, ok := evtFields[key]
 		if !ok {
-			break
+			continue
 		}
-		anyMatch := false
-		for _, value := range values {
-			if value.MatchString(evtValue) {
-				anyMatch = true
-			}
-		}
-		if anyMatch {
+		if anyMatches(values, evtValue) {
 			include = false
 			break
 		}
 	}
 	return evtFields, include
 }
+
+func anyMatches(values []*regexp.Regexp, s string) bool {
+	for _, value := range values {
+		if value.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// isColumnField returns true if the field is stored with the event instead of being extracted from it.
+func isColumnField(key string) bool {
+	return key == "host" || key == "source" || key == "index"
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package steps
+
+import (
+	"context"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/pipeline"
+)
+
+// reversePipelineStep reverses the order of the events. It does not reorder anything itself, instead the pipeline compiler reverses
+// the order of the step producing the events so they are retrieved in the reversed order from the start.
+type reversePipelineStep struct{}
+
+func (s *reversePipelineStep) Execute(ctx context.Context, pipe pipeline.Pipe, params pipeline.Parameters) {
+	defer close(pipe.Output)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case res, ok := <-pipe.Input:
+			if !ok {
+				return
+			}
+			pipe.Output <- res
+		}
+	}
+}
+
+func (s *reversePipelineStep) ReversesOrder() {}
+
+func (s *reversePipelineStep) Name() string {
+	return "reverse"
+}
+
+func (s *reversePipelineStep) InputType() pipeline.PipeType {
+	return pipeline.PipeTypeEvents
+}
+
+func (s *reversePipelineStep) OutputType() pipeline.PipeType {
+	return pipeline.PipeTypeEvents
+}
+
+var reverseStepDefinition = pipeline.StepDefinition{
+	StepName: "reverse",
+	Compiler: compileReverseStep,
+
+	Summary:              "Reverses the order of the events so that the oldest events are shown first.",
+	Options:              []pipeline.StepOption{},
+	IgnoreUnknownOptions: true,
+	Examples:             []string{`| search "userId=123" | reverse`},
+	InputType:            pipeline.PipeTypeEvents,
+	OutputType:           pipeline.PipeTypeEvents,
+}
+
+func compileReverseStep(input string, options map[string]string) (pipeline.Step, error) {
+	return &reversePipelineStep{}, nil
+}
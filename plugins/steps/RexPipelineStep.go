@@ -85,11 +85,25 @@ func (r *RexPipelineStep) OutputType() pipeline.PipeType {
 	return pipeline.PipeTypeEvents
 }
 
+var rexStepDefinition = pipeline.StepDefinition{
+	StepName: "rex",
+	Compiler: compileRexStep,
+
+	Summary: "Extracts new fields from an existing field using a regular expression.",
+	Value:   "<regex>",
+	Options: []pipeline.StepOption{
+		{Name: "field", Description: "The field to extract from.", Type: pipeline.StepOptionTypeString, Default: "_raw"},
+	},
+	Examples: []string{
+		`| rex "userId (?P<userId>\d+)"`,
+		`| rex field=source "(?P<app>\w+)\.log"`,
+	},
+	InputType:  pipeline.PipeTypeEvents,
+	OutputType: pipeline.PipeTypeEvents,
+}
+
 func compileRexStep(input string, options map[string]string) (pipeline.Step, error) {
-	field, ok := options["field"]
-	if !ok {
-		field = "_raw"
-	}
+	field := options["field"]
 
 	regex, err := regexp.Compile(input)
 	if err != nil {
@@ -26,7 +26,7 @@ import (
 )
 
 func TestRexPipelineStep(t *testing.T) {
-	rps, err := compileRexStep("userid was (?P<userid>\\d+).", map[string]string{})
+	rps, err := rexStepDefinition.Compile("userid was (?P<userid>\\d+).", map[string]string{})
 	if err != nil {
 		t.Fatalf("TestRexPipelineStep got unexpected error: %v", err)
 	}
@@ -61,7 +61,7 @@ func TestRexPipelineStep(t *testing.T) {
 }
 
 func TestRexPipelineStep_MultipleExtractions(t *testing.T) {
-	rps, err := compileRexStep("(\\w+)=(\\w+)", map[string]string{})
+	rps, err := rexStepDefinition.Compile("(\\w+)=(\\w+)", map[string]string{})
 	if err != nil {
 		t.Fatalf("TestRexPipelineStep got unexpected error: %v", err)
 	}
@@ -97,7 +97,7 @@ func TestRexPipelineStep_MultipleExtractions(t *testing.T) {
 }
 
 func TestRexPipelineStep_ExtractedField(t *testing.T) {
-	rps, err := compileRexStep("userid was (?P<userid>\\d+).", map[string]string{
+	rps, err := rexStepDefinition.Compile("userid was (?P<userid>\\d+).", map[string]string{
 		"field": "MyExtractedField",
 	})
 	if err != nil {
@@ -136,7 +136,7 @@ func TestRexPipelineStep_ExtractedField(t *testing.T) {
 }
 
 func TestRexPipelineStep_Source(t *testing.T) {
-	rps, err := compileRexStep("log-(?P<logid>\\d+)", map[string]string{
+	rps, err := rexStepDefinition.Compile("log-(?P<logid>\\d+)", map[string]string{
 		"field": "source",
 	})
 	if err != nil {
@@ -173,7 +173,7 @@ func TestRexPipelineStep_Source(t *testing.T) {
 }
 
 func TestRexPipelineStep_Host(t *testing.T) {
-	rps, err := compileRexStep("host-(?P<hostid>\\d+)", map[string]string{
+	rps, err := rexStepDefinition.Compile("host-(?P<hostid>\\d+)", map[string]string{
 		"field": "host",
 	})
 	if err != nil {
@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"regexp"
 	"time"
 
 	"github.com/araddon/dateparse"
@@ -32,6 +33,8 @@ import (
 type SearchPipelineStep struct {
 	Search             *search.Search
 	StartTime, EndTime *time.Time
+	// Reversed is true if the events should be returned oldest first instead of newest first.
+	Reversed bool
 }
 
 func (s *SearchPipelineStep) Execute(ctx context.Context, pipe pipeline.Pipe, params pipeline.Parameters) {
@@ -44,11 +47,17 @@ func (s *SearchPipelineStep) Execute(ctx context.Context, pipe pipeline.Pipe, pa
 		return
 	}
 
-	inputEvents := params.EventsRepo.FilterStream(s.Search, s.StartTime, s.EndTime)
-	compiledFrags := compileKeys(s.Search.Fragments, params.Logger)
-	compiledNotFrags := compileKeys(s.Search.NotFragments, params.Logger)
-	compiledFields := compileFieldValues(s.Search.Fields, params.Logger)
-	compiledNotFields := compileFieldValues(s.Search.NotFields, params.Logger)
+	indexedFiles, err := indexedfiles.ReadFileConfig(&cfg.Cfg, params.Logger)
+	if err != nil {
+		params.Logger.Error("got error when executing search pipeline step: failed to read file config",
+			slog.Any("error", err))
+		return
+	}
+
+	srch := withIndexedFieldsVersions(withDefaultIndexes(s.Search, cfg.Cfg.DefaultIndexes), indexedFiles)
+	inputEvents := params.EventsRepo.FilterStream(srch, s.StartTime, s.EndTime, s.SortMode())
+	cs := compileSearch(s.Search, params.Logger)
+	fieldReader, _ := params.EventsRepo.(events.IndexedFieldReader)
 
 	for {
 		select {
@@ -58,36 +67,16 @@ func (s *SearchPipelineStep) Execute(ctx context.Context, pipe pipeline.Pipe, pa
 			if !ok {
 				return
 			}
-			indexedFiles, err := indexedfiles.ReadFileConfig(&cfg.Cfg, params.Logger)
-			if err != nil {
-				// TODO: signal error to rest of pipe??
-				return
-			}
-			sourceToIfc := getSourceToIndexedFileConfig(evts, indexedFiles)
-			retEvts := make([]events.EventWithExtractedFields, 0)
-			for _, evt := range evts {
-				ifc, ok := sourceToIfc[evt.Source]
-				if !ok {
-					// TODO: How does the user get feedback about this?
-					params.Logger.Warn("failed to find file configuration for event, this event will be ignored",
-						slog.String("source", evt.Source))
-					continue
-				}
-				evtFields, include := shouldIncludeEvent(evt, ifc.FileParser, compiledFrags, compiledNotFrags, compiledFields, compiledNotFields)
-				if include {
-					retEvts = append(retEvts, events.EventWithExtractedFields{
-						Id:        evt.Id,
-						Raw:       evt.Raw,
-						Timestamp: evt.Timestamp,
-						Host:      evt.Host,
-						Source:    evt.Source,
-						SourceId:  evt.SourceId,
-						Fields:    evtFields,
-					})
+			var stored map[int64]events.StoredFields
+			if fieldReader != nil && cs.hasFieldConditions() {
+				stored, err = fieldReader.GetIndexedFields(eventIds(evts))
+				if err != nil {
+					params.Logger.Warn("failed to get indexed fields, will extract the fields from the events instead",
+						slog.Any("error", err))
 				}
 			}
 			pipe.Output <- pipeline.StepResult{
-				Events: retEvts,
+				Events: cs.filterEvents(evts, indexedFiles, stored, params.Logger),
 			}
 		}
 	}
@@ -105,21 +94,194 @@ func (r *SearchPipelineStep) OutputType() pipeline.PipeType {
 	return pipeline.PipeTypeEvents
 }
 
-func compileSearchStep(input string, options map[string]string) (pipeline.Step, error) {
-	var startTime, endTime *time.Time
-	if t, ok := options["startTime"]; ok {
-		startTimeParsed, err := dateparse.ParseStrict(t)
+func (s *SearchPipelineStep) SortMode() events.SortMode {
+	if s.Reversed {
+		return events.SortModeTimestampAsc
+	}
+	return events.SortModeTimestampDesc
+}
+
+func (s *SearchPipelineStep) Reverse() {
+	s.Reversed = !s.Reversed
+}
+
+func (s *SearchPipelineStep) Explain(params pipeline.Parameters) (map[string]any, error) {
+	ret := map[string]any{
+		// Fragments and fields are always checked by shouldIncludeEvent, even if the repository also filters on some of them
+		"inProcessFilters": append(s.Search.DescribeFragments(), s.Search.DescribeFields()...),
+	}
+	if fe, ok := params.EventsRepo.(events.FilterExplainer); ok {
+		cfg, err := params.ConfigSource.Get()
 		if err != nil {
-			return nil, fmt.Errorf("failed to create search: error parsing startTime: %w", err)
+			return nil, fmt.Errorf("failed to get config: %w", err)
 		}
-		startTime = &startTimeParsed
-	}
-	if t, ok := options["endTime"]; ok {
-		endTimeParsed, err := dateparse.ParseStrict(t)
+		indexedFiles, err := indexedfiles.ReadFileConfig(&cfg.Cfg, params.Logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file config: %w", err)
+		}
+		srch := withIndexedFieldsVersions(withDefaultIndexes(s.Search, cfg.Cfg.DefaultIndexes), indexedFiles)
+		explanation, err := fe.ExplainFilter(srch, s.StartTime, s.EndTime, s.SortMode())
 		if err != nil {
-			return nil, fmt.Errorf("failed to create search: error parsing endTime: %w", err)
+			return nil, fmt.Errorf("failed to explain search: %w", err)
+		}
+		ret["repository"] = explanation
+	}
+	return ret, nil
+}
+
+// compiledSearch contains the regular expressions used to check whether events match a search.
+type compiledSearch struct {
+	frags, notFrags   []*regexp.Regexp
+	fields, notFields map[string][]*regexp.Regexp
+}
+
+func compileSearch(srch *search.Search, logger *slog.Logger) *compiledSearch {
+	return &compiledSearch{
+		frags:     compileKeys(srch.Fragments, logger),
+		notFrags:  compileKeys(srch.NotFragments, logger),
+		fields:    compileFieldValues(srch.Fields, logger),
+		notFields: compileFieldValues(srch.NotFields, logger),
+	}
+}
+
+// hasFieldConditions returns true if the search contains conditions on fields which may be indexed fields.
+func (cs *compiledSearch) hasFieldConditions() bool {
+	for k := range cs.fields {
+		if !isColumnField(k) {
+			return true
+		}
+	}
+	for k := range cs.notFields {
+		if !isColumnField(k) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedByStoredFields returns true if the indexed fields saved with an event show that the event does not match the field conditions of
+// the search, so that the fields do not have to be extracted from the event. indexedFields are the names of the indexed fields which
+// were extracted when the fields were saved. Conditions on other fields can only be checked by extracting the fields.
+func (cs *compiledSearch) excludedByStoredFields(fields map[string]string, indexedFields map[string]struct{}) bool {
+	for key, values := range cs.fields {
+		if _, ok := indexedFields[key]; !ok || isColumnField(key) {
+			continue
+		}
+		// Indexed fields which were not found in the event are not saved
+		value, ok := fields[key]
+		if !ok || !anyMatches(values, value) {
+			return true
+		}
+	}
+	for key, values := range cs.notFields {
+		if _, ok := indexedFields[key]; !ok || isColumnField(key) {
+			continue
 		}
-		endTime = &endTimeParsed
+		if value, ok := fields[key]; ok && anyMatches(values, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterEvents returns the events which match the search together with the fields extracted from them. stored contains the indexed fields
+// saved with the events, which are used to exclude events that do not match the search without extracting their fields. Indexed fields
+// saved with another version of the field extraction than the current one are ignored, since their values may be stale.
+func (cs *compiledSearch) filterEvents(evts []events.EventWithId, indexedFiles []indexedfiles.IndexedFileConfig, stored map[int64]events.StoredFields, logger *slog.Logger) []events.EventWithExtractedFields {
+	sourceToIfc := getSourceToIndexedFileConfig(evts, indexedFiles)
+	sourceToVersion := map[string]string{}
+	sourceToIndexedFields := map[string]map[string]struct{}{}
+	retEvts := make([]events.EventWithExtractedFields, 0)
+	for _, evt := range evts {
+		ifc, ok := sourceToIfc[evt.Source]
+		if !ok {
+			// TODO: How does the user get feedback about this?
+			logger.Warn("failed to find file configuration for event, this event will be ignored",
+				slog.String("source", evt.Source))
+			continue
+		}
+		if sf, ok := stored[evt.Id]; ok {
+			version, ok := sourceToVersion[evt.Source]
+			if !ok {
+				version = parser.ExtractorVersion(ifc.FileParser, ifc.IndexedFields)
+				sourceToVersion[evt.Source] = version
+				sourceToIndexedFields[evt.Source] = lowercaseSet(ifc.IndexedFields)
+			}
+			if version != "" && sf.Version == version && cs.excludedByStoredFields(sf.Fields, sourceToIndexedFields[evt.Source]) {
+				continue
+			}
+		}
+		evtFields, include := shouldIncludeEvent(evt, ifc.FileParser, cs.frags, cs.notFrags, cs.fields, cs.notFields)
+		if include {
+			retEvts = append(retEvts, events.EventWithExtractedFields{
+				Id:        evt.Id,
+				Raw:       evt.Raw,
+				Timestamp: evt.Timestamp,
+				Host:      evt.Host,
+				Source:    evt.Source,
+				SourceId:  evt.SourceId,
+				Index:     evt.Index,
+				Fields:    evtFields,
+			})
+		}
+	}
+	return retEvts
+}
+
+// withIndexedFieldsVersions returns a copy of the search with the versions of the field extraction of the indexed files, so that the
+// repository only uses indexed fields which are up to date to narrow down the events.
+func withIndexedFieldsVersions(srch *search.Search, indexedFiles []indexedfiles.IndexedFileConfig) *search.Search {
+	versions := map[string]struct{}{}
+	for _, ifc := range indexedFiles {
+		if v := parser.ExtractorVersion(ifc.FileParser, ifc.IndexedFields); v != "" {
+			versions[v] = struct{}{}
+		}
+	}
+	if len(versions) == 0 {
+		return srch
+	}
+	ret := *srch
+	ret.IndexedFieldsVersions = versions
+	return &ret
+}
+
+// withDefaultIndexes returns a copy of the search which only includes the default indexes if the search does not specify which indexes to
+// include. Since the field values of index are always checked by shouldIncludeEvent, only the repository needs to know about the defaults.
+func withDefaultIndexes(srch *search.Search, defaultIndexes []string) *search.Search {
+	if len(srch.Indexes) > 0 || len(defaultIndexes) == 0 {
+		return srch
+	}
+	ret := *srch
+	ret.Indexes = make(map[string]struct{}, len(defaultIndexes))
+	for _, idx := range defaultIndexes {
+		ret.Indexes[idx] = struct{}{}
+	}
+	return &ret
+}
+
+var searchStepDefinition = pipeline.StepDefinition{
+	StepName: "search",
+	Compiler: compileSearchStep,
+
+	Summary: "Retrieves events matching the given search.",
+	Value:   "<search>",
+	Options: []pipeline.StepOption{
+		{Name: "startTime", Description: "Only include events after this time.", Type: pipeline.StepOptionTypeTime},
+		{Name: "endTime", Description: "Only include events before this time.", Type: pipeline.StepOptionTypeTime},
+	},
+	Examples:   []string{`| search "source=*access* userId=123"`},
+	InputType:  pipeline.PipeTypeNone,
+	OutputType: pipeline.PipeTypeEvents,
+}
+
+func compileSearchStep(input string, options map[string]string) (pipeline.Step, error) {
+	startTime, err := parseTimeOption(options, "startTime")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create search: %w", err)
+	}
+	endTime, err := parseTimeOption(options, "endTime")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create search: %w", err)
 	}
 
 	srch, err := parser.Parse(input)
@@ -132,3 +294,16 @@ func compileSearchStep(input string, options map[string]string) (pipeline.Step,
 		EndTime:   endTime,
 	}, nil
 }
+
+// parseTimeOption parses the time in the option with the given name. Returns nil if the option is not set.
+func parseTimeOption(options map[string]string, name string) (*time.Time, error) {
+	t, ok := options[name]
+	if !ok {
+		return nil, nil
+	}
+	parsed, err := dateparse.ParseStrict(t)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %v: %w", name, err)
+	}
+	return &parsed, nil
+}
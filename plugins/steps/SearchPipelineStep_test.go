@@ -17,15 +17,20 @@ package steps
 import (
 	"context"
 	"log/slog"
+	"reflect"
+	"regexp"
 	"testing"
 	"time"
 
+	"github.com/jackbister/logsuck/pkg/logsuck/config"
 	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/indexedfiles"
+	"github.com/jackbister/logsuck/pkg/logsuck/parser"
 	"github.com/jackbister/logsuck/pkg/logsuck/pipeline"
 )
 
 func TestSearchPipelineStep(t *testing.T) {
-	sps, err := compileSearchStep("", map[string]string{})
+	sps, err := searchStepDefinition.Compile("", map[string]string{})
 	if err != nil {
 		t.Fatalf("TestSearchPipelineStep got unexpected error: %v", err)
 	}
@@ -63,3 +68,266 @@ func TestSearchPipelineStep(t *testing.T) {
 		t.Fatal("TestSearchPipelineStep got unexpected ok when receiving output, expected the channel to be closed by now")
 	}
 }
+
+func TestSearchPipelineStep_FieldValuesAreVerifiedAfterPushdown(t *testing.T) {
+	sps, err := searchStepDefinition.Compile("userid=42", map[string]string{})
+	if err != nil {
+		t.Fatalf("TestSearchPipelineStep_FieldValuesAreVerifiedAfterPushdown got unexpected error: %v", err)
+	}
+	repo := newInMemRepo(t)
+	params := pipeline.Parameters{
+		ConfigSource: newConfigSource(),
+		EventsRepo:   repo,
+
+		Logger: slog.Default(),
+	}
+	pipe, input, output := newPipe()
+	close(input)
+	repo.AddBatch([]events.Event{
+		{
+			Raw:       "2021-01-20 20:29:00 userid=42",
+			Host:      "MYHOST",
+			Offset:    0,
+			Source:    "my-log.txt",
+			SourceId:  "1a9a7cd6-0f00-4aa6-ae2e-1ad17d40bb35",
+			Timestamp: time.Date(2021, 1, 20, 20, 29, 0, 0, time.UTC),
+		},
+		{
+			// Contains the token 42, so it is a candidate, but the userid field does not match
+			Raw:       "2021-01-20 20:29:01 userid=7 count=42",
+			Host:      "MYHOST",
+			Offset:    1,
+			Source:    "my-log.txt",
+			SourceId:  "1a9a7cd6-0f00-4aa6-ae2e-1ad17d40bb35",
+			Timestamp: time.Date(2021, 1, 20, 20, 29, 1, 0, time.UTC),
+		},
+		{
+			Raw:       "2021-01-20 20:29:02 userid=7",
+			Host:      "MYHOST",
+			Offset:    2,
+			Source:    "my-log.txt",
+			SourceId:  "1a9a7cd6-0f00-4aa6-ae2e-1ad17d40bb35",
+			Timestamp: time.Date(2021, 1, 20, 20, 29, 2, 0, time.UTC),
+		},
+	})
+
+	go sps.Execute(context.Background(), pipe, params)
+
+	result, ok := <-output
+	if !ok {
+		t.Fatal("TestSearchPipelineStep_FieldValuesAreVerifiedAfterPushdown got unexpected !ok when receiving output")
+	}
+	if len(result.Events) != 1 {
+		t.Fatalf("TestSearchPipelineStep_FieldValuesAreVerifiedAfterPushdown got unexpected number of events, expected 1 but got %v", len(result.Events))
+	}
+	if result.Events[0].Fields["userid"] != "42" {
+		t.Fatalf("TestSearchPipelineStep_FieldValuesAreVerifiedAfterPushdown got unexpected event, expected userid=42 but got %v", result.Events[0].Raw)
+	}
+}
+
+func TestSearchPipelineStep_FieldValueInsideToken(t *testing.T) {
+	sps, err := searchStepDefinition.Compile("duration=42", map[string]string{})
+	if err != nil {
+		t.Fatalf("TestSearchPipelineStep_FieldValueInsideToken got unexpected error: %v", err)
+	}
+	repo := newInMemRepo(t)
+	cs := newConfigSource().(*TestConfigSource)
+	ft := cs.config.FileTypes["DEFAULT"]
+	// The extracted value 42 is only part of the token 42ms in the raw event
+	ft.Regex = &config.RegexParserConfig{
+		EventDelimiter:  regexp.MustCompile("\n"),
+		FieldExtractors: []*regexp.Regexp{regexp.MustCompile("(\\w+)=(\\d+)")},
+	}
+	cs.config.FileTypes["DEFAULT"] = ft
+	params := pipeline.Parameters{
+		ConfigSource: cs,
+		EventsRepo:   repo,
+
+		Logger: slog.Default(),
+	}
+	pipe, input, output := newPipe()
+	close(input)
+	repo.AddBatch([]events.Event{
+		{
+			Raw:       "2021-01-20 20:29:00 duration=42ms",
+			Host:      "MYHOST",
+			Offset:    0,
+			Source:    "my-log.txt",
+			SourceId:  "1a9a7cd6-0f00-4aa6-ae2e-1ad17d40bb35",
+			Timestamp: time.Date(2021, 1, 20, 20, 29, 0, 0, time.UTC),
+		},
+	})
+
+	go sps.Execute(context.Background(), pipe, params)
+
+	result, ok := <-output
+	if !ok {
+		t.Fatal("TestSearchPipelineStep_FieldValueInsideToken got unexpected !ok when receiving output")
+	}
+	if len(result.Events) != 1 {
+		t.Fatalf("TestSearchPipelineStep_FieldValueInsideToken got unexpected number of events, expected 1 but got %v", len(result.Events))
+	}
+}
+
+// The search step must match fragments and field values in the same way as the repositories, see search.CompileFragment.
+func TestSearchPipelineStep_MatchesLikeRepositories(t *testing.T) {
+	tests := []struct {
+		search   string
+		expected []string
+	}{
+		// . must only match itself, not any character
+		{"code=1.3", []string{"code=1.3"}},
+		// A leading wildcard must not make the fragment case sensitive
+		{"*ERROR", []string{"fatal error"}},
+	}
+	for _, tt := range tests {
+		sps, err := searchStepDefinition.Compile(tt.search, map[string]string{})
+		if err != nil {
+			t.Fatalf("got unexpected error when compiling search=%v: %v", tt.search, err)
+		}
+		repo := newInMemRepo(t)
+		cs := newConfigSource().(*TestConfigSource)
+		ft := cs.config.FileTypes["DEFAULT"]
+		ft.Regex = &config.RegexParserConfig{
+			EventDelimiter:  regexp.MustCompile("\n"),
+			FieldExtractors: []*regexp.Regexp{regexp.MustCompile("(\\w+)=(\\S+)")},
+		}
+		cs.config.FileTypes["DEFAULT"] = ft
+		params := pipeline.Parameters{
+			ConfigSource: cs,
+			EventsRepo:   repo,
+
+			Logger: slog.Default(),
+		}
+		pipe, input, output := newPipe()
+		close(input)
+		for i, raw := range []string{"code=123", "code=1.3", "fatal error"} {
+			repo.AddBatch([]events.Event{
+				{
+					Raw:       raw,
+					Host:      "MYHOST",
+					Offset:    int64(i),
+					Source:    "my-log.txt",
+					SourceId:  "1a9a7cd6-0f00-4aa6-ae2e-1ad17d40bb35",
+					Timestamp: time.Date(2021, 1, 20, 20, 29, i, 0, time.UTC),
+				},
+			})
+		}
+
+		go sps.Execute(context.Background(), pipe, params)
+
+		raws := []string{}
+		for result := range output {
+			for _, evt := range result.Events {
+				raws = append(raws, evt.Raw)
+			}
+		}
+		if !reflect.DeepEqual(raws, tt.expected) {
+			t.Fatalf("got unexpected events for search=%v, expected=%v, got=%v", tt.search, tt.expected, raws)
+		}
+	}
+}
+
+func TestSearchPipelineStep_NotFieldsAfterMissingField(t *testing.T) {
+	// Go randomizes the iteration order of maps, so the search is repeated to make sure that level is checked after one of the fields
+	// which are missing from the events
+	for i := 0; i < 5; i++ {
+		sps, err := searchStepDefinition.Compile("a!=x b!=x c!=x d!=x level!=debug", map[string]string{})
+		if err != nil {
+			t.Fatalf("got unexpected error when compiling search: %v", err)
+		}
+		repo := newInMemRepo(t)
+		cs := newConfigSource().(*TestConfigSource)
+		params := pipeline.Parameters{
+			ConfigSource: cs,
+			EventsRepo:   repo,
+
+			Logger: slog.Default(),
+		}
+		pipe, input, output := newPipe()
+		close(input)
+		for j, raw := range []string{"level=debug", "level=info"} {
+			repo.AddBatch([]events.Event{
+				{
+					Raw:       raw,
+					Host:      "MYHOST",
+					Offset:    int64(j),
+					Source:    "my-log.txt",
+					SourceId:  "1a9a7cd6-0f00-4aa6-ae2e-1ad17d40bb35",
+					Timestamp: time.Date(2021, 1, 20, 20, 29, j, 0, time.UTC),
+				},
+			})
+		}
+
+		go sps.Execute(context.Background(), pipe, params)
+
+		raws := []string{}
+		for result := range output {
+			for _, evt := range result.Events {
+				raws = append(raws, evt.Raw)
+			}
+		}
+		if !reflect.DeepEqual(raws, []string{"level=info"}) {
+			t.Fatalf("got unexpected events, expected=[level=info], got=%v", raws)
+		}
+	}
+}
+
+func TestSearchPipelineStep_UsesCurrentIndexedFields(t *testing.T) {
+	// status!=5* has a wildcard so it is not pushed down to the repository, and is only checked by the search step
+	sps, err := searchStepDefinition.Compile("status!=5*", map[string]string{})
+	if err != nil {
+		t.Fatalf("got unexpected error when compiling search: %v", err)
+	}
+	repo := newInMemRepo(t)
+	cs := newConfigSource().(*TestConfigSource)
+	ft := cs.config.FileTypes["DEFAULT"]
+	ft.IndexedFields = []string{"status"}
+	cs.config.FileTypes["DEFAULT"] = ft
+	indexedFiles, err := indexedfiles.ReadFileConfig(&cs.config, slog.Default())
+	if err != nil {
+		t.Fatalf("got unexpected error when reading file config: %v", err)
+	}
+	version := parser.ExtractorVersion(indexedFiles[0].FileParser, indexedFiles[0].IndexedFields)
+	params := pipeline.Parameters{
+		ConfigSource: cs,
+		EventsRepo:   repo,
+
+		Logger: slog.Default(),
+	}
+	pipe, input, output := newPipe()
+	close(input)
+	// The saved value of status differs from the value in the event, which shows whether the saved value was used
+	for i, tt := range []struct {
+		raw     string
+		version string
+	}{
+		{"status=200", version},
+		{"status=201", "stale"},
+	} {
+		repo.AddBatch([]events.Event{
+			{
+				Raw:                  tt.raw,
+				Host:                 "MYHOST",
+				Offset:               int64(i),
+				Source:               "my-log.txt",
+				SourceId:             "1a9a7cd6-0f00-4aa6-ae2e-1ad17d40bb35",
+				Timestamp:            time.Date(2021, 1, 20, 20, 29, i, 0, time.UTC),
+				IndexedFields:        map[string]string{"status": "500"},
+				IndexedFieldsVersion: tt.version,
+			},
+		})
+	}
+
+	go sps.Execute(context.Background(), pipe, params)
+
+	raws := []string{}
+	for result := range output {
+		for _, evt := range result.Events {
+			raws = append(raws, evt.Raw)
+		}
+	}
+	if !reflect.DeepEqual(raws, []string{"status=201"}) {
+		t.Fatalf("expected only the event with stale indexed fields to be returned, got=%v", raws)
+	}
+}
@@ -25,50 +25,22 @@ import (
 var Plugin = logsuck.Plugin{
 	Name: "@logsuck/steps",
 	Provide: func(c *dig.Container, logger *slog.Logger) error {
-		err := c.Provide(func() pipeline.StepDefinition {
-			return pipeline.StepDefinition{
-				StepName: "rex",
-				Compiler: compileRexStep,
+		for _, sd := range []pipeline.StepDefinition{
+			archiveSearchStepDefinition,
+			rexStepDefinition,
+			reverseStepDefinition,
+			searchStepDefinition,
+			surroundingStepDefinition,
+			tableStepDefinition,
+			whereStepDefinition,
+		} {
+			sd := sd
+			err := c.Provide(func() pipeline.StepDefinition {
+				return sd
+			}, dig.Group("steps"))
+			if err != nil {
+				return err
 			}
-		}, dig.Group("steps"))
-		if err != nil {
-			return err
-		}
-		err = c.Provide(func() pipeline.StepDefinition {
-			return pipeline.StepDefinition{
-				StepName: "search",
-				Compiler: compileSearchStep,
-			}
-		}, dig.Group("steps"))
-		if err != nil {
-			return err
-		}
-		err = c.Provide(func() pipeline.StepDefinition {
-			return pipeline.StepDefinition{
-				StepName: "surrounding",
-				Compiler: compileSurroundingStep,
-			}
-		}, dig.Group("steps"))
-		if err != nil {
-			return err
-		}
-		err = c.Provide(func() pipeline.StepDefinition {
-			return pipeline.StepDefinition{
-				StepName: "table",
-				Compiler: compileTableStep,
-			}
-		}, dig.Group("steps"))
-		if err != nil {
-			return err
-		}
-		err = c.Provide(func() pipeline.StepDefinition {
-			return pipeline.StepDefinition{
-				StepName: "where",
-				Compiler: compileWhereStep,
-			}
-		}, dig.Group("steps"))
-		if err != nil {
-			return err
 		}
 		return nil
 	},
@@ -72,6 +72,7 @@ func (s *SurroundingPipelineStep) Execute(ctx context.Context, pipe pipeline.Pip
 			Host:      evt.Host,
 			Source:    evt.Source,
 			SourceId:  evt.SourceId,
+			Index:     evt.Index,
 			Fields:    evtFields,
 		}
 	}
@@ -96,24 +97,28 @@ func (r *SurroundingPipelineStep) SortMode() events.SortMode {
 	return events.SortModePreserveArgOrder
 }
 
+var surroundingStepDefinition = pipeline.StepDefinition{
+	StepName: "surrounding",
+	Compiler: compileSurroundingStep,
+
+	Summary: "Retrieves the events from the same source which were close to the given event in the log file.",
+	Options: []pipeline.StepOption{
+		{Name: "eventId", Description: "The ID of the event to get the surrounding events of.", Type: pipeline.StepOptionTypeInt, Required: true},
+		{Name: "count", Description: "The number of events to retrieve.", Type: pipeline.StepOptionTypeInt, Default: "100"},
+	},
+	Examples:   []string{"| surrounding eventId=123", "| surrounding eventId=123 count=10"},
+	InputType:  pipeline.PipeTypeNone,
+	OutputType: pipeline.PipeTypeEvents,
+}
+
 func compileSurroundingStep(input string, options map[string]string) (pipeline.Step, error) {
-	eventIdString, ok := options["eventId"]
-	if !ok {
-		return nil, fmt.Errorf("failed to compile surrounding: eventId must be provided")
-	}
-	eventId, err := strconv.ParseInt(eventIdString, 10, 64)
+	eventId, err := strconv.ParseInt(options["eventId"], 10, 64)
 	if err != nil {
 		return nil, fmt.Errorf("failed to compile surrounding: failed to parse eventId as integer: %w", err)
 	}
-	var count int
-	countString, ok := options["count"]
-	if !ok {
-		count = 100
-	} else {
-		count, err = strconv.Atoi(countString)
-		if err != nil {
-			return nil, fmt.Errorf("failed to compile surrounding: failed to parse count as integer: %w", err)
-		}
+	count, err := strconv.Atoi(options["count"])
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile surrounding: failed to parse count as integer: %w", err)
 	}
 	return &SurroundingPipelineStep{
 		eventId: eventId,
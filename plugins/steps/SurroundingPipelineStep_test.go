@@ -25,7 +25,7 @@ import (
 )
 
 func TestSurroundingPipelineStep(t *testing.T) {
-	sps, err := compileSurroundingStep("", map[string]string{
+	sps, err := surroundingStepDefinition.Compile("", map[string]string{
 		"eventId": "3",
 	})
 	if err != nil {
@@ -67,6 +67,19 @@ func (r *tablePipelineStep) OutputType() pipeline.PipeType {
 	return pipeline.PipeTypeTable
 }
 
+var tableStepDefinition = pipeline.StepDefinition{
+	StepName: "table",
+	Compiler: compileTableStep,
+
+	Summary:              "Creates a table containing the values of the given fields.",
+	Value:                "<field1, field2, ...>",
+	Options:              []pipeline.StepOption{},
+	IgnoreUnknownOptions: true,
+	Examples:             []string{`| table "host, source, userId"`},
+	InputType:            pipeline.PipeTypeEvents,
+	OutputType:           pipeline.PipeTypeTable,
+}
+
 func compileTableStep(input string, options map[string]string) (pipeline.Step, error) {
 	fields := strings.Split(input, ",")
 	trimmedFields := make([]string, 0, len(fields))
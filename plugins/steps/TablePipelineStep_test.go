@@ -22,3 +22,10 @@ func TestTablePipelineStep_NoFields_Error(t *testing.T) {
 		t.Error("Did not get an error when compiling table step without any given fields. This is not allowed because the table pipeline wouldn't do anything if not given any fields.")
 	}
 }
+
+func TestTablePipelineStep_IgnoresOptions(t *testing.T) {
+	_, err := tableStepDefinition.Compile("host, source", map[string]string{"unknown": "value"})
+	if err != nil {
+		t.Errorf("got unexpected error when compiling table step with an unknown option: %v", err)
+	}
+}
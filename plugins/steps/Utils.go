@@ -15,7 +15,7 @@
 package steps
 
 import (
-	"path/filepath"
+	"strings"
 
 	"github.com/jackbister/logsuck/pkg/logsuck/events"
 	"github.com/jackbister/logsuck/pkg/logsuck/indexedfiles"
@@ -28,17 +28,7 @@ func getSourceToIndexedFileConfig(evts []events.EventWithId, indexedFileConfigs
 			continue
 		}
 		for i, ifc := range indexedFileConfigs {
-			absGlob, err := filepath.Abs(ifc.Filename)
-			if err != nil {
-				// TODO:
-				continue
-			}
-			absSource, err := filepath.Abs(evt.Source)
-			if err != nil {
-				// TODO:
-				continue
-			}
-			if m, err := filepath.Match(absGlob, absSource); err == nil && m {
+			if ifc.Matches(evt.Source) {
 				sourceToConfig[evt.Source] = &indexedFileConfigs[i]
 				goto nextfile
 			}
@@ -47,3 +37,19 @@ func getSourceToIndexedFileConfig(evts []events.EventWithId, indexedFileConfigs
 	}
 	return sourceToConfig
 }
+
+func eventIds(evts []events.EventWithId) []int64 {
+	ret := make([]int64, len(evts))
+	for i, evt := range evts {
+		ret[i] = evt.Id
+	}
+	return ret
+}
+
+func lowercaseSet(values []string) map[string]struct{} {
+	ret := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		ret[strings.ToLower(v)] = struct{}{}
+	}
+	return ret
+}
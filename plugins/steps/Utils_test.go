@@ -25,6 +25,7 @@ import (
 	"github.com/jackbister/logsuck/pkg/logsuck/events"
 	"github.com/jackbister/logsuck/pkg/logsuck/pipeline"
 
+	"github.com/jackbister/logsuck/plugins/sqlite_common"
 	"github.com/jackbister/logsuck/plugins/sqlite_events"
 )
 
@@ -83,6 +84,10 @@ func newInMemRepo(t *testing.T) events.Repository {
 	if err != nil {
 		t.Fatalf("newInMemRepo got error when creating in-memory SQLite database: %v", err)
 	}
+	err = sqlite_common.Migrate(db, slog.Default(), sqlite_events.Migrations)
+	if err != nil {
+		t.Fatalf("newInMemRepo got error when migrating database: %v", err)
+	}
 	repo, err := sqlite_events.NewSqliteEventRepository(sqlite_events.SqliteEventRepositoryParams{
 		Db: db,
 		Cfg: &sqlite_events.Config{
@@ -83,6 +83,17 @@ func (r *WherePipelineStep) OutputType() pipeline.PipeType {
 	return pipeline.PipeTypePropagate
 }
 
+var whereStepDefinition = pipeline.StepDefinition{
+	StepName: "where",
+	Compiler: compileWhereStep,
+
+	Summary: "Filters events by field value. Accepts any number of <field>=<value> options.",
+	// Options is left nil since where accepts arbitrary field names as options
+	Examples:   []string{"| where userId=123", "| where userId=123 method=GET"},
+	InputType:  pipeline.PipeTypePropagate,
+	OutputType: pipeline.PipeTypePropagate,
+}
+
 func compileWhereStep(input string, options map[string]string) (pipeline.Step, error) {
 	return &WherePipelineStep{
 		fieldValues: options,
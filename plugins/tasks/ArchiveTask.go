@@ -0,0 +1,197 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/archive"
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/search"
+	"github.com/jackbister/logsuck/pkg/logsuck/tasks"
+)
+
+// archiveBatchSize is the number of events which are held in memory before they are written to the archive and deleted from the
+// repository.
+const archiveBatchSize = 10000
+
+// ArchiveTask moves events which are older than a certain age from the repository to compressed files in a directory, see the archive
+// package. Only whole days (UTC) are archived.
+type ArchiveTask struct {
+	Repo events.Repository
+
+	Logger *slog.Logger
+}
+
+func NewArchiveTask(repo events.Repository, logger *slog.Logger) tasks.Task {
+	return &ArchiveTask{
+		Repo:   repo,
+		Logger: logger,
+	}
+}
+
+func (t *ArchiveTask) Name() string {
+	return archive.TaskName
+}
+
+type archiveConfig struct {
+	directory string
+	minAge    time.Duration
+}
+
+func (t *ArchiveTask) Run(cfg map[string]any, ctx context.Context) {
+	c, err := parseArchiveConfig(cfg)
+	if err != nil {
+		t.Logger.Error("Failed to parse config. Will not do anything.",
+			slog.Any("error", err))
+		return
+	}
+	if enc, ok := t.Repo.(events.EncryptionReporter); ok && enc.Encrypted() {
+		t.Logger.Error("The events are encrypted and the archive files would not be, so the events will not be archived. Disable the archive task or the encryption.",
+			slog.String("directory", c.directory))
+		return
+	}
+	numArchived, err := t.archive(ctx, c.directory, archiveCutoff(time.Now(), c.minAge))
+	if err != nil {
+		t.Logger.Error("Failed to archive events",
+			slog.String("directory", c.directory),
+			slog.Int("numEvents", numArchived),
+			slog.Any("error", err))
+	} else if numArchived > 0 {
+		t.Logger.Info("Archived events",
+			slog.String("directory", c.directory),
+			slog.Int("numEvents", numArchived))
+	}
+	if sizer, ok := t.Repo.(events.StorageSizer); ok && numArchived > 0 {
+		err = sizer.Compact()
+		if err != nil {
+			t.Logger.Error("Failed to compact storage after archiving events",
+				slog.Any("error", err))
+		}
+	}
+}
+
+// archiveCutoff returns the start of the day (UTC) containing now - minAge. Events before the cutoff are archived, so the day containing
+// now - minAge is only archived once all of its events are older than minAge.
+func archiveCutoff(now time.Time, minAge time.Duration) time.Time {
+	return now.Add(-minAge).UTC().Truncate(24 * time.Hour)
+}
+
+// archive writes the events before cutoff to the archive in dir and deletes them from the repository. The events of thawed days are left
+// in the repository. Returns the number of archived events.
+func (t *ArchiveTask) archive(ctx context.Context, dir string, cutoff time.Time) (int, error) {
+	eventsChan := t.Repo.FilterStream(&search.Search{}, nil, &cutoff, events.SortModeTimestampAsc)
+	defer drainInBackground(eventsChan)
+	numArchived := 0
+	numPending := 0
+	pending := map[string][]events.EventWithId{}
+	thawed := map[string]bool{}
+	flush := func() error {
+		days := make([]string, 0, len(pending))
+		for day := range pending {
+			days = append(days, day)
+		}
+		sort.Strings(days)
+		for _, day := range days {
+			evts := pending[day]
+			err := archive.Append(dir, day, evts)
+			if err != nil {
+				return err
+			}
+			ids := make([]int64, len(evts))
+			for i, evt := range evts {
+				ids[i] = evt.Id
+			}
+			err = t.Repo.DeleteBatch(ids)
+			if err != nil {
+				return fmt.Errorf("failed to delete archived events of day=%v, they will be archived again by the next run: %w", day, err)
+			}
+			numArchived += len(evts)
+		}
+		pending = map[string][]events.EventWithId{}
+		numPending = 0
+		return nil
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return numArchived, errors.Join(ctx.Err(), flush())
+		case evts, ok := <-eventsChan:
+			if !ok {
+				return numArchived, flush()
+			}
+			for _, evt := range evts {
+				if !evt.Timestamp.Before(cutoff) {
+					continue
+				}
+				day := archive.Day(evt.Timestamp)
+				isThawed, ok := thawed[day]
+				if !ok {
+					isThawed = archive.IsThawed(dir, day)
+					thawed[day] = isThawed
+				}
+				if isThawed {
+					continue
+				}
+				pending[day] = append(pending[day], evt)
+				numPending++
+			}
+			if numPending >= archiveBatchSize {
+				err := flush()
+				if err != nil {
+					return numArchived, err
+				}
+			}
+		}
+	}
+}
+
+func (t *ArchiveTask) ConfigSchema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"directory": map[string]any{
+				"description": "The directory where the archive files are written. It is created if it does not exist.",
+				"type":        "string",
+			},
+			"minAge": map[string]any{
+				"description": "Days where all events are older than this are moved to the archive. For example 30d.",
+				"type":        "string",
+			},
+		},
+		"required": []any{"directory", "minAge"},
+	}
+}
+
+func parseArchiveConfig(cfg map[string]any) (*archiveConfig, error) {
+	dir, ok := cfg["directory"].(string)
+	if !ok || dir == "" {
+		return nil, errors.New("directory must be set")
+	}
+	minAgeStr, ok := cfg["minAge"].(string)
+	if !ok || minAgeStr == "" {
+		return nil, errors.New("minAge must be set")
+	}
+	minAge, err := parseDuration(minAgeStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse minAge: %w", err)
+	}
+	return &archiveConfig{directory: dir, minAge: minAge}, nil
+}
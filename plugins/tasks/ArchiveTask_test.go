@@ -0,0 +1,143 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tasks
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/archive"
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/search"
+)
+
+func TestArchiveTask(t *testing.T) {
+	repo := createRepo(t)
+	dir := t.TempDir()
+	task := &ArchiveTask{
+		Repo:   repo,
+		Logger: slog.Default(),
+	}
+	now := time.Now()
+	old := now.Add(-10 * 24 * time.Hour)
+	err := repo.AddBatch([]events.Event{
+		{Raw: "old event", Timestamp: old, Host: "localhost", Source: "log.txt", Offset: 0},
+		{Raw: "old event 2", Timestamp: old, Host: "localhost", Source: "log.txt", Offset: 1},
+		{Raw: "new event", Timestamp: now, Host: "localhost", Source: "log.txt", Offset: 2},
+	})
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	task.Run(map[string]any{"directory": dir, "minAge": "7d"}, context.Background())
+
+	assertRaws(t, repo, []string{"new event"})
+	day := archive.Day(old)
+	idx, err := archive.ReadIndex(dir, day)
+	if err != nil || idx.NumEvents != 2 {
+		t.Fatalf("expected index with 2 events for day=%v, got idx=%+v, err=%v", day, idx, err)
+	}
+
+	numEvents, err := archive.Thaw(dir, day, repo)
+	if err != nil || numEvents != 2 {
+		t.Fatalf("expected 2 events to be thawed, got numEvents=%v, err=%v", numEvents, err)
+	}
+	assertRaws(t, repo, []string{"new event", "old event 2", "old event"})
+	// The thawed day should not be archived again
+	task.Run(map[string]any{"directory": dir, "minAge": "7d"}, context.Background())
+	assertRaws(t, repo, []string{"new event", "old event 2", "old event"})
+	days, err := archive.Days(dir)
+	if err != nil || len(days) != 0 {
+		t.Fatalf("expected the archive to be empty after thawing, got days=%v, err=%v", days, err)
+	}
+}
+
+// encryptedRepo is a repository which reports that its events are encrypted.
+type encryptedRepo struct {
+	events.Repository
+}
+
+func (r encryptedRepo) Encrypted() bool {
+	return true
+}
+
+func TestArchiveTaskRefusesEncryptedRepository(t *testing.T) {
+	repo := createRepo(t)
+	dir := t.TempDir()
+	task := &ArchiveTask{
+		Repo:   encryptedRepo{repo},
+		Logger: slog.Default(),
+	}
+	err := repo.AddBatch([]events.Event{
+		{Raw: "old event", Timestamp: time.Now().Add(-10 * 24 * time.Hour), Host: "localhost", Source: "log.txt"},
+	})
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	task.Run(map[string]any{"directory": dir, "minAge": "7d"}, context.Background())
+
+	assertRaws(t, repo, []string{"old event"})
+	days, err := archive.Days(dir)
+	if err != nil || len(days) != 0 {
+		t.Fatalf("expected nothing to be archived from an encrypted repository, got days=%v, err=%v", days, err)
+	}
+}
+
+func TestArchiveCutoff(t *testing.T) {
+	now := time.Date(2024, 3, 10, 15, 30, 0, 0, time.UTC)
+	cutoff := archiveCutoff(now, 7*24*time.Hour)
+	expected := time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC)
+	if !cutoff.Equal(expected) {
+		t.Fatalf("expected cutoff=%v, got %v", expected, cutoff)
+	}
+}
+
+func TestParseArchiveConfig(t *testing.T) {
+	for _, cfg := range []map[string]any{
+		{},
+		{"directory": "/tmp/archive"},
+		{"minAge": "7d"},
+		{"directory": "/tmp/archive", "minAge": "7x"},
+	} {
+		_, err := parseArchiveConfig(cfg)
+		if err == nil {
+			t.Fatalf("expected error when parsing cfg=%v", cfg)
+		}
+	}
+	c, err := parseArchiveConfig(map[string]any{"directory": "/tmp/archive", "minAge": "7d"})
+	if err != nil || c.directory != "/tmp/archive" || c.minAge != 7*24*time.Hour {
+		t.Fatalf("got unexpected config=%+v, err=%v", c, err)
+	}
+}
+
+func assertRaws(t *testing.T, repo events.Repository, expected []string) {
+	raws := []string{}
+	for evts := range repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampDesc) {
+		for _, evt := range evts {
+			raws = append(raws, evt.Raw)
+		}
+	}
+	if len(raws) != len(expected) {
+		t.Fatalf("expected raws=%v, got %v", expected, raws)
+	}
+	for i := range raws {
+		if raws[i] != expected[i] {
+			t.Fatalf("expected raws=%v, got %v", expected, raws)
+		}
+	}
+}
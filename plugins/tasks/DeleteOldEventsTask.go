@@ -20,6 +20,7 @@ import (
 	"log/slog"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jackbister/logsuck/pkg/logsuck/events"
@@ -45,55 +46,366 @@ func (t *DeleteOldEventsTask) Name() string {
 }
 
 func (t *DeleteOldEventsTask) Run(cfg map[string]any, ctx context.Context) {
-	minAgeAny, ok := cfg["minAge"]
-	if !ok {
-		t.Logger.Error("Failed to get minAge. Will not do anything.")
+	policy, err := parseRetentionPolicy(cfg)
+	if err != nil {
+		t.Logger.Error("Failed to parse config. Will not do anything.",
+			slog.Any("error", err))
 		return
 	}
-	minAgeStr, ok := minAgeAny.(string)
+	numDeleted := t.deleteByAge(ctx, policy)
+	if policy.maxSize > 0 {
+		numDeleted += t.deleteBySize(ctx, policy.maxSize)
+	}
+	if sizer, ok := t.Repo.(events.StorageSizer); ok && numDeleted > 0 {
+		err = sizer.Compact()
+		if err != nil {
+			t.Logger.Error("Failed to compact storage after deleting events",
+				slog.Any("error", err))
+		}
+	}
+}
+
+// deleteByAge deletes the events which are older than the minAge of the first rule matching them, or the global minAge if no rule matches.
+// Returns the number of deleted events, not counting the events in deleted partitions.
+func (t *DeleteOldEventsTask) deleteByAge(ctx context.Context, policy *retentionPolicy) int {
+	minAge, ok := policy.shortestMinAge()
 	if !ok {
-		t.Logger.Error("Failed to cast minAge to string. Will not do anything.")
-		return
+		return 0
 	}
-	if minAgeStr == "" {
-		t.Logger.Error("minAgeStr=''. Will not do anything.")
-		return
+	now := time.Now()
+	if maxAge, ok := policy.longestMinAge(); ok {
+		if pd, ok := t.Repo.(events.PartitionDeleter); ok {
+			numPartitions, err := pd.DeletePartitionsBefore(now.Add(-maxAge))
+			if err != nil {
+				t.Logger.Error("Failed to delete old partitions. Will delete the events one by one instead.",
+					slog.Any("error", err))
+			} else {
+				t.Logger.Info("Deleted old partitions",
+					slog.Int("numPartitions", numPartitions))
+			}
+		}
 	}
-	d, err := parseDuration(minAgeStr)
+	// Events in partitions which also contain newer events, or in repositories which do not use partitions, are deleted one by one
+	endTime := now.Add(-minAge)
+	eventsChan := t.Repo.FilterStream(&search.Search{}, nil, &endTime, events.SortModeTimestampDesc)
+	defer drainInBackground(eventsChan)
+	numDeleted := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return numDeleted
+		case evts, ok := <-eventsChan:
+			if !ok {
+				return numDeleted
+			}
+			ids := make([]int64, 0, len(evts))
+			for _, evt := range evts {
+				if age, ok := policy.minAgeFor(evt); ok && evt.Timestamp.Before(now.Add(-age)) {
+					ids = append(ids, evt.Id)
+				}
+			}
+			if len(ids) == 0 {
+				continue
+			}
+			t.Logger.Info("Got events to delete",
+				slog.Int("numEvents", len(ids)))
+			err := t.Repo.DeleteBatch(ids)
+			if err != nil {
+				t.Logger.Error("Failed to delete events",
+					slog.Int("numEvents", len(ids)),
+					slog.Any("error", err))
+				continue
+			}
+			numDeleted += len(ids)
+		}
+	}
+}
+
+// deleteBySize deletes the oldest events until the storage used by the repository is at most maxSize bytes. Returns the number of deleted
+// events.
+func (t *DeleteOldEventsTask) deleteBySize(ctx context.Context, maxSize int64) int {
+	sizer, ok := t.Repo.(events.StorageSizer)
+	if !ok {
+		t.Logger.Error("maxSize is set but the events repository does not support getting its size. Will not delete events based on size.")
+		return 0
+	}
+	size, err := sizer.StorageSize()
 	if err != nil {
-		t.Logger.Error("Failed to parse minAgeStr. Will not do anything.",
-			slog.String("minAgeStr", minAgeStr))
-		return
+		t.Logger.Error("Failed to get storage size. Will not delete events based on size.",
+			slog.Any("error", err))
+		return 0
 	}
-	endTime := time.Now().Add(-d)
-	eventsChan := t.Repo.FilterStream(&search.Search{}, nil, &endTime)
-	for events := range eventsChan {
-		t.Logger.Info("Got events to delete",
-			slog.Int("numEvents", len(events)))
-		ids := make([]int64, len(events))
-		for i, evt := range events {
-			ids[i] = evt.Id
-		}
-		err := t.Repo.DeleteBatch(ids)
-		if err != nil {
-			t.Logger.Error("Failed to delete events",
-				slog.Int("numEvents", len(ids)),
-				slog.Any("error", err))
+	if size <= maxSize {
+		return 0
+	}
+	t.Logger.Info("Storage size is above maxSize, deleting the oldest events",
+		slog.Int64("size", size),
+		slog.Int64("maxSize", maxSize))
+	eventsChan := t.Repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampAsc)
+	defer drainInBackground(eventsChan)
+	numDeleted := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return numDeleted
+		case evts, ok := <-eventsChan:
+			if !ok {
+				return numDeleted
+			}
+			ids := make([]int64, len(evts))
+			for i, evt := range evts {
+				ids[i] = evt.Id
+			}
+			err := t.Repo.DeleteBatch(ids)
+			if err != nil {
+				t.Logger.Error("Failed to delete events",
+					slog.Int("numEvents", len(ids)),
+					slog.Any("error", err))
+				return numDeleted
+			}
+			numDeleted += len(ids)
+			newSize, err := sizer.StorageSize()
+			if err != nil {
+				t.Logger.Error("Failed to get storage size after deleting events",
+					slog.Any("error", err))
+				return numDeleted
+			}
+			if newSize <= maxSize {
+				t.Logger.Info("Deleted the oldest events to get below maxSize",
+					slog.Int("numEvents", numDeleted),
+					slog.Int64("size", newSize))
+				return numDeleted
+			}
+			if newSize >= size {
+				// Stop instead of deleting every event if the storage does not shrink, which can happen if most of it is not used by events
+				t.Logger.Warn("Storage size did not decrease after deleting events. Will not delete more events based on size.",
+					slog.Int("numEvents", numDeleted),
+					slog.Int64("size", newSize),
+					slog.Int64("maxSize", maxSize))
+				return numDeleted
+			}
+			size = newSize
 		}
 	}
 }
 
+// drainInBackground reads the rest of a FilterStream which is no longer needed. The goroutine producing the events blocks until they have
+// been read, and keeps holding resources such as database connections or segments until it has finished.
+func drainInBackground(eventsChan <-chan []events.EventWithId) {
+	go func() {
+		for range eventsChan {
+		}
+	}()
+}
+
 func (t *DeleteOldEventsTask) ConfigSchema() map[string]any {
 	return map[string]any{
 		"type": "object",
 		"properties": map[string]any{
 			"minAge": map[string]any{
-				"type": "string",
+				"description": "Events older than this are deleted unless they match one of the rules. For example 30d.",
+				"type":        "string",
+			},
+			"rules": map[string]any{
+				"description": "Retention rules for specific sources, hosts and indexes. Each event uses the minAge of the first rule where source, host and index all match it. * in source, host and index matches any characters.",
+				"type":        "array",
+				"items": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"source": map[string]any{
+							"description": "The sources this rule applies to, for example *access*. Matches all sources if not set.",
+							"type":        "string",
+						},
+						"host": map[string]any{
+							"description": "The hosts this rule applies to. Matches all hosts if not set.",
+							"type":        "string",
+						},
+						"index": map[string]any{
+							"description": "The indexes this rule applies to. Matches all indexes if not set.",
+							"type":        "string",
+						},
+						"minAge": map[string]any{
+							"description": "Events matching this rule are deleted when they are older than this.",
+							"type":        "string",
+						},
+					},
+					"required": []any{"minAge"},
+				},
+			},
+			"maxSize": map[string]any{
+				"description": "If the storage used by the events is larger than this, the oldest events are deleted until it is not. For example 20GB.",
+				"type":        "string",
 			},
 		},
 	}
 }
 
+// retentionPolicy decides which events DeleteOldEventsTask should delete.
+type retentionPolicy struct {
+	// minAge is the age at which events which do not match any of the rules are deleted, or 0 if they should not be deleted
+	minAge time.Duration
+	rules  []retentionRule
+	// maxSize is the maximum number of bytes the events may use, or 0 if there is no maximum
+	maxSize int64
+}
+
+type retentionRule struct {
+	// source matches the sources the rule applies to, or is nil if the rule applies to all sources
+	source *regexp.Regexp
+	// host matches the hosts the rule applies to, or is nil if the rule applies to all hosts
+	host *regexp.Regexp
+	// index matches the indexes the rule applies to, or is nil if the rule applies to all indexes
+	index  *regexp.Regexp
+	minAge time.Duration
+}
+
+func parseRetentionPolicy(cfg map[string]any) (*retentionPolicy, error) {
+	ret := retentionPolicy{}
+	if minAgeAny, ok := cfg["minAge"]; ok {
+		minAgeStr, ok := minAgeAny.(string)
+		if !ok {
+			return nil, fmt.Errorf("minAge must be a string")
+		}
+		d, err := parseDuration(minAgeStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse minAge: %w", err)
+		}
+		ret.minAge = d
+	}
+	if rulesAny, ok := cfg["rules"]; ok {
+		rules, ok := rulesAny.([]any)
+		if !ok {
+			return nil, fmt.Errorf("rules must be an array")
+		}
+		for i, r := range rules {
+			rule, err := parseRetentionRule(r)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse rule at index=%v: %w", i, err)
+			}
+			ret.rules = append(ret.rules, *rule)
+		}
+	}
+	if maxSizeAny, ok := cfg["maxSize"]; ok {
+		maxSizeStr, ok := maxSizeAny.(string)
+		if !ok {
+			return nil, fmt.Errorf("maxSize must be a string")
+		}
+		size, err := parseSize(maxSizeStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse maxSize: %w", err)
+		}
+		ret.maxSize = size
+	}
+	if ret.minAge == 0 && len(ret.rules) == 0 && ret.maxSize == 0 {
+		return nil, fmt.Errorf("at least one of minAge, rules and maxSize must be set")
+	}
+	return &ret, nil
+}
+
+func parseRetentionRule(r any) (*retentionRule, error) {
+	m, ok := r.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("rule must be an object")
+	}
+	ret := retentionRule{}
+	minAgeStr, ok := m["minAge"].(string)
+	if !ok {
+		return nil, fmt.Errorf("minAge must be set to a string")
+	}
+	d, err := parseDuration(minAgeStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse minAge: %w", err)
+	}
+	ret.minAge = d
+	if source, ok := m["source"].(string); ok && source != "" {
+		ret.source = compileGlob(source)
+	}
+	if host, ok := m["host"].(string); ok && host != "" {
+		ret.host = compileGlob(host)
+	}
+	if index, ok := m["index"].(string); ok && index != "" {
+		// Index names are always stored in lowercase
+		ret.index = compileGlob(strings.ToLower(index))
+	}
+	return &ret, nil
+}
+
+// compileGlob creates a regexp matching strings which match the glob, where * matches any characters.
+func compileGlob(glob string) *regexp.Regexp {
+	parts := strings.Split(glob, "*")
+	for i, p := range parts {
+		parts[i] = regexp.QuoteMeta(p)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+}
+
+func (r *retentionRule) matches(evt events.EventWithId) bool {
+	return (r.source == nil || r.source.MatchString(evt.Source)) && (r.host == nil || r.host.MatchString(evt.Host)) &&
+		(r.index == nil || r.index.MatchString(evt.Index))
+}
+
+// minAgeFor returns the age at which the event should be deleted, or false if it should not be deleted based on its age.
+func (p *retentionPolicy) minAgeFor(evt events.EventWithId) (time.Duration, bool) {
+	for _, r := range p.rules {
+		if r.matches(evt) {
+			return r.minAge, true
+		}
+	}
+	return p.minAge, p.minAge > 0
+}
+
+// shortestMinAge returns the age of the youngest events which may be deleted, or false if no events should be deleted based on their age.
+func (p *retentionPolicy) shortestMinAge() (time.Duration, bool) {
+	ret := p.minAge
+	for _, r := range p.rules {
+		if ret == 0 || r.minAge < ret {
+			ret = r.minAge
+		}
+	}
+	return ret, ret > 0
+}
+
+// longestMinAge returns the age after which all events should be deleted, or false if some events should never be deleted based on their
+// age.
+func (p *retentionPolicy) longestMinAge() (time.Duration, bool) {
+	if p.minAge == 0 {
+		return 0, false
+	}
+	ret := p.minAge
+	for _, r := range p.rules {
+		if r.minAge > ret {
+			ret = r.minAge
+		}
+	}
+	return ret, true
+}
+
+var sizeRegexp = regexp.MustCompile("^(\\d+)(B|KB|MB|GB|TB)$")
+
+// parseSize converts strings like "20GB" to a number of bytes. The units are powers of 1024, so 1KB = 1024 bytes.
+func parseSize(str string) (int64, error) {
+	match := sizeRegexp.FindStringSubmatch(str)
+	if len(match) < 3 {
+		return 0, fmt.Errorf("str='%s' does not match the size pattern. A size must be a positive number followed by one of B, KB, MB, GB or TB. For example 20GB.", str)
+	}
+	count, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("str='%s' could not be converted to a size. Failed to convert '%s' to a number.", str, match[1])
+	}
+	switch match[2] {
+	case "B":
+		return count, nil
+	case "KB":
+		return count << 10, nil
+	case "MB":
+		return count << 20, nil
+	case "GB":
+		return count << 30, nil
+	default:
+		return count << 40, nil
+	}
+}
+
 var durationRegexp = regexp.MustCompile("^(\\d+)(s|m|h|d|M|y)$")
 
 // Unfortunately time.ParseDuration does not support strings like "1d".
@@ -17,12 +17,21 @@ package tasks
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/search"
 
+	"github.com/jackbister/logsuck/plugins/sqlite_common"
 	"github.com/jackbister/logsuck/plugins/sqlite_events"
 )
 
@@ -91,6 +100,230 @@ func TestDeleteOldEventsDeletesOldEvents(t *testing.T) {
 	task.Run(cfg, context.Background())
 }
 
+func TestDeleteOldEventsDropsPartitions(t *testing.T) {
+	repo := createRepoWithCfg(t, &sqlite_events.Config{
+		TrueBatch:      true,
+		PartitionHours: 24,
+	})
+	task := &DeleteOldEventsTask{
+		Repo:   repo,
+		Logger: slog.Default()}
+
+	now := time.Now()
+	err := repo.AddBatch([]events.Event{
+		{
+			Raw:       "my event",
+			Timestamp: now,
+			Host:      "localhost",
+			Source:    "log.txt",
+			Offset:    1,
+		},
+		{
+			Raw:       "my old event",
+			Timestamp: now.Add(-30 * 24 * time.Hour),
+			Host:      "localhost",
+			Source:    "log.txt",
+			Offset:    0,
+		},
+	})
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	task.Run(map[string]any{"minAge": "7d"}, context.Background())
+
+	remaining := 0
+	for evts := range repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampDesc) {
+		for _, evt := range evts {
+			if evt.Raw != "my event" {
+				t.Fatalf("expected only the new event to remain, got raw=%v", evt.Raw)
+			}
+			remaining++
+		}
+	}
+	if remaining != 1 {
+		t.Fatalf("expected 1 event to remain after running task, got %v", remaining)
+	}
+	numPartitions, err := repo.(events.PartitionDeleter).DeletePartitionsBefore(now.Add(-7 * 24 * time.Hour))
+	if err != nil || numPartitions != 0 {
+		t.Fatalf("expected the old partition to have been deleted by the task, got numPartitions=%v, err=%v", numPartitions, err)
+	}
+}
+
+func TestDeleteOldEventsRules(t *testing.T) {
+	repo := createRepo(t)
+	task := &DeleteOldEventsTask{
+		Repo:   repo,
+		Logger: slog.Default()}
+
+	now := time.Now()
+	err := repo.AddBatch([]events.Event{
+		{Raw: "access", Timestamp: now.Add(-10 * 24 * time.Hour), Host: "localhost", Source: "/var/log/access.log", Offset: 0},
+		{Raw: "audit", Timestamp: now.Add(-10 * 24 * time.Hour), Host: "localhost", Source: "/var/log/audit.log", Offset: 0},
+		{Raw: "other", Timestamp: now.Add(-10 * 24 * time.Hour), Host: "localhost", Source: "/var/log/other.log", Offset: 0},
+		{Raw: "old other", Timestamp: now.Add(-40 * 24 * time.Hour), Host: "localhost", Source: "/var/log/other.log", Offset: 1},
+		{Raw: "old audit on other host", Timestamp: now.Add(-40 * 24 * time.Hour), Host: "otherhost", Source: "/var/log/audit.log", Offset: 1},
+		{Raw: "old security", Timestamp: now.Add(-40 * 24 * time.Hour), Host: "localhost", Source: "/var/log/auth.log", Offset: 0, Index: "security"},
+	})
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	task.Run(map[string]any{
+		"minAge": "30d",
+		"rules": []any{
+			map[string]any{"source": "*access*", "minAge": "7d"},
+			map[string]any{"source": "*audit*", "host": "localhost", "minAge": "1y"},
+			map[string]any{"index": "SECUR*", "minAge": "1y"},
+		},
+	}, context.Background())
+
+	remaining := map[string]struct{}{}
+	for evts := range repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampDesc) {
+		for _, evt := range evts {
+			remaining[evt.Raw] = struct{}{}
+		}
+	}
+	expected := map[string]struct{}{"audit": {}, "other": {}, "old security": {}}
+	if !reflect.DeepEqual(remaining, expected) {
+		t.Fatalf("expected events=%v to remain after running task, got %v", expected, remaining)
+	}
+}
+
+func TestDeleteOldEventsMaxSize(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "logsuck.db")
+	repo := createRepoWithDataSourceName(t, "file:"+fileName+"?_auto_vacuum=incremental", &sqlite_events.Config{
+		TrueBatch: true,
+	})
+	tracked := &streamTrackingRepo{Repository: repo}
+	task := &DeleteOldEventsTask{
+		Repo:   tracked,
+		Logger: slog.Default()}
+
+	startTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for batch := 0; batch < 5; batch++ {
+		evts := make([]events.Event, 1000)
+		for i := range evts {
+			n := batch*len(evts) + i
+			evts[i] = events.Event{
+				Raw:       fmt.Sprintf("event %v %v", n, strings.Repeat("x", 1000)),
+				Timestamp: startTime.Add(time.Duration(n) * time.Second),
+				Host:      "localhost",
+				Source:    "log.txt",
+				Offset:    int64(n),
+			}
+		}
+		err := repo.AddBatch(evts)
+		if err != nil {
+			t.Fatalf("got error when adding events: %v", err)
+		}
+	}
+	sizer := repo.(events.StorageSizer)
+	size, err := sizer.StorageSize()
+	if err != nil {
+		t.Fatalf("got error when getting storage size: %v", err)
+	}
+	maxSize := size / 2
+
+	task.Run(map[string]any{"maxSize": strconv.FormatInt(maxSize, 10) + "B"}, context.Background())
+	// The task stops reading the events once it is below maxSize, but the streams must still be read to the end
+	tracked.waitForStreams(t)
+
+	newSize, err := sizer.StorageSize()
+	if err != nil {
+		t.Fatalf("got error when getting storage size: %v", err)
+	}
+	if newSize > maxSize {
+		t.Fatalf("expected storage size to be at most maxSize=%v after running task, got size=%v", maxSize, newSize)
+	}
+	fileInfo, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatalf("got error when getting size of database file: %v", err)
+	}
+	if fileInfo.Size() > maxSize {
+		t.Fatalf("expected database file to be compacted to at most maxSize=%v after running task, got fileSize=%v", maxSize, fileInfo.Size())
+	}
+	remaining := []events.EventWithId{}
+	for evts := range repo.FilterStream(&search.Search{}, nil, nil, events.SortModeTimestampAsc) {
+		remaining = append(remaining, evts...)
+	}
+	if len(remaining) == 0 || len(remaining) == 5000 {
+		t.Fatalf("expected some but not all events to be deleted, got numRemaining=%v", len(remaining))
+	}
+	// The oldest events are deleted first, so the remaining events must be the newest ones
+	if !remaining[len(remaining)-1].Timestamp.Equal(startTime.Add(4999 * time.Second)) {
+		t.Fatalf("expected the newest event to remain, got newest timestamp=%v", remaining[len(remaining)-1].Timestamp)
+	}
+	if !remaining[0].Timestamp.Equal(startTime.Add(time.Duration(5000-len(remaining)) * time.Second)) {
+		t.Fatalf("expected only the oldest events to be deleted, got oldest timestamp=%v with numRemaining=%v", remaining[0].Timestamp, len(remaining))
+	}
+}
+
+// streamTrackingRepo keeps track of whether the FilterStreams it has returned have been read to the end.
+type streamTrackingRepo struct {
+	events.Repository
+	wg sync.WaitGroup
+}
+
+func (r *streamTrackingRepo) FilterStream(srch *search.Search, searchStartTime, searchEndTime *time.Time, sortMode events.SortMode) <-chan []events.EventWithId {
+	in := r.Repository.FilterStream(srch, searchStartTime, searchEndTime, sortMode)
+	out := make(chan []events.EventWithId)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer close(out)
+		for evts := range in {
+			out <- evts
+		}
+	}()
+	return out
+}
+
+func (r *streamTrackingRepo) StorageSize() (int64, error) {
+	return r.Repository.(events.StorageSizer).StorageSize()
+}
+
+func (r *streamTrackingRepo) Compact() error {
+	return r.Repository.(events.StorageSizer).Compact()
+}
+
+func (r *streamTrackingRepo) waitForStreams(t *testing.T) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for FilterStreams to be read to the end")
+	}
+}
+
+var parseSizeTests = []struct {
+	str      string
+	expected int64
+	valid    bool
+}{
+	{"100B", 100, true},
+	{"2KB", 2048, true},
+	{"20GB", 20 * 1024 * 1024 * 1024, true},
+	{"1TB", 1024 * 1024 * 1024 * 1024, true},
+	{"20", 0, false},
+	{"-1GB", 0, false},
+	{"1.5GB", 0, false},
+}
+
+func TestParseSize(t *testing.T) {
+	for _, tt := range parseSizeTests {
+		got, err := parseSize(tt.str)
+		if (err == nil) != tt.valid || got != tt.expected {
+			t.Fatalf("got unexpected result when parsing str=%v, expected=%v (valid=%v), got=%v (err=%v)", tt.str, tt.expected, tt.valid, got, err)
+		}
+	}
+}
+
 func checkForEvent(t *testing.T, repo events.Repository) {
 	evts, err := repo.GetByIds([]int64{1}, events.SortModeNone)
 	if err != nil {
@@ -102,15 +335,28 @@ func checkForEvent(t *testing.T, repo events.Repository) {
 }
 
 func createRepo(t *testing.T) events.Repository {
-	db, err := sql.Open("sqlite3", ":memory:")
+	return createRepoWithCfg(t, &sqlite_events.Config{
+		TrueBatch: true,
+	})
+}
+
+func createRepoWithCfg(t *testing.T, cfg *sqlite_events.Config) events.Repository {
+	return createRepoWithDataSourceName(t, ":memory:", cfg)
+}
+
+func createRepoWithDataSourceName(t *testing.T, dataSourceName string, cfg *sqlite_events.Config) events.Repository {
+	db, err := sql.Open("sqlite3", dataSourceName)
 	if err != nil {
-		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+		t.Fatalf("got error when creating SQLite database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = sqlite_common.Migrate(db, slog.Default(), sqlite_events.Migrations)
+	if err != nil {
+		t.Fatalf("got error when migrating database: %v", err)
 	}
 	repo, err := sqlite_events.NewSqliteEventRepository(sqlite_events.SqliteEventRepositoryParams{
-		Db: db,
-		Cfg: &sqlite_events.Config{
-			TrueBatch: true,
-		},
+		Db:     db,
+		Cfg:    cfg,
 		Logger: slog.Default(),
 	})
 	if err != nil {
@@ -0,0 +1,71 @@
+// Copyright 2024 Jack Bister
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tasks
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/jackbister/logsuck/pkg/logsuck/events"
+	"github.com/jackbister/logsuck/pkg/logsuck/tasks"
+)
+
+// ReencryptEventsTask encrypts the events which were encrypted using a previous key with the current key, so that the previous key can
+// be removed from the configuration after rotating the encryption key.
+type ReencryptEventsTask struct {
+	Repo events.Repository
+
+	Logger *slog.Logger
+}
+
+func NewReencryptEventsTask(repo events.Repository, logger *slog.Logger) tasks.Task {
+	return &ReencryptEventsTask{
+		Repo:   repo,
+		Logger: logger,
+	}
+}
+
+func (t *ReencryptEventsTask) Name() string {
+	return "@logsuck/ReencryptEventsTask"
+}
+
+func (t *ReencryptEventsTask) Run(cfg map[string]any, ctx context.Context) {
+	reencrypter, ok := t.Repo.(events.Reencrypter)
+	if !ok {
+		t.Logger.Error("The events repository does not support encryption. Will not do anything.")
+		return
+	}
+	startTime := time.Now()
+	numEvents, err := reencrypter.Reencrypt(ctx)
+	if err != nil {
+		t.Logger.Error("Failed to re-encrypt events",
+			slog.Int("numEvents", numEvents),
+			slog.Any("error", err))
+		return
+	}
+	if numEvents > 0 {
+		t.Logger.Info("Re-encrypted events using the current key",
+			slog.Int("numEvents", numEvents),
+			slog.Duration("duration", time.Since(startTime)))
+	}
+}
+
+func (t *ReencryptEventsTask) ConfigSchema() map[string]any {
+	return map[string]any{
+		"type":       "object",
+		"properties": map[string]any{},
+	}
+}
@@ -28,6 +28,14 @@ var Plugin = logsuck.Plugin{
 		if err != nil {
 			return err
 		}
+		err = c.Provide(NewArchiveTask, dig.Group("tasks"))
+		if err != nil {
+			return err
+		}
+		err = c.Provide(NewReencryptEventsTask, dig.Group("tasks"))
+		if err != nil {
+			return err
+		}
 		return nil
 	},
 }